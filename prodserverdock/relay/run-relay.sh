@@ -35,6 +35,7 @@ socat openssl-listen:$public_port,fork,reuseaddr,cert=data/$HOSTNAME.pem,verify=
 $pwd/bin/RelayHttpServer \
 	-Url $url \
 	-Port $local_port \
+	-TLSOffloaded \
 	-Workdir $pwd/data \
 	`grep -v '^#' config/relay.txt` 2>> $logfile 
 
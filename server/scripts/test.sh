@@ -1,18 +1,16 @@
 #!/bin/bash -e
-TESTPORT=8543
-TESTADDRS=0x90F8bf6A479f320ead074411a4B0e7944Ea8c9C1,0xFFcf8FDEE72ac11b5c542428B35EEF5769C409f0,0x22d491Bde2303f2f43325b2108D26f1eAbA1e32b
-
-trap onexit EXIT
-
-onexit() {
-  if [ -f "ganache.pid" ]; then 
-    echo "Stopping ganache"
-    kill `cat ganache.pid` && rm ganache.pid 
-  fi
-}
-
-cd .. && \
-  ./scripts/run-ganache ${TESTPORT} > ganache.pid
+# The librelay tests run on a simulated chain. To run them against ganache instead, start it with
+# scripts/run-ganache 8543 and add: -args -ganache http://localhost:8543
 
 go test -v -count=1 librelay
 go test -v -count=1 librelay/txstore
+go test -v -count=1 librelay/config
+go test -v -count=1 librelay/reputation
+go test -v -count=1 librelay/hubindex
+go test -v -count=1 librelay/incident
+go test -v -count=1 librelay/notify
+go test -v -count=1 librelay/funding
+go test -v -count=1 librelay/lifecycle
+go test -v -count=1 librelay/scheduler
+go test -v -count=1 librelay/simbackend
+go test -v -count=1 relayhttp
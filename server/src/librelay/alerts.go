@@ -0,0 +1,157 @@
+package librelay
+
+import (
+	"context"
+	"fmt"
+	"librelay/notify"
+	"log"
+	"math/big"
+	"time"
+)
+
+// Kinds of alerts raised by CheckAlerts. Penalizations and removals are alerted with the incident's kind.
+const (
+	AlertBalance         = "Balance"
+	AlertPendingTx       = "PendingTx"
+	AlertRegistration    = "Registration"
+	AlertNodeUnreachable = "NodeUnreachable"
+)
+
+// AlertRules are the conditions CheckAlerts raises alerts for. A zero value disables a rule.
+type AlertRules struct {
+	BalanceBelow       *big.Int      // the relay's balance is below this amount in wei
+	PendingTxAge       time.Duration // a sent tx is not mined this long after it was sent or resent
+	RegistrationBlocks uint64        // the relay's registration is seen by clients for fewer blocks than this
+	RegistrationWindow uint64        // blocks clients look back for RelayAdded events
+}
+
+// notify sends the alert with the relay's notifier, or only logs it if there is none
+func (relay *RelayServer) notify(alert *notify.Alert) {
+	if alert.Time == 0 {
+		alert.Time = relay.clock.Now().Unix()
+	}
+	if alert.Fields == nil {
+		alert.Fields = map[string]string{}
+	}
+	alert.Fields["relay"] = relay.Address().Hex()
+	notifier := relay.Notifier
+	if notifier == nil {
+		notifier = notify.LogNotifier{}
+	}
+	if err := notifier.Notify(alert); err != nil {
+		log.Println("Could not send alert", alert.Kind, err)
+	}
+}
+
+// CheckAlerts raises an alert for every AlertRules condition that holds: the node cannot be reached, the balance is
+// low, a tx is pending for too long or the registration is about to expire. Alerts are sent with the relay's notifier,
+// which drops the ones already sent recently.
+func (relay *RelayServer) CheckAlerts() (alerts []*notify.Alert) {
+	ctx := context.Background()
+	latest, err := relay.Client.HeaderByNumber(ctx, nil)
+	if err != nil {
+		alerts = append(alerts, &notify.Alert{
+			Kind:    AlertNodeUnreachable,
+			Title:   "Ethereum node unreachable",
+			Message: fmt.Sprintf("Could not get the latest block from %s: %v", relay.EthereumNodeURL, err),
+		})
+	} else {
+		alerts = append(alerts, relay.balanceAlerts(ctx)...)
+		alerts = append(alerts, relay.pendingTxAlerts()...)
+		alerts = append(alerts, relay.registrationAlerts(ctx, latest.Number.Uint64())...)
+	}
+	for _, alert := range alerts {
+		relay.notify(alert)
+	}
+	return
+}
+
+func (relay *RelayServer) balanceAlerts(ctx context.Context) (alerts []*notify.Alert) {
+	if relay.AlertRules.BalanceBelow == nil || relay.AlertRules.BalanceBelow.Sign() <= 0 {
+		return
+	}
+	balance, err := relay.Client.BalanceAt(ctx, relay.Address(), nil)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if balance.Cmp(relay.AlertRules.BalanceBelow) >= 0 {
+		return
+	}
+	return []*notify.Alert{{
+		Kind:    AlertBalance,
+		Title:   "Relay balance low",
+		Message: fmt.Sprintf("The relay's balance of %s wei is below %s wei, send it funds", balance, relay.AlertRules.BalanceBelow),
+		Fields:  map[string]string{"balance": balance.String()},
+	}}
+}
+
+// pendingTxAlerts alerts about the sent txs not mined within PendingTxAge
+func (relay *RelayServer) pendingTxAlerts() (alerts []*notify.Alert) {
+	if relay.AlertRules.PendingTxAge <= 0 {
+		return
+	}
+	txs, err := relay.TxStore.ListTransactions()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	now := relay.clock.Now()
+	for _, tx := range txs {
+		sent := time.Unix(tx.Timestamp, 0)
+		if tx.IsMined() || now.Sub(sent) < relay.AlertRules.PendingTxAge {
+			continue
+		}
+		alerts = append(alerts, &notify.Alert{
+			Kind:    AlertPendingTx,
+			Title:   fmt.Sprintf("Transaction %d pending", tx.Nonce()),
+			Message: fmt.Sprintf("Transaction %s was sent %d minutes ago and is not mined yet", tx.Hash().Hex(), int64(now.Sub(sent)/time.Minute)),
+			Fields:  map[string]string{"tx": tx.Hash().Hex(), "gasPrice": tx.GasPrice().String()},
+		})
+	}
+	return
+}
+
+// registrationAlerts alerts when clients will stop seeing the relay's last RelayAdded event within RegistrationBlocks
+func (relay *RelayServer) registrationAlerts(ctx context.Context, latest uint64) (alerts []*notify.Alert) {
+	rules := relay.AlertRules
+	if rules.RegistrationBlocks == 0 || rules.RegistrationWindow == 0 {
+		return
+	}
+	if halted, _ := relay.Halted(); halted {
+		return
+	}
+	// Registrations are looked for from the last one recorded, or within the window clients look at
+	state, err := relay.LifecycleState()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	fromBlock := state.RegisteredBlock
+	if fromBlock == 0 && latest > rules.RegistrationWindow {
+		fromBlock = latest - rules.RegistrationWindow
+	}
+	logs, err := relay.hubEventLogs(ctx, "RelayAdded", fromBlock, latest)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if len(logs) == 0 {
+		return
+	}
+	registered := logs[len(logs)-1].BlockNumber
+	left := int64(registered+rules.RegistrationWindow) - int64(latest)
+	if left >= int64(rules.RegistrationBlocks) {
+		return
+	}
+	message := fmt.Sprintf("Clients stop seeing the relay in %d blocks, check that it can register again", left)
+	if left <= 0 {
+		message = fmt.Sprintf("Clients stopped seeing the relay %d blocks ago, check that it can register again", -left)
+	}
+	return []*notify.Alert{{
+		Kind:    AlertRegistration,
+		Title:   "Relay registration expiring",
+		Message: message,
+		Fields:  map[string]string{"registeredBlock": fmt.Sprint(registered)},
+	}}
+}
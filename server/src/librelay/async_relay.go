@@ -0,0 +1,161 @@
+package librelay
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"librelay/txstore"
+	"log"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// States of an asynchronous relay request
+const (
+	RelayStatusQueued = "queued" // accepted, waiting for a worker
+	RelayStatusSent   = "sent"   // relayCall sent, not mined yet
+	RelayStatusMined  = "mined"  // relayCall mined, and the call relayed to the recipient succeeded
+	RelayStatusFailed = "failed" // rejected by a worker, not sent, reverted, or the relayed call failed
+)
+
+// ErrUnknownRequestId is returned for the status of a request the relay has no record of, e.g. expired
+var ErrUnknownRequestId = errors.New("Unknown request id")
+
+// How long the status of a request is kept in the TxStore after its last update
+const AsyncStatusTTL = time.Hour
+
+// RelayRequestStatus is what /relay/status reports for an asynchronous request
+type RelayRequestStatus struct {
+	RequestId string
+	Status    string
+	Error     string         `json:",omitempty"`
+	TxHash    *common.Hash   `json:",omitempty"`
+	Nonce     *uint64        `json:",omitempty"`
+	Receipt   *types.Receipt `json:",omitempty"`
+}
+
+func newRequestId() (id string, err error) {
+	buf := make([]byte, 16)
+	if _, err = rand.Read(buf); err != nil {
+		return
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// SubmitRelayTransaction runs the checks that need no call to the ethereum node and queues the request on the relay
+// pool. It returns the id to poll the request's status with.
+func (relay *RelayServer) SubmitRelayTransaction(request RelayTransactionRequest) (requestId string, err error) {
+	if relay.pool == nil {
+		err = fmt.Errorf("Relay pool is not started")
+		log.Println(err)
+		return
+	}
+	err = relay.ValidateRelayTransaction(&request)
+	if err != nil {
+		return
+	}
+	requestId, err = newRequestId()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	err = relay.setRequestStatus(requestId, txstore.RequestStatus{Status: RelayStatusQueued})
+	if err != nil {
+		return "", err
+	}
+	err = relay.pool.enqueue(&relayJob{id: requestId, request: request})
+	if err != nil {
+		relay.TxStore.RemoveRequestStatus(requestId)
+		return "", err
+	}
+	log.Println("Queued relay request", requestId)
+	return
+}
+
+// finishAsyncRelay records the outcome of an asynchronous request
+func (relay *RelayServer) finishAsyncRelay(requestId string, signedTx *types.Transaction, err error) {
+	if err != nil {
+		relay.setRequestStatus(requestId, txstore.RequestStatus{Status: RelayStatusFailed, Error: err.Error()})
+		return
+	}
+	relay.setRequestStatus(requestId, txstore.RequestStatus{Status: RelayStatusSent, Nonce: signedTx.Nonce(), TxHash: signedTx.Hash()})
+	log.Println("Relayed request", requestId, "in tx", signedTx.Hash().Hex())
+}
+
+// setRequestStatus stores the status of the request, dropping those not updated for AsyncStatusTTL
+func (relay *RelayServer) setRequestStatus(requestId string, status txstore.RequestStatus) (err error) {
+	err = relay.TxStore.RemoveRequestStatusesBefore(relay.clock.Now().Add(-AsyncStatusTTL).Unix())
+	if err != nil {
+		log.Println("Error removing expired request statuses", err)
+		return
+	}
+	err = relay.TxStore.SaveRequestStatus(requestId, status)
+	if err != nil {
+		log.Println("Error saving status of request", requestId, err)
+	}
+	return
+}
+
+// RelayTransactionStatus reports the progress of an asynchronous request. Sent requests are looked up in the TxStore,
+// since the tx may have been resent with a higher gas price under the same nonce, and any of its hashes may be mined.
+func (relay *RelayServer) RelayTransactionStatus(requestId string) (status *RelayRequestStatus, err error) {
+	stored, err := relay.TxStore.GetRequestStatus(requestId)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if stored == nil {
+		return nil, ErrUnknownRequestId
+	}
+	status = &RelayRequestStatus{RequestId: requestId, Status: stored.Status, Error: stored.Error}
+	if stored.TxHash == (common.Hash{}) {
+		return
+	}
+	status.Nonce = &stored.Nonce
+	status.TxHash = &stored.TxHash
+
+	hashes := []common.Hash{stored.TxHash}
+	if stored.Status == RelayStatusSent {
+		tx, err := relay.TxStore.GetTransactionByNonce(stored.Nonce)
+		if err != nil {
+			log.Println(err)
+			return nil, err
+		}
+		// Once confirmed, the tx is removed from the store and only the hash it was sent with is left
+		if tx != nil && tx.HasHash(stored.TxHash) {
+			hashes = append([]common.Hash{tx.Hash()}, tx.PreviousHashes...)
+		}
+	}
+	for _, hash := range hashes {
+		receipt, err := relay.Client.TransactionReceipt(context.Background(), hash)
+		if err == ethereum.NotFound || (err == nil && receipt == nil) {
+			continue
+		}
+		if err != nil {
+			log.Println(err)
+			return nil, err
+		}
+		if stored.Status == RelayStatusSent {
+			stored.TxHash = hash
+			stored.Status = RelayStatusMined
+			// RelayHub does not revert when the relayed call fails, it reports it in TransactionRelayed
+			if _, ok, reason := relay.relayCallOutcome(receipt); !ok {
+				stored.Status = RelayStatusFailed
+				stored.Error = reason
+			}
+			if err = relay.setRequestStatus(requestId, *stored); err != nil {
+				return nil, err
+			}
+		}
+		return &RelayRequestStatus{requestId, stored.Status, stored.Error, &stored.TxHash, &stored.Nonce, receipt}, nil
+	}
+	// Not mined yet: report the transaction currently pending
+	status.TxHash = &hashes[0]
+	return status, nil
+}
@@ -0,0 +1,575 @@
+package config
+
+import (
+	"encoding"
+	"fmt"
+	"io/ioutil"
+	"librelay"
+	"librelay/notify"
+	"librelay/reputation"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/params"
+)
+
+// RelayLookupWindowBlocks is the number of blocks clients look back for RelayAdded events (see relayLookupLimitBlocks
+// in RelayClient.js). A relay that re-registers less often than this becomes invisible to clients.
+const RelayLookupWindowBlocks = 6000
+
+const MaxFee = 1000
+const MaxGasPricePercent = 1000
+const MaxBatchSize = 1000
+const MaxConfirmations = 1000
+const MaxRelayWorkers = 64
+
+// Config holds every setting of the relay server. Keys in config files are the same as the command line flag names,
+// and every field can be overridden by the environment variable in its env tag.
+type Config struct {
+	OwnerAddress          string `yaml:"OwnerAddress" toml:"OwnerAddress" env:"GSN_RELAY_OWNER_ADDRESS"`
+	Fee                   int64  `yaml:"Fee" toml:"Fee" env:"GSN_RELAY_FEE"`
+	Url                   string `yaml:"Url" toml:"Url" env:"GSN_RELAY_URL"`
+	Port                  string `yaml:"Port" toml:"Port" env:"GSN_RELAY_PORT"`
+	RelayHubAddress       string `yaml:"RelayHubAddress" toml:"RelayHubAddress" env:"GSN_RELAY_HUB_ADDRESS"`
+	DefaultGasPrice       int64  `yaml:"DefaultGasPrice" toml:"DefaultGasPrice" env:"GSN_RELAY_DEFAULT_GAS_PRICE"`
+	GasPricePercent       int64  `yaml:"GasPricePercent" toml:"GasPricePercent" env:"GSN_RELAY_GAS_PRICE_PERCENT"`
+	RegistrationBlockRate uint64 `yaml:"RegistrationBlockRate" toml:"RegistrationBlockRate" env:"GSN_RELAY_REGISTRATION_BLOCK_RATE"`
+	EthereumNodeUrl       string `yaml:"EthereumNodeUrl" toml:"EthereumNodeUrl" env:"GSN_RELAY_ETHEREUM_NODE_URL"`
+	Workdir               string `yaml:"Workdir" toml:"Workdir" env:"GSN_RELAY_WORKDIR"`
+	DevMode               bool   `yaml:"DevMode" toml:"DevMode" env:"GSN_RELAY_DEV_MODE"`
+
+	TLSCertFile      string `yaml:"TLSCertFile" toml:"TLSCertFile" env:"GSN_RELAY_TLS_CERT_FILE"`
+	TLSKeyFile       string `yaml:"TLSKeyFile" toml:"TLSKeyFile" env:"GSN_RELAY_TLS_KEY_FILE"`
+	TLSOffloaded     bool   `yaml:"TLSOffloaded" toml:"TLSOffloaded" env:"GSN_RELAY_TLS_OFFLOADED"`
+	ACME             bool   `yaml:"ACME" toml:"ACME" env:"GSN_RELAY_ACME"`
+	ACMEDirectoryUrl string `yaml:"ACMEDirectoryUrl" toml:"ACMEDirectoryUrl" env:"GSN_RELAY_ACME_DIRECTORY_URL"`
+	ACMEEmail        string `yaml:"ACMEEmail" toml:"ACMEEmail" env:"GSN_RELAY_ACME_EMAIL"`
+	ACMECARootFile   string `yaml:"ACMECARootFile" toml:"ACMECARootFile" env:"GSN_RELAY_ACME_CA_ROOT_FILE"`
+	ACMEHttpPort     string `yaml:"ACMEHttpPort" toml:"ACMEHttpPort" env:"GSN_RELAY_ACME_HTTP_PORT"`
+
+	MaxBatchSize int64 `yaml:"MaxBatchSize" toml:"MaxBatchSize" env:"GSN_RELAY_MAX_BATCH_SIZE"`
+
+	RelayWorkers   int64 `yaml:"RelayWorkers" toml:"RelayWorkers" env:"GSN_RELAY_WORKERS"`
+	RelayQueueSize int64 `yaml:"RelayQueueSize" toml:"RelayQueueSize" env:"GSN_RELAY_QUEUE_SIZE"`
+
+	SimulateRelayCall bool `yaml:"SimulateRelayCall" toml:"SimulateRelayCall" env:"GSN_RELAY_SIMULATE_RELAY_CALL"`
+	EnforceSimulation bool `yaml:"EnforceSimulation" toml:"EnforceSimulation" env:"GSN_RELAY_ENFORCE_SIMULATION"`
+
+	MinProfit        int64 `yaml:"MinProfit" toml:"MinProfit" env:"GSN_RELAY_MIN_PROFIT"`
+	MinProfitPercent int64 `yaml:"MinProfitPercent" toml:"MinProfitPercent" env:"GSN_RELAY_MIN_PROFIT_PERCENT"`
+
+	ReputationMinSamples        int64 `yaml:"ReputationMinSamples" toml:"ReputationMinSamples" env:"GSN_RELAY_REPUTATION_MIN_SAMPLES"`
+	ReputationMaxFailurePercent int64 `yaml:"ReputationMaxFailurePercent" toml:"ReputationMaxFailurePercent" env:"GSN_RELAY_REPUTATION_MAX_FAILURE_PERCENT"`
+	ReputationWindowMinutes     int64 `yaml:"ReputationWindowMinutes" toml:"ReputationWindowMinutes" env:"GSN_RELAY_REPUTATION_WINDOW_MINUTES"`
+	BlacklistMinutes            int64 `yaml:"BlacklistMinutes" toml:"BlacklistMinutes" env:"GSN_RELAY_BLACKLIST_MINUTES"`
+
+	AdminToken string `yaml:"AdminToken" toml:"AdminToken" env:"GSN_RELAY_ADMIN_TOKEN"`
+
+	HubIndexStartBlock uint64 `yaml:"HubIndexStartBlock" toml:"HubIndexStartBlock" env:"GSN_RELAY_HUB_INDEX_START_BLOCK"`
+
+	Confirmations uint64 `yaml:"Confirmations" toml:"Confirmations" env:"GSN_RELAY_CONFIRMATIONS"`
+
+	AlertWebhookUrl         string `yaml:"AlertWebhookUrl" toml:"AlertWebhookUrl" env:"GSN_RELAY_ALERT_WEBHOOK_URL"`
+	AlertSlackWebhookUrl    string `yaml:"AlertSlackWebhookUrl" toml:"AlertSlackWebhookUrl" env:"GSN_RELAY_ALERT_SLACK_WEBHOOK_URL"`
+	AlertSmtpAddr           string `yaml:"AlertSmtpAddr" toml:"AlertSmtpAddr" env:"GSN_RELAY_ALERT_SMTP_ADDR"`
+	AlertSmtpFrom           string `yaml:"AlertSmtpFrom" toml:"AlertSmtpFrom" env:"GSN_RELAY_ALERT_SMTP_FROM"`
+	AlertSmtpTo             string `yaml:"AlertSmtpTo" toml:"AlertSmtpTo" env:"GSN_RELAY_ALERT_SMTP_TO"`
+	AlertSmtpUsername       string `yaml:"AlertSmtpUsername" toml:"AlertSmtpUsername" env:"GSN_RELAY_ALERT_SMTP_USERNAME"`
+	AlertSmtpPassword       string `yaml:"AlertSmtpPassword" toml:"AlertSmtpPassword" env:"GSN_RELAY_ALERT_SMTP_PASSWORD"`
+	AlertDedupMinutes       int64  `yaml:"AlertDedupMinutes" toml:"AlertDedupMinutes" env:"GSN_RELAY_ALERT_DEDUP_MINUTES"`
+	AlertMaxPerHour         int64  `yaml:"AlertMaxPerHour" toml:"AlertMaxPerHour" env:"GSN_RELAY_ALERT_MAX_PER_HOUR"`
+	AlertBalanceBelow       Wei    `yaml:"AlertBalanceBelow" toml:"AlertBalanceBelow" env:"GSN_RELAY_ALERT_BALANCE_BELOW"`
+	AlertPendingTxMinutes   int64  `yaml:"AlertPendingTxMinutes" toml:"AlertPendingTxMinutes" env:"GSN_RELAY_ALERT_PENDING_TX_MINUTES"`
+	AlertRegistrationBlocks uint64 `yaml:"AlertRegistrationBlocks" toml:"AlertRegistrationBlocks" env:"GSN_RELAY_ALERT_REGISTRATION_BLOCKS"`
+
+	MinimumRelayBalance  Wei    `yaml:"MinimumRelayBalance" toml:"MinimumRelayBalance" env:"GSN_RELAY_MINIMUM_RELAY_BALANCE"`
+	RefillBelow          Wei    `yaml:"RefillBelow" toml:"RefillBelow" env:"GSN_RELAY_REFILL_BELOW"`
+	RefillAmount         Wei    `yaml:"RefillAmount" toml:"RefillAmount" env:"GSN_RELAY_REFILL_AMOUNT"`
+	RefillHookUrl        string `yaml:"RefillHookUrl" toml:"RefillHookUrl" env:"GSN_RELAY_REFILL_HOOK_URL"`
+	RefillKeyFile        string `yaml:"RefillKeyFile" toml:"RefillKeyFile" env:"GSN_RELAY_REFILL_KEY_FILE"`
+	RefillTimeoutMinutes int64  `yaml:"RefillTimeoutMinutes" toml:"RefillTimeoutMinutes" env:"GSN_RELAY_REFILL_TIMEOUT_MINUTES"`
+
+	SweepKeepBalance     Wei   `yaml:"SweepKeepBalance" toml:"SweepKeepBalance" env:"GSN_RELAY_SWEEP_KEEP_BALANCE"`
+	SweepIntervalMinutes int64 `yaml:"SweepIntervalMinutes" toml:"SweepIntervalMinutes" env:"GSN_RELAY_SWEEP_INTERVAL_MINUTES"`
+	SweepDryRun          bool  `yaml:"SweepDryRun" toml:"SweepDryRun" env:"GSN_RELAY_SWEEP_DRY_RUN"`
+}
+
+// Wei is an amount of wei, set from a decimal string since amounts above about 9.22 ether overflow an int64
+type Wei struct {
+	big.Int
+}
+
+func NewWei(amount int64) (wei Wei) {
+	wei.SetInt64(amount)
+	return
+}
+
+func (wei *Wei) UnmarshalText(text []byte) error {
+	if _, ok := wei.SetString(string(text), 10); !ok {
+		return fmt.Errorf("Invalid amount of wei %q", text)
+	}
+	return nil
+}
+
+func (wei Wei) String() string {
+	return wei.Int.String()
+}
+
+// Big returns a copy of the amount
+func (wei *Wei) Big() *big.Int {
+	return new(big.Int).Set(&wei.Int)
+}
+
+// Errors collects every problem found while loading or validating a configuration, so they can be reported at once
+type Errors []error
+
+func (errs Errors) Error() string {
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("%d configuration error(s):\n\t%s", len(errs), strings.Join(msgs, "\n\t"))
+}
+
+// Default returns the configuration used when no file, environment variable or flag overrides a setting
+func Default() *Config {
+	return &Config{
+		OwnerAddress:          common.HexToAddress("0").Hex(),
+		Fee:                   70,
+		Url:                   "http://localhost:8090",
+		Port:                  "",
+		RelayHubAddress:       "0xD216153c06E857cD7f72665E0aF1d7D82172F494",
+		DefaultGasPrice:       int64(params.GWei),
+		GasPricePercent:       10,
+		RegistrationBlockRate: 6000 - 200,
+		EthereumNodeUrl:       "http://localhost:8545",
+		Workdir:               filepath.Join(os.Getenv("PWD"), "data"),
+		DevMode:               false,
+		ACMEDirectoryUrl:      "https://acme-v02.api.letsencrypt.org/directory",
+		MaxBatchSize:          20,
+		RelayWorkers:          4,
+		RelayQueueSize:        100,
+
+		ReputationMinSamples:        int64(reputation.DefaultSettings.MinSamples),
+		ReputationMaxFailurePercent: int64(reputation.DefaultSettings.MaxFailurePercent),
+		ReputationWindowMinutes:     int64(reputation.DefaultSettings.Window / time.Minute),
+		BlacklistMinutes:            int64(reputation.DefaultSettings.Cooldown / time.Minute),
+
+		AlertDedupMinutes:       60,
+		AlertMaxPerHour:         20,
+		AlertBalanceBelow:       NewWei(2e17),
+		AlertPendingTxMinutes:   30,
+		AlertRegistrationBlocks: 100,
+
+		MinimumRelayBalance:  NewWei(1e17),
+		RefillBelow:          NewWei(3e17),
+		RefillAmount:         NewWei(1e18),
+		RefillTimeoutMinutes: 30,
+		SweepIntervalMinutes: 60,
+	}
+}
+
+// LoadFile reads a YAML (.yaml, .yml) or TOML (.toml) file over the current values. Unknown keys are rejected.
+func (cfg *Config) LoadFile(path string) (err error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return yaml.UnmarshalStrict(data, cfg)
+	case ".toml":
+		meta, err := toml.DecodeFile(path, cfg)
+		if err != nil {
+			return err
+		}
+		if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+			return fmt.Errorf("Unknown keys in %s: %v", path, undecoded)
+		}
+		return nil
+	default:
+		return fmt.Errorf("Unsupported config file format %s: use .yaml, .yml or .toml", path)
+	}
+}
+
+// ApplyEnv overrides every setting whose environment variable is set, using lookup (usually os.LookupEnv)
+func (cfg *Config) ApplyEnv(lookup func(string) (string, bool)) error {
+	var errs Errors
+	t := reflect.TypeOf(*cfg)
+	for i := 0; i < t.NumField(); i++ {
+		value, ok := lookup(t.Field(i).Tag.Get("env"))
+		if !ok {
+			continue
+		}
+		if err := cfg.Set(t.Field(i).Name, value); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", t.Field(i).Tag.Get("env"), err))
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// Set parses value into the setting with the given key (the flag name)
+func (cfg *Config) Set(key string, value string) error {
+	field := reflect.ValueOf(cfg).Elem().FieldByName(key)
+	if !field.IsValid() {
+		return fmt.Errorf("Unknown setting %s", key)
+	}
+	if unmarshaler, ok := field.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		if err := unmarshaler.UnmarshalText([]byte(value)); err != nil {
+			return fmt.Errorf("%v for %s", err, key)
+		}
+		return nil
+	}
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("Invalid boolean %q for %s", value, key)
+		}
+		field.SetBool(b)
+	case reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("Invalid integer %q for %s", value, key)
+		}
+		field.SetInt(n)
+	case reflect.Uint64:
+		n, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("Invalid unsigned integer %q for %s", value, key)
+		}
+		field.SetUint(n)
+	default:
+		return fmt.Errorf("Setting %s cannot be set from a string", key)
+	}
+	return nil
+}
+
+// AlertSmtpRecipients returns the comma separated addresses of AlertSmtpTo
+func (cfg *Config) AlertSmtpRecipients() (recipients []string) {
+	for _, address := range strings.Split(cfg.AlertSmtpTo, ",") {
+		if address = strings.TrimSpace(address); address != "" {
+			recipients = append(recipients, address)
+		}
+	}
+	return
+}
+
+// ListenPort returns Port, or the port in Url when Port is not set
+func (cfg *Config) ListenPort() string {
+	if cfg.Port != "" {
+		return cfg.Port
+	}
+	u, err := url.Parse(cfg.Url)
+	if err != nil {
+		return ""
+	}
+	return u.Port()
+}
+
+// Validate checks every setting and returns an Errors value listing all the invalid ones, or nil
+func (cfg *Config) Validate() error {
+	var errs Errors
+	fail := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	if !common.IsHexAddress(cfg.RelayHubAddress) {
+		fail("RelayHubAddress %q is not a valid address", cfg.RelayHubAddress)
+	} else if common.HexToAddress(cfg.RelayHubAddress) == (common.Address{}) {
+		fail("RelayHubAddress must not be the zero address")
+	}
+
+	if !common.IsHexAddress(cfg.OwnerAddress) {
+		fail("OwnerAddress %q is not a valid address", cfg.OwnerAddress)
+	}
+
+	u, err := url.Parse(cfg.Url)
+	if err != nil {
+		fail("Url %q cannot be parsed: %v", cfg.Url, err)
+	} else {
+		if u.Scheme != "http" && u.Scheme != "https" {
+			fail("Url %q must use http or https", cfg.Url)
+		}
+		if u.Hostname() == "" {
+			fail("Url %q has no host", cfg.Url)
+		}
+		// Behind a TLS proxy the advertised port is the proxy's, not the one we listen on
+		if !cfg.TLSOffloaded && cfg.Port != "" && u.Port() != "" && cfg.Port != u.Port() {
+			fail("Port %s does not match the port in Url %q", cfg.Port, cfg.Url)
+		}
+	}
+
+	if port := cfg.ListenPort(); port == "" {
+		fail("Port is not set and Url %q has no port", cfg.Url)
+	} else if n, err := strconv.ParseUint(port, 10, 16); err != nil || n == 0 {
+		fail("Port %q is not a valid TCP port", port)
+	}
+
+	if cfg.Fee < 0 || cfg.Fee > MaxFee {
+		fail("Fee %d must be between 0 and %d", cfg.Fee, MaxFee)
+	}
+	if cfg.GasPricePercent <= -100 || cfg.GasPricePercent > MaxGasPricePercent {
+		fail("GasPricePercent %d must be greater than -100 and at most %d", cfg.GasPricePercent, MaxGasPricePercent)
+	}
+	if cfg.DefaultGasPrice <= 0 {
+		fail("DefaultGasPrice %d must be positive", cfg.DefaultGasPrice)
+	}
+	if cfg.RegistrationBlockRate == 0 || cfg.RegistrationBlockRate >= RelayLookupWindowBlocks {
+		fail("RegistrationBlockRate %d must be between 1 and %d, or clients will not find the relay", cfg.RegistrationBlockRate, RelayLookupWindowBlocks-1)
+	}
+
+	if cfg.Confirmations > MaxConfirmations {
+		fail("Confirmations %d must be at most %d (0 uses the chain's default)", cfg.Confirmations, MaxConfirmations)
+	}
+
+	if cfg.EthereumNodeUrl == "" {
+		fail("EthereumNodeUrl is not set")
+	} else if _, err := url.Parse(cfg.EthereumNodeUrl); err != nil {
+		fail("EthereumNodeUrl %q cannot be parsed: %v", cfg.EthereumNodeUrl, err)
+	}
+
+	if cfg.AlertWebhookUrl != "" {
+		if webhook, err := url.Parse(cfg.AlertWebhookUrl); err != nil || (webhook.Scheme != "http" && webhook.Scheme != "https") {
+			fail("AlertWebhookUrl %q must be an http or https url", cfg.AlertWebhookUrl)
+		}
+	}
+	if cfg.AlertSlackWebhookUrl != "" {
+		if webhook, err := url.Parse(cfg.AlertSlackWebhookUrl); err != nil || (webhook.Scheme != "http" && webhook.Scheme != "https") {
+			fail("AlertSlackWebhookUrl %q must be an http or https url", cfg.AlertSlackWebhookUrl)
+		}
+	}
+	if cfg.AlertSmtpAddr != "" {
+		if _, _, err := net.SplitHostPort(cfg.AlertSmtpAddr); err != nil {
+			fail("AlertSmtpAddr %q must be a host:port address", cfg.AlertSmtpAddr)
+		}
+		if cfg.AlertSmtpFrom == "" || len(cfg.AlertSmtpRecipients()) == 0 {
+			fail("AlertSmtpFrom and AlertSmtpTo must be set to send alerts through AlertSmtpAddr")
+		}
+	}
+	if cfg.AlertDedupMinutes < 0 {
+		fail("AlertDedupMinutes %d must not be negative", cfg.AlertDedupMinutes)
+	}
+	if cfg.AlertMaxPerHour < 0 {
+		fail("AlertMaxPerHour %d must not be negative (0 sends every alert)", cfg.AlertMaxPerHour)
+	}
+	if cfg.AlertBalanceBelow.Sign() < 0 {
+		fail("AlertBalanceBelow %s must not be negative", cfg.AlertBalanceBelow)
+	}
+	if cfg.AlertPendingTxMinutes < 0 {
+		fail("AlertPendingTxMinutes %d must not be negative", cfg.AlertPendingTxMinutes)
+	}
+	if cfg.AlertRegistrationBlocks >= RelayLookupWindowBlocks {
+		fail("AlertRegistrationBlocks %d must be less than %d", cfg.AlertRegistrationBlocks, RelayLookupWindowBlocks)
+	}
+
+	if cfg.MinimumRelayBalance.Sign() < 0 {
+		fail("MinimumRelayBalance %s must not be negative", cfg.MinimumRelayBalance)
+	}
+	if cfg.RefillHookUrl != "" && cfg.RefillKeyFile != "" {
+		fail("RefillHookUrl and RefillKeyFile cannot be used together")
+	}
+	if cfg.RefillHookUrl != "" {
+		if hook, err := url.Parse(cfg.RefillHookUrl); err != nil || (hook.Scheme != "http" && hook.Scheme != "https") {
+			fail("RefillHookUrl %q must be an http or https url", cfg.RefillHookUrl)
+		}
+	}
+	if cfg.RefillHookUrl != "" || cfg.RefillKeyFile != "" {
+		if cfg.RefillBelow.Cmp(&cfg.MinimumRelayBalance.Int) <= 0 {
+			fail("RefillBelow %s must be above MinimumRelayBalance %s, or the relay stops serving before it is refilled", cfg.RefillBelow, cfg.MinimumRelayBalance)
+		}
+		if cfg.RefillAmount.Sign() <= 0 {
+			fail("RefillAmount %s must be positive", cfg.RefillAmount)
+		}
+		if cfg.RefillTimeoutMinutes < 1 {
+			fail("RefillTimeoutMinutes %d must be positive", cfg.RefillTimeoutMinutes)
+		}
+	}
+
+	if cfg.SweepKeepBalance.Sign() < 0 {
+		fail("SweepKeepBalance %s must not be negative (0 disables sweeping)", cfg.SweepKeepBalance)
+	} else if cfg.SweepKeepBalance.Sign() > 0 {
+		if cfg.SweepKeepBalance.Cmp(&cfg.MinimumRelayBalance.Int) <= 0 {
+			fail("SweepKeepBalance %s must be above MinimumRelayBalance %s, or the relay stops serving after a sweep", cfg.SweepKeepBalance, cfg.MinimumRelayBalance)
+		}
+		refilled := new(big.Int).Add(&cfg.RefillBelow.Int, &cfg.RefillAmount.Int)
+		if (cfg.RefillHookUrl != "" || cfg.RefillKeyFile != "") && cfg.SweepKeepBalance.Cmp(refilled) < 0 {
+			fail("SweepKeepBalance %s must be at least RefillBelow plus RefillAmount, or refills are swept back to the owner", cfg.SweepKeepBalance)
+		}
+		if cfg.SweepIntervalMinutes < 1 {
+			fail("SweepIntervalMinutes %d must be positive", cfg.SweepIntervalMinutes)
+		}
+	}
+
+	if cfg.Workdir == "" {
+		fail("Workdir is not set")
+	}
+
+	if (cfg.TLSCertFile == "") != (cfg.TLSKeyFile == "") {
+		fail("TLSCertFile and TLSKeyFile must be set together")
+	}
+	if cfg.ACME && cfg.TLSCertFile != "" {
+		fail("ACME cannot be used together with TLSCertFile and TLSKeyFile")
+	}
+	if cfg.ACME && cfg.TLSOffloaded {
+		fail("ACME cannot be used when TLS is offloaded to a proxy")
+	}
+	if cfg.ACME {
+		if _, err := url.Parse(cfg.ACMEDirectoryUrl); err != nil || cfg.ACMEDirectoryUrl == "" {
+			fail("ACMEDirectoryUrl %q is not a valid url", cfg.ACMEDirectoryUrl)
+		}
+	}
+	if cfg.MaxBatchSize < 1 || cfg.MaxBatchSize > MaxBatchSize {
+		fail("MaxBatchSize %d must be between 1 and %d", cfg.MaxBatchSize, MaxBatchSize)
+	}
+	if cfg.RelayWorkers < 1 || cfg.RelayWorkers > MaxRelayWorkers {
+		fail("RelayWorkers %d must be between 1 and %d", cfg.RelayWorkers, MaxRelayWorkers)
+	}
+	if cfg.RelayQueueSize < 1 {
+		fail("RelayQueueSize %d must be positive", cfg.RelayQueueSize)
+	}
+	if cfg.EnforceSimulation && !cfg.SimulateRelayCall {
+		fail("EnforceSimulation requires SimulateRelayCall")
+	}
+	if cfg.MinProfit < 0 {
+		fail("MinProfit %d must not be negative", cfg.MinProfit)
+	}
+	if cfg.MinProfitPercent < 0 || cfg.MinProfitPercent > MaxFee {
+		fail("MinProfitPercent %d must be between 0 and %d", cfg.MinProfitPercent, MaxFee)
+	} else if cfg.MinProfitPercent > 0 && cfg.MinProfitPercent*120 > (cfg.Fee-20)*100 {
+		// The margin must hold if the tx is resent at a 20% higher gas price
+		fail("MinProfitPercent %d is above the %d%% margin Fee %d leaves once a tx is resent 20%% higher: requests paying the relay's own fee would be rejected",
+			cfg.MinProfitPercent, (cfg.Fee-20)*100/120, cfg.Fee)
+	}
+	if cfg.ReputationMinSamples < 1 {
+		fail("ReputationMinSamples %d must be positive", cfg.ReputationMinSamples)
+	}
+	if cfg.ReputationMaxFailurePercent < 0 || cfg.ReputationMaxFailurePercent > 100 {
+		fail("ReputationMaxFailurePercent %d must be between 0 (never blacklist) and 100", cfg.ReputationMaxFailurePercent)
+	}
+	if cfg.ReputationWindowMinutes < 1 {
+		fail("ReputationWindowMinutes %d must be positive", cfg.ReputationWindowMinutes)
+	}
+	if cfg.BlacklistMinutes < 1 {
+		fail("BlacklistMinutes %d must be positive", cfg.BlacklistMinutes)
+	}
+
+	if u != nil && (u.Scheme == "http" || u.Scheme == "https") && u.Scheme != cfg.ServedScheme() {
+		fail("Url %q is advertised to clients but the relay serves %s (see TLSCertFile, ACME and TLSOffloaded)", cfg.Url, cfg.ServedScheme())
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// RelayParams converts a validated configuration into the parameters used to construct the relay server
+func (cfg *Config) RelayParams() (relayParams librelay.RelayParams) {
+	relayParams.OwnerAddress = common.HexToAddress(cfg.OwnerAddress)
+	relayParams.Fee = big.NewInt(cfg.Fee)
+	relayParams.Url = cfg.Url
+	relayParams.Port = cfg.ListenPort()
+	relayParams.RelayHubAddress = common.HexToAddress(cfg.RelayHubAddress)
+	relayParams.DefaultGasPrice = cfg.DefaultGasPrice
+	relayParams.GasPricePercent = big.NewInt(cfg.GasPricePercent)
+	relayParams.RegistrationBlockRate = cfg.RegistrationBlockRate
+	relayParams.EthereumNodeURL = cfg.EthereumNodeUrl
+	relayParams.DBFile = filepath.Join(cfg.Workdir, "db")
+	relayParams.ReputationDBFile = filepath.Join(cfg.Workdir, "reputation")
+	relayParams.HubIndexDBFile = filepath.Join(cfg.Workdir, "hubindex")
+	relayParams.HubIndexStartBlock = cfg.HubIndexStartBlock
+	relayParams.Confirmations = cfg.Confirmations
+	relayParams.IncidentDBFile = filepath.Join(cfg.Workdir, "incidents")
+	relayParams.StateDBFile = filepath.Join(cfg.Workdir, "state")
+	relayParams.AlertSettings = notify.Settings{
+		WebhookUrl:      cfg.AlertWebhookUrl,
+		SlackWebhookUrl: cfg.AlertSlackWebhookUrl,
+		SMTP: notify.SMTPSettings{
+			Addr:     cfg.AlertSmtpAddr,
+			From:     cfg.AlertSmtpFrom,
+			To:       cfg.AlertSmtpRecipients(),
+			Username: cfg.AlertSmtpUsername,
+			Password: cfg.AlertSmtpPassword,
+		},
+		DedupWindow: time.Duration(cfg.AlertDedupMinutes) * time.Minute,
+		MaxPerHour:  int(cfg.AlertMaxPerHour),
+	}
+	relayParams.AlertRules = librelay.AlertRules{
+		BalanceBelow:       cfg.AlertBalanceBelow.Big(),
+		PendingTxAge:       time.Duration(cfg.AlertPendingTxMinutes) * time.Minute,
+		RegistrationBlocks: cfg.AlertRegistrationBlocks,
+		RegistrationWindow: RelayLookupWindowBlocks,
+	}
+	relayParams.MinimumBalance = cfg.MinimumRelayBalance.Big()
+	relayParams.RefillTimeout = time.Duration(cfg.RefillTimeoutMinutes) * time.Minute
+	if cfg.SweepKeepBalance.Sign() > 0 {
+		relayParams.SweepKeepBalance = cfg.SweepKeepBalance.Big()
+	}
+	relayParams.SweepInterval = time.Duration(cfg.SweepIntervalMinutes) * time.Minute
+	relayParams.SweepDryRun = cfg.SweepDryRun
+	relayParams.SweepAuditFile = filepath.Join(cfg.Workdir, "sweeps.log")
+	if cfg.RefillHookUrl != "" || cfg.RefillKeyFile != "" {
+		relayParams.RefillBelow = cfg.RefillBelow.Big()
+		relayParams.RefillAmount = cfg.RefillAmount.Big()
+		relayParams.RefillHookUrl = cfg.RefillHookUrl
+		relayParams.RefillKeyFile = cfg.RefillKeyFile
+	}
+	relayParams.ReputationSettings = reputation.Settings{
+		MinSamples:        uint64(cfg.ReputationMinSamples),
+		MaxFailurePercent: uint64(cfg.ReputationMaxFailurePercent),
+		Window:            time.Duration(cfg.ReputationWindowMinutes) * time.Minute,
+		Cooldown:          time.Duration(cfg.BlacklistMinutes) * time.Minute,
+	}
+	relayParams.DevMode = cfg.DevMode
+	relayParams.UrlScheme = cfg.ServedScheme()
+	relayParams.SimulateRelayCall = cfg.SimulateRelayCall
+	relayParams.EnforceSimulation = cfg.EnforceSimulation
+	if cfg.MinProfit > 0 {
+		relayParams.MinProfit = big.NewInt(cfg.MinProfit)
+	}
+	if cfg.MinProfitPercent > 0 {
+		relayParams.MinProfitPercent = big.NewInt(cfg.MinProfitPercent)
+	}
+	return
+}
+
+// TLSEnabled returns whether the relay terminates TLS itself, either with certificate files or ACME
+func (cfg *Config) TLSEnabled() bool {
+	return cfg.TLSCertFile != "" || cfg.ACME
+}
+
+// ServedScheme returns the scheme clients reach the relay with: https when the relay or a proxy in front of it
+// terminates TLS, http otherwise
+func (cfg *Config) ServedScheme() string {
+	if cfg.TLSEnabled() || cfg.TLSOffloaded {
+		return "https"
+	}
+	return "http"
+}
+
+// ACMECacheDir returns the directory where ACME account keys and certificates are kept
+func (cfg *Config) ACMECacheDir() string {
+	return filepath.Join(cfg.Workdir, "acme")
+}
+
+// KeystoreDir returns the directory holding the relay's private key
+func (cfg *Config) KeystoreDir() string {
+	return filepath.Join(cfg.Workdir, "keystore")
+}
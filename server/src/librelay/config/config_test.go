@@ -0,0 +1,195 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"librelay/test"
+)
+
+func writeConfigFile(t *testing.T, name string, contents string) string {
+	dir, err := ioutil.TempDir("", "relayconfig")
+	test.ErrFail(err, t)
+	path := filepath.Join(dir, name)
+	test.ErrFail(ioutil.WriteFile(path, []byte(contents), 0600), t)
+	return path
+}
+
+func TestDefaultIsValid(t *testing.T) {
+	test.ErrFailWithDesc(Default().Validate(), t, "Default configuration")
+}
+
+func TestLoadYaml(t *testing.T) {
+	path := writeConfigFile(t, "relay.yaml", "Url: https://relay.example.com:8443\nFee: 20\nDevMode: true\n")
+	defer os.RemoveAll(filepath.Dir(path))
+
+	cfg := Default()
+	test.ErrFail(cfg.LoadFile(path), t)
+	if cfg.Url != "https://relay.example.com:8443" || cfg.Fee != 20 || !cfg.DevMode {
+		t.Errorf("Configuration not loaded from yaml: %+v", cfg)
+	}
+	if cfg.ListenPort() != "8443" {
+		t.Errorf("Expected port from Url but got %q", cfg.ListenPort())
+	}
+}
+
+func TestLoadToml(t *testing.T) {
+	path := writeConfigFile(t, "relay.toml", "Fee = 30\nRegistrationBlockRate = 100\n")
+	defer os.RemoveAll(filepath.Dir(path))
+
+	cfg := Default()
+	test.ErrFail(cfg.LoadFile(path), t)
+	if cfg.Fee != 30 || cfg.RegistrationBlockRate != 100 {
+		t.Errorf("Configuration not loaded from toml: %+v", cfg)
+	}
+}
+
+func TestLoadRejectsUnknownKeys(t *testing.T) {
+	for name, contents := range map[string]string{"relay.yaml": "Fees: 20\n", "relay.toml": "Fees = 20\n"} {
+		path := writeConfigFile(t, name, contents)
+		if err := Default().LoadFile(path); err == nil {
+			t.Errorf("Expected %s with unknown key to be rejected", name)
+		}
+		os.RemoveAll(filepath.Dir(path))
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	env := map[string]string{
+		"GSN_RELAY_FEE":      "15",
+		"GSN_RELAY_DEV_MODE": "true",
+		"GSN_RELAY_PORT":     "not a number is fine here",
+	}
+	cfg := Default()
+	test.ErrFail(cfg.ApplyEnv(func(key string) (value string, ok bool) {
+		value, ok = env[key]
+		return
+	}), t)
+	if cfg.Fee != 15 || !cfg.DevMode || cfg.Port != env["GSN_RELAY_PORT"] {
+		t.Errorf("Environment overrides not applied: %+v", cfg)
+	}
+
+	err := cfg.ApplyEnv(func(key string) (string, bool) {
+		return "abc", key == "GSN_RELAY_FEE" || key == "GSN_RELAY_REGISTRATION_BLOCK_RATE"
+	})
+	if errs, ok := err.(Errors); !ok || len(errs) != 2 {
+		t.Errorf("Expected two errors for invalid numbers but got %v", err)
+	}
+}
+
+func TestWeiAmounts(t *testing.T) {
+	// Amounts of 10 and 20 ether do not fit in an int64
+	path := writeConfigFile(t, "relay.yaml", "RefillAmount: 10000000000000000000\nSweepKeepBalance: \"20000000000000000000\"\n")
+	defer os.RemoveAll(filepath.Dir(path))
+	cfg := Default()
+	test.ErrFail(cfg.LoadFile(path), t)
+	if cfg.RefillAmount.String() != "10000000000000000000" || cfg.SweepKeepBalance.String() != "20000000000000000000" {
+		t.Errorf("Amounts not loaded from yaml: %v %v", cfg.RefillAmount, cfg.SweepKeepBalance)
+	}
+
+	tomlPath := writeConfigFile(t, "relay.toml", "RefillBelow = \"30000000000000000000\"\nAlertBalanceBelow = 1000\n")
+	defer os.RemoveAll(filepath.Dir(tomlPath))
+	test.ErrFail(cfg.LoadFile(tomlPath), t)
+	if cfg.RefillBelow.String() != "30000000000000000000" || cfg.AlertBalanceBelow.Int64() != 1000 {
+		t.Errorf("Amounts not loaded from toml: %v %v", cfg.RefillBelow, cfg.AlertBalanceBelow)
+	}
+
+	test.ErrFail(cfg.Set("MinimumRelayBalance", "40000000000000000000"), t)
+	if relayParams := cfg.RelayParams(); relayParams.MinimumBalance.String() != "40000000000000000000" {
+		t.Errorf("Expected a minimum balance of 40 ether but got %v", relayParams.MinimumBalance)
+	}
+	if err := cfg.Set("RefillAmount", "1e18"); err == nil {
+		t.Error("Expected an amount that is not a decimal integer to be rejected")
+	}
+}
+
+func TestValidateReportsAllErrors(t *testing.T) {
+	cfg := Default()
+	cfg.RelayHubAddress = "0x0000000000000000000000000000000000000000"
+	cfg.Url = "ftp://relay.example.com:8090"
+	cfg.Port = "8091"
+	cfg.Fee = -1
+	cfg.GasPricePercent = -100
+	cfg.RegistrationBlockRate = RelayLookupWindowBlocks
+	cfg.Confirmations = MaxConfirmations + 1
+	cfg.AlertWebhookUrl = "ftp://alerts.example.com"
+	cfg.AlertSmtpAddr = "smtp.example.com:587"
+	cfg.RefillHookUrl = "http://treasury.example.com/fund"
+	cfg.RefillBelow = NewWei(cfg.MinimumRelayBalance.Int64())
+	cfg.SweepKeepBalance = NewWei(9e18)
+	cfg.SweepIntervalMinutes = 0
+
+	err := cfg.Validate()
+	errs, ok := err.(Errors)
+	if !ok {
+		t.Fatalf("Expected configuration errors but got %v", err)
+	}
+	expected := []string{"RelayHubAddress", "http or https", "does not match", "Fee", "GasPricePercent", "RegistrationBlockRate", "Confirmations", "AlertWebhookUrl", "AlertSmtpTo", "RefillBelow", "SweepIntervalMinutes"}
+	if len(errs) != len(expected) {
+		t.Errorf("Expected %d errors but got %v", len(expected), errs)
+	}
+	for _, substr := range expected {
+		if !strings.Contains(errs.Error(), substr) {
+			t.Errorf("Expected an error mentioning %s in %v", substr, errs)
+		}
+	}
+}
+
+func TestRelayParams(t *testing.T) {
+	cfg := Default()
+	cfg.Url = "https://relay.example.com:8443"
+	cfg.Workdir = "/tmp/relay"
+	relayParams := cfg.RelayParams()
+	if relayParams.Port != "8443" || relayParams.DBFile != "/tmp/relay/db" || relayParams.Fee.Int64() != cfg.Fee {
+		t.Errorf("Wrong relay params %+v", relayParams)
+	}
+
+	cfg.AlertSmtpTo = "ops@example.com, oncall@example.com,"
+	relayParams = cfg.RelayParams()
+	if to := relayParams.AlertSettings.SMTP.To; len(to) != 2 || to[1] != "oncall@example.com" {
+		t.Errorf("Wrong alert recipients %v", to)
+	}
+	if relayParams.AlertRules.PendingTxAge != 30*time.Minute || relayParams.AlertRules.RegistrationWindow != RelayLookupWindowBlocks {
+		t.Errorf("Wrong alert rules %+v", relayParams.AlertRules)
+	}
+	if relayParams.MinimumBalance.Cmp(&cfg.MinimumRelayBalance.Int) != 0 || relayParams.RefillBelow != nil {
+		t.Errorf("Expected the minimum balance and no refill but got %v %v", relayParams.MinimumBalance, relayParams.RefillBelow)
+	}
+}
+
+func TestValidateTLS(t *testing.T) {
+	cfg := Default()
+	cfg.Url = "https://relay.example.com:443"
+	cfg.Port = "8091"
+	if cfg.Validate() == nil {
+		t.Error("Expected https url to be rejected when serving plain http")
+	}
+
+	cfg.TLSOffloaded = true
+	test.ErrFailWithDesc(cfg.Validate(), t, "TLS offloaded to a proxy")
+
+	cfg.TLSOffloaded = false
+	cfg.Port = ""
+	cfg.TLSCertFile = "cert.pem"
+	if err, ok := cfg.Validate().(Errors); !ok || len(err) != 1 {
+		t.Errorf("Expected missing TLSKeyFile to be the only error but got %v", err)
+	}
+
+	cfg.TLSKeyFile = "key.pem"
+	test.ErrFailWithDesc(cfg.Validate(), t, "TLS with certificate files")
+
+	cfg.ACME = true
+	if cfg.Validate() == nil {
+		t.Error("Expected ACME with certificate files to be rejected")
+	}
+
+	cfg.Url = "http://relay.example.com:8090"
+	cfg.TLSCertFile, cfg.TLSKeyFile = "", ""
+	if cfg.Validate() == nil {
+		t.Error("Expected http url to be rejected when serving TLS")
+	}
+}
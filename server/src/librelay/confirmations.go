@@ -0,0 +1,99 @@
+package librelay
+
+import (
+	"context"
+	"librelay/txstore"
+	"log"
+	"strings"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// DefaultConfirmationsNeeded is the number of blocks mined on top of a tx before it is considered final, on chains
+// without a known default
+const DefaultConfirmationsNeeded = 12
+
+// chainConfirmations are the defaults of the known chains by chain id. Ropsten is a proof of work testnet prone to deep
+// reorgs; the proof of authority testnets reorg far less than mainnet.
+var chainConfirmations = map[int64]uint64{
+	1:  12, // mainnet
+	3:  24, // ropsten
+	4:  6,  // rinkeby
+	5:  6,  // goerli
+	42: 6,  // kovan
+}
+
+// ConfirmationsNeeded returns the configured Confirmations, or the default of the relay's chain
+func (relay *RelayServer) ConfirmationsNeeded() uint64 {
+	if relay.Confirmations != 0 {
+		return relay.Confirmations
+	}
+	chainID, err := relay.ChainID()
+	if err != nil || !chainID.IsInt64() {
+		return DefaultConfirmationsNeeded
+	}
+	if confirmations, ok := chainConfirmations[chainID.Int64()]; ok {
+		return confirmations
+	}
+	return DefaultConfirmationsNeeded
+}
+
+// transactionBlock returns the block the tx or one it replaced is mined in on the current chain, or a zero hash if none is
+func (relay *RelayServer) transactionBlock(ctx context.Context, tx *txstore.TimestampedTransaction) (blockNumber uint64, blockHash common.Hash, err error) {
+	for _, hash := range append([]common.Hash{tx.Hash()}, tx.PreviousHashes...) {
+		blockNumber, blockHash, err = relay.Client.TransactionBlock(ctx, hash)
+		if err == ethereum.NotFound {
+			continue
+		}
+		return
+	}
+	return 0, common.Hash{}, nil
+}
+
+// trackMinedBlock records the block the stored tx is mined in on the current chain. A tx that was recorded as mined but
+// is no longer found on the chain was dropped by a reorg: its signed tx is broadcast again, since the node it was sent
+// to may have discarded it.
+func (relay *RelayServer) trackMinedBlock(ctx context.Context, tx *txstore.TimestampedTransaction) (tracked *txstore.TimestampedTransaction, err error) {
+	blockNumber, blockHash, err := relay.transactionBlock(ctx, tx)
+	if err != nil {
+		return nil, err
+	}
+	if blockHash == tx.MinedBlockHash {
+		return tx, nil
+	}
+	err = relay.TxStore.UpdateMinedBlock(tx.Nonce(), blockNumber, blockHash)
+	if err != nil {
+		return nil, err
+	}
+	updated := *tx
+	updated.MinedBlock, updated.MinedBlockHash = blockNumber, blockHash
+	if !tx.IsMined() {
+		return &updated, nil
+	}
+
+	if updated.IsMined() {
+		log.Println("Transaction", tx.Nonce(), tx.Hash().Hex(), "moved by a reorg from block", tx.MinedBlock, tx.MinedBlockHash.Hex(),
+			"to block", blockNumber, blockHash.Hex())
+		return &updated, nil
+	}
+	log.Println("Transaction", tx.Nonce(), tx.Hash().Hex(), "mined in block", tx.MinedBlock, tx.MinedBlockHash.Hex(),
+		"was dropped by a reorg, broadcasting it again")
+	relay.rebroadcastTransaction(ctx, &updated)
+	return &updated, nil
+}
+
+// rebroadcastTransaction sends the stored signed tx again. The node may still know it, or a tx it replaced may have
+// been mined again in the meantime, neither of which is an error.
+func (relay *RelayServer) rebroadcastTransaction(ctx context.Context, tx *txstore.TimestampedTransaction) {
+	err := relay.Client.SendTransaction(ctx, tx.Transaction)
+	if err == nil {
+		return
+	}
+	message := strings.ToLower(err.Error())
+	if strings.Contains(message, "known transaction") || strings.Contains(message, "already known") || strings.Contains(message, "nonce too low") {
+		log.Println("Transaction", tx.Hash().Hex(), "was not broadcast again:", err)
+		return
+	}
+	log.Println("Could not broadcast transaction", tx.Hash().Hex(), "again:", err)
+}
@@ -0,0 +1,228 @@
+package librelay
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// Uint256 is a big.Int that unmarshals from json numbers as well as from decimal or 0x-prefixed hex strings, which is
+// how eth_signTypedData clients (see src/js/relayclient/EIP712) send uint256 values
+type Uint256 struct {
+	big.Int
+}
+
+func (value *Uint256) UnmarshalJSON(data []byte) error {
+	str := strings.Trim(string(data), `"`)
+	if _, ok := value.SetString(str, 0); !ok || !isUint256(&value.Int) {
+		return fmt.Errorf("Invalid uint256 %s", string(data))
+	}
+	return nil
+}
+
+type EIP712Type struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+type EIP712Domain struct {
+	Name              string         `json:"name"`
+	Version           string         `json:"version"`
+	ChainId           *Uint256       `json:"chainId,omitempty"`
+	VerifyingContract common.Address `json:"verifyingContract"`
+}
+
+type EIP712CallData struct {
+	Target          common.Address `json:"target"`
+	GasLimit        Uint256        `json:"gasLimit"`
+	GasPrice        Uint256        `json:"gasPrice"`
+	EncodedFunction hexutil.Bytes  `json:"encodedFunction"`
+}
+
+type EIP712RelayData struct {
+	SenderAccount common.Address `json:"senderAccount"`
+	SenderNonce   Uint256        `json:"senderNonce"`
+	RelayAddress  common.Address `json:"relayAddress"`
+	PctRelayFee   Uint256        `json:"pctRelayFee"`
+}
+
+type EIP712RelayRequest struct {
+	CallData  EIP712CallData  `json:"callData"`
+	RelayData EIP712RelayData `json:"relayData"`
+}
+
+// RelayTypedData is the eth_signTypedData payload a client signed for a relay request
+type RelayTypedData struct {
+	Types       map[string][]EIP712Type `json:"types"`
+	PrimaryType string                  `json:"primaryType"`
+	Domain      EIP712Domain            `json:"domain"`
+	Message     EIP712RelayRequest      `json:"message"`
+}
+
+// Struct types of a RelayRequest, as declared in EIP712Sig.sol and Eip712Helper.js
+var relayRequestTypes = map[string][]EIP712Type{
+	"RelayRequest": {{"callData", "CallData"}, {"relayData", "RelayData"}},
+	"CallData":     {{"target", "address"}, {"gasLimit", "uint256"}, {"gasPrice", "uint256"}, {"encodedFunction", "bytes"}},
+	"RelayData":    {{"senderAccount", "address"}, {"senderNonce", "uint256"}, {"relayAddress", "address"}, {"pctRelayFee", "uint256"}},
+}
+
+var eip712DomainFieldTypes = map[string]string{
+	"name":              "string",
+	"version":           "string",
+	"chainId":           "uint256",
+	"verifyingContract": "address",
+}
+
+func sameTypes(a []EIP712Type, b []EIP712Type) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// checkTypes makes sure the signed types are the ones the hub hashes, so that the message is interpreted as signed
+func (typedData *RelayTypedData) checkTypes() error {
+	if typedData.PrimaryType != "RelayRequest" {
+		return fmt.Errorf("Unsupported primaryType %s", typedData.PrimaryType)
+	}
+	for name, fields := range relayRequestTypes {
+		if !sameTypes(typedData.Types[name], fields) {
+			return fmt.Errorf("Type %s does not match RelayHub's: %v", name, typedData.Types[name])
+		}
+	}
+	domainFields := typedData.Types["EIP712Domain"]
+	if len(domainFields) == 0 {
+		return fmt.Errorf("Missing EIP712Domain type")
+	}
+	for _, field := range domainFields {
+		if eip712DomainFieldTypes[field.Name] != field.Type {
+			return fmt.Errorf("Unsupported EIP712Domain field %s %s", field.Type, field.Name)
+		}
+	}
+	if len(typedData.Types) != len(relayRequestTypes)+1 {
+		return fmt.Errorf("Unexpected types in typed data: %v", typedData.Types)
+	}
+	return nil
+}
+
+// DomainSeparator hashes the domain with the fields declared in its EIP712Domain type, in their declared order
+func (typedData *RelayTypedData) DomainSeparator() (separator common.Hash, err error) {
+	domain := typedData.Domain
+	fields := typedData.Types["EIP712Domain"]
+	names := make([]string, len(fields))
+	encoded := [][]byte{nil}
+	for i, field := range fields {
+		names[i] = field.Type + " " + field.Name
+		switch field.Name {
+		case "name":
+			encoded = append(encoded, crypto.Keccak256([]byte(domain.Name)))
+		case "version":
+			encoded = append(encoded, crypto.Keccak256([]byte(domain.Version)))
+		case "chainId":
+			if domain.ChainId == nil {
+				return separator, fmt.Errorf("EIP712Domain declares chainId but the domain has none")
+			}
+			encoded = append(encoded, abiUint256(&domain.ChainId.Int))
+		case "verifyingContract":
+			encoded = append(encoded, abiAddress(domain.VerifyingContract))
+		}
+	}
+	encoded[0] = crypto.Keccak256([]byte("EIP712Domain(" + strings.Join(names, ",") + ")"))
+	return crypto.Keccak256Hash(encoded...), nil
+}
+
+// Hash returns the EIP-712 digest of the typed data, i.e. what eth_signTypedData signed
+func (typedData *RelayTypedData) Hash() (hash common.Hash, err error) {
+	if err = typedData.checkTypes(); err != nil {
+		return
+	}
+	separator, err := typedData.DomainSeparator()
+	if err != nil {
+		return
+	}
+	request := typedData.RelayTransactionRequest()
+	return eip712Digest(separator, request.StructHash(typedData.Message.RelayData.RelayAddress)), nil
+}
+
+// RecoverSigner returns the address that signed the typed data
+func (typedData *RelayTypedData) RecoverSigner(signature []byte) (signer common.Address, err error) {
+	hash, err := typedData.Hash()
+	if err != nil {
+		return
+	}
+	return recoverSigner(hash, signature)
+}
+
+// RelayTransactionRequest returns the fields of the typed message as a legacy request, without signature
+func (typedData *RelayTypedData) RelayTransactionRequest() (request RelayTransactionRequest) {
+	callData := typedData.Message.CallData
+	relayData := typedData.Message.RelayData
+	request.EncodedFunction = hexutil.Encode(callData.EncodedFunction)
+	request.From = relayData.SenderAccount
+	request.To = callData.Target
+	request.GasPrice.Set(&callData.GasPrice.Int)
+	request.GasLimit.Set(&callData.GasLimit.Int)
+	request.RecipientNonce.Set(&relayData.SenderNonce.Int)
+	request.RelayFee.Set(&relayData.PctRelayFee.Int)
+	request.RelayHubAddress = typedData.Domain.VerifyingContract
+	return
+}
+
+// resolveTypedData validates a typed-data request against this relay and fills in the legacy request fields from it
+func (relay *RelayServer) resolveTypedData(request *RelayTransactionRequest) (err error) {
+	typedData := request.TypedData
+	domain := typedData.Domain
+	if domain.Name != eip712DomainName || domain.Version != eip712DomainVersion {
+		return fmt.Errorf("Unsupported EIP712 domain %s version %s", domain.Name, domain.Version)
+	}
+	if domain.VerifyingContract != relay.RelayHubAddress {
+		return fmt.Errorf("Wrong verifyingContract %s, relay's hub is %s", domain.VerifyingContract.Hex(), relay.RelayHubAddress.Hex())
+	}
+	if domain.ChainId != nil {
+		chainID, err := relay.ChainID()
+		if err != nil {
+			return err
+		}
+		if domain.ChainId.Cmp(chainID) != 0 {
+			return fmt.Errorf("Wrong chainId %s, relay is on chain %s", domain.ChainId.String(), chainID.String())
+		}
+	}
+	if typedData.Message.RelayData.RelayAddress != relay.Address() {
+		return fmt.Errorf("Request signed for relay %s", typedData.Message.RelayData.RelayAddress.Hex())
+	}
+
+	signer, err := typedData.RecoverSigner(request.Signature)
+	if err != nil {
+		return fmt.Errorf("Invalid typed data signature: %v", err)
+	}
+	if signer != typedData.Message.RelayData.SenderAccount {
+		return fmt.Errorf("Wrong typed data signature: signed by %s, request from %s", signer.Hex(), typedData.Message.RelayData.SenderAccount.Hex())
+	}
+
+	// RelayHub only hashes name, version and verifyingContract: a signature over any other domain is valid off-chain
+	// but would fail canRelay with WrongSignature
+	separator, _ := typedData.DomainSeparator()
+	if separator != RelayHubDomainSeparator(relay.RelayHubAddress) {
+		return fmt.Errorf("Typed data domain is not the one RelayHub verifies: EIP712Domain must be (string name,string version,address verifyingContract)")
+	}
+
+	resolved := typedData.RelayTransactionRequest()
+	request.EncodedFunction = resolved.EncodedFunction
+	request.From = resolved.From
+	request.To = resolved.To
+	request.GasPrice.Set(&resolved.GasPrice)
+	request.GasLimit.Set(&resolved.GasLimit)
+	request.RecipientNonce.Set(&resolved.RecipientNonce)
+	request.RelayFee.Set(&resolved.RelayFee)
+	request.RelayHubAddress = resolved.RelayHubAddress
+	return nil
+}
@@ -0,0 +1,84 @@
+package librelay
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"librelay/test"
+
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// newTypedRelayTransactionRequest builds the request the js client sends, as produced by Eip712Helper.js
+func newTypedRelayTransactionRequest(t *testing.T, recipientNonce int64, chainIdType string) (request RelayTransactionRequest) {
+	chainID, err := relay.ChainID()
+	test.ErrFail(err, t)
+	body := fmt.Sprintf(`{
+		"ApprovalData": "",
+		"RelayMaxNonce": 1000000,
+		"TypedData": {
+			"types": {
+				"EIP712Domain": [{"name": "name", "type": "string"}, {"name": "version", "type": "string"}, %s {"name": "verifyingContract", "type": "address"}],
+				"RelayRequest": [{"name": "callData", "type": "CallData"}, {"name": "relayData", "type": "RelayData"}],
+				"CallData": [{"name": "target", "type": "address"}, {"name": "gasLimit", "type": "uint256"}, {"name": "gasPrice", "type": "uint256"}, {"name": "encodedFunction", "type": "bytes"}],
+				"RelayData": [{"name": "senderAccount", "type": "address"}, {"name": "senderNonce", "type": "uint256"}, {"name": "relayAddress", "type": "address"}, {"name": "pctRelayFee", "type": "uint256"}]
+			},
+			"domain": {"name": "GSN Relayed Transaction", "version": "1", "chainId": %s, "verifyingContract": "%s"},
+			"primaryType": "RelayRequest",
+			"message": {
+				"callData": {"target": "%s", "gasLimit": "1000000", "gasPrice": "2000", "encodedFunction": "0x2ac0df260000000000000000000000000000000000000000000000000000000000000020000000000000000000000000000000000000000000000000000000000000000b68656c6c6f20776f726c64000000000000000000000000000000000000000000"},
+				"relayData": {"senderAccount": "%s", "senderNonce": "%d", "relayAddress": "%s", "pctRelayFee": "10"}
+			}
+		}
+	}`, chainIdType, chainID.String(), rhaddr.Hex(), sampleRecipient.Hex(), crypto.PubkeyToAddress(gaslessKey2.PublicKey).Hex(), recipientNonce, relay.Address().Hex())
+	test.ErrFailWithDesc(json.Unmarshal([]byte(body), &request), t, "Parsing typed data request")
+
+	hash, err := request.TypedData.Hash()
+	test.ErrFail(err, t)
+	request.Signature, err = crypto.Sign(hash.Bytes(), gaslessKey2)
+	test.ErrFail(err, t)
+	request.Signature[64] += 27
+	return
+}
+
+func TestTypedDataMatchesLegacyHash(t *testing.T) {
+	request := newTypedRelayTransactionRequest(t, 3, "")
+	typedHash, err := request.TypedData.Hash()
+	test.ErrFail(err, t)
+
+	legacy := request.TypedData.RelayTransactionRequest()
+	if legacy.Hash(relay.Address()) != typedHash {
+		t.Errorf("Typed data hash %s differs from the hash RelayHub verifies %s", typedHash.Hex(), legacy.Hash(relay.Address()).Hex())
+	}
+}
+
+func TestResolveTypedData(t *testing.T) {
+	request := newTypedRelayTransactionRequest(t, 3, "")
+	test.ErrFailWithDesc(relay.resolveTypedData(&request), t, "Resolving typed data request")
+	if request.From != crypto.PubkeyToAddress(gaslessKey2.PublicKey) || request.To != sampleRecipient ||
+		request.RecipientNonce.Int64() != 3 || request.GasLimit.Int64() != 1000000 || request.RelayHubAddress != rhaddr {
+		t.Errorf("Typed data not copied into request: %+v", request)
+	}
+	test.ErrFailWithDesc(relay.validateRequestSignature(&request), t, "Validating resolved request signature")
+
+	// Signed over a domain that includes chainId, which RelayHub would reject
+	request = newTypedRelayTransactionRequest(t, 3, `{"name": "chainId", "type": "uint256"},`)
+	if relay.resolveTypedData(&request) == nil {
+		t.Error("Expected typed data with chainId in the signed domain to be rejected")
+	}
+
+	// Tampered message
+	request = newTypedRelayTransactionRequest(t, 3, "")
+	request.TypedData.Message.CallData.GasPrice.SetInt64(1)
+	if relay.resolveTypedData(&request) == nil {
+		t.Error("Expected tampered typed data to be rejected")
+	}
+
+	// Wrong chain
+	request = newTypedRelayTransactionRequest(t, 3, "")
+	request.TypedData.Domain.ChainId.SetInt64(1)
+	if relay.resolveTypedData(&request) == nil {
+		t.Error("Expected typed data for another chain to be rejected")
+	}
+}
@@ -0,0 +1,184 @@
+package funding
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// Funder sends funds to a relay whose balance is low, returning the hash of the funding tx to track
+type Funder interface {
+	RequestFunds(relay common.Address, amount *big.Int) (txHash common.Hash, err error)
+	// ReplaceFunds replaces the funding tx txHash, not mined in time, with one sending amount at the same nonce and a
+	// higher gas price, so that only one of them can be mined. A tx the node dropped is sent again at its nonce.
+	// Returns txHash if it is already mined.
+	ReplaceFunds(relay common.Address, amount *big.Int, txHash common.Hash) (newTxHash common.Hash, err error)
+}
+
+// FundingRequest is posted by HttpFunder to the treasury service
+type FundingRequest struct {
+	Relay    common.Address
+	Amount   *big.Int
+	Replaces *common.Hash `json:",omitempty"` // funding tx to replace at the same nonce, if set
+}
+
+// FundingResponse is the treasury service's answer: the hash of the tx sending the funds, or why it did not send them
+type FundingResponse struct {
+	TxHash common.Hash
+	Error  string `json:"error"`
+}
+
+// HttpFunder asks a treasury service at Url to fund the relay
+type HttpFunder struct {
+	Url    string
+	Client *http.Client
+}
+
+func NewHttpFunder(url string) *HttpFunder {
+	return &HttpFunder{Url: url, Client: &http.Client{Timeout: 30 * time.Second}}
+}
+
+func (funder *HttpFunder) RequestFunds(relay common.Address, amount *big.Int) (txHash common.Hash, err error) {
+	return funder.post(FundingRequest{Relay: relay, Amount: amount})
+}
+
+// ReplaceFunds asks the treasury service to replace its funding tx txHash. The service must send the replacement at
+// the same nonce, also when the tx was dropped, or answer the hash of the tx if it was mined.
+func (funder *HttpFunder) ReplaceFunds(relay common.Address, amount *big.Int, txHash common.Hash) (newTxHash common.Hash, err error) {
+	return funder.post(FundingRequest{Relay: relay, Amount: amount, Replaces: &txHash})
+}
+
+func (funder *HttpFunder) post(request FundingRequest) (txHash common.Hash, err error) {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return
+	}
+	resp, err := funder.Client.Post(funder.Url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	var response FundingResponse
+	decodeErr := json.NewDecoder(resp.Body).Decode(&response)
+	if response.Error != "" {
+		return txHash, fmt.Errorf("Funding service %s refused: %s", funder.Url, response.Error)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return txHash, fmt.Errorf("Funding service %s answered %s", funder.Url, resp.Status)
+	}
+	if decodeErr != nil {
+		return txHash, fmt.Errorf("Funding service %s sent an invalid answer: %v", funder.Url, decodeErr)
+	}
+	if response.TxHash == (common.Hash{}) {
+		return txHash, fmt.Errorf("Funding service %s sent no tx hash", funder.Url)
+	}
+	return response.TxHash, nil
+}
+
+// Backend is the part of the ethereum client WalletFunder sends txs with
+type Backend interface {
+	PendingNonceAt(ctx context.Context, account common.Address) (uint64, error)
+	SuggestGasPrice(ctx context.Context) (*big.Int, error)
+	SendTransaction(ctx context.Context, tx *types.Transaction) error
+	TransactionByHash(ctx context.Context, txHash common.Hash) (tx *types.Transaction, isPending bool, err error)
+}
+
+// WalletFunder sends funds from a hot wallet key that is only used to fund the relay. Its txs are signed for ChainID,
+// the chain id the relay signs its own txs for.
+type WalletFunder struct {
+	Key     *ecdsa.PrivateKey
+	ChainID *big.Int
+	Backend Backend
+	mutex   sync.Mutex
+	sent    map[common.Hash]*types.Transaction // txs sent, to send a tx the node dropped again at its nonce
+}
+
+func NewWalletFunder(key *ecdsa.PrivateKey, chainID *big.Int, backend Backend) *WalletFunder {
+	return &WalletFunder{Key: key, ChainID: chainID, Backend: backend}
+}
+
+// NewWalletFunderFromFile loads the hex encoded private key of the wallet from keyFile
+func NewWalletFunderFromFile(keyFile string, chainID *big.Int, backend Backend) (funder *WalletFunder, err error) {
+	key, err := crypto.LoadECDSA(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("Could not load funding key %s: %v", keyFile, err)
+	}
+	return NewWalletFunder(key, chainID, backend), nil
+}
+
+func (funder *WalletFunder) Address() common.Address {
+	return crypto.PubkeyToAddress(funder.Key.PublicKey)
+}
+
+func (funder *WalletFunder) RequestFunds(relay common.Address, amount *big.Int) (txHash common.Hash, err error) {
+	ctx := context.Background()
+	nonce, err := funder.Backend.PendingNonceAt(ctx, funder.Address())
+	if err != nil {
+		return
+	}
+	gasPrice, err := funder.Backend.SuggestGasPrice(ctx)
+	if err != nil {
+		return
+	}
+	return funder.send(ctx, nonce, relay, amount, gasPrice)
+}
+
+// ReplaceFunds sends the funds again at the nonce of the pending funding tx txHash, paying enough more gas for nodes
+// to accept the replacement. A tx the node dropped is looked up in the txs this wallet sent.
+func (funder *WalletFunder) ReplaceFunds(relay common.Address, amount *big.Int, txHash common.Hash) (newTxHash common.Hash, err error) {
+	ctx := context.Background()
+	tx, pending, err := funder.Backend.TransactionByHash(ctx, txHash)
+	if err == ethereum.NotFound {
+		funder.mutex.Lock()
+		tx, pending, err = funder.sent[txHash], true, nil
+		funder.mutex.Unlock()
+		if tx == nil {
+			return newTxHash, fmt.Errorf("Funding tx %s is unknown to the node and was not sent by this wallet", txHash.Hex())
+		}
+	}
+	if err != nil {
+		return newTxHash, fmt.Errorf("Could not get funding tx %s to replace: %v", txHash.Hex(), err)
+	}
+	if !pending {
+		return txHash, nil
+	}
+	gasPrice, err := funder.Backend.SuggestGasPrice(ctx)
+	if err != nil {
+		return
+	}
+	bumped := new(big.Int).Mul(tx.GasPrice(), big.NewInt(110))
+	bumped.Div(bumped, big.NewInt(100)).Add(bumped, big.NewInt(1))
+	if gasPrice.Cmp(bumped) < 0 {
+		gasPrice = bumped
+	}
+	return funder.send(ctx, tx.Nonce(), relay, amount, gasPrice)
+}
+
+func (funder *WalletFunder) send(ctx context.Context, nonce uint64, relay common.Address, amount *big.Int, gasPrice *big.Int) (txHash common.Hash, err error) {
+	tx := types.NewTransaction(nonce, relay, amount, 21000, gasPrice, nil)
+	signedTx, err := types.SignTx(tx, types.NewEIP155Signer(funder.ChainID), funder.Key)
+	if err != nil {
+		return
+	}
+	if err = funder.Backend.SendTransaction(ctx, signedTx); err != nil {
+		return
+	}
+	funder.mutex.Lock()
+	defer funder.mutex.Unlock()
+	if funder.sent == nil {
+		funder.sent = map[common.Hash]*types.Transaction{}
+	}
+	funder.sent[signedTx.Hash()] = signedTx
+	return signedTx.Hash(), nil
+}
@@ -0,0 +1,143 @@
+package funding
+
+import (
+	"context"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"librelay/test"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+var relayAddress = common.HexToAddress("0x90F8bf6A479f320ead074411a4B0e7944Ea8c9C1")
+
+func TestHttpFunder(t *testing.T) {
+	txHash := common.HexToHash("0x1234")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request FundingRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if request.Replaces != nil {
+			json.NewEncoder(w).Encode(FundingResponse{TxHash: common.BigToHash(new(big.Int).Add(request.Replaces.Big(), big.NewInt(1)))})
+			return
+		}
+		if request.Amount.Cmp(big.NewInt(1e18)) > 0 {
+			json.NewEncoder(w).Encode(FundingResponse{Error: "Amount too high"})
+			return
+		}
+		if request.Relay != relayAddress {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(FundingResponse{TxHash: txHash})
+	}))
+	defer server.Close()
+	funder := NewHttpFunder(server.URL)
+
+	hash, err := funder.RequestFunds(relayAddress, big.NewInt(1e17))
+	test.ErrFail(err, t)
+	if hash != txHash {
+		t.Errorf("Expected tx %v but got %v", txHash.Hex(), hash.Hex())
+	}
+	if _, err = funder.RequestFunds(relayAddress, big.NewInt(2e18)); err == nil || err.Error() != "Funding service "+server.URL+" refused: Amount too high" {
+		t.Error("Expected the funding service to refuse but got", err)
+	}
+	if _, err = funder.RequestFunds(common.Address{}, big.NewInt(1e17)); err == nil {
+		t.Error("Expected an error when the funding service fails")
+	}
+
+	// The tx to replace is passed on to the service
+	if hash, err = funder.ReplaceFunds(relayAddress, big.NewInt(1e17), txHash); err != nil || hash != common.HexToHash("0x1235") {
+		t.Errorf("Expected the replacement tx 0x1235 but got %v (error %v)", hash.Hex(), err)
+	}
+}
+
+type fakeBackend struct {
+	sent    []*types.Transaction
+	mined   map[common.Hash]bool
+	dropped map[common.Hash]bool
+}
+
+func (backend *fakeBackend) PendingNonceAt(ctx context.Context, account common.Address) (uint64, error) {
+	nonce := uint64(0)
+	for _, tx := range backend.sent {
+		if tx.Nonce() >= nonce {
+			nonce = tx.Nonce() + 1
+		}
+	}
+	return nonce, nil
+}
+
+func (backend *fakeBackend) SuggestGasPrice(ctx context.Context) (*big.Int, error) {
+	return big.NewInt(1e9), nil
+}
+
+func (backend *fakeBackend) SendTransaction(ctx context.Context, tx *types.Transaction) error {
+	backend.sent = append(backend.sent, tx)
+	return nil
+}
+
+func (backend *fakeBackend) TransactionByHash(ctx context.Context, txHash common.Hash) (*types.Transaction, bool, error) {
+	for _, tx := range backend.sent {
+		if tx.Hash() == txHash && !backend.dropped[txHash] {
+			return tx, !backend.mined[txHash], nil
+		}
+	}
+	return nil, false, ethereum.NotFound
+}
+
+func TestWalletFunder(t *testing.T) {
+	key, err := crypto.GenerateKey()
+	test.ErrFail(err, t)
+	backend := &fakeBackend{mined: map[common.Hash]bool{}, dropped: map[common.Hash]bool{}}
+	funder := NewWalletFunder(key, big.NewInt(1337), backend)
+
+	for i := 0; i < 2; i++ {
+		hash, err := funder.RequestFunds(relayAddress, big.NewInt(1e17))
+		test.ErrFail(err, t)
+		tx := backend.sent[i]
+		if hash != tx.Hash() || *tx.To() != relayAddress || tx.Value().Int64() != 1e17 || tx.Nonce() != uint64(i) {
+			t.Errorf("Wrong funding tx %v", tx)
+		}
+		sender, err := types.Sender(types.NewEIP155Signer(big.NewInt(1337)), tx)
+		test.ErrFail(err, t)
+		if sender != funder.Address() {
+			t.Errorf("Expected the funding tx to be sent by %v but got %v", funder.Address().Hex(), sender.Hex())
+		}
+	}
+
+	// A pending tx is replaced at its nonce with a higher gas price, a mined one is kept
+	pending := backend.sent[1]
+	hash, err := funder.ReplaceFunds(relayAddress, big.NewInt(1e17), pending.Hash())
+	test.ErrFail(err, t)
+	replacement := backend.sent[2]
+	if hash != replacement.Hash() || replacement.Nonce() != pending.Nonce() || replacement.GasPrice().Cmp(big.NewInt(1.1e9)) <= 0 {
+		t.Errorf("Expected tx %v to be replaced at nonce %d with a higher gas price but got %v", pending.Hash().Hex(), pending.Nonce(), replacement)
+	}
+	backend.mined[replacement.Hash()] = true
+	if hash, err = funder.ReplaceFunds(relayAddress, big.NewInt(1e17), replacement.Hash()); err != nil || hash != replacement.Hash() || len(backend.sent) != 3 {
+		t.Errorf("Expected the mined tx not to be replaced but got %v (error %v)", hash.Hex(), err)
+	}
+	if _, err = funder.ReplaceFunds(relayAddress, big.NewInt(1e17), common.HexToHash("0x1234")); err == nil {
+		t.Error("Expected an unknown tx not to be replaced")
+	}
+
+	// A tx the node dropped is sent again at its nonce
+	hash, err = funder.RequestFunds(relayAddress, big.NewInt(1e17))
+	test.ErrFail(err, t)
+	backend.dropped[hash] = true
+	resent, err := funder.ReplaceFunds(relayAddress, big.NewInt(1e17), hash)
+	test.ErrFail(err, t)
+	if tx := backend.sent[len(backend.sent)-1]; resent != tx.Hash() || resent == hash || tx.Nonce() != 2 || tx.GasPrice().Cmp(big.NewInt(1e9)) <= 0 {
+		t.Errorf("Expected the dropped tx %v to be sent again at nonce 2 but got %v", hash.Hex(), tx)
+	}
+}
@@ -0,0 +1,60 @@
+package librelay
+
+import (
+	"context"
+	"fmt"
+	"gen/librelay"
+	"log"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+)
+
+// hasIndexedEvent returns whether the hub ever emitted the event for this relay, after indexing the latest blocks
+func (relay *RelayServer) hasIndexedEvent(name string) (found bool, err error) {
+	err = relay.HubIndex.Sync(context.Background())
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	vLog, err := relay.HubIndex.LastEvent(name, relay.Address())
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	return vLog != nil, nil
+}
+
+// indexedBlockCountSinceRegistration is BlockCountSinceRegistration answered from the hub index: the relay's last
+// RelayAdded event must be within the last RegistrationBlockRate blocks, with the relay's current fee and url
+func (relay *RelayServer) indexedBlockCountSinceRegistration() (count uint64, err error) {
+	err = relay.HubIndex.Sync(context.Background())
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	lastBlockNumber, _, err := relay.HubIndex.LastBlock()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	vLog, err := relay.HubIndex.LastEvent("RelayAdded", relay.Address())
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	event := new(librelay.IRelayHubRelayAdded)
+	if vLog != nil {
+		boundHub := bind.NewBoundContract(relay.RelayHubAddress, relayHubABI, nil, nil, nil)
+		if err = boundHub.UnpackLog(event, "RelayAdded", *vLog); err != nil {
+			log.Println(err)
+			return
+		}
+		event.Raw = *vLog
+	}
+	if vLog == nil || lastBlockNumber-vLog.BlockNumber > relay.RegistrationBlockRate ||
+		event.TransactionFee.Cmp(relay.Fee) != 0 || event.Url != relay.Url {
+		return 0, fmt.Errorf("Could not receive RelayAdded events for our relay")
+	}
+	count = lastBlockNumber - event.Raw.BlockNumber
+	return
+}
@@ -0,0 +1,357 @@
+package hubindex
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"gen/librelay"
+	"log"
+	"math/big"
+	"strings"
+	"sync"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// EventNames are the RelayHub events indexed. Each of them has an address as its first indexed argument (the relay,
+// or the recipient or account for Deposited and Withdrawn), which events are looked up by.
+var EventNames = []string{"RelayAdded", "RelayRemoved", "Staked", "Unstaked", "Penalized", "TransactionRelayed", "Deposited", "Withdrawn"}
+
+const DefaultMaxBlockRange = 5000
+const DefaultMaxReorgDepth = 100
+
+// Keys of the index. Events are stored under their event id, address, block number and log index, so the events of
+// an address are sorted by age.
+var (
+	hubKey        = []byte("hub")
+	cursorKey     = []byte("cursor")
+	blockPrefix   = []byte("block")
+	eventPrefix   = []byte("event")
+	eventKeyBlock = len(eventPrefix) + common.HashLength + common.AddressLength
+)
+
+// ChainReader is the part of the ethereum client the indexer needs
+type ChainReader interface {
+	HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error)
+	FilterLogs(ctx context.Context, query ethereum.FilterQuery) ([]types.Log, error)
+}
+
+// Indexer tails the RelayHub's events into a LevelDB database, so that queries about them need no eth_getLogs over
+// the whole chain. The hashes of the last indexed block and of blocks with events are kept as checkpoints: when the
+// last indexed block is no longer on the canonical chain, the events after the latest checkpoint still on it are
+// dropped and indexed again.
+type Indexer struct {
+	StartBlock    uint64 // first block indexed, e.g. the block the hub was deployed in
+	MaxBlockRange uint64 // number of blocks requested per eth_getLogs
+	MaxReorgDepth uint64 // checkpoints older than this many blocks are pruned
+
+	db       *leveldb.DB
+	client   ChainReader
+	hub      common.Address
+	eventIDs map[string]common.Hash
+	mutex    *sync.Mutex
+}
+
+// NewIndexer opens the index in file, or an index in memory if file is empty. An index of another hub is cleared.
+func NewIndexer(file string, client ChainReader, hub common.Address) (indexer *Indexer, err error) {
+	hubABI, err := abi.JSON(strings.NewReader(librelay.IRelayHubABI))
+	if err != nil {
+		return
+	}
+	var db *leveldb.DB
+	if file == "" {
+		db, err = leveldb.Open(storage.NewMemStorage(), nil)
+	} else {
+		db, err = leveldb.OpenFile(file, nil)
+	}
+	if err != nil {
+		return
+	}
+	indexer = &Indexer{
+		MaxBlockRange: DefaultMaxBlockRange,
+		MaxReorgDepth: DefaultMaxReorgDepth,
+		db:            db,
+		client:        client,
+		hub:           hub,
+		eventIDs:      make(map[string]common.Hash),
+		mutex:         &sync.Mutex{},
+	}
+	for _, name := range EventNames {
+		indexer.eventIDs[name] = hubABI.Events[name].Id()
+	}
+
+	indexedHub, err := db.Get(hubKey, nil)
+	if err != nil && err != leveldb.ErrNotFound {
+		db.Close()
+		return nil, err
+	}
+	if !bytes.Equal(indexedHub, hub.Bytes()) {
+		if err == nil {
+			log.Println("Hub index was built for hub", common.BytesToAddress(indexedHub).Hex(), "clearing it")
+		}
+		if err = indexer.deleteRange(nil); err != nil {
+			db.Close()
+			return nil, err
+		}
+		if err = db.Put(hubKey, hub.Bytes(), nil); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	return indexer, nil
+}
+
+func (indexer *Indexer) Close() (err error) {
+	return indexer.db.Close()
+}
+
+func blockKey(number uint64) []byte {
+	key := make([]byte, len(blockPrefix)+8)
+	copy(key, blockPrefix)
+	binary.BigEndian.PutUint64(key[len(blockPrefix):], number)
+	return key
+}
+
+func eventKey(eventID common.Hash, address common.Address, number uint64, index uint) []byte {
+	key := make([]byte, 0, eventKeyBlock+12)
+	key = append(key, eventPrefix...)
+	key = append(key, eventID.Bytes()...)
+	key = append(key, address.Bytes()...)
+	key = append(key, make([]byte, 12)...)
+	binary.BigEndian.PutUint64(key[eventKeyBlock:], number)
+	binary.BigEndian.PutUint32(key[eventKeyBlock+8:], uint32(index))
+	return key
+}
+
+// LastBlock returns the number of the last block indexed, if any
+func (indexer *Indexer) LastBlock() (number uint64, ok bool, err error) {
+	value, err := indexer.db.Get(cursorKey, nil)
+	if err == leveldb.ErrNotFound {
+		return 0, false, nil
+	} else if err != nil {
+		return
+	}
+	return binary.BigEndian.Uint64(value[:8]), true, nil
+}
+
+func (indexer *Indexer) hashOf(ctx context.Context, number uint64) (hash common.Hash, err error) {
+	header, err := indexer.client.HeaderByNumber(ctx, new(big.Int).SetUint64(number))
+	if err == ethereum.NotFound || (err == nil && header == nil) {
+		return common.Hash{}, nil
+	} else if err != nil {
+		return
+	}
+	return header.Hash(), nil
+}
+
+// findFork returns the first block to index: the one after the last indexed block if it is still on the canonical
+// chain, otherwise the one after the latest checkpoint that is
+func (indexer *Indexer) findFork(ctx context.Context) (next uint64, err error) {
+	value, err := indexer.db.Get(cursorKey, nil)
+	if err == leveldb.ErrNotFound {
+		return indexer.StartBlock, nil
+	} else if err != nil {
+		return
+	}
+	cursor := binary.BigEndian.Uint64(value[:8])
+	iter := indexer.db.NewIterator(&util.Range{Start: blockKey(0), Limit: blockKey(cursor + 1)}, nil)
+	defer iter.Release()
+	for ok := iter.Last(); ok; ok = iter.Prev() {
+		number := binary.BigEndian.Uint64(iter.Key()[len(blockPrefix):])
+		hash, err := indexer.hashOf(ctx, number)
+		if err != nil {
+			return 0, err
+		}
+		if hash == common.BytesToHash(iter.Value()) {
+			if number != cursor {
+				log.Println("Hub index: chain reorganized after block", number, "reindexing up to block", cursor)
+			}
+			return number + 1, nil
+		}
+	}
+	if err = iter.Error(); err != nil {
+		return
+	}
+	log.Println("Hub index: chain reorganized deeper than the checkpoints kept, reindexing from block", indexer.StartBlock)
+	return indexer.StartBlock, nil
+}
+
+// rollback removes the events and checkpoints of blocks from next on
+func (indexer *Indexer) rollback(next uint64) (err error) {
+	batch := new(leveldb.Batch)
+	iter := indexer.db.NewIterator(util.BytesPrefix(eventPrefix), nil)
+	for iter.Next() {
+		if binary.BigEndian.Uint64(iter.Key()[eventKeyBlock:]) >= next {
+			batch.Delete(append([]byte{}, iter.Key()...))
+		}
+	}
+	iter.Release()
+	if err = iter.Error(); err != nil {
+		return
+	}
+	iter = indexer.db.NewIterator(&util.Range{Start: blockKey(next), Limit: util.BytesPrefix(blockPrefix).Limit}, nil)
+	for iter.Next() {
+		batch.Delete(append([]byte{}, iter.Key()...))
+	}
+	iter.Release()
+	if err = iter.Error(); err != nil {
+		return
+	}
+	batch.Delete(cursorKey)
+	if next > indexer.StartBlock {
+		value, err := indexer.db.Get(blockKey(next-1), nil)
+		if err != nil {
+			return err
+		}
+		cursor := make([]byte, 8)
+		binary.BigEndian.PutUint64(cursor, next-1)
+		batch.Put(cursorKey, append(cursor, value...))
+	}
+	return indexer.db.Write(batch, nil)
+}
+
+func (indexer *Indexer) deleteRange(prefix []byte) (err error) {
+	batch := new(leveldb.Batch)
+	iter := indexer.db.NewIterator(util.BytesPrefix(prefix), nil)
+	for iter.Next() {
+		batch.Delete(append([]byte{}, iter.Key()...))
+	}
+	iter.Release()
+	if err = iter.Error(); err != nil {
+		return
+	}
+	return indexer.db.Write(batch, nil)
+}
+
+// Sync indexes the events of the blocks mined since the last sync, after undoing the blocks reorganized away
+func (indexer *Indexer) Sync(ctx context.Context) (err error) {
+	indexer.mutex.Lock()
+	defer indexer.mutex.Unlock()
+
+	head, err := indexer.client.HeaderByNumber(ctx, nil)
+	if err != nil {
+		return
+	}
+	next, err := indexer.findFork(ctx)
+	if err != nil {
+		return
+	}
+	if last, ok, err := indexer.LastBlock(); err != nil {
+		return err
+	} else if ok && next <= last {
+		if err = indexer.rollback(next); err != nil {
+			return err
+		}
+	}
+
+	topics := [][]common.Hash{{}}
+	for _, id := range indexer.eventIDs {
+		topics[0] = append(topics[0], id)
+	}
+	headNumber := head.Number.Uint64()
+	for from := next; from <= headNumber; from += indexer.MaxBlockRange {
+		to := from + indexer.MaxBlockRange - 1
+		if to > headNumber {
+			to = headNumber
+		}
+		logs, err := indexer.client.FilterLogs(ctx, ethereum.FilterQuery{
+			FromBlock: new(big.Int).SetUint64(from),
+			ToBlock:   new(big.Int).SetUint64(to),
+			Addresses: []common.Address{indexer.hub},
+			Topics:    topics,
+		})
+		if err != nil {
+			return fmt.Errorf("Could not get hub events of blocks %d to %d: %v", from, to, err)
+		}
+		toHash, err := indexer.hashOf(ctx, to)
+		if err != nil {
+			return err
+		}
+
+		batch := new(leveldb.Batch)
+		for _, vLog := range logs {
+			if vLog.Removed || len(vLog.Topics) < 2 {
+				continue
+			}
+			value, err := json.Marshal(vLog)
+			if err != nil {
+				return err
+			}
+			batch.Put(eventKey(vLog.Topics[0], common.BytesToAddress(vLog.Topics[1].Bytes()), vLog.BlockNumber, vLog.Index), value)
+			batch.Put(blockKey(vLog.BlockNumber), vLog.BlockHash.Bytes())
+		}
+		batch.Put(blockKey(to), toHash.Bytes())
+		cursor := make([]byte, 8)
+		binary.BigEndian.PutUint64(cursor, to)
+		batch.Put(cursorKey, append(cursor, toHash.Bytes()...))
+		if err = indexer.db.Write(batch, nil); err != nil {
+			return err
+		}
+	}
+	return indexer.pruneCheckpoints(headNumber)
+}
+
+// pruneCheckpoints removes the checkpoints older than MaxReorgDepth, keeping the latest of them
+func (indexer *Indexer) pruneCheckpoints(head uint64) (err error) {
+	if head <= indexer.MaxReorgDepth {
+		return nil
+	}
+	iter := indexer.db.NewIterator(&util.Range{Start: blockKey(0), Limit: blockKey(head - indexer.MaxReorgDepth)}, nil)
+	var keys [][]byte
+	for iter.Next() {
+		keys = append(keys, append([]byte{}, iter.Key()...))
+	}
+	iter.Release()
+	if err = iter.Error(); err != nil || len(keys) < 2 {
+		return
+	}
+	batch := new(leveldb.Batch)
+	for _, key := range keys[:len(keys)-1] {
+		batch.Delete(key)
+	}
+	return indexer.db.Write(batch, nil)
+}
+
+// Events returns the indexed events of the given name emitted for address, oldest first
+func (indexer *Indexer) Events(name string, address common.Address) (logs []types.Log, err error) {
+	eventID, ok := indexer.eventIDs[name]
+	if !ok {
+		return nil, fmt.Errorf("Event %s is not indexed", name)
+	}
+	iter := indexer.db.NewIterator(util.BytesPrefix(eventKey(eventID, address, 0, 0)[:eventKeyBlock]), nil)
+	defer iter.Release()
+	logs = []types.Log{}
+	for iter.Next() {
+		var vLog types.Log
+		if err = json.Unmarshal(iter.Value(), &vLog); err != nil {
+			return nil, err
+		}
+		logs = append(logs, vLog)
+	}
+	return logs, iter.Error()
+}
+
+// LastEvent returns the latest indexed event of the given name emitted for address, or nil if there is none
+func (indexer *Indexer) LastEvent(name string, address common.Address) (vLog *types.Log, err error) {
+	eventID, ok := indexer.eventIDs[name]
+	if !ok {
+		return nil, fmt.Errorf("Event %s is not indexed", name)
+	}
+	iter := indexer.db.NewIterator(util.BytesPrefix(eventKey(eventID, address, 0, 0)[:eventKeyBlock]), nil)
+	defer iter.Release()
+	if !iter.Last() {
+		return nil, iter.Error()
+	}
+	vLog = &types.Log{}
+	err = json.Unmarshal(iter.Value(), vLog)
+	return
+}
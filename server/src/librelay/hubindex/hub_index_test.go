@@ -0,0 +1,186 @@
+package hubindex
+
+import (
+	"context"
+	"math/big"
+	"os"
+	"testing"
+
+	"librelay/test"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+var hub = common.HexToAddress("0x254dffcd3277C0b1660F6d42EFbB754edaBAbC2B")
+var relayAddress = common.HexToAddress("0x90F8bf6A479f320ead074411a4B0e7944Ea8c9C1")
+
+// fakeChain serves headers and hub logs of a chain that can be reorganized
+type fakeChain struct {
+	headers []*types.Header
+	logs    []types.Log
+}
+
+func (chain *fakeChain) HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error) {
+	if number == nil {
+		return chain.headers[len(chain.headers)-1], nil
+	}
+	if number.Uint64() >= uint64(len(chain.headers)) {
+		return nil, ethereum.NotFound
+	}
+	return chain.headers[number.Uint64()], nil
+}
+
+func (chain *fakeChain) FilterLogs(ctx context.Context, query ethereum.FilterQuery) (logs []types.Log, err error) {
+	for _, vLog := range chain.logs {
+		if vLog.BlockNumber < query.FromBlock.Uint64() || vLog.BlockNumber > query.ToBlock.Uint64() || vLog.Address != query.Addresses[0] {
+			continue
+		}
+		for _, topic := range query.Topics[0] {
+			if vLog.Topics[0] == topic {
+				logs = append(logs, vLog)
+			}
+		}
+	}
+	return
+}
+
+// mine extends the chain from block number from with blocks up to number to, dropping the blocks after from
+// (and their logs) first. fork distinguishes the blocks of different branches.
+func (chain *fakeChain) mine(from uint64, to uint64, fork string) {
+	chain.headers = chain.headers[:from]
+	logs := []types.Log{}
+	for _, vLog := range chain.logs {
+		if vLog.BlockNumber < from {
+			logs = append(logs, vLog)
+		}
+	}
+	chain.logs = logs
+	for number := from; number <= to; number++ {
+		header := &types.Header{Number: new(big.Int).SetUint64(number), Extra: []byte(fork), Difficulty: big.NewInt(1)}
+		if number > 0 {
+			header.ParentHash = chain.headers[number-1].Hash()
+		}
+		chain.headers = append(chain.headers, header)
+	}
+}
+
+func (chain *fakeChain) emit(indexer *Indexer, name string, address common.Address, number uint64) {
+	chain.logs = append(chain.logs, types.Log{
+		Address:     hub,
+		Topics:      []common.Hash{indexer.eventIDs[name], common.BytesToHash(address.Bytes())},
+		Data:        []byte{},
+		BlockNumber: number,
+		BlockHash:   chain.headers[number].Hash(),
+		Index:       uint(len(chain.logs)),
+	})
+}
+
+func assertLastEvent(t *testing.T, indexer *Indexer, name string, number uint64) {
+	vLog, err := indexer.LastEvent(name, relayAddress)
+	test.ErrFail(err, t)
+	if number == 0 && vLog != nil {
+		t.Errorf("Expected no %s event but got one on block %d", name, vLog.BlockNumber)
+	} else if number != 0 && (vLog == nil || vLog.BlockNumber != number) {
+		t.Errorf("Expected last %s event on block %d but got %+v", name, number, vLog)
+	}
+}
+
+func TestIndexer(t *testing.T) {
+	chain := &fakeChain{}
+	indexer, err := NewIndexer("", chain, hub)
+	test.ErrFail(err, t)
+	defer indexer.Close()
+	indexer.MaxBlockRange = 4
+	indexer.MaxReorgDepth = 5
+
+	chain.mine(0, 10, "a")
+	chain.emit(indexer, "Staked", relayAddress, 2)
+	chain.emit(indexer, "RelayAdded", relayAddress, 3)
+	chain.emit(indexer, "RelayAdded", relayAddress, 8)
+	chain.emit(indexer, "Deposited", hub, 8)
+	test.ErrFail(indexer.Sync(context.Background()), t)
+
+	last, ok, err := indexer.LastBlock()
+	test.ErrFail(err, t)
+	if !ok || last != 10 {
+		t.Errorf("Expected block 10 to be indexed but got %d", last)
+	}
+	events, err := indexer.Events("RelayAdded", relayAddress)
+	test.ErrFail(err, t)
+	if len(events) != 2 || events[0].BlockNumber != 3 || events[1].BlockNumber != 8 {
+		t.Errorf("Wrong RelayAdded events %+v", events)
+	}
+	assertLastEvent(t, indexer, "Staked", 2)
+	assertLastEvent(t, indexer, "RelayRemoved", 0)
+	if _, err = indexer.Events("Transfer", relayAddress); err == nil {
+		t.Error("Expected unknown event to be rejected")
+	}
+
+	t.Run("Sync only indexes new blocks", func(t *testing.T) {
+		chain.mine(11, 13, "a")
+		chain.emit(indexer, "Unstaked", relayAddress, 12)
+		// Logs of indexed blocks that were not reorganized are not requested again
+		chain.emit(indexer, "Penalized", relayAddress, 5)
+		test.ErrFail(indexer.Sync(context.Background()), t)
+		assertLastEvent(t, indexer, "Unstaked", 12)
+		assertLastEvent(t, indexer, "Penalized", 0)
+	})
+
+	t.Run("Reorganized blocks are reindexed", func(t *testing.T) {
+		// Block 8 is the latest checkpoint left on the new branch
+		chain.mine(9, 15, "b")
+		chain.emit(indexer, "RelayRemoved", relayAddress, 10)
+		test.ErrFail(indexer.Sync(context.Background()), t)
+		assertLastEvent(t, indexer, "RelayAdded", 8)
+		assertLastEvent(t, indexer, "RelayRemoved", 10)
+		assertLastEvent(t, indexer, "Unstaked", 0)
+		assertLastEvent(t, indexer, "Penalized", 0)
+		last, _, err := indexer.LastBlock()
+		test.ErrFail(err, t)
+		if last != 15 {
+			t.Errorf("Expected block 15 to be indexed but got %d", last)
+		}
+	})
+
+	t.Run("Reorg deeper than the checkpoints reindexes everything", func(t *testing.T) {
+		chain.mine(16, 30, "b")
+		test.ErrFail(indexer.Sync(context.Background()), t)
+		chain.mine(1, 31, "c")
+		chain.emit(indexer, "Staked", relayAddress, 4)
+		test.ErrFail(indexer.Sync(context.Background()), t)
+		assertLastEvent(t, indexer, "Staked", 4)
+		assertLastEvent(t, indexer, "RelayRemoved", 0)
+		events, err := indexer.Events("Deposited", hub)
+		test.ErrFail(err, t)
+		if len(events) != 0 {
+			t.Errorf("Expected Deposited event of the reorganized block to be dropped but got %+v", events)
+		}
+	})
+}
+
+func TestIndexerClearedForAnotherHub(t *testing.T) {
+	os.RemoveAll("test.db")
+	defer os.RemoveAll("test.db")
+	chain := &fakeChain{}
+	chain.mine(0, 5, "a")
+	indexer, err := NewIndexer("test.db", chain, hub)
+	test.ErrFail(err, t)
+	chain.emit(indexer, "Staked", relayAddress, 2)
+	test.ErrFail(indexer.Sync(context.Background()), t)
+	test.ErrFail(indexer.Close(), t)
+
+	indexer, err = NewIndexer("test.db", chain, hub)
+	test.ErrFail(err, t)
+	assertLastEvent(t, indexer, "Staked", 2)
+	test.ErrFail(indexer.Close(), t)
+
+	indexer, err = NewIndexer("test.db", chain, relayAddress)
+	test.ErrFail(err, t)
+	defer indexer.Close()
+	assertLastEvent(t, indexer, "Staked", 0)
+	if _, ok, _ := indexer.LastBlock(); ok {
+		t.Error("Expected index of another hub to be cleared")
+	}
+}
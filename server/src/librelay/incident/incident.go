@@ -0,0 +1,54 @@
+package incident
+
+import (
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// Kinds of incidents, named after the hub event that revealed them
+const (
+	KindPenalized    = "Penalized"
+	KindRelayRemoved = "RelayRemoved"
+)
+
+// Incident is a hub event that took the relay out of service. The relay stops signing while any incident is unresolved.
+type Incident struct {
+	ID                string
+	Kind              string
+	Relay             common.Address
+	BlockNumber       uint64
+	TxHash            common.Hash    // tx that emitted the event
+	OffendingTxHashes []common.Hash  `json:",omitempty"` // txs of the relay the penalization proved illegal, if decoded
+	Reporter          common.Address // who was rewarded for the penalization
+	Amount            *big.Int       `json:",omitempty"` // stake rewarded to the reporter
+	Detected          int64          // unix time the incident was recorded
+	Resolved          bool
+}
+
+// EventID identifies the incident of the event emitted in the tx with the given log index
+func EventID(txHash common.Hash, logIndex uint) string {
+	return fmt.Sprintf("%s-%d", txHash.Hex(), logIndex)
+}
+
+type IIncidentStore interface {
+	GetIncident(id string) (incident *Incident, err error)
+	SaveIncident(incident *Incident) (err error)
+	ListIncidents() (incidents []*Incident, err error)
+	Close() (err error)
+}
+
+// Unresolved returns the incidents of the store that are not resolved yet
+func Unresolved(store IIncidentStore) (incidents []*Incident, err error) {
+	all, err := store.ListIncidents()
+	if err != nil {
+		return
+	}
+	for _, incident := range all {
+		if !incident.Resolved {
+			incidents = append(incidents, incident)
+		}
+	}
+	return
+}
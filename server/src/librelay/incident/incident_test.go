@@ -0,0 +1,72 @@
+package incident
+
+import (
+	"math/big"
+	"os"
+	"testing"
+
+	"librelay/test"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func testStore(t *testing.T, store IIncidentStore) {
+	txHash := common.HexToHash("0x1234")
+	removed := &Incident{ID: EventID(txHash, 0), Kind: KindRelayRemoved, TxHash: txHash}
+	penalized := &Incident{
+		ID:                EventID(txHash, 1),
+		Kind:              KindPenalized,
+		TxHash:            txHash,
+		OffendingTxHashes: []common.Hash{common.HexToHash("0xabcd")},
+		Reporter:          common.HexToAddress("0xFFcf8FDEE72ac11b5c542428B35EEF5769C409f0"),
+		Amount:            big.NewInt(1e18),
+	}
+
+	t.Run("GetIncident returns nil for unknown incidents", func(t *testing.T) {
+		incident, err := store.GetIncident(removed.ID)
+		if incident != nil || err != nil {
+			t.Errorf("Expected no incident but got %v (error %v)", incident, err)
+		}
+	})
+
+	t.Run("SaveIncident stores the incident", func(t *testing.T) {
+		test.ErrFail(store.SaveIncident(penalized), t)
+		test.ErrFail(store.SaveIncident(removed), t)
+		incident, err := store.GetIncident(penalized.ID)
+		test.ErrFail(err, t)
+		if incident == nil || incident.Kind != KindPenalized || incident.Amount.Cmp(penalized.Amount) != 0 ||
+			len(incident.OffendingTxHashes) != 1 || incident.OffendingTxHashes[0] != penalized.OffendingTxHashes[0] {
+			t.Errorf("Expected %+v but got %+v", penalized, incident)
+		}
+		incidents, err := store.ListIncidents()
+		test.ErrFail(err, t)
+		if len(incidents) != 2 || incidents[0].ID != removed.ID || incidents[1].ID != penalized.ID {
+			t.Errorf("Expected incidents sorted by id but got %v", incidents)
+		}
+	})
+
+	t.Run("Unresolved skips resolved incidents", func(t *testing.T) {
+		removed.Resolved = true
+		test.ErrFail(store.SaveIncident(removed), t)
+		incidents, err := Unresolved(store)
+		test.ErrFail(err, t)
+		if len(incidents) != 1 || incidents[0].ID != penalized.ID {
+			t.Errorf("Expected only the penalization to be unresolved but got %v", incidents)
+		}
+	})
+}
+
+func TestMemoryIncidentStore(t *testing.T) {
+	testStore(t, NewMemoryIncidentStore())
+}
+
+func TestLevelDbIncidentStore(t *testing.T) {
+	os.RemoveAll("test.db")
+	store, err := NewLevelDbIncidentStore("test.db")
+	test.ErrFail(err, t)
+	defer func() {
+		store.Close()
+		os.RemoveAll("test.db")
+	}()
+	testStore(t, store)
+}
@@ -0,0 +1,56 @@
+package incident
+
+import (
+	"encoding/json"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+type LevelDbIncidentStore struct {
+	*leveldb.DB
+}
+
+func NewLevelDbIncidentStore(file string) (store *LevelDbIncidentStore, err error) {
+	db, err := leveldb.OpenFile(file, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &LevelDbIncidentStore{db}, nil
+}
+
+// GetIncident returns the incident with the given id, or nil if there is none. Incidents are stored as json under
+// their id.
+func (store *LevelDbIncidentStore) GetIncident(id string) (incident *Incident, err error) {
+	value, err := store.Get([]byte(id), nil)
+	if err == leveldb.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	incident = &Incident{}
+	err = json.Unmarshal(value, incident)
+	return
+}
+
+func (store *LevelDbIncidentStore) SaveIncident(incident *Incident) (err error) {
+	value, err := json.Marshal(incident)
+	if err != nil {
+		return
+	}
+	return store.Put([]byte(incident.ID), value, nil)
+}
+
+// ListIncidents returns all incidents, sorted by id
+func (store *LevelDbIncidentStore) ListIncidents() (incidents []*Incident, err error) {
+	iter := store.NewIterator(nil, nil)
+	defer iter.Release()
+	incidents = make([]*Incident, 0, 20)
+	for iter.Next() {
+		incident := &Incident{}
+		if err = json.Unmarshal(iter.Value(), incident); err != nil {
+			return nil, err
+		}
+		incidents = append(incidents, incident)
+	}
+	return incidents, iter.Error()
+}
@@ -0,0 +1,55 @@
+package incident
+
+import (
+	"sort"
+	"sync"
+)
+
+type MemoryIncidentStore struct {
+	incidents map[string]Incident
+	mutex     *sync.Mutex
+}
+
+func NewMemoryIncidentStore() *MemoryIncidentStore {
+	return &MemoryIncidentStore{
+		incidents: make(map[string]Incident),
+		mutex:     &sync.Mutex{},
+	}
+}
+
+// GetIncident returns the incident with the given id, or nil if there is none
+func (store *MemoryIncidentStore) GetIncident(id string) (incident *Incident, err error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	found, ok := store.incidents[id]
+	if !ok {
+		return nil, nil
+	}
+	return &found, nil
+}
+
+func (store *MemoryIncidentStore) SaveIncident(incident *Incident) (err error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.incidents[incident.ID] = *incident
+	return nil
+}
+
+// ListIncidents returns all incidents, sorted by id like the LevelDB store
+func (store *MemoryIncidentStore) ListIncidents() (incidents []*Incident, err error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	incidents = make([]*Incident, 0, len(store.incidents))
+	for _, incident := range store.incidents {
+		incident := incident
+		incidents = append(incidents, &incident)
+	}
+	sort.Slice(incidents, func(i, j int) bool {
+		return incidents[i].ID < incidents[j].ID
+	})
+	return
+}
+
+func (store *MemoryIncidentStore) Close() (err error) {
+	return nil
+}
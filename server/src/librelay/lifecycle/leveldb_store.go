@@ -0,0 +1,42 @@
+package lifecycle
+
+import (
+	"encoding/json"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+var stateKey = []byte("state")
+
+type LevelDbStateStore struct {
+	*leveldb.DB
+}
+
+func NewLevelDbStateStore(file string) (store *LevelDbStateStore, err error) {
+	db, err := leveldb.OpenFile(file, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &LevelDbStateStore{db}, nil
+}
+
+// GetState returns the state stored as json, or an empty state if none was saved
+func (store *LevelDbStateStore) GetState() (state *State, err error) {
+	state = &State{}
+	value, err := store.Get(stateKey, nil)
+	if err == leveldb.ErrNotFound {
+		return state, nil
+	} else if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(value, state)
+	return
+}
+
+func (store *LevelDbStateStore) SaveState(state *State) (err error) {
+	value, err := json.Marshal(state)
+	if err != nil {
+		return
+	}
+	return store.Put(stateKey, value, nil)
+}
@@ -0,0 +1,36 @@
+package lifecycle
+
+import (
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// State is what the relay learned about its lifecycle on the hub, persisted so a restarted relay resumes where it was
+type State struct {
+	Phase             Phase          `json:",omitempty"`
+	Owner             common.Address // set when the stake is first seen
+	Stake             *big.Int       `json:",omitempty"`
+	UnstakeDelay      *big.Int       `json:",omitempty"`
+	RegisteredBlock   uint64         // block of the relay's last registration
+	Removed           int64          // unix time the relay was seen removed, 0 if not removed
+	Unstaked          int64          // unix time the relay was seen unstaked
+	WithdrawalNonce   *uint64        `json:",omitempty"` // nonce of the withdrawal to the owner after unstaking, once sent
+	Withdrawn         int64          // unix time the balance was withdrawn to the owner after unstaking
+	Refill            *Refill        `json:",omitempty"` // refill being tracked, so a restart does not request funds again
+	PenalizationBlock uint64         // block the penalization watch resumes looking for hub events from
+}
+
+// Refill is a refill requested from the funding hook and not mined yet
+type Refill struct {
+	TxHashes  []common.Hash // the refill tx, then the txs replacing it at the same nonce
+	Amount    *big.Int
+	Requested int64 // unix time the last tx was sent
+}
+
+type IStateStore interface {
+	// GetState returns the saved state, or an empty state if none was saved
+	GetState() (state *State, err error)
+	SaveState(state *State) (err error)
+	Close() (err error)
+}
@@ -0,0 +1,80 @@
+package lifecycle
+
+import (
+	"math/big"
+	"os"
+	"testing"
+
+	"librelay/test"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func testStore(t *testing.T, store IStateStore) {
+	t.Run("GetState returns an empty state before one is saved", func(t *testing.T) {
+		state, err := store.GetState()
+		test.ErrFail(err, t)
+		if state == nil || state.Owner != (common.Address{}) || state.Stake != nil || state.Removed != 0 {
+			t.Errorf("Expected an empty state but got %+v", state)
+		}
+	})
+
+	t.Run("SaveState stores the state", func(t *testing.T) {
+		saved := &State{
+			Phase:           Removed,
+			Owner:           common.HexToAddress("0xFFcf8FDEE72ac11b5c542428B35EEF5769C409f0"),
+			Stake:           big.NewInt(1e18),
+			UnstakeDelay:    big.NewInt(3600),
+			RegisteredBlock: 42,
+			Removed:         1000,
+		}
+		test.ErrFail(store.SaveState(saved), t)
+		saved.Unstaked = 2000
+		state, err := store.GetState()
+		test.ErrFail(err, t)
+		if state.Phase != Removed || state.Owner != saved.Owner || state.Stake.Cmp(saved.Stake) != 0 || state.UnstakeDelay.Cmp(saved.UnstakeDelay) != 0 ||
+			state.RegisteredBlock != 42 || state.Removed != 1000 || state.Unstaked != 0 {
+			t.Errorf("Expected the saved state but got %+v", state)
+		}
+	})
+}
+
+func TestPhaseTransitions(t *testing.T) {
+	if !New.CanMoveTo(Staked) || !Ready.CanMoveTo(Staked) || !Ready.CanMoveTo(Removed) || !Removed.CanMoveTo(Unstaked) {
+		t.Error("Expected the lifecycle transitions to be allowed")
+	}
+	if Removed.CanMoveTo(Ready) || Unstaked.CanMoveTo(Removed) || Withdrawn.CanMoveTo(New) || New.CanMoveTo(Unstaked) {
+		t.Error("Expected a removed relay to only move forward")
+	}
+	if !Unstaked.IsRemoved() || Ready.IsRemoved() {
+		t.Error("Wrong removed phases")
+	}
+	if Phase("Deleted").Validate() == nil || Ready.Validate() != nil {
+		t.Error("Wrong phase validation")
+	}
+}
+
+func TestMemoryStateStore(t *testing.T) {
+	testStore(t, NewMemoryStateStore())
+}
+
+func TestLevelDbStateStore(t *testing.T) {
+	os.RemoveAll("test.db")
+	store, err := NewLevelDbStateStore("test.db")
+	test.ErrFail(err, t)
+	defer func() {
+		store.Close()
+		os.RemoveAll("test.db")
+	}()
+	testStore(t, store)
+
+	// The state survives reopening the store
+	test.ErrFail(store.Close(), t)
+	store, err = NewLevelDbStateStore("test.db")
+	test.ErrFail(err, t)
+	state, err := store.GetState()
+	test.ErrFail(err, t)
+	if state.RegisteredBlock != 42 {
+		t.Errorf("Expected the state to be persisted but got %+v", state)
+	}
+}
@@ -0,0 +1,32 @@
+package lifecycle
+
+import (
+	"sync"
+)
+
+type MemoryStateStore struct {
+	state State
+	mutex *sync.Mutex
+}
+
+func NewMemoryStateStore() *MemoryStateStore {
+	return &MemoryStateStore{mutex: &sync.Mutex{}}
+}
+
+func (store *MemoryStateStore) GetState() (state *State, err error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	found := store.state
+	return &found, nil
+}
+
+func (store *MemoryStateStore) SaveState(state *State) (err error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.state = *state
+	return nil
+}
+
+func (store *MemoryStateStore) Close() (err error) {
+	return nil
+}
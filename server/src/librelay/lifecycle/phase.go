@@ -0,0 +1,58 @@
+package lifecycle
+
+import (
+	"fmt"
+)
+
+// Phase is where the relay is in its lifecycle on the hub
+type Phase string
+
+const (
+	New        Phase = "New"        // waiting for the owner's stake
+	Staked     Phase = "Staked"     // waiting for the balance to reach the minimum
+	Funded     Phase = "Funded"     // registering on the hub
+	Registered Phase = "Registered" // waiting for the gas price
+	Ready      Phase = "Ready"      // serving relay requests, re-registering when due
+	Removed    Phase = "Removed"    // removed by the owner, waiting for the unstake
+	Unstaked   Phase = "Unstaked"   // withdrawing the balance to the owner
+	Withdrawn  Phase = "Withdrawn"  // done: the relay can be shut down
+)
+
+// active are the phases of a relay on the hub. The relay moves back to an earlier one when e.g. its balance drops or its
+// registration expires.
+var active = []Phase{New, Staked, Funded, Registered, Ready}
+
+// transitions are the phases each phase may move to
+var transitions = map[Phase][]Phase{
+	New:        append(active, Removed),
+	Staked:     append(active, Removed),
+	Funded:     append(active, Removed),
+	Registered: append(active, Removed),
+	Ready:      append(active, Removed),
+	Removed:    {Unstaked},
+	Unstaked:   {Withdrawn},
+	Withdrawn:  {},
+}
+
+// CanMoveTo returns whether the relay may move from the phase to next
+func (phase Phase) CanMoveTo(next Phase) bool {
+	for _, allowed := range transitions[phase] {
+		if allowed == next {
+			return true
+		}
+	}
+	return false
+}
+
+// IsRemoved returns whether the relay was removed from the hub, i.e. only has to withdraw its balance
+func (phase Phase) IsRemoved() bool {
+	return phase == Removed || phase == Unstaked || phase == Withdrawn
+}
+
+// Validate checks that the phase is known, e.g. when read from the state store
+func (phase Phase) Validate() error {
+	if _, ok := transitions[phase]; !ok {
+		return fmt.Errorf("Unknown lifecycle phase %q", phase)
+	}
+	return nil
+}
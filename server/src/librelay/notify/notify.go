@@ -0,0 +1,111 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"code.cloudfoundry.org/clock"
+)
+
+// Alert is something the relay operator has to act on. Alerts with the same kind and title report the same condition.
+type Alert struct {
+	Kind     string // what raised the alert, e.g. the hub event
+	Title    string
+	Message  string
+	Time     int64             // unix time the alert was raised
+	Fields   map[string]string `json:",omitempty"`
+	Critical bool              // sent even beyond the rate limit
+}
+
+// Key identifies the condition the alert reports, for deduplication
+func (alert *Alert) Key() string {
+	return alert.Kind + ":" + alert.Title
+}
+
+type Notifier interface {
+	Notify(alert *Alert) (err error)
+}
+
+// LogNotifier only logs alerts, for relays with no sink configured
+type LogNotifier struct{}
+
+func (LogNotifier) Notify(alert *Alert) (err error) {
+	log.Printf("ALERT %s: %s. %s %v\n", alert.Kind, alert.Title, alert.Message, alert.Fields)
+	return nil
+}
+
+// WebhookNotifier posts alerts as json to Url
+type WebhookNotifier struct {
+	Url    string
+	Client *http.Client
+}
+
+func NewWebhookNotifier(url string) *WebhookNotifier {
+	return &WebhookNotifier{Url: url, Client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (notifier *WebhookNotifier) Notify(alert *Alert) (err error) {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return
+	}
+	return post(notifier.Client, notifier.Url, body)
+}
+
+func post(client *http.Client, url string, body []byte) (err error) {
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("Webhook %s answered %s", url, resp.Status)
+	}
+	return nil
+}
+
+// Settings select the sinks alerts are sent to, and how often. Alerts are always logged.
+type Settings struct {
+	WebhookUrl      string // generic json webhook
+	SlackWebhookUrl string // Slack incoming webhook
+	SMTP            SMTPSettings
+	DedupWindow     time.Duration // an alert with the same kind and title is not sent again within this window
+	MaxPerHour      int           // at most this many alerts are sent per hour, 0 for no limit
+}
+
+// New returns a notifier logging every alert, and sending them to the sinks of settings deduplicated and rate limited
+func New(settings Settings, clk clock.Clock) Notifier {
+	sinks := Multi{}
+	if settings.WebhookUrl != "" {
+		sinks = append(sinks, NewWebhookNotifier(settings.WebhookUrl))
+	}
+	if settings.SlackWebhookUrl != "" {
+		sinks = append(sinks, NewSlackNotifier(settings.SlackWebhookUrl))
+	}
+	if settings.SMTP.Addr != "" {
+		sinks = append(sinks, NewSMTPNotifier(settings.SMTP))
+	}
+	if len(sinks) == 0 {
+		return LogNotifier{}
+	}
+	return Multi{LogNotifier{}, NewThrottle(sinks, settings.DedupWindow, settings.MaxPerHour, clk)}
+}
+
+// Multi sends alerts to all its notifiers, returning the first error
+type Multi []Notifier
+
+func (notifiers Multi) Notify(alert *Alert) (err error) {
+	for _, notifier := range notifiers {
+		if notifyErr := notifier.Notify(alert); notifyErr != nil {
+			log.Println("Could not send alert:", notifyErr)
+			if err == nil {
+				err = notifyErr
+			}
+		}
+	}
+	return
+}
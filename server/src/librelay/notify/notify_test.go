@@ -0,0 +1,151 @@
+package notify
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/smtp"
+	"strings"
+	"testing"
+	"time"
+
+	"librelay/test"
+
+	"code.cloudfoundry.org/clock/fakeclock"
+)
+
+func TestWebhookNotifier(t *testing.T) {
+	received := make(chan *Alert, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		alert := &Alert{}
+		if err := json.NewDecoder(r.Body).Decode(alert); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		received <- alert
+	}))
+	defer server.Close()
+
+	alert := &Alert{Kind: "Penalized", Title: "Relay penalized", Fields: map[string]string{"tx": "0x1234"}}
+	test.ErrFail(New(Settings{WebhookUrl: server.URL}, nil).Notify(alert), t)
+	got := <-received
+	if got.Kind != alert.Kind || got.Title != alert.Title || got.Fields["tx"] != "0x1234" {
+		t.Errorf("Expected %+v but webhook received %+v", alert, got)
+	}
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	if err := New(Settings{WebhookUrl: failing.URL}, nil).Notify(alert); err == nil {
+		t.Error("Expected an error when the webhook fails")
+	}
+}
+
+func TestSlackNotifier(t *testing.T) {
+	received := make(chan SlackMessage, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var message SlackMessage
+		if err := json.NewDecoder(r.Body).Decode(&message); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		received <- message
+	}))
+	defer server.Close()
+
+	alert := &Alert{Kind: "Balance", Title: "Relay balance low", Message: "Fund the relay", Fields: map[string]string{"balance": "1", "address": "0x12"}}
+	test.ErrFail(NewSlackNotifier(server.URL).Notify(alert), t)
+	expected := "*Relay balance low*\nFund the relay\naddress: `0x12`\nbalance: `1`"
+	if message := <-received; message.Text != expected {
+		t.Errorf("Expected slack text %q but got %q", expected, message.Text)
+	}
+}
+
+func TestSMTPNotifier(t *testing.T) {
+	notifier := NewSMTPNotifier(SMTPSettings{Addr: "mail.example.com:587", From: "relay@example.com", To: []string{"ops@example.com"}, Username: "relay", Password: "secret"})
+	var sentTo []string
+	var sentMsg string
+	notifier.send = func(addr string, auth smtp.Auth, from string, to []string, msg []byte) error {
+		if addr != "mail.example.com:587" || auth == nil || from != "relay@example.com" {
+			t.Errorf("Unexpected mail server %s, auth %v or sender %s", addr, auth, from)
+		}
+		sentTo, sentMsg = to, string(msg)
+		return nil
+	}
+	test.ErrFail(notifier.Notify(&Alert{Kind: "Penalized", Title: "Relay penalized", Message: "Relay halted", Fields: map[string]string{"tx": "0x1234"}}), t)
+	if len(sentTo) != 1 || sentTo[0] != "ops@example.com" {
+		t.Errorf("Expected mail to ops@example.com but got %v", sentTo)
+	}
+	for _, expected := range []string{"Subject: [GSN relay] Relay penalized\r\n", "\r\n\r\nRelay halted\r\n", "tx: 0x1234\r\n"} {
+		if !strings.Contains(sentMsg, expected) {
+			t.Errorf("Expected %q in mail %q", expected, sentMsg)
+		}
+	}
+}
+
+type countingNotifier struct {
+	alerts []*Alert
+	err    error
+}
+
+func (notifier *countingNotifier) Notify(alert *Alert) error {
+	if notifier.err != nil {
+		return notifier.err
+	}
+	notifier.alerts = append(notifier.alerts, alert)
+	return nil
+}
+
+func TestThrottle(t *testing.T) {
+	clk := fakeclock.NewFakeClock(time.Now())
+	sink := &countingNotifier{}
+	throttle := NewThrottle(sink, 10*time.Minute, 3, clk)
+	balance := &Alert{Kind: "Balance", Title: "Relay balance low"}
+
+	t.Run("Duplicates are dropped within DedupWindow", func(t *testing.T) {
+		test.ErrFail(throttle.Notify(balance), t)
+		clk.Increment(5 * time.Minute)
+		test.ErrFail(throttle.Notify(&Alert{Kind: "Balance", Title: "Relay balance low", Message: "Lower still"}), t)
+		if len(sink.alerts) != 1 {
+			t.Errorf("Expected the duplicate alert to be dropped but got %d alerts", len(sink.alerts))
+		}
+		clk.Increment(5 * time.Minute)
+		test.ErrFail(throttle.Notify(balance), t)
+		if len(sink.alerts) != 2 {
+			t.Errorf("Expected the alert to be sent again after DedupWindow but got %d alerts", len(sink.alerts))
+		}
+	})
+
+	t.Run("Alerts beyond MaxPerHour are dropped", func(t *testing.T) {
+		test.ErrFail(throttle.Notify(&Alert{Kind: "PendingTx", Title: "Transaction 1 pending"}), t)
+		test.ErrFail(throttle.Notify(&Alert{Kind: "PendingTx", Title: "Transaction 2 pending"}), t)
+		if len(sink.alerts) != 3 {
+			t.Errorf("Expected the alert over the limit to be dropped but got %d alerts", len(sink.alerts))
+		}
+		test.ErrFail(throttle.Notify(&Alert{Kind: "Penalized", Title: "Relay penalized", Critical: true}), t)
+		if len(sink.alerts) != 4 {
+			t.Errorf("Expected the critical alert to be sent over the limit but got %d alerts", len(sink.alerts))
+		}
+		clk.Increment(51 * time.Minute)
+		test.ErrFail(throttle.Notify(&Alert{Kind: "PendingTx", Title: "Transaction 2 pending"}), t)
+		if len(sink.alerts) != 5 {
+			t.Errorf("Expected the alert to be sent once the first one is an hour old but got %d alerts", len(sink.alerts))
+		}
+	})
+
+	t.Run("Alerts that could not be sent are tried again", func(t *testing.T) {
+		clk.Increment(time.Hour)
+		sink.err = errors.New("connection refused")
+		registration := &Alert{Kind: "Registration", Title: "Registration expiring"}
+		if err := throttle.Notify(registration); err != sink.err {
+			t.Error("Expected the sink error but got", err)
+		}
+		sink.err = nil
+		test.ErrFail(throttle.Notify(registration), t)
+		if len(sink.alerts) != 6 || sink.alerts[5] != registration {
+			t.Errorf("Expected the failed alert to be sent on the next try but got %d alerts", len(sink.alerts))
+		}
+	})
+}
@@ -0,0 +1,50 @@
+package notify
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SlackNotifier posts alerts to a Slack incoming webhook, or any service accepting its payload
+type SlackNotifier struct {
+	Url    string
+	Client *http.Client
+}
+
+func NewSlackNotifier(url string) *SlackNotifier {
+	return &SlackNotifier{Url: url, Client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// SlackMessage is the payload of a Slack incoming webhook
+type SlackMessage struct {
+	Text string `json:"text"`
+}
+
+func (notifier *SlackNotifier) Notify(alert *Alert) (err error) {
+	body, err := json.Marshal(SlackMessage{Text: slackText(alert)})
+	if err != nil {
+		return
+	}
+	return post(notifier.Client, notifier.Url, body)
+}
+
+// slackText formats the alert as the title in bold, the message and the fields sorted by name
+func slackText(alert *Alert) string {
+	lines := []string{fmt.Sprintf("*%s*", alert.Title)}
+	if alert.Message != "" {
+		lines = append(lines, alert.Message)
+	}
+	names := make([]string, 0, len(alert.Fields))
+	for name := range alert.Fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		lines = append(lines, fmt.Sprintf("%s: `%s`", name, alert.Fields[name]))
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,61 @@
+package notify
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/smtp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SMTPSettings are the mail server and addresses alerts are mailed with
+type SMTPSettings struct {
+	Addr     string // host:port of the mail server
+	From     string
+	To       []string
+	Username string // PLAIN authentication is used if set
+	Password string
+}
+
+// SMTPNotifier mails alerts
+type SMTPNotifier struct {
+	SMTPSettings
+	send func(addr string, auth smtp.Auth, from string, to []string, msg []byte) error
+}
+
+func NewSMTPNotifier(settings SMTPSettings) *SMTPNotifier {
+	return &SMTPNotifier{settings, smtp.SendMail}
+}
+
+func (notifier *SMTPNotifier) Notify(alert *Alert) (err error) {
+	var auth smtp.Auth
+	if notifier.Username != "" {
+		host, _, err := net.SplitHostPort(notifier.Addr)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", notifier.Username, notifier.Password, host)
+	}
+	return notifier.send(notifier.Addr, auth, notifier.From, notifier.To, notifier.message(alert))
+}
+
+func (notifier *SMTPNotifier) message(alert *Alert) []byte {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", notifier.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(notifier.To, ", "))
+	fmt.Fprintf(&msg, "Subject: [GSN relay] %s\r\n", alert.Title)
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Unix(alert.Time, 0).UTC().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&msg, "%s\r\n", alert.Message)
+	names := make([]string, 0, len(alert.Fields))
+	for name := range alert.Fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(&msg, "%s: %s\r\n", name, alert.Fields[name])
+	}
+	return msg.Bytes()
+}
@@ -0,0 +1,70 @@
+package notify
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/clock"
+)
+
+// Throttle passes alerts on to a notifier, dropping the ones reporting a condition already alerted within DedupWindow,
+// and the ones beyond MaxPerHour in the last hour unless they are critical
+type Throttle struct {
+	Notifier    Notifier
+	DedupWindow time.Duration
+	MaxPerHour  int
+	lastSent    map[string]time.Time
+	sent        []time.Time // times alerts were sent within the last hour, oldest first
+	mutex       *sync.Mutex
+	clock       clock.Clock
+}
+
+func NewThrottle(notifier Notifier, dedupWindow time.Duration, maxPerHour int, clk clock.Clock) *Throttle {
+	if clk == nil {
+		clk = clock.NewClock()
+	}
+	return &Throttle{
+		Notifier:    notifier,
+		DedupWindow: dedupWindow,
+		MaxPerHour:  maxPerHour,
+		lastSent:    make(map[string]time.Time),
+		mutex:       &sync.Mutex{},
+		clock:       clk,
+	}
+}
+
+// Notify sends the alert unless it is a duplicate or the rate limit is reached. An alert is only recorded once it was
+// sent, so one the notifier failed to send is tried again next time.
+func (throttle *Throttle) Notify(alert *Alert) (err error) {
+	throttle.mutex.Lock()
+	now := throttle.clock.Now()
+	if last, ok := throttle.lastSent[alert.Key()]; ok && now.Sub(last) < throttle.DedupWindow {
+		throttle.mutex.Unlock()
+		return nil
+	}
+	for len(throttle.sent) > 0 && now.Sub(throttle.sent[0]) >= time.Hour {
+		throttle.sent = throttle.sent[1:]
+	}
+	if throttle.MaxPerHour > 0 && len(throttle.sent) >= throttle.MaxPerHour && !alert.Critical {
+		throttle.mutex.Unlock()
+		log.Printf("Alert rate limit of %d per hour reached, dropping %s: %s\n", throttle.MaxPerHour, alert.Kind, alert.Title)
+		return nil
+	}
+	throttle.mutex.Unlock()
+
+	if err = throttle.Notifier.Notify(alert); err != nil {
+		return
+	}
+
+	throttle.mutex.Lock()
+	defer throttle.mutex.Unlock()
+	throttle.lastSent[alert.Key()] = now
+	throttle.sent = append(throttle.sent, now)
+	for key, last := range throttle.lastSent {
+		if now.Sub(last) >= throttle.DedupWindow {
+			delete(throttle.lastSent, key)
+		}
+	}
+	return nil
+}
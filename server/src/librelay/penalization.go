@@ -0,0 +1,372 @@
+package librelay
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"gen/librelay"
+	"librelay/incident"
+	"librelay/lifecycle"
+	"librelay/notify"
+	"log"
+	"math/big"
+	"strings"
+	"sync"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/event"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// Hub events taking the relay out of service
+var watchedEvents = []string{incident.KindPenalized, incident.KindRelayRemoved}
+
+// Hub methods penalizing a relay, taking pairs of an unsigned tx of the relay and its signature
+var penalizeMethods = []string{"penalizeRepeatedNonce", "penalizeIllegalTransaction"}
+
+// penalizationWatch is where WatchPenalization resumes looking for hub events
+type penalizationWatch struct {
+	mutex     sync.Mutex
+	fromBlock uint64
+}
+
+// Halt stops the relay from signing relayed calls, registrations and resent txs. Sending its balance to the owner is
+// still allowed, since it cannot be used against the relay.
+func (relay *RelayServer) Halt(reason string) {
+	relay.haltReason.Store(reason)
+}
+
+// Resume lets a halted relay sign again
+func (relay *RelayServer) Resume() {
+	relay.haltReason.Store("")
+}
+
+// Halted returns whether the relay is halted, and why
+func (relay *RelayServer) Halted() (halted bool, reason string) {
+	reason, _ = relay.haltReason.Load().(string)
+	return reason != "", reason
+}
+
+func (relay *RelayServer) checkNotHalted() (err error) {
+	if halted, reason := relay.Halted(); halted {
+		return fmt.Errorf("Relay halted: %s", reason)
+	}
+	return nil
+}
+
+// RestoreIncidents halts the relay if the incident store has unresolved incidents, e.g. after a restart
+func (relay *RelayServer) RestoreIncidents() (err error) {
+	if relay.Incidents == nil {
+		return nil
+	}
+	unresolved, err := incident.Unresolved(relay.Incidents)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if len(unresolved) > 0 {
+		relay.Halt(haltReason(unresolved[len(unresolved)-1]))
+	}
+	return
+}
+
+func haltReason(inc *incident.Incident) string {
+	return fmt.Sprintf("%s incident %s is unresolved", inc.Kind, inc.ID)
+}
+
+// ListIncidents returns all incidents recorded by the penalization watchdog
+func (relay *RelayServer) ListIncidents() (incidents []*incident.Incident, err error) {
+	if relay.Incidents == nil {
+		return []*incident.Incident{}, nil
+	}
+	return relay.Incidents.ListIncidents()
+}
+
+// ResolveIncident marks the incident as handled by the operator. The relay signs again once no incident is unresolved.
+func (relay *RelayServer) ResolveIncident(id string) (err error) {
+	if relay.Incidents == nil {
+		return fmt.Errorf("Unknown incident %s", id)
+	}
+	inc, err := relay.Incidents.GetIncident(id)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if inc == nil {
+		return fmt.Errorf("Unknown incident %s", id)
+	}
+	inc.Resolved = true
+	if err = relay.Incidents.SaveIncident(inc); err != nil {
+		log.Println(err)
+		return
+	}
+	log.Println("Incident", id, "resolved")
+	unresolved, err := incident.Unresolved(relay.Incidents)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if len(unresolved) == 0 {
+		relay.Resume()
+	} else {
+		relay.Halt(haltReason(unresolved[len(unresolved)-1]))
+	}
+	return
+}
+
+// hubEventLogs returns the logs of the hub event for this relay mined from fromBlock to toBlock, from the hub index if
+// there is one
+func (relay *RelayServer) hubEventLogs(ctx context.Context, name string, fromBlock uint64, toBlock uint64) (logs []types.Log, err error) {
+	if relay.HubIndex != nil {
+		if err = relay.HubIndex.Sync(ctx); err != nil {
+			return
+		}
+		var indexed []types.Log
+		if indexed, err = relay.HubIndex.Events(name, relay.Address()); err != nil {
+			return
+		}
+		for _, vLog := range indexed {
+			if vLog.BlockNumber >= fromBlock && vLog.BlockNumber <= toBlock {
+				logs = append(logs, vLog)
+			}
+		}
+		return logs, nil
+	}
+	return relay.Client.FilterLogs(ctx, ethereum.FilterQuery{
+		FromBlock: new(big.Int).SetUint64(fromBlock),
+		ToBlock:   new(big.Int).SetUint64(toBlock),
+		Addresses: []common.Address{relay.RelayHubAddress},
+		Topics:    [][]common.Hash{{relayHubABI.Events[name].Id()}, {common.BytesToHash(relay.Address().Bytes())}},
+	})
+}
+
+// WatchPenalization looks for Penalized and RelayRemoved events of the relay not recorded as incidents yet. Each one
+// is persisted as an incident, halts the relay and raises an alert. Does nothing without an incident store.
+// It looks from the block it last checked, persisted in the relay state, less ConfirmationsNeeded blocks in case the
+// events were reorged; a relay with no state starts from the first block.
+func (relay *RelayServer) WatchPenalization() (incidents []*incident.Incident, err error) {
+	if relay.Incidents == nil {
+		return nil, nil
+	}
+	relay.penalization.mutex.Lock()
+	defer relay.penalization.mutex.Unlock()
+	ctx := context.Background()
+	header, err := relay.Client.HeaderByNumber(ctx, nil)
+	if err != nil {
+		log.Println("WatchPenalization: could not get the latest block", err)
+		return nil, err
+	}
+	latest := header.Number.Uint64()
+	for _, name := range watchedEvents {
+		logs, err := relay.hubEventLogs(ctx, name, relay.penalization.fromBlock, latest)
+		if err != nil {
+			log.Println("WatchPenalization: error retrieving", name, "events", err)
+			return nil, err
+		}
+		for _, vLog := range logs {
+			id := incident.EventID(vLog.TxHash, vLog.Index)
+			existing, err := relay.Incidents.GetIncident(id)
+			if err != nil {
+				log.Println(err)
+				return nil, err
+			}
+			if existing != nil {
+				continue
+			}
+			inc := relay.newIncident(ctx, name, vLog)
+			if err = relay.Incidents.SaveIncident(inc); err != nil {
+				log.Println(err)
+				return nil, err
+			}
+			relay.Halt(haltReason(inc))
+			log.Printf("WatchPenalization: relay halted, %s incident %+v\n", name, inc)
+			relay.alertIncident(inc)
+			incidents = append(incidents, inc)
+		}
+	}
+	if confirmations := relay.ConfirmationsNeeded(); latest >= confirmations && latest-confirmations > relay.penalization.fromBlock {
+		relay.penalization.fromBlock = latest - confirmations
+		relay.recordPenalizationBlock(relay.penalization.fromBlock)
+	}
+	return
+}
+
+// restorePenalizationWatch resumes looking for hub events from the block checked before a restart
+func (relay *RelayServer) restorePenalizationWatch(state *lifecycle.State) {
+	relay.penalization.mutex.Lock()
+	defer relay.penalization.mutex.Unlock()
+	if state.PenalizationBlock > relay.penalization.fromBlock {
+		relay.penalization.fromBlock = state.PenalizationBlock
+	}
+}
+
+// SubscribePenalization subscribes to the Penalized and RelayRemoved events of the relay, handling each one as it is
+// mined like WatchPenalization does. The subscription fails when the node drops it or cannot support it; the events
+// mined meanwhile are only found by polling WatchPenalization.
+func (relay *RelayServer) SubscribePenalization() (sub ethereum.Subscription, err error) {
+	if relay.Incidents == nil {
+		return nil, fmt.Errorf("No incident store to record penalizations")
+	}
+	topics := make([]common.Hash, len(watchedEvents))
+	for i, name := range watchedEvents {
+		topics[i] = relayHubABI.Events[name].Id()
+	}
+	logs := make(chan types.Log)
+	hubSub, err := relay.Client.SubscribeFilterLogs(context.Background(), ethereum.FilterQuery{
+		Addresses: []common.Address{relay.RelayHubAddress},
+		Topics:    [][]common.Hash{topics, {common.BytesToHash(relay.Address().Bytes())}},
+	}, logs)
+	if err != nil {
+		log.Println("SubscribePenalization: could not subscribe to hub events", err)
+		return nil, err
+	}
+	return event.NewSubscription(func(quit <-chan struct{}) error {
+		defer hubSub.Unsubscribe()
+		for {
+			select {
+			case <-logs:
+				if _, err := relay.WatchPenalization(); err != nil {
+					return err
+				}
+			case err := <-hubSub.Err():
+				return err
+			case <-quit:
+				return nil
+			}
+		}
+	}), nil
+}
+
+// newIncident records the event. The offending txs of a penalization are decoded from the penalizing tx when it called
+// the hub directly.
+func (relay *RelayServer) newIncident(ctx context.Context, kind string, vLog types.Log) (inc *incident.Incident) {
+	inc = &incident.Incident{
+		ID:          incident.EventID(vLog.TxHash, vLog.Index),
+		Kind:        kind,
+		Relay:       relay.Address(),
+		BlockNumber: vLog.BlockNumber,
+		TxHash:      vLog.TxHash,
+		Detected:    relay.clock.Now().Unix(),
+	}
+	if kind != incident.KindPenalized {
+		return
+	}
+	event := new(librelay.IRelayHubPenalized)
+	boundHub := bind.NewBoundContract(relay.RelayHubAddress, relayHubABI, nil, nil, nil)
+	if err := boundHub.UnpackLog(event, "Penalized", vLog); err != nil {
+		log.Println("Could not decode Penalized event", err)
+	} else {
+		inc.Reporter = event.Sender
+		inc.Amount = event.Amount
+	}
+	penalizingTx, _, err := relay.Client.TransactionByHash(ctx, vLog.TxHash)
+	if err != nil {
+		log.Println("Could not get penalizing tx", vLog.TxHash.Hex(), err)
+		return
+	}
+	inc.OffendingTxHashes, err = offendingTransactions(penalizingTx.Data())
+	if err != nil {
+		log.Println("Could not decode the txs penalized by", vLog.TxHash.Hex(), err)
+	}
+	return
+}
+
+func (relay *RelayServer) alertIncident(inc *incident.Incident) {
+	alert := &notify.Alert{
+		Kind:     inc.Kind,
+		Time:     inc.Detected,
+		Critical: true,
+		Message:  "The relay stopped signing transactions until the incident is resolved with the admin API",
+		Fields: map[string]string{
+			"incident": inc.ID,
+			"tx":       inc.TxHash.Hex(),
+			"block":    fmt.Sprint(inc.BlockNumber),
+		},
+	}
+	if inc.Kind == incident.KindPenalized {
+		alert.Title = fmt.Sprintf("Relay %s was penalized in tx %s", inc.Relay.Hex(), inc.TxHash.Hex())
+		hashes := make([]string, len(inc.OffendingTxHashes))
+		for i, hash := range inc.OffendingTxHashes {
+			hashes[i] = hash.Hex()
+		}
+		alert.Fields["offendingTxs"] = strings.Join(hashes, ",")
+		alert.Fields["reporter"] = inc.Reporter.Hex()
+		alert.Fields["amount"] = fmt.Sprint(inc.Amount)
+	} else {
+		alert.Title = fmt.Sprintf("Relay %s was removed from the hub in tx %s", inc.Relay.Hex(), inc.TxHash.Hex())
+	}
+	relay.notify(alert)
+}
+
+// offendingTransactions returns the hashes of the relay's txs passed to a penalize method of the hub
+func offendingTransactions(data []byte) (hashes []common.Hash, err error) {
+	if len(data) < 4 {
+		return nil, fmt.Errorf("Not a penalize call")
+	}
+	for _, name := range penalizeMethods {
+		method := relayHubABI.Methods[name]
+		if !bytes.Equal(data[:4], method.Id()) {
+			continue
+		}
+		args, err := method.Inputs.UnpackValues(data[4:])
+		if err != nil {
+			return nil, err
+		}
+		for i := 0; i+1 < len(args); i += 2 {
+			unsignedTx, ok1 := args[i].([]byte)
+			signature, ok2 := args[i+1].([]byte)
+			if !ok1 || !ok2 {
+				return nil, fmt.Errorf("Unexpected %s arguments", name)
+			}
+			hash, err := signedTransactionHash(unsignedTx, signature)
+			if err != nil {
+				return nil, err
+			}
+			hashes = append(hashes, hash)
+		}
+		return hashes, nil
+	}
+	return nil, fmt.Errorf("Not a penalize call")
+}
+
+// signedTransactionHash returns the hash of the tx the relay broadcast, given the rlp encoded tx it signed (with the
+// EIP-155 chain id fields or not) and its 65 bytes signature, as passed to the hub's penalize methods
+func signedTransactionHash(unsignedTx []byte, signature []byte) (hash common.Hash, err error) {
+	var fields []rlp.RawValue
+	if err = rlp.DecodeBytes(unsignedTx, &fields); err != nil {
+		return
+	}
+	if len(fields) != 6 && len(fields) != 9 {
+		return hash, fmt.Errorf("Unsigned tx has %d fields", len(fields))
+	}
+	if len(signature) != 65 {
+		return hash, fmt.Errorf("Signature has %d bytes", len(signature))
+	}
+	recoveryID := uint64(signature[64])
+	if recoveryID >= 27 {
+		recoveryID -= 27
+	}
+	v := new(big.Int).SetUint64(recoveryID + 27)
+	if len(fields) == 9 {
+		chainID := new(big.Int)
+		if err = rlp.DecodeBytes(fields[6], chainID); err != nil {
+			return
+		}
+		v.Mul(chainID, big.NewInt(2))
+		v.Add(v, new(big.Int).SetUint64(recoveryID+35))
+	}
+	signedTx := make([]interface{}, 0, 9)
+	for _, field := range fields[:6] {
+		signedTx = append(signedTx, field)
+	}
+	signedTx = append(signedTx, v, new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:64]))
+	encoded, err := rlp.EncodeToBytes(signedTx)
+	if err != nil {
+		return
+	}
+	return crypto.Keccak256Hash(encoded), nil
+}
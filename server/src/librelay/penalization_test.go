@@ -0,0 +1,59 @@
+package librelay
+
+import (
+	"crypto/ecdsa"
+	"math/big"
+	"testing"
+
+	"librelay/test"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// illegalTransaction signs a plain transfer with key, and returns it with the unsigned tx and signature the hub's
+// penalize methods take. A nil chainID signs without EIP-155.
+func illegalTransaction(t *testing.T, key *ecdsa.PrivateKey, chainID *big.Int) (signedTx *types.Transaction, unsignedTx []byte, signature []byte) {
+	tx := types.NewTransaction(3, common.HexToAddress("0xFFcf8FDEE72ac11b5c542428B35EEF5769C409f0"), big.NewInt(1), 21000, big.NewInt(1e9), nil)
+	var signer types.Signer = types.HomesteadSigner{}
+	fields := []interface{}{tx.Nonce(), tx.GasPrice(), tx.Gas(), tx.To(), tx.Value(), tx.Data()}
+	if chainID != nil {
+		signer = types.NewEIP155Signer(chainID)
+		fields = append(fields, chainID, uint(0), uint(0))
+	}
+	signedTx, err := types.SignTx(tx, signer, key)
+	test.ErrFail(err, t)
+	unsignedTx, err = rlp.EncodeToBytes(fields)
+	test.ErrFail(err, t)
+	signature, err = crypto.Sign(signer.Hash(tx).Bytes(), key)
+	test.ErrFail(err, t)
+	signature[64] += 27
+	return
+}
+
+func TestOffendingTransactions(t *testing.T) {
+	key, err := crypto.GenerateKey()
+	test.ErrFail(err, t)
+	for _, chainID := range []*big.Int{nil, big.NewInt(1), big.NewInt(1337)} {
+		signedTx, unsignedTx, signature := illegalTransaction(t, key, chainID)
+		hash, err := signedTransactionHash(unsignedTx, signature)
+		test.ErrFail(err, t)
+		if hash != signedTx.Hash() {
+			t.Errorf("Expected hash %v on chain %v but got %v", signedTx.Hash().Hex(), chainID, hash.Hex())
+		}
+
+		data, err := relayHubABI.Pack("penalizeIllegalTransaction", unsignedTx, signature)
+		test.ErrFail(err, t)
+		hashes, err := offendingTransactions(data)
+		test.ErrFail(err, t)
+		if len(hashes) != 1 || hashes[0] != signedTx.Hash() {
+			t.Errorf("Expected offending tx %v but got %v", signedTx.Hash().Hex(), hashes)
+		}
+	}
+
+	if _, err = offendingTransactions(common.FromHex("0x12345678")); err == nil {
+		t.Error("Expected an error for a call other than penalize")
+	}
+}
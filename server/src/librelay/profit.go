@@ -0,0 +1,232 @@
+package librelay
+
+import (
+	"context"
+	"fmt"
+	"gen/librelay"
+	"log"
+	"math/big"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/clock"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// How long the expected profit of a sent tx is kept waiting for the tx to be confirmed
+const profitTrackingTTL = 24 * time.Hour
+
+// RelayHub's gasOverhead: the gas of relayCall outside of what it measures with gasleft(), which getChargeableGas adds
+// to the measured gas
+const hubGasOverhead = 49791
+
+// ProfitEstimate is the expected outcome of relaying a request. The hub charges the recipient for the chargeable gas
+// at the request's gas price plus the relay fee (see RelayHub.getChargeableGas and calculateCharge); the relay pays
+// the whole tx's gas at the price it sends the tx with, or at the resend price if it is pending for too long.
+type ProfitEstimate struct {
+	Gas           uint64   // expected gas used by the relayCall tx
+	ChargeableGas uint64   // expected gas the hub charges the recipient for
+	Charge        *big.Int // expected charge in the TransactionRelayed event
+	Cost          *big.Int // expected gas cost for the relay at the send price
+	ResendCost    *big.Int // gas cost for the relay if the tx has to be resent
+	Profit        *big.Int // Charge - Cost, may be negative
+	ResendProfit  *big.Int // Charge - ResendCost, may be negative
+}
+
+// chargeableGas is the gas RelayHub.getChargeableGas computes for a relayCall tx using gas in total: relayCall measures
+// the gas it uses itself, which leaves out the intrinsic gas of the tx, and adds gasOverhead to it
+func chargeableGas(gas uint64, data []byte) (chargeable uint64, err error) {
+	intrinsicGas, err := core.IntrinsicGas(data, false, true)
+	if err != nil {
+		return
+	}
+	if gas < intrinsicGas {
+		return 0, fmt.Errorf("Gas %d is below the intrinsic gas %d of the tx", gas, intrinsicGas)
+	}
+	return gas - intrinsicGas + hubGasOverhead, nil
+}
+
+// estimateProfit applies the hub's charge formula to the chargeable gas, and the send and resend prices to the gas
+func estimateProfit(gas uint64, chargeable uint64, sendGasPrice *big.Int, requestGasPrice *big.Int, fee *big.Int) *ProfitEstimate {
+	charge := new(big.Int).Mul(new(big.Int).SetUint64(chargeable), requestGasPrice)
+	charge.Mul(charge, new(big.Int).Add(big.NewInt(100), fee))
+	charge.Div(charge, big.NewInt(100))
+	cost := new(big.Int).Mul(new(big.Int).SetUint64(gas), sendGasPrice)
+	resendCost := new(big.Int).Mul(new(big.Int).SetUint64(gas), maxBig(sendGasPrice, resentGasPrice(sendGasPrice)))
+	return &ProfitEstimate{
+		Gas:           gas,
+		ChargeableGas: chargeable,
+		Charge:        charge,
+		Cost:          cost,
+		ResendCost:    resendCost,
+		Profit:        new(big.Int).Sub(charge, cost),
+		ResendProfit:  new(big.Int).Sub(charge, resendCost),
+	}
+}
+
+func maxBig(a *big.Int, b *big.Int) *big.Int {
+	if a.Cmp(b) >= 0 {
+		return a
+	}
+	return b
+}
+
+// checkProfit rejects requests expected to lose money at the send price. The margins of MinProfit wei and
+// MinProfitPercent percent of the cost must still be left if the tx has to be resent.
+func (relay *RelayServer) checkProfit(estimate *ProfitEstimate) (err error) {
+	if estimate.Profit.Sign() < 0 {
+		return fmt.Errorf("Unprofitable request: expected charge %s is below the gas cost %s", estimate.Charge.String(), estimate.Cost.String())
+	}
+	if relay.MinProfit != nil && estimate.ResendProfit.Cmp(relay.MinProfit) < 0 {
+		return fmt.Errorf("Unprofitable request: expected profit %s if resent is below the minimum of %s", estimate.ResendProfit.String(), relay.MinProfit.String())
+	}
+	if relay.MinProfitPercent != nil {
+		minProfit := new(big.Int).Mul(estimate.ResendCost, relay.MinProfitPercent)
+		minProfit.Div(minProfit, big.NewInt(100))
+		if estimate.ResendProfit.Cmp(minProfit) < 0 {
+			return fmt.Errorf("Unprofitable request: expected profit %s if resent is below %s%% of the gas cost %s", estimate.ResendProfit.String(), relay.MinProfitPercent.String(), estimate.ResendCost.String())
+		}
+	}
+	return nil
+}
+
+// relayCallGasPrice is the gas price the relay sends the relayCall of the request with: the hub requires at least the
+// request's, which is already checked to be at least the relay's own
+func (relay *RelayServer) relayCallGasPrice(request *RelayTransactionRequest) *big.Int {
+	return new(big.Int).Set(&request.GasPrice)
+}
+
+// packRelayCall returns the data of the request's relayCall tx
+func packRelayCall(request *RelayTransactionRequest) ([]byte, error) {
+	return relayHubABI.Pack("relayCall", request.From, request.To, common.FromHex(request.EncodedFunction), &request.RelayFee,
+		&request.GasPrice, &request.GasLimit, &request.RecipientNonce, request.Signature, request.ApprovalData)
+}
+
+// estimateRelayCallGas runs eth_estimateGas of the request's relayCall as sent by this relay
+func (relay *RelayServer) estimateRelayCallGas(request *RelayTransactionRequest) (gas uint64, err error) {
+	relayCall, err := packRelayCall(request)
+	if err != nil {
+		return
+	}
+	return relay.Client.EstimateGas(context.Background(), ethereum.CallMsg{
+		From:     relay.Address(),
+		To:       &relay.RelayHubAddress,
+		GasPrice: relay.relayCallGasPrice(request),
+		Data:     relayCall,
+	})
+}
+
+// estimateRelayProfit estimates the profit of relaying a request with the gas from the simulation if there was one,
+// or else from eth_estimateGas of its relayCall
+func (relay *RelayServer) estimateRelayProfit(request *RelayTransactionRequest, simulation *RelayCallSimulation) (estimate *ProfitEstimate, err error) {
+	var gas uint64
+	if simulation != nil && simulation.EstimatedGas != 0 {
+		gas = simulation.EstimatedGas
+	} else {
+		gas, err = relay.estimateRelayCallGas(request)
+		if err != nil {
+			err = fmt.Errorf("Could not estimate relayCall gas: %v", err)
+			log.Println(err)
+			return
+		}
+	}
+	relayCall, err := packRelayCall(request)
+	if err != nil {
+		return
+	}
+	chargeable, err := chargeableGas(gas, relayCall)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	estimate = estimateProfit(gas, chargeable, relay.relayCallGasPrice(request), &request.GasPrice, &request.RelayFee)
+	log.Println("Expected profit of relayed tx:", estimate.Profit, "if resent:", estimate.ResendProfit, "charge:", estimate.Charge,
+		"cost:", estimate.Cost, "gas:", gas, "chargeable gas:", chargeable)
+	return
+}
+
+type expectedProfit struct {
+	estimate *ProfitEstimate
+	sent     time.Time
+}
+
+// profitTracker keeps the expected profit of sent relayCalls by relay nonce, until the tx is confirmed and the
+// realised profit can be logged next to it
+type profitTracker struct {
+	expected map[uint64]expectedProfit
+	mutex    *sync.Mutex
+	clock    clock.Clock
+}
+
+func newProfitTracker(clk clock.Clock) *profitTracker {
+	return &profitTracker{
+		expected: make(map[uint64]expectedProfit),
+		mutex:    &sync.Mutex{},
+		clock:    clk,
+	}
+}
+
+func (tracker *profitTracker) set(nonce uint64, estimate *ProfitEstimate) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	now := tracker.clock.Now()
+	for n, entry := range tracker.expected {
+		if now.Sub(entry.sent) > profitTrackingTTL {
+			delete(tracker.expected, n)
+		}
+	}
+	tracker.expected[nonce] = expectedProfit{estimate, now}
+}
+
+// take removes and returns the expected profit of the tx with the given nonce
+func (tracker *profitTracker) take(nonce uint64) (estimate *ProfitEstimate) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	entry, ok := tracker.expected[nonce]
+	if !ok {
+		return nil
+	}
+	delete(tracker.expected, nonce)
+	return entry.estimate
+}
+
+// RealisedProfit returns the charge of the TransactionRelayed event emitted for this relay in the receipt, and the gas
+// cost actually paid for the tx. A relayCall that emitted no TransactionRelayed (e.g. CanRelayFailed) has a charge of 0.
+func (relay *RelayServer) RealisedProfit(tx *types.Transaction, receipt *types.Receipt) (charge *big.Int, cost *big.Int, err error) {
+	cost = new(big.Int).Mul(new(big.Int).SetUint64(receipt.GasUsed), tx.GasPrice())
+	charge = big.NewInt(0)
+	boundHub := bind.NewBoundContract(relay.RelayHubAddress, relayHubABI, nil, nil, nil)
+	eventID := relayHubABI.Events["TransactionRelayed"].Id()
+	relayTopic := common.BytesToHash(relay.Address().Bytes())
+	for _, vLog := range receipt.Logs {
+		if vLog.Address != relay.RelayHubAddress || len(vLog.Topics) < 2 || vLog.Topics[0] != eventID || vLog.Topics[1] != relayTopic {
+			continue
+		}
+		event := new(librelay.IRelayHubTransactionRelayed)
+		if err = boundHub.UnpackLog(event, "TransactionRelayed", *vLog); err != nil {
+			log.Println(err)
+			return nil, nil, err
+		}
+		charge = event.Charge
+	}
+	return
+}
+
+// logRealisedProfit logs the realised profit of a mined relayCall next to the profit expected when it was sent
+func (relay *RelayServer) logRealisedProfit(minedTx *types.Transaction, receipt *types.Receipt) {
+	expected := relay.profits.take(minedTx.Nonce())
+	if expected == nil {
+		return
+	}
+	charge, cost, err := relay.RealisedProfit(minedTx, receipt)
+	if err != nil {
+		return
+	}
+	log.Println("Relayed tx", minedTx.Hash().Hex(), "expected profit:", expected.Profit, "realised profit:", new(big.Int).Sub(charge, cost),
+		"charge:", charge, "cost:", cost, "gas used:", receipt.GasUsed)
+}
@@ -0,0 +1,109 @@
+package librelay
+
+import (
+	"math/big"
+	"strings"
+	"testing"
+
+	"librelay/test"
+
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func TestEstimateProfit(t *testing.T) {
+	// 100000 gas at 2 gwei with a 40% fee: charge 280000 gwei, cost 200000 gwei at the same price, 240000 gwei if
+	// resent 20% higher
+	gwei := big.NewInt(1e9)
+	price := new(big.Int).Mul(big.NewInt(2), gwei)
+	estimate := estimateProfit(100000, 100000, price, price, big.NewInt(40))
+	if estimate.Charge.Cmp(new(big.Int).Mul(big.NewInt(280000), gwei)) != 0 || estimate.Cost.Cmp(new(big.Int).Mul(big.NewInt(200000), gwei)) != 0 ||
+		estimate.ResendCost.Cmp(new(big.Int).Mul(big.NewInt(240000), gwei)) != 0 {
+		t.Errorf("Wrong charge or cost %+v", estimate)
+	}
+	if estimate.Profit.Cmp(new(big.Int).Mul(big.NewInt(80000), gwei)) != 0 || estimate.ResendProfit.Cmp(new(big.Int).Mul(big.NewInt(40000), gwei)) != 0 {
+		t.Errorf("Wrong profit %s, %s if resent", estimate.Profit.String(), estimate.ResendProfit.String())
+	}
+
+	relayServer := &RelayServer{}
+	if err := relayServer.checkProfit(estimate); err != nil {
+		t.Error("Expected profitable request but got", err)
+	}
+	// The margins must hold at the resend price: 40000 gwei is 16.6% of 240000 gwei
+	relayServer.MinProfitPercent = big.NewInt(16)
+	if err := relayServer.checkProfit(estimate); err != nil {
+		t.Error("Expected request with a 16% margin to be accepted but got", err)
+	}
+	relayServer.MinProfitPercent = big.NewInt(17)
+	if err := relayServer.checkProfit(estimate); err == nil {
+		t.Error("Expected request below MinProfitPercent to be rejected")
+	}
+	relayServer.MinProfitPercent = nil
+	relayServer.MinProfit = new(big.Int).Set(estimate.ResendProfit)
+	if err := relayServer.checkProfit(estimate); err != nil {
+		t.Error("Expected request at MinProfit to be accepted but got", err)
+	}
+	relayServer.MinProfit.Add(relayServer.MinProfit, big.NewInt(1))
+	if err := relayServer.checkProfit(estimate); err == nil {
+		t.Error("Expected request below MinProfit to be rejected")
+	}
+
+	// A 10% fee does not cover a resend
+	estimate = estimateProfit(100000, 100000, price, price, big.NewInt(10))
+	if estimate.ResendProfit.Sign() >= 0 || (&RelayServer{MinProfitPercent: big.NewInt(0)}).checkProfit(estimate) == nil {
+		t.Errorf("Expected request losing money if resent to be rejected: %+v", estimate)
+	}
+	// Nor being charged for less gas than the tx uses
+	estimate = estimateProfit(100000, 90000, price, price, big.NewInt(10))
+	if estimate.Profit.Sign() >= 0 || (&RelayServer{}).checkProfit(estimate) == nil {
+		t.Errorf("Expected unprofitable request to be rejected: %+v", estimate)
+	}
+
+	// The resend price is capped
+	estimate = estimateProfit(100000, 100000, new(big.Int).Mul(big.NewInt(90), gwei), price, big.NewInt(10))
+	if estimate.ResendCost.Cmp(new(big.Int).Mul(big.NewInt(100000*100), gwei)) != 0 {
+		t.Errorf("Expected the resend price to be capped at %d but got cost %s", uint64(maxGasPrice), estimate.ResendCost.String())
+	}
+}
+
+func TestChargeableGas(t *testing.T) {
+	// 21000 for the tx, 4 per zero byte and 68 per non-zero byte of data
+	chargeable, err := chargeableGas(100000, []byte{0, 0, 1})
+	test.ErrFail(err, t)
+	if expected := uint64(100000 - 21000 - 4 - 4 - 68 + 49791); chargeable != expected {
+		t.Errorf("Expected %d chargeable gas but got %d", expected, chargeable)
+	}
+	if _, err = chargeableGas(20000, nil); err == nil {
+		t.Error("Expected gas below the intrinsic gas to be rejected")
+	}
+}
+
+func TestRelayTransactionUnprofitable(t *testing.T) {
+	test.ErrFail(relay.TxStore.Clear(), t)
+	test.ErrFail(relay.RefreshGasPrice(), t)
+	from := crypto.PubkeyToAddress(gaslessKey2.PublicKey)
+	gaslessNonce, err := rhub.GetNonce(nil, from)
+	test.ErrFail(err, t)
+	request := newSignedRelayTransactionRequest(t, gaslessNonce.Int64())
+
+	// The request's 10% fee leaves a profit at the price it is sent with, but not if it has to be resent 20% higher
+	estimate, err := relay.estimateRelayProfit(&request, nil)
+	test.ErrFail(err, t)
+	if estimate.Profit.Sign() <= 0 || estimate.ResendProfit.Sign() >= 0 {
+		t.Fatalf("Expected a profit only at the send price but got %+v", estimate)
+	}
+	relay.MinProfitPercent = big.NewInt(0)
+	defer func() { relay.MinProfitPercent = nil }()
+	if _, err = relay.CreateRelayTransaction(request); err == nil || !strings.Contains(err.Error(), "Unprofitable") {
+		t.Fatal("Expected the request to be rejected as unprofitable but got", err)
+	}
+	nonce, err := rhub.GetNonce(nil, from)
+	test.ErrFail(err, t)
+	if nonce.Cmp(gaslessNonce) != 0 {
+		t.Errorf("Expected the rejected request not to be relayed, but the sender's nonce went from %s to %s", gaslessNonce, nonce)
+	}
+
+	relay.MinProfitPercent = nil
+	signedTx, err := relay.CreateRelayTransaction(request)
+	test.ErrFail(err, t)
+	assertTransactionRelayed(t, signedTx.Hash())
+}
@@ -0,0 +1,201 @@
+package librelay
+
+import (
+	"context"
+	"fmt"
+	"librelay/funding"
+	"librelay/lifecycle"
+	"librelay/notify"
+	"log"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// AlertRefill is the kind of the alerts raised when a refill cannot be requested or its tx fails
+const AlertRefill = "Refill"
+
+// DefaultRefillTimeout is how long a refill tx may stay unmined before it is replaced
+const DefaultRefillTimeout = 30 * time.Minute
+
+// RefillRules configure topping up the relay's balance with a funding hook
+type RefillRules struct {
+	Funder  funding.Funder // requests the funds, refilling is disabled if not set
+	Below   *big.Int       // low-water mark: funds are requested when the balance is below this amount in wei
+	Amount  *big.Int       // wei requested per refill
+	Timeout time.Duration  // a refill tx not mined within this duration is replaced, DefaultRefillTimeout if 0
+}
+
+// refillState is the refill being tracked, if any
+type refillState struct {
+	mutex   sync.Mutex
+	tracked *lifecycle.Refill
+}
+
+// RefillBalance requests funds from the funding hook when the relay's balance is below the low-water mark, and tracks
+// the refill tx until it is mined or failed. No new refill is requested while one is pending: a refill tx not mined in
+// time is replaced at the same nonce, so that the relay is never funded twice. Returns the hash of the refill tx
+// being tracked, if any.
+func (relay *RelayServer) RefillBalance() (txHash common.Hash, err error) {
+	rules := relay.RefillRules
+	if rules.Funder == nil || rules.Below == nil || rules.Amount == nil {
+		return
+	}
+	state := relay.refill
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+
+	ctx := context.Background()
+	if state.tracked != nil {
+		pending, err := relay.trackRefill(ctx)
+		if pending {
+			return state.tracked.TxHashes[len(state.tracked.TxHashes)-1], err
+		}
+		if err != nil {
+			return txHash, err
+		}
+	}
+
+	balance, err := relay.Balance()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if balance.Cmp(rules.Below) >= 0 {
+		return
+	}
+	log.Println("Balance", balance, "is below", rules.Below, "requesting", rules.Amount, "wei from the funding hook")
+	txHash, err = rules.Funder.RequestFunds(relay.Address(), rules.Amount)
+	if err != nil {
+		log.Println("Could not request funds:", err)
+		relay.notify(&notify.Alert{
+			Kind:    AlertRefill,
+			Title:   "Relay refill failed",
+			Message: fmt.Sprintf("Could not request %s wei with a balance of %s wei: %v", rules.Amount, balance, err),
+			Fields:  map[string]string{"balance": balance.String()},
+		})
+		return
+	}
+	log.Println("Refill tx sent:", txHash.Hex())
+	err = relay.trackRefillTxs([]common.Hash{txHash}, rules.Amount)
+	return
+}
+
+// trackRefill checks the txs of the refill being tracked, forgetting them once one of them is mined or failed. When
+// none is mined within the timeout, the last one is replaced. When the node dropped them all, the refill is sent again,
+// or forgotten so that funds are requested again if it cannot be.
+func (relay *RelayServer) trackRefill(ctx context.Context) (pending bool, err error) {
+	refill := relay.refill.tracked
+	for _, txHash := range refill.TxHashes {
+		receipt, err := relay.Client.TransactionReceipt(ctx, txHash)
+		if err == ethereum.NotFound || (err == nil && receipt == nil) {
+			continue
+		} else if err != nil {
+			log.Println("Could not get refill tx receipt", err)
+			return true, err
+		}
+		if receipt.Status != 1 {
+			relay.notify(&notify.Alert{
+				Kind:    AlertRefill,
+				Title:   "Relay refill failed",
+				Message: fmt.Sprintf("Refill tx %s of %s wei failed", txHash.Hex(), refill.Amount),
+				Fields:  map[string]string{"tx": txHash.Hex()},
+			})
+		} else {
+			log.Println("Refill tx", txHash.Hex(), "of", refill.Amount, "wei mined")
+		}
+		return false, relay.trackRefillTxs(nil, nil)
+	}
+
+	timeout := relay.RefillRules.Timeout
+	if timeout == 0 {
+		timeout = DefaultRefillTimeout
+	}
+	if relay.clock.Now().Sub(time.Unix(refill.Requested, 0)) < timeout {
+		return true, nil
+	}
+	dropped, err := relay.refillDropped(ctx, refill.TxHashes)
+	if err != nil {
+		return true, err
+	}
+	last := refill.TxHashes[len(refill.TxHashes)-1]
+	txHashes := refill.TxHashes
+	newTxHash, replaceErr := relay.RefillRules.Funder.ReplaceFunds(relay.Address(), refill.Amount, last)
+	if dropped {
+		if replaceErr != nil || newTxHash == last {
+			log.Println("Refill tx", last.Hex(), "was dropped by the node and could not be sent again, requesting funds again", replaceErr)
+			return false, relay.trackRefillTxs(nil, nil)
+		}
+		log.Println("Refill tx", last.Hex(), "was dropped by the node, sent again as", newTxHash.Hex())
+		relay.notify(&notify.Alert{
+			Kind:    AlertRefill,
+			Title:   "Relay refill dropped",
+			Message: fmt.Sprintf("Refill tx %s of %s wei was dropped by the node, sent again as %s", last.Hex(), refill.Amount, newTxHash.Hex()),
+			Fields:  map[string]string{"tx": last.Hex(), "replacement": newTxHash.Hex()},
+		})
+		return true, relay.trackRefillTxs([]common.Hash{newTxHash}, refill.Amount)
+	}
+	if replaceErr != nil {
+		log.Println("Could not replace refill tx", last.Hex(), replaceErr)
+		relay.notify(&notify.Alert{
+			Kind:    AlertRefill,
+			Title:   "Relay refill not mined",
+			Message: fmt.Sprintf("Refill tx %s of %s wei is not mined after %v and could not be replaced: %v", last.Hex(), refill.Amount, timeout, replaceErr),
+			Fields:  map[string]string{"tx": last.Hex()},
+		})
+	} else if newTxHash != last {
+		log.Println("Refill tx", last.Hex(), "replaced by", newTxHash.Hex())
+		relay.notify(&notify.Alert{
+			Kind:    AlertRefill,
+			Title:   "Relay refill not mined",
+			Message: fmt.Sprintf("Refill tx %s of %s wei is not mined after %v, replaced by %s", last.Hex(), refill.Amount, timeout, newTxHash.Hex()),
+			Fields:  map[string]string{"tx": last.Hex(), "replacement": newTxHash.Hex()},
+		})
+		txHashes = append(append([]common.Hash{}, txHashes...), newTxHash)
+	}
+	return true, relay.trackRefillTxs(txHashes, refill.Amount)
+}
+
+// refillDropped returns whether the node knows none of the refill txs, which are not mined either: it dropped them
+func (relay *RelayServer) refillDropped(ctx context.Context, txHashes []common.Hash) (dropped bool, err error) {
+	for _, txHash := range txHashes {
+		_, _, err = relay.Client.TransactionByHash(ctx, txHash)
+		if err == ethereum.NotFound {
+			continue
+		}
+		if err != nil {
+			log.Println("Could not get refill tx", txHash.Hex(), err)
+			return
+		}
+		return false, nil
+	}
+	return true, nil
+}
+
+// trackRefillTxs sets the refill being tracked, persisting it so that a restarted relay keeps tracking it instead of
+// requesting funds again. No refill is tracked if txHashes is empty.
+func (relay *RelayServer) trackRefillTxs(txHashes []common.Hash, amount *big.Int) (err error) {
+	var refill *lifecycle.Refill
+	if len(txHashes) > 0 {
+		refill = &lifecycle.Refill{TxHashes: txHashes, Amount: amount, Requested: relay.clock.Now().Unix()}
+	}
+	relay.refill.tracked = refill
+	return relay.updateState(func(state *lifecycle.State) bool {
+		state.Refill = refill
+		return true
+	})
+}
+
+// restoreRefill resumes tracking the refill saved before a restart
+func (relay *RelayServer) restoreRefill(state *lifecycle.State) {
+	if state.Refill == nil || len(state.Refill.TxHashes) == 0 {
+		return
+	}
+	relay.refill.mutex.Lock()
+	defer relay.refill.mutex.Unlock()
+	relay.refill.tracked = state.Refill
+	log.Println("Tracking refill tx", state.Refill.TxHashes[len(state.Refill.TxHashes)-1].Hex())
+}
@@ -0,0 +1,103 @@
+package librelay
+
+import (
+	"encoding/json"
+	"log"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// Error codes reported for each item of a batch
+const (
+	ErrCodeInvalidRequest = "InvalidRequest" // the item could not be parsed
+	ErrCodeRejected       = "Rejected"       // the request failed validation and was not sent
+	ErrCodeSendFailed     = "SendFailed"     // the request was valid but signing or sending the transaction failed
+)
+
+// RelayError is the error reported for a request that was not relayed
+type RelayError struct {
+	Code    string
+	Message string
+}
+
+func (err *RelayError) Error() string {
+	return err.Code + ": " + err.Message
+}
+
+// RelayTransactionResult holds either the signed transaction or the error for one request of a batch
+type RelayTransactionResult struct {
+	SignedTx *types.Transaction `json:",omitempty"`
+	Error    *RelayError        `json:",omitempty"`
+}
+
+func (result *RelayTransactionResult) MarshalJSON() ([]byte, error) {
+	if result.Error != nil {
+		return json.Marshal(struct{ Error *RelayError }{result.Error})
+	}
+	return json.Marshal(&RelayTransactionResponse{SignedTx: result.SignedTx})
+}
+
+// relayBatch is a /relay/batch request on its way through the relay pool
+type relayBatch struct {
+	requests []RelayTransactionRequest
+	prepared []*preparedRelay
+	results  []RelayTransactionResult
+}
+
+// CreateRelayTransactions validates all requests first, then sends the valid ones in order, with consecutive nonces
+// under a single hold of the nonce lock. Requests from the same sender must carry consecutive nonces, each one past
+// those of the sender's earlier accepted requests. Results are in the same order as requests. Once the relay pool is
+// started, the batch waits its turn there as a single request, and ErrRelayQueueFull is returned if the queue is full.
+func (relay *RelayServer) CreateRelayTransactions(requests []RelayTransactionRequest) (results []RelayTransactionResult, err error) {
+	batch := &relayBatch{requests: requests}
+	if relay.pool != nil {
+		job := &relayJob{batch: batch, result: make(chan relayJobResult, 1)}
+		if err = relay.pool.enqueue(job); err != nil {
+			return
+		}
+		<-job.result
+		return batch.results, nil
+	}
+	relay.prepareBatch(batch)
+	nonceMutex.Lock()
+	defer nonceMutex.Unlock()
+	relay.sendBatch(batch)
+	return batch.results, nil
+}
+
+// prepareBatch runs the checks on every request of the batch, recording the rejected ones in its results
+func (relay *RelayServer) prepareBatch(batch *relayBatch) {
+	batch.results = make([]RelayTransactionResult, len(batch.requests))
+	batch.prepared = make([]*preparedRelay, len(batch.requests))
+	accepted := make(map[common.Address]int64)
+	for i, request := range batch.requests {
+		prepared, err := relay.prepareRelayTransaction(request, accepted[request.From])
+		if err != nil {
+			batch.results[i].Error = &RelayError{ErrCodeRejected, err.Error()}
+			continue
+		}
+		batch.prepared[i] = prepared
+		if prepared.duplicateOf == nil {
+			accepted[request.From]++
+		}
+	}
+}
+
+// sendBatch sends the prepared requests of the batch in order. The caller must hold nonceMutex.
+func (relay *RelayServer) sendBatch(batch *relayBatch) {
+	sent := 0
+	for i, prepared := range batch.prepared {
+		if prepared == nil {
+			continue
+		}
+		signedTx, err := relay.sendRelayTransaction(prepared)
+		if err != nil {
+			batch.results[i].Error = &RelayError{ErrCodeSendFailed, err.Error()}
+			continue
+		}
+		batch.results[i].SignedTx = signedTx
+		sent++
+	}
+	log.Printf("Batch relayed %d of %d requests\n", sent, len(batch.requests))
+}
@@ -0,0 +1,203 @@
+package librelay
+
+import (
+	"fmt"
+	"librelay/lifecycle"
+	"log"
+	"time"
+)
+
+// WithdrawDelay is how long the relay waits after seeing the unstake before withdrawing its balance to the owner
+const WithdrawDelay = 2 * time.Minute
+
+// Phase returns the relay's lifecycle phase
+func (relay *RelayServer) Phase() lifecycle.Phase {
+	phase, _ := relay.phase.Load().(lifecycle.Phase)
+	if phase == "" {
+		return lifecycle.New
+	}
+	return phase
+}
+
+// Ready returns whether the relay serves relay requests: it is registered, knows the gas price and is not halted
+func (relay *RelayServer) Ready() bool {
+	halted, _ := relay.Halted()
+	return relay.Phase() == lifecycle.Ready && !halted
+}
+
+// restorePhase resumes the phase of a removed relay saved before a restart, from when the relay was seen removed or
+// unstaked so that a restart does not start the WithdrawDelay over. The active phases start over from New, so the
+// relay is not ready until the first Step has checked its stake, balance, registration and the gas price again.
+func (relay *RelayServer) restorePhase(state *lifecycle.State) {
+	if state.Phase == "" {
+		return
+	}
+	if err := state.Phase.Validate(); err != nil {
+		log.Println(err)
+		return
+	}
+	if !state.Phase.IsRemoved() {
+		return
+	}
+	relay.phase.Store(state.Phase)
+	relay.phaseSince = relay.clock.Now()
+	if state.Phase == lifecycle.Removed && state.Removed != 0 {
+		relay.phaseSince = time.Unix(state.Removed, 0)
+	}
+	if state.Phase == lifecycle.Unstaked && state.Unstaked != 0 {
+		relay.phaseSince = time.Unix(state.Unstaked, 0)
+	}
+	relay.withdrawalNonce = state.WithdrawalNonce
+	log.Println("Lifecycle phase restored:", state.Phase)
+}
+
+// moveTo makes the transition to the next phase, persisting it
+func (relay *RelayServer) moveTo(next lifecycle.Phase) (err error) {
+	current := relay.Phase()
+	if next == current {
+		return nil
+	}
+	if !current.CanMoveTo(next) {
+		return fmt.Errorf("Invalid lifecycle transition from %s to %s", current, next)
+	}
+	log.Println("Lifecycle:", current, "->", next)
+	relay.phase.Store(next)
+	relay.phaseSince = relay.clock.Now()
+	return relay.updateState(func(state *lifecycle.State) bool {
+		state.Phase = next
+		return true
+	})
+}
+
+// Step checks the relay's state on the chain and makes the transitions it calls for: it registers the relay when its
+// registration is due, and withdraws its balance once it is unstaked. Step never blocks longer than a registration, so
+// it is meant to be called periodically. Returns the phase the relay is in afterwards.
+func (relay *RelayServer) Step() (phase lifecycle.Phase, err error) {
+	relay.lifecycleMutex.Lock()
+	defer relay.lifecycleMutex.Unlock()
+
+	switch relay.Phase() {
+	case lifecycle.Withdrawn:
+	case lifecycle.Unstaked:
+		err = relay.stepUnstaked()
+	case lifecycle.Removed:
+		err = relay.stepRemoved()
+	default:
+		err = relay.stepActive()
+	}
+	return relay.Phase(), err
+}
+
+// stepActive finds the first condition for serving that does not hold, taking the actions that satisfy it
+func (relay *RelayServer) stepActive() (err error) {
+	removed, err := relay.IsRemoved()
+	if err != nil {
+		return
+	}
+	if removed {
+		return relay.moveTo(lifecycle.Removed)
+	}
+
+	staked, err := relay.IsStaked()
+	if err != nil {
+		return
+	}
+	if !staked {
+		log.Println("Waiting for stake...")
+		return relay.moveTo(lifecycle.New)
+	}
+
+	balance, err := relay.Balance()
+	if err != nil {
+		return
+	}
+	if relay.MinimumBalance != nil && balance.Cmp(relay.MinimumBalance) <= 0 {
+		log.Printf("Server's balance too low (%s, required %s). Waiting for funding...", balance, relay.MinimumBalance)
+		return relay.moveTo(lifecycle.Staked)
+	}
+
+	count, err := relay.BlockCountSinceRegistration()
+	if err != nil || count >= relay.RegistrationBlockRate {
+		if relay.Phase() != lifecycle.Ready {
+			if err = relay.moveTo(lifecycle.Funded); err != nil {
+				return
+			}
+		}
+		log.Println("Registering relay...")
+		if err = relay.RegisterRelay(); err != nil {
+			log.Println(err)
+			return
+		}
+		log.Println("Done registering")
+	}
+	if relay.Phase() != lifecycle.Ready {
+		if err = relay.moveTo(lifecycle.Registered); err != nil {
+			return
+		}
+	}
+
+	if err = relay.RefreshGasPrice(); err != nil {
+		return
+	}
+	if relay.Phase() != lifecycle.Ready {
+		log.Println("Relay ready for client requests.")
+	}
+	return relay.moveTo(lifecycle.Ready)
+}
+
+func (relay *RelayServer) stepRemoved() (err error) {
+	unstaked, err := relay.IsUnstaked()
+	if err != nil || !unstaked {
+		return
+	}
+	log.Println("Relay unstaked. Sending balance back to owner")
+	return relay.moveTo(lifecycle.Unstaked)
+}
+
+// stepUnstaked withdraws the balance to the owner, once the unstake had time to be confirmed. The withdrawal is not
+// waited for: its nonce is saved, and the next Steps resend it with a higher gas price until it is mined.
+func (relay *RelayServer) stepUnstaked() (err error) {
+	if relay.withdrawalNonce != nil {
+		return relay.checkWithdrawal(*relay.withdrawalNonce)
+	}
+	if !relay.DevMode && relay.clock.Since(relay.phaseSince) < WithdrawDelay {
+		return
+	}
+	tx, err := relay.Withdraw(relay.OwnerAddress, nil, nil)
+	if err == ErrBalanceTooLow {
+		log.Println("Nothing left to withdraw to the owner")
+		return relay.finishWithdrawal()
+	}
+	if err != nil {
+		return
+	}
+	nonce := tx.Nonce()
+	relay.withdrawalNonce = &nonce
+	return relay.updateState(func(state *lifecycle.State) bool {
+		state.WithdrawalNonce = &nonce
+		return true
+	})
+}
+
+// checkWithdrawal ends the lifecycle once the withdrawal is mined. The updatePendingTxs job leaves removed relays
+// alone, so the withdrawal is resent from here meanwhile.
+func (relay *RelayServer) checkWithdrawal(nonce uint64) (err error) {
+	mined, err := relay.withdrawalMined(nonce)
+	if err != nil {
+		return
+	}
+	if !mined {
+		if _, err = relay.UpdateUnconfirmedTransactions(); err != nil {
+			log.Println("Withdrawal", nonce, "not resent:", err)
+		}
+		return
+	}
+	return relay.finishWithdrawal()
+}
+
+func (relay *RelayServer) finishWithdrawal() (err error) {
+	if err = relay.RecordWithdrawn(); err != nil {
+		return
+	}
+	return relay.moveTo(lifecycle.Withdrawn)
+}
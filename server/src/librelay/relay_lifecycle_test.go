@@ -0,0 +1,353 @@
+package librelay
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math/big"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"librelay/lifecycle"
+	"librelay/test"
+	"librelay/txstore"
+
+	"code.cloudfoundry.org/clock/fakeclock"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// fakeHubChain is an IClient serving the hub's view of a single relay. Every sent tx is mined in a block of its own,
+// and registerRelay calls emit RelayAdded. Txs of others can be set pending.
+type fakeHubChain struct {
+	mutex   sync.Mutex
+	relay   common.Address
+	owner   common.Address
+	stake   *big.Int
+	balance *big.Int
+	block   uint64
+	logs    []types.Log
+	sent    []*types.Transaction
+	mined   map[common.Hash]uint64
+	pending map[common.Hash]bool
+}
+
+func newFakeHubChain(relay common.Address, owner common.Address) *fakeHubChain {
+	return &fakeHubChain{relay: relay, owner: owner, stake: big.NewInt(0), balance: big.NewInt(0), block: 1, mined: map[common.Hash]uint64{}, pending: map[common.Hash]bool{}}
+}
+
+func (chain *fakeHubChain) emit(name string, args ...interface{}) {
+	event := relayHubABI.Events[name]
+	data, err := event.Inputs.NonIndexed().Pack(args...)
+	if err != nil {
+		panic(err)
+	}
+	topics := []common.Hash{event.Id(), common.BytesToHash(chain.relay.Bytes())}
+	if name == "RelayAdded" {
+		topics = append(topics, common.BytesToHash(chain.owner.Bytes()))
+	}
+	chain.block++
+	chain.logs = append(chain.logs, types.Log{Topics: topics, Data: data, BlockNumber: chain.block, Index: uint(len(chain.logs))})
+}
+
+func (chain *fakeHubChain) CodeAt(ctx context.Context, contract common.Address, blockNumber *big.Int) ([]byte, error) {
+	return []byte{1}, nil
+}
+
+func (chain *fakeHubChain) CallContract(ctx context.Context, call ethereum.CallMsg, blockNumber *big.Int) ([]byte, error) {
+	chain.mutex.Lock()
+	defer chain.mutex.Unlock()
+	method := relayHubABI.Methods["getRelay"]
+	if !bytes.Equal(call.Data[:4], method.Id()) {
+		return nil, errors.New("Unexpected call")
+	}
+	state := uint8(0)
+	if chain.stake.Sign() > 0 {
+		state = 1
+	}
+	return method.Outputs.Pack(chain.stake, big.NewInt(3600), big.NewInt(0), chain.owner, state)
+}
+
+func (chain *fakeHubChain) PendingCallContract(ctx context.Context, call ethereum.CallMsg) ([]byte, error) {
+	return chain.CallContract(ctx, call, nil)
+}
+
+func (chain *fakeHubChain) PendingCodeAt(ctx context.Context, account common.Address) ([]byte, error) {
+	return []byte{1}, nil
+}
+
+func (chain *fakeHubChain) PendingNonceAt(ctx context.Context, account common.Address) (uint64, error) {
+	return chain.NonceAt(ctx, account, nil)
+}
+
+func (chain *fakeHubChain) SuggestGasPrice(ctx context.Context) (*big.Int, error) {
+	return big.NewInt(1e9), nil
+}
+
+func (chain *fakeHubChain) EstimateGas(ctx context.Context, call ethereum.CallMsg) (uint64, error) {
+	return 100000, nil
+}
+
+func (chain *fakeHubChain) SendTransaction(ctx context.Context, tx *types.Transaction) error {
+	chain.mutex.Lock()
+	defer chain.mutex.Unlock()
+	chain.sent = append(chain.sent, tx)
+	chain.balance.Sub(chain.balance, tx.Cost())
+	method := relayHubABI.Methods["registerRelay"]
+	if len(tx.Data()) >= 4 && bytes.Equal(tx.Data()[:4], method.Id()) {
+		args, err := method.Inputs.UnpackValues(tx.Data()[4:])
+		if err != nil {
+			return err
+		}
+		chain.emit("RelayAdded", args[0], chain.stake, big.NewInt(3600), args[1])
+	} else {
+		chain.block++
+	}
+	chain.mined[tx.Hash()] = chain.block
+	return nil
+}
+
+func (chain *fakeHubChain) FilterLogs(ctx context.Context, query ethereum.FilterQuery) (logs []types.Log, err error) {
+	chain.mutex.Lock()
+	defer chain.mutex.Unlock()
+	for _, vLog := range chain.logs {
+		if (query.FromBlock != nil && vLog.BlockNumber < query.FromBlock.Uint64()) ||
+			(query.ToBlock != nil && vLog.BlockNumber > query.ToBlock.Uint64()) {
+			continue
+		}
+		if vLog.Topics[0] == query.Topics[0][0] {
+			logs = append(logs, vLog)
+		}
+	}
+	return
+}
+
+func (chain *fakeHubChain) SubscribeFilterLogs(ctx context.Context, query ethereum.FilterQuery, ch chan<- types.Log) (ethereum.Subscription, error) {
+	return nil, errors.New("Not supported")
+}
+
+func (chain *fakeHubChain) TransactionByHash(ctx context.Context, txHash common.Hash) (tx *types.Transaction, isPending bool, err error) {
+	chain.mutex.Lock()
+	defer chain.mutex.Unlock()
+	for _, tx = range chain.sent {
+		if tx.Hash() == txHash {
+			return tx, false, nil
+		}
+	}
+	if chain.pending[txHash] {
+		return types.NewTransaction(0, chain.relay, big.NewInt(0), 21000, big.NewInt(1), nil), true, nil
+	}
+	return nil, false, ethereum.NotFound
+}
+
+func (chain *fakeHubChain) TransactionReceipt(ctx context.Context, txHash common.Hash) (*types.Receipt, error) {
+	chain.mutex.Lock()
+	defer chain.mutex.Unlock()
+	if _, ok := chain.mined[txHash]; !ok {
+		return nil, ethereum.NotFound
+	}
+	return &types.Receipt{Status: 1, TxHash: txHash}, nil
+}
+
+func (chain *fakeHubChain) NetworkID(ctx context.Context) (*big.Int, error) {
+	return big.NewInt(1337), nil
+}
+
+func (chain *fakeHubChain) BlockByNumber(ctx context.Context, number *big.Int) (*types.Block, error) {
+	return nil, ethereum.NotFound
+}
+
+func (chain *fakeHubChain) HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error) {
+	chain.mutex.Lock()
+	defer chain.mutex.Unlock()
+	return &types.Header{Number: new(big.Int).SetUint64(chain.block)}, nil
+}
+
+func (chain *fakeHubChain) BalanceAt(ctx context.Context, account common.Address, blockNumber *big.Int) (*big.Int, error) {
+	chain.mutex.Lock()
+	defer chain.mutex.Unlock()
+	return new(big.Int).Set(chain.balance), nil
+}
+
+func (chain *fakeHubChain) StorageAt(ctx context.Context, account common.Address, key common.Hash, blockNumber *big.Int) ([]byte, error) {
+	return nil, nil
+}
+
+func (chain *fakeHubChain) NonceAt(ctx context.Context, account common.Address, blockNumber *big.Int) (uint64, error) {
+	chain.mutex.Lock()
+	defer chain.mutex.Unlock()
+	return uint64(len(chain.sent)), nil
+}
+
+func (chain *fakeHubChain) TransactionBlock(ctx context.Context, txHash common.Hash) (blockNumber uint64, blockHash common.Hash, err error) {
+	chain.mutex.Lock()
+	defer chain.mutex.Unlock()
+	blockNumber, ok := chain.mined[txHash]
+	if !ok {
+		return 0, common.Hash{}, ethereum.NotFound
+	}
+	return blockNumber, common.BigToHash(new(big.Int).SetUint64(blockNumber)), nil
+}
+
+func (chain *fakeHubChain) setPending(txHash common.Hash, pending bool) {
+	chain.mutex.Lock()
+	defer chain.mutex.Unlock()
+	chain.pending[txHash] = pending
+}
+
+func (chain *fakeHubChain) setBalance(balance int64) {
+	chain.mutex.Lock()
+	defer chain.mutex.Unlock()
+	chain.balance = big.NewInt(balance)
+}
+
+func assertStep(t *testing.T, relay *RelayServer, expected lifecycle.Phase) {
+	phase, err := relay.Step()
+	if phase != expected || relay.Phase() != expected {
+		t.Errorf("Expected phase %s but got %s (%v)", expected, phase, err)
+	}
+}
+
+func TestLifecycle(t *testing.T) {
+	// The fake chain's nonces must not leak into the nonce cache of the tests on ganache
+	defer atomic.StoreUint64(&lastNonce, atomic.LoadUint64(&lastNonce))
+
+	relayKey, err := crypto.GenerateKey()
+	test.ErrFail(err, t)
+	ownerKey, err := crypto.GenerateKey()
+	test.ErrFail(err, t)
+	owner := crypto.PubkeyToAddress(ownerKey.PublicKey)
+	chain := newFakeHubChain(crypto.PubkeyToAddress(relayKey.PublicKey), owner)
+	clk := fakeclock.NewFakeClock(time.Now())
+	states := lifecycle.NewMemoryStateStore()
+	newRelay := func() *RelayServer {
+		relay, err := NewRelayServer(
+			common.Address{}, big.NewInt(10), "http://localhost:8090", "8090", common.HexToAddress("0x254dffcd3277C0b1660F6d42EFbB754edaBAbC2B"),
+			1e9, big.NewInt(10), relayKey, 10, "", chain, txstore.NewMemoryTxStore(clk), clk, false)
+		test.ErrFail(err, t)
+		relay.State = states
+		relay.MinimumBalance = big.NewInt(1e17)
+		_, err = relay.RestoreState()
+		test.ErrFail(err, t)
+		return relay
+	}
+	relay := newRelay()
+
+	// Waiting for the owner
+	assertStep(t, relay, lifecycle.New)
+	chain.stake = big.NewInt(1e18)
+	assertStep(t, relay, lifecycle.Staked)
+	if relay.OwnerAddress != owner {
+		t.Errorf("Expected owner %v but got %v", owner.Hex(), relay.OwnerAddress.Hex())
+	}
+	chain.setBalance(1e18)
+	relay.UrlScheme = "https"
+	assertStep(t, relay, lifecycle.Funded)
+	if relay.Ready() {
+		t.Error("Expected the relay not to be ready before registering")
+	}
+
+	// Registering
+	relay.UrlScheme = ""
+	assertStep(t, relay, lifecycle.Ready)
+	if !relay.Ready() || len(chain.sent) != 1 {
+		t.Errorf("Expected the relay to be registered and ready, sent %d txs", len(chain.sent))
+	}
+	state, err := states.GetState()
+	test.ErrFail(err, t)
+	if state.Phase != lifecycle.Ready || state.Owner != owner || state.Stake.Cmp(chain.stake) != 0 || state.RegisteredBlock != chain.block {
+		t.Errorf("Wrong persisted state %+v", state)
+	}
+
+	// Back to waiting for funding, and ready again without registering while the registration is fresh
+	chain.setBalance(5e16)
+	assertStep(t, relay, lifecycle.Staked)
+	if relay.Ready() {
+		t.Error("Expected the relay not to be ready while its balance is low")
+	}
+	chain.setBalance(1e18)
+	assertStep(t, relay, lifecycle.Ready)
+	if len(chain.sent) != 1 {
+		t.Errorf("Expected no registration but sent %d txs", len(chain.sent))
+	}
+
+	// A restart does not restore an active phase: the relay is not ready until a Step checks it again
+	relay = newRelay()
+	if relay.Phase() != lifecycle.New || relay.Ready() {
+		t.Errorf("Expected a restarted relay to start from %s but got %s", lifecycle.New, relay.Phase())
+	}
+	assertStep(t, relay, lifecycle.Ready)
+	if len(chain.sent) != 1 {
+		t.Errorf("Expected no registration but sent %d txs", len(chain.sent))
+	}
+
+	// Registering again once due, without leaving Ready
+	chain.block += relay.RegistrationBlockRate
+	assertStep(t, relay, lifecycle.Ready)
+	if len(chain.sent) != 2 {
+		t.Errorf("Expected the relay to register again but sent %d txs", len(chain.sent))
+	}
+
+	if err = relay.moveTo(lifecycle.Withdrawn); err == nil {
+		t.Error("Expected the transition from Ready to Withdrawn to be rejected")
+	}
+
+	// Removal
+	chain.emit("RelayRemoved", big.NewInt(clk.Now().Unix()+3600))
+	assertStep(t, relay, lifecycle.Removed)
+	assertStep(t, relay, lifecycle.Removed)
+	if relay.Ready() {
+		t.Error("Expected a removed relay not to be ready")
+	}
+	if err = relay.moveTo(lifecycle.Ready); err == nil {
+		t.Error("Expected the transition from Removed to Ready to be rejected")
+	}
+
+	// A restart resumes waiting for the unstake
+	relay = newRelay()
+	if relay.Phase() != lifecycle.Removed {
+		t.Errorf("Expected phase %s to be restored but got %s", lifecycle.Removed, relay.Phase())
+	}
+	chain.emit("Unstaked", big.NewInt(1e18))
+	assertStep(t, relay, lifecycle.Unstaked)
+
+	// Withdrawing after the delay, which a restart does not start over
+	assertStep(t, relay, lifecycle.Unstaked)
+	clk.Increment(WithdrawDelay / 2)
+	relay = newRelay()
+	assertStep(t, relay, lifecycle.Unstaked)
+	if len(chain.sent) != 2 {
+		t.Errorf("Expected no withdrawal before the delay but sent %d txs", len(chain.sent))
+	}
+	clk.Increment(WithdrawDelay / 2)
+	assertStep(t, relay, lifecycle.Unstaked)
+	withdrawal := chain.sent[len(chain.sent)-1]
+	if len(chain.sent) != 3 || *withdrawal.To() != owner || withdrawal.Value().Sign() <= 0 {
+		t.Errorf("Expected the balance to be withdrawn to the owner, sent %d txs", len(chain.sent))
+	}
+	state, err = states.GetState()
+	test.ErrFail(err, t)
+	if state.WithdrawalNonce == nil || *state.WithdrawalNonce != withdrawal.Nonce() {
+		t.Errorf("Expected the withdrawal nonce %d to be persisted but got %+v", withdrawal.Nonce(), state)
+	}
+
+	// A restart keeps waiting for the withdrawal sent, instead of sending another one
+	relay = newRelay()
+	if relay.withdrawalNonce == nil || *relay.withdrawalNonce != withdrawal.Nonce() {
+		t.Errorf("Expected the withdrawal nonce %d to be restored", withdrawal.Nonce())
+	}
+	assertStep(t, relay, lifecycle.Withdrawn)
+	if len(chain.sent) != 3 {
+		t.Errorf("Expected no other withdrawal but sent %d txs", len(chain.sent))
+	}
+	assertStep(t, relay, lifecycle.Withdrawn)
+	state, err = states.GetState()
+	test.ErrFail(err, t)
+	if state.Phase != lifecycle.Withdrawn || state.Removed == 0 || state.Unstaked == 0 || state.Withdrawn == 0 {
+		t.Errorf("Wrong persisted state %+v", state)
+	}
+}
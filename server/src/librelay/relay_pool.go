@@ -0,0 +1,226 @@
+package librelay
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// ErrRelayQueueFull is returned when a request arrives while the relay pool's queue is full
+var ErrRelayQueueFull = errors.New("Relay queue is full, try again later")
+
+// ErrRelayPoolStopped is returned when a request arrives after the relay pool was stopped
+var ErrRelayPoolStopped = errors.New("Relay pool is stopped")
+
+// relayJob is a request going through the relay pool. Synchronous requests wait on result, asynchronous ones are
+// tracked by id. A batch goes through as a single job, its items prepared by one worker and sent together.
+type relayJob struct {
+	id       string
+	request  RelayTransactionRequest
+	prepared *preparedRelay
+	batch    *relayBatch
+	result   chan relayJobResult
+}
+
+type relayJobResult struct {
+	signedTx *types.Transaction
+	err      error
+}
+
+// RelayPoolStats are the counters and queue depths of the relay pool, reported on /metrics
+type RelayPoolStats struct {
+	Workers              int
+	QueueCapacity        int
+	ValidationQueueDepth int    // requests waiting for a validation worker
+	SendQueueDepth       int    // validated requests waiting for the sender
+	Accepted             uint64 // requests queued
+	RejectedQueueFull    uint64 // requests refused because the queue was full
+	Relayed              uint64 // requests sent on chain
+	Failed               uint64 // requests that failed validation or sending
+}
+
+// relayPool processes relay requests in two stages: workers run the checks that call the node (canRelay, balances,
+// gas) concurrently, then a single sender signs and sends the prepared transactions one at a time, in order.
+type relayPool struct {
+	validationQueue chan *relayJob
+	sendQueue       chan *relayJob
+	workers         int
+	validate        func(job *relayJob) bool // runs on a worker, returns whether the job goes on to the sender
+	send            func(job *relayJob)
+
+	mutex       *sync.RWMutex
+	stopped     bool
+	workersDone *sync.WaitGroup
+	senderDone  *sync.WaitGroup
+
+	accepted          uint64
+	rejectedQueueFull uint64
+	relayed           uint64
+	failed            uint64
+}
+
+func newRelayPool(workers int, queueSize int, validate func(job *relayJob) bool, send func(job *relayJob)) *relayPool {
+	return &relayPool{
+		validationQueue: make(chan *relayJob, queueSize),
+		sendQueue:       make(chan *relayJob, workers),
+		workers:         workers,
+		validate:        validate,
+		send:            send,
+		mutex:           &sync.RWMutex{},
+		workersDone:     &sync.WaitGroup{},
+		senderDone:      &sync.WaitGroup{},
+	}
+}
+
+func (pool *relayPool) start() {
+	pool.workersDone.Add(pool.workers)
+	for i := 0; i < pool.workers; i++ {
+		go func() {
+			defer pool.workersDone.Done()
+			for job := range pool.validationQueue {
+				if pool.validate(job) {
+					pool.sendQueue <- job
+				}
+			}
+		}()
+	}
+	pool.senderDone.Add(1)
+	go func() {
+		defer pool.senderDone.Done()
+		for job := range pool.sendQueue {
+			pool.send(job)
+		}
+	}()
+}
+
+// stop refuses new jobs and returns once the queued ones are sent or failed
+func (pool *relayPool) stop() {
+	pool.mutex.Lock()
+	if pool.stopped {
+		pool.mutex.Unlock()
+		return
+	}
+	pool.stopped = true
+	close(pool.validationQueue)
+	pool.mutex.Unlock()
+
+	pool.workersDone.Wait()
+	close(pool.sendQueue)
+	pool.senderDone.Wait()
+}
+
+// StartRelayPool starts workers validation workers and the sender. At most queueSize requests wait for a worker, more
+// are refused with ErrRelayQueueFull. Once started, CreateRelayTransaction and CreateRelayTransactions also go through
+// the pool.
+func (relay *RelayServer) StartRelayPool(workers int, queueSize int) {
+	pool := newRelayPool(workers, queueSize, relay.validateJob, relay.sendJob)
+	pool.start()
+	relay.pool = pool
+	log.Printf("Relay pool started with %d workers and a queue of %d\n", workers, queueSize)
+}
+
+// StopRelayPool refuses new requests with ErrRelayPoolStopped and returns once the queued ones are done
+func (relay *RelayServer) StopRelayPool() {
+	if relay.pool == nil {
+		return
+	}
+	relay.pool.stop()
+	log.Println("Relay pool stopped")
+}
+
+func (pool *relayPool) enqueue(job *relayJob) error {
+	pool.mutex.RLock()
+	defer pool.mutex.RUnlock()
+	if pool.stopped {
+		return ErrRelayPoolStopped
+	}
+	select {
+	case pool.validationQueue <- job:
+		atomic.AddUint64(&pool.accepted, 1)
+		return nil
+	default:
+		atomic.AddUint64(&pool.rejectedQueueFull, 1)
+		log.Println(ErrRelayQueueFull)
+		return ErrRelayQueueFull
+	}
+}
+
+func (relay *RelayServer) validateJob(job *relayJob) bool {
+	if job.batch != nil {
+		relay.prepareBatch(job.batch)
+		return true
+	}
+	prepared, err := relay.prepareRelayTransaction(job.request, 0)
+	if err != nil {
+		relay.finishJob(job, nil, err)
+		return false
+	}
+	job.prepared = prepared
+	return true
+}
+
+func (relay *RelayServer) sendJob(job *relayJob) {
+	nonceMutex.Lock()
+	if job.batch != nil {
+		relay.sendBatch(job.batch)
+		nonceMutex.Unlock()
+		relay.finishJob(job, nil, nil)
+		return
+	}
+	signedTx, err := relay.sendRelayTransaction(job.prepared)
+	nonceMutex.Unlock()
+	relay.finishJob(job, signedTx, err)
+}
+
+func (relay *RelayServer) finishJob(job *relayJob, signedTx *types.Transaction, err error) {
+	if job.batch != nil {
+		for _, result := range job.batch.results {
+			if result.Error != nil {
+				atomic.AddUint64(&relay.pool.failed, 1)
+			} else {
+				atomic.AddUint64(&relay.pool.relayed, 1)
+			}
+		}
+	} else if err != nil {
+		atomic.AddUint64(&relay.pool.failed, 1)
+	} else {
+		atomic.AddUint64(&relay.pool.relayed, 1)
+	}
+	if job.id != "" {
+		relay.finishAsyncRelay(job.id, signedTx, err)
+	}
+	if job.result != nil {
+		job.result <- relayJobResult{signedTx, err}
+	}
+}
+
+// relayThroughPool queues a synchronous request and waits for it to be sent
+func (relay *RelayServer) relayThroughPool(request RelayTransactionRequest) (signedTx *types.Transaction, err error) {
+	job := &relayJob{request: request, result: make(chan relayJobResult, 1)}
+	if err = relay.pool.enqueue(job); err != nil {
+		return
+	}
+	result := <-job.result
+	return result.signedTx, result.err
+}
+
+// RelayPoolStats returns the relay pool's counters and current queue depths, or nil if the pool is not started
+func (relay *RelayServer) RelayPoolStats() *RelayPoolStats {
+	pool := relay.pool
+	if pool == nil {
+		return nil
+	}
+	return &RelayPoolStats{
+		Workers:              pool.workers,
+		QueueCapacity:        cap(pool.validationQueue),
+		ValidationQueueDepth: len(pool.validationQueue),
+		SendQueueDepth:       len(pool.sendQueue),
+		Accepted:             atomic.LoadUint64(&pool.accepted),
+		RejectedQueueFull:    atomic.LoadUint64(&pool.rejectedQueueFull),
+		Relayed:              atomic.LoadUint64(&pool.relayed),
+		Failed:               atomic.LoadUint64(&pool.failed),
+	}
+}
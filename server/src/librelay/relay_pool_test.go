@@ -0,0 +1,115 @@
+package librelay
+
+import (
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRelayPoolQueueFull(t *testing.T) {
+	// Not started: queued jobs stay in the queue
+	relayServer := &RelayServer{pool: newRelayPool(1, 2, nil, nil)}
+	for i := 0; i < 2; i++ {
+		if err := relayServer.pool.enqueue(&relayJob{}); err != nil {
+			t.Fatalf("Expected job %d to be queued but got %v", i, err)
+		}
+	}
+	if err := relayServer.pool.enqueue(&relayJob{}); err != ErrRelayQueueFull {
+		t.Errorf("Expected full queue but got %v", err)
+	}
+	// A batch takes a single place in the queue, and is refused as a whole
+	if _, err := relayServer.CreateRelayTransactions(make([]RelayTransactionRequest, 3)); err != ErrRelayQueueFull {
+		t.Errorf("Expected the batch to be refused but got %v", err)
+	}
+
+	stats := relayServer.RelayPoolStats()
+	if stats.Accepted != 2 || stats.RejectedQueueFull != 2 || stats.ValidationQueueDepth != 2 || stats.QueueCapacity != 2 {
+		t.Errorf("Wrong pool stats %+v", stats)
+	}
+	if (&RelayServer{}).RelayPoolStats() != nil {
+		t.Error("Expected no stats without a pool")
+	}
+}
+
+func TestRelayPoolWorkers(t *testing.T) {
+	var validating, maxValidating, sending int32
+	release := make(chan struct{})
+	sent := []string{}
+	pool := newRelayPool(3, 10, func(job *relayJob) bool {
+		count := atomic.AddInt32(&validating, 1)
+		for max := atomic.LoadInt32(&maxValidating); count > max; max = atomic.LoadInt32(&maxValidating) {
+			atomic.CompareAndSwapInt32(&maxValidating, max, count)
+		}
+		<-release
+		atomic.AddInt32(&validating, -1)
+		return job.id != "3"
+	}, func(job *relayJob) {
+		if atomic.AddInt32(&sending, 1) != 1 {
+			t.Error("Expected jobs to be sent one at a time")
+		}
+		sent = append(sent, job.id)
+		atomic.AddInt32(&sending, -1)
+	})
+	pool.start()
+	for i := 0; i < 10; i++ {
+		if err := pool.enqueue(&relayJob{id: strconv.Itoa(i)}); err != nil {
+			t.Fatalf("Expected job %d to be queued but got %v", i, err)
+		}
+	}
+
+	// Every worker picks a job and the others wait in the queue
+	for i := 0; i < 100 && (atomic.LoadInt32(&validating) < 3 || len(pool.validationQueue) > 7); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if count := atomic.LoadInt32(&maxValidating); count != 3 {
+		t.Errorf("Expected 3 jobs validated at once but got %d", count)
+	}
+	if depth := len(pool.validationQueue); depth != 7 {
+		t.Errorf("Expected 7 jobs waiting for a worker but got %d", depth)
+	}
+
+	// Stopping refuses new jobs and waits for the queued ones
+	close(release)
+	pool.stop()
+	if err := pool.enqueue(&relayJob{}); err != ErrRelayPoolStopped {
+		t.Errorf("Expected the stopped pool to refuse jobs but got %v", err)
+	}
+	if count := atomic.LoadInt32(&maxValidating); len(sent) != 9 || count != 3 {
+		t.Errorf("Expected the 9 valid jobs to be sent by 3 workers but got %v (%d workers)", sent, count)
+	}
+	// Stopping again is harmless
+	pool.stop()
+}
+
+func TestRelayPoolSendOrder(t *testing.T) {
+	validated := map[string]chan struct{}{"a": make(chan struct{}), "b": make(chan struct{}), "c": make(chan struct{})}
+	sent := make(chan string, 3)
+	pool := newRelayPool(3, 3, func(job *relayJob) bool {
+		<-validated[job.id]
+		return true
+	}, func(job *relayJob) {
+		sent <- job.id
+	})
+	pool.start()
+	defer pool.stop()
+	for _, id := range []string{"a", "b", "c"} {
+		if err := pool.enqueue(&relayJob{id: id}); err != nil {
+			t.Fatalf("Expected job %s to be queued but got %v", id, err)
+		}
+	}
+
+	// Jobs are sent in the order they pass validation, not the order they arrived in
+	for _, id := range []string{"c", "a", "b"} {
+		close(validated[id])
+		select {
+		case sentId := <-sent:
+			if sentId != id {
+				t.Errorf("Expected job %s to be sent but got %s", id, sentId)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Job %s was not sent", id)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package librelay
+
+import (
+	"fmt"
+	"gen/librelay"
+	"librelay/reputation"
+	"log"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// Reputation is tracked for the recipient and the sender of each relayed call
+var reputationKinds = []string{reputation.KindRecipient, reputation.KindSender}
+
+// checkReputation refuses requests whose recipient or sender is blacklisted
+func (relay *RelayServer) checkReputation(request *RelayTransactionRequest) (err error) {
+	if relay.Reputation == nil {
+		return nil
+	}
+	addresses := []common.Address{request.To, request.From}
+	for i, kind := range reputationKinds {
+		address := addresses[i]
+		until, blacklisted, err := relay.Reputation.BlacklistedUntil(kind, address)
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+		if blacklisted {
+			return fmt.Errorf("Blacklisted %s %s: too many of its relayed calls failed, retry after %s", kind, address.Hex(), until.UTC().Format("2006-01-02 15:04:05 MST"))
+		}
+	}
+	return nil
+}
+
+// relayCallOutcome tells whether a mined relayCall of this relay says anything about its recipient and sender, and if
+// so whether it succeeded, and why not. A TransactionRelayed event with an OK status is a success, one with another
+// status or a CanRelayFailed event a failure. A relayCall reverting or emitting neither failed the relay's own checks
+// (e.g. its registration or gas limit), which does not count against the recipient or sender.
+func (relay *RelayServer) relayCallOutcome(receipt *types.Receipt) (counted bool, ok bool, reason string) {
+	if receipt.Status == types.ReceiptStatusFailed {
+		return false, false, "relayCall reverted"
+	}
+	boundHub := bind.NewBoundContract(relay.RelayHubAddress, relayHubABI, nil, nil, nil)
+	relayTopic := common.BytesToHash(relay.Address().Bytes())
+	for _, vLog := range receipt.Logs {
+		if vLog.Address != relay.RelayHubAddress || len(vLog.Topics) < 2 || vLog.Topics[1] != relayTopic {
+			continue
+		}
+		switch vLog.Topics[0] {
+		case relayHubABI.Events["TransactionRelayed"].Id():
+			event := new(librelay.IRelayHubTransactionRelayed)
+			if err := boundHub.UnpackLog(event, "TransactionRelayed", *vLog); err != nil {
+				log.Println(err)
+				return false, false, err.Error()
+			}
+			if event.Status != RelayCallStatusOK {
+				return true, false, fmt.Sprintf("TransactionRelayed with status %d", event.Status)
+			}
+			return true, true, ""
+		case relayHubABI.Events["CanRelayFailed"].Id():
+			event := new(librelay.IRelayHubCanRelayFailed)
+			if err := boundHub.UnpackLog(event, "CanRelayFailed", *vLog); err != nil {
+				log.Println(err)
+				return false, false, err.Error()
+			}
+			return true, false, fmt.Sprintf("CanRelayFailed with reason %s", event.Reason.String())
+		}
+	}
+	return false, false, "No TransactionRelayed event"
+}
+
+// recordRelayOutcome counts the outcome of a mined relayCall towards the reputation of its recipient and sender
+func (relay *RelayServer) recordRelayOutcome(minedTx *types.Transaction, receipt *types.Receipt) {
+	if relay.Reputation == nil {
+		return
+	}
+	from, to, _, isRelayCall := decodeRelayCall(minedTx)
+	if !isRelayCall {
+		return
+	}
+	counted, ok, reason := relay.relayCallOutcome(receipt)
+	if !counted {
+		log.Println("Relayed tx", minedTx.Hash().Hex(), "not counted towards reputations:", reason)
+		return
+	}
+	addresses := []common.Address{to, from}
+	for i, kind := range reputationKinds {
+		address := addresses[i]
+		if ok {
+			if err := relay.Reputation.RecordSuccess(kind, address); err != nil {
+				log.Println(err)
+			}
+			continue
+		}
+		blacklisted, err := relay.Reputation.RecordFailure(kind, address, reason)
+		if err != nil {
+			log.Println(err)
+		} else if blacklisted {
+			log.Println("Blacklisted", kind, address.Hex(), "for", relay.Reputation.Cooldown, "after relayed tx", minedTx.Hash().Hex(), "failed:", reason)
+		}
+	}
+}
+
+// ReputationTracker returns the tracker of recipients' and senders' reputation, or nil if it is disabled
+func (relay *RelayServer) ReputationTracker() *reputation.Tracker {
+	return relay.Reputation
+}
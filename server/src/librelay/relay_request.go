@@ -0,0 +1,202 @@
+package librelay
+
+import (
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/clock"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// EIP-712 type hashes, as defined in EIP712Sig.sol
+var (
+	eip712DomainTypeHash = crypto.Keccak256Hash([]byte("EIP712Domain(string name,string version,address verifyingContract)"))
+	relayRequestTypeHash = crypto.Keccak256Hash([]byte("RelayRequest(CallData callData,RelayData relayData)CallData(address target,uint256 gasLimit,uint256 gasPrice,bytes encodedFunction)RelayData(address senderAccount,uint256 senderNonce,address relayAddress,uint256 pctRelayFee)"))
+	callDataTypeHash     = crypto.Keccak256Hash([]byte("CallData(address target,uint256 gasLimit,uint256 gasPrice,bytes encodedFunction)"))
+	relayDataTypeHash    = crypto.Keccak256Hash([]byte("RelayData(address senderAccount,uint256 senderNonce,address relayAddress,uint256 pctRelayFee)"))
+)
+
+const eip712DomainName = "GSN Relayed Transaction"
+const eip712DomainVersion = "1"
+
+// secp256k1 half order: signatures with a higher s value are rejected by OpenZeppelin's ECDSA.recover
+var secp256k1HalfN, _ = new(big.Int).SetString("7fffffffffffffffffffffffffffffff5d576e7357a4501ddfe92f46681b20a0", 16)
+
+func abiAddress(address common.Address) []byte {
+	return common.LeftPadBytes(address.Bytes(), 32)
+}
+
+func abiUint256(value *big.Int) []byte {
+	return common.LeftPadBytes(value.Bytes(), 32)
+}
+
+func isUint256(value *big.Int) bool {
+	return value.Sign() >= 0 && value.BitLen() <= 256
+}
+
+// RelayHubDomainSeparator returns the EIP-712 domain separator the hub at hubAddress verifies signatures with
+func RelayHubDomainSeparator(hubAddress common.Address) common.Hash {
+	return crypto.Keccak256Hash(
+		eip712DomainTypeHash.Bytes(),
+		crypto.Keccak256([]byte(eip712DomainName)),
+		crypto.Keccak256([]byte(eip712DomainVersion)),
+		abiAddress(hubAddress),
+	)
+}
+
+// StructHash returns the EIP-712 hash of the RelayRequest struct signed by the sender for the given relay
+func (request *RelayTransactionRequest) StructHash(relayAddress common.Address) common.Hash {
+	callDataHash := crypto.Keccak256(
+		callDataTypeHash.Bytes(),
+		abiAddress(request.To),
+		abiUint256(&request.GasLimit),
+		abiUint256(&request.GasPrice),
+		crypto.Keccak256(common.FromHex(request.EncodedFunction)),
+	)
+	relayDataHash := crypto.Keccak256(
+		relayDataTypeHash.Bytes(),
+		abiAddress(request.From),
+		abiUint256(&request.RecipientNonce),
+		abiAddress(relayAddress),
+		abiUint256(&request.RelayFee),
+	)
+	return crypto.Keccak256Hash(relayRequestTypeHash.Bytes(), callDataHash, relayDataHash)
+}
+
+// Hash returns the EIP-712 digest the hub recovers the sender from in canRelay, i.e. EIP712Sig.verify
+func (request *RelayTransactionRequest) Hash(relayAddress common.Address) common.Hash {
+	return eip712Digest(RelayHubDomainSeparator(request.RelayHubAddress), request.StructHash(relayAddress))
+}
+
+func eip712Digest(domainSeparator common.Hash, structHash common.Hash) common.Hash {
+	return crypto.Keccak256Hash([]byte{0x19, 0x01}, domainSeparator.Bytes(), structHash.Bytes())
+}
+
+// recoverSigner returns the address that produced signature over hash, applying the same rules as ECDSA.recover
+func recoverSigner(hash common.Hash, signature []byte) (signer common.Address, err error) {
+	if len(signature) != 65 {
+		return signer, fmt.Errorf("Invalid signature length %d", len(signature))
+	}
+	// ECDSA.recover only accepts v as 27 or 28, not the recovery id itself
+	if signature[64] != 27 && signature[64] != 28 {
+		return signer, fmt.Errorf("Invalid signature recovery id %d", signature[64])
+	}
+	sig := make([]byte, 65)
+	copy(sig, signature)
+	sig[64] -= 27
+	if new(big.Int).SetBytes(sig[32:64]).Cmp(secp256k1HalfN) > 0 {
+		return signer, fmt.Errorf("Invalid signature: malleable s value")
+	}
+	pubKey, err := crypto.SigToPub(hash.Bytes(), sig)
+	if err != nil {
+		return
+	}
+	return crypto.PubkeyToAddress(*pubKey), nil
+}
+
+// RecoverSigner returns the address that signed the request for the given relay
+func (request *RelayTransactionRequest) RecoverSigner(relayAddress common.Address) (signer common.Address, err error) {
+	return recoverSigner(request.Hash(relayAddress), request.Signature)
+}
+
+// validateRequestSignature checks, without calling the node, that the request is well formed and signed by From
+func (relay *RelayServer) validateRequestSignature(request *RelayTransactionRequest) (err error) {
+	names := []string{"GasPrice", "GasLimit", "RecipientNonce", "RelayFee"}
+	for i, value := range []*big.Int{&request.GasPrice, &request.GasLimit, &request.RecipientNonce, &request.RelayFee} {
+		if !isUint256(value) {
+			return fmt.Errorf("Invalid %s: %s", names[i], value.String())
+		}
+	}
+	if len(common.FromHex(request.EncodedFunction)) < 4 {
+		return fmt.Errorf("Invalid EncodedFunction: %s", request.EncodedFunction)
+	}
+	signer, err := request.RecoverSigner(relay.Address())
+	if err != nil {
+		return fmt.Errorf("Invalid signature: %v", err)
+	}
+	if signer != request.From {
+		return fmt.Errorf("Wrong signature: signed by %s, request from %s", signer.Hex(), request.From.Hex())
+	}
+	return nil
+}
+
+const nonceCacheTTL = 10 * time.Minute
+
+type nonceCacheEntry struct {
+	nonce   *big.Int
+	fetched time.Time
+}
+
+// nonceCache remembers the hub's getNonce for recent senders. Nonces only grow, so a request below the cached nonce
+// is rejected without calling the node; anything else refreshes the cached value before being compared.
+type nonceCache struct {
+	entries map[common.Address]nonceCacheEntry
+	mutex   *sync.Mutex
+	clock   clock.Clock
+}
+
+func newNonceCache(clk clock.Clock) *nonceCache {
+	return &nonceCache{
+		entries: make(map[common.Address]nonceCacheEntry),
+		mutex:   &sync.Mutex{},
+		clock:   clk,
+	}
+}
+
+func (cache *nonceCache) get(from common.Address) *big.Int {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	entry, ok := cache.entries[from]
+	if !ok || cache.clock.Since(entry.fetched) > nonceCacheTTL {
+		delete(cache.entries, from)
+		return nil
+	}
+	return entry.nonce
+}
+
+func (cache *nonceCache) set(from common.Address, nonce *big.Int) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	now := cache.clock.Now()
+	for address, entry := range cache.entries {
+		if now.Sub(entry.fetched) > nonceCacheTTL {
+			delete(cache.entries, address)
+		}
+	}
+	cache.entries[from] = nonceCacheEntry{nonce, now}
+}
+
+// validateRecipientNonce checks the request's nonce against the hub's getNonce for the sender. previous is the number
+// of requests from the same sender that will be sent before this one, as in a batch, so the expected nonce is that
+// many past getNonce.
+func (relay *RelayServer) validateRecipientNonce(request *RelayTransactionRequest, previous int64) (err error) {
+	cached := relay.nonces.get(request.From)
+	if cached != nil {
+		expected := new(big.Int).Add(cached, big.NewInt(previous))
+		if request.RecipientNonce.Cmp(expected) < 0 {
+			return fmt.Errorf("Wrong nonce: %s already used by %s (next is %s)", request.RecipientNonce.String(), request.From.Hex(), expected.String())
+		}
+		if request.RecipientNonce.Cmp(expected) == 0 {
+			return nil
+		}
+	}
+	callOpt := &bind.CallOpts{
+		From:    relay.Address(),
+		Pending: false,
+	}
+	nonce, err := relay.rhub.GetNonce(callOpt, request.From)
+	if err != nil {
+		return
+	}
+	relay.nonces.set(request.From, nonce)
+	expected := new(big.Int).Add(nonce, big.NewInt(previous))
+	if request.RecipientNonce.Cmp(expected) != 0 {
+		return fmt.Errorf("Wrong nonce: %s for %s, expected %s", request.RecipientNonce.String(), request.From.Hex(), expected.String())
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package librelay
+
+import (
+	"crypto/ecdsa"
+	"math/big"
+	"strings"
+	"testing"
+
+	"librelay/test"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// newSignedRelayTransactionRequest builds a request signed in go, without touching the relay's gas price
+func newSignedRelayTransactionRequest(t *testing.T, recipientNonce int64) (request RelayTransactionRequest) {
+	request = RelayTransactionRequest{
+		EncodedFunction: "0x2ac0df260000000000000000000000000000000000000000000000000000000000000020000000000000000000000000000000000000000000000000000000000000000b68656c6c6f20776f726c64000000000000000000000000000000000000000000",
+		From:            crypto.PubkeyToAddress(gaslessKey2.PublicKey),
+		To:              sampleRecipient,
+		GasPrice:        *big.NewInt(2000),
+		GasLimit:        *big.NewInt(1000000),
+		RecipientNonce:  *big.NewInt(recipientNonce),
+		RelayMaxNonce:   *big.NewInt(1000000),
+		RelayFee:        *big.NewInt(10),
+		RelayHubAddress: rhaddr,
+	}
+	signRelayRequest(t, &request)
+	return
+}
+
+func signRelayRequest(t *testing.T, request *RelayTransactionRequest) {
+	signRelayRequestWithKey(t, request, gaslessKey2)
+}
+
+func signRelayRequestWithKey(t *testing.T, request *RelayTransactionRequest, key *ecdsa.PrivateKey) {
+	request.From = crypto.PubkeyToAddress(key.PublicKey)
+	signature, err := crypto.Sign(request.Hash(relay.Address()).Bytes(), key)
+	test.ErrFail(err, t)
+	signature[64] += 27
+	request.Signature = signature
+}
+
+func TestRecoverSigner(t *testing.T) {
+	// Signature generated by the js client (see printSignature) for the hub deployed in TestMain
+	request := newSignedRelayTransactionRequest(t, 0)
+	request.Signature = common.FromHex("0xd735f61c4364b4543fe627529959558ea14f7d50940347c2073db1ef1d18691958be8c4da835d65bb84e74eff73c428085dc1b3fce14b34fb024e27c4e6921391c")
+	signer, err := request.RecoverSigner(relay.Address())
+	test.ErrFail(err, t)
+	if signer != request.From {
+		t.Errorf("Recovered signer %s but request is from %s", signer.Hex(), request.From.Hex())
+	}
+
+	request.RelayFee = *big.NewInt(11)
+	signer, err = request.RecoverSigner(relay.Address())
+	if err == nil && signer == request.From {
+		t.Error("Signature should not match a request with a different fee")
+	}
+}
+
+func TestValidateRequestSignature(t *testing.T) {
+	request := newSignedRelayTransactionRequest(t, 100)
+	test.ErrFailWithDesc(relay.validateRequestSignature(&request), t, "Validating request signed in go")
+
+	// Signed for another relay
+	signature, err := crypto.Sign(request.Hash(common.HexToAddress("0x1")).Bytes(), gaslessKey2)
+	test.ErrFail(err, t)
+	signature[64] += 27
+	request.Signature = signature
+	if relay.validateRequestSignature(&request) == nil {
+		t.Error("Expected request signed for another relay to be rejected")
+	}
+
+	// Signed right, with v as the recovery id the hub rejects
+	signRelayRequest(t, &request)
+	request.Signature[64] -= 27
+	if err = relay.validateRequestSignature(&request); err == nil || !strings.Contains(err.Error(), "recovery id") {
+		t.Error("Expected request with v of 0 or 1 to be rejected but got", err)
+	}
+
+	// Garbage signature
+	request.Signature = []byte{1, 2, 3}
+	if relay.validateRequestSignature(&request) == nil {
+		t.Error("Expected request with short signature to be rejected")
+	}
+
+	// Negative values cannot be abi encoded
+	signRelayRequest(t, &request)
+	request.GasLimit = *big.NewInt(-1)
+	if relay.validateRequestSignature(&request) == nil {
+		t.Error("Expected request with negative gas limit to be rejected")
+	}
+}
+
+func TestValidateRecipientNonce(t *testing.T) {
+	request := newSignedRelayTransactionRequest(t, 0)
+	nonce, err := rhub.GetNonce(nil, request.From)
+	test.ErrFail(err, t)
+
+	request.RecipientNonce = *nonce
+	test.ErrFailWithDesc(relay.validateRecipientNonce(&request, 0), t, "Validating current nonce")
+
+	request.RecipientNonce = *big.NewInt(0).Add(nonce, big.NewInt(1))
+	if relay.validateRecipientNonce(&request, 0) == nil {
+		t.Error("Expected future nonce to be rejected")
+	}
+	test.ErrFailWithDesc(relay.validateRecipientNonce(&request, 1), t, "Validating nonce after one earlier request")
+	if relay.validateRecipientNonce(&request, 2) == nil {
+		t.Error("Expected nonce used by an earlier request to be rejected")
+	}
+
+	if nonce.Sign() > 0 {
+		request.RecipientNonce = *big.NewInt(0).Sub(nonce, big.NewInt(1))
+		if relay.validateRecipientNonce(&request, 0) == nil {
+			t.Error("Expected used nonce to be rejected")
+		}
+	}
+}
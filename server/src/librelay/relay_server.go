@@ -7,11 +7,18 @@ import (
 	"encoding/json"
 	"fmt"
 	"gen/librelay"
+	"librelay/hubindex"
+	"librelay/incident"
+	"librelay/lifecycle"
+	"librelay/notify"
+	"librelay/reputation"
 	"librelay/txstore"
 	"log"
 	"math/big"
+	"net/url"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 	"strconv"
 
@@ -26,10 +33,12 @@ import (
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/rpc"
 )
 
 const TxReceiptTimeout = 60 * time.Second
 
+// lastNonce is the nonce of the relay's next transaction. It is written under nonceMutex, and read atomically.
 var lastNonce uint64 = 0
 var nonceMutex = &sync.Mutex{}
 
@@ -46,6 +55,9 @@ type RelayTransactionRequest struct {
 	RelayMaxNonce   big.Int
 	RelayFee        big.Int
 	RelayHubAddress common.Address
+	// Optional EIP-712 typed data signed by the client. When present, it replaces the fields above (except
+	// ApprovalData, Signature and RelayMaxNonce) once validated.
+	TypedData *RelayTypedData `json:",omitempty"`
 }
 
 type SetHubRequest struct {
@@ -60,6 +72,7 @@ type GetEthAddrResponse struct {
 	RelayServerAddress common.Address
 	MinGasPrice        big.Int
 	Ready              bool
+	Phase              lifecycle.Phase
 	Version            string
 }
 
@@ -101,6 +114,48 @@ type IRelay interface {
 
 	CreateRelayTransaction(request RelayTransactionRequest) (signedTx *types.Transaction, err error)
 
+	CreateRelayTransactions(requests []RelayTransactionRequest) (results []RelayTransactionResult, err error)
+
+	SubmitRelayTransaction(request RelayTransactionRequest) (requestId string, err error)
+
+	RelayTransactionStatus(requestId string) (status *RelayRequestStatus, err error)
+
+	RelayPoolStats() *RelayPoolStats
+
+	GetRelayedTransactionByHash(hash common.Hash) (info *RelayedTransactionInfo, err error)
+
+	GetRelayedTransactionBySender(from common.Address, nonce *big.Int) (info *RelayedTransactionInfo, err error)
+
+	ReputationTracker() *reputation.Tracker
+
+	WatchPenalization() (incidents []*incident.Incident, err error)
+
+	SubscribePenalization() (sub ethereum.Subscription, err error)
+
+	ListIncidents() (incidents []*incident.Incident, err error)
+
+	ResolveIncident(id string) (err error)
+
+	Halted() (halted bool, reason string)
+
+	CheckAlerts() (alerts []*notify.Alert)
+
+	RefillBalance() (txHash common.Hash, err error)
+
+	SweepExcessBalance() (record *SweepRecord, err error)
+
+	LifecycleState() (state *lifecycle.State, err error)
+
+	Step() (phase lifecycle.Phase, err error)
+
+	Phase() lifecycle.Phase
+
+	Ready() bool
+
+	RecordWithdrawn() (err error)
+
+	Withdraw(to common.Address, amount *big.Int, approval *WithdrawalApproval) (tx *types.Transaction, err error)
+
 	Address() (relayAddress common.Address)
 
 	HubAddress() common.Address
@@ -111,6 +166,8 @@ type IRelay interface {
 
 	UpdateUnconfirmedTransactions() (newTx *types.Transaction, err error)
 
+	StopRelayPool()
+
 	Close() (err error)
 
 	sendRegisterTransaction() (tx *types.Transaction, err error)
@@ -120,6 +177,7 @@ type IRelay interface {
 
 type IClient interface {
 	bind.ContractBackend
+	bind.PendingContractCaller
 	ethereum.TransactionReader
 
 	NetworkID(ctx context.Context) (*big.Int, error)
@@ -132,12 +190,30 @@ type IClient interface {
 	BalanceAt(ctx context.Context, account common.Address, blockNumber *big.Int) (*big.Int, error)
 	StorageAt(ctx context.Context, account common.Address, key common.Hash, blockNumber *big.Int) ([]byte, error)
 	NonceAt(ctx context.Context, account common.Address, blockNumber *big.Int) (uint64, error)
+
+	// TransactionBlock returns the number and hash of the block the tx was mined in, or ethereum.NotFound
+	TransactionBlock(ctx context.Context, txHash common.Hash) (blockNumber uint64, blockHash common.Hash, err error)
 }
 
 type RelayServer struct {
 	OwnerAddress          common.Address
 	Fee                   *big.Int
 	Url                   string
+	UrlScheme             string                  // scheme actually served to clients, checked against Url before registering
+	SimulateRelayCall     bool                    // simulate each relayCall against the pending block before sending it
+	EnforceSimulation     bool                    // also reject requests whose simulated relayCall reverts or needs more gas than sent
+	MinProfit             *big.Int                // minimum expected profit of a relayed tx in wei, if set
+	MinProfitPercent      *big.Int                // minimum expected profit of a relayed tx as a percentage of its gas cost, if set
+	Reputation            *reputation.Tracker     // blacklists recipients and senders whose relayed calls fail, if set
+	HubIndex              *hubindex.Indexer       // answers queries about the hub's events locally, if set
+	Confirmations         uint64                  // blocks mined on top of a tx before it is final, 0 for the chain's default
+	Incidents             incident.IIncidentStore // penalizations and removals of the relay, watched if set
+	Notifier              notify.Notifier         // alerts the operator, alerts are only logged if not set
+	AlertRules            AlertRules              // conditions CheckAlerts raises alerts for
+	RefillRules           RefillRules             // tops up the relay's balance, if a funder is set
+	SweepRules            SweepRules              // sends the balance above a working balance to the owner, if set
+	State                 lifecycle.IStateStore   // persists the relay's lifecycle across restarts, if set
+	MinimumBalance        *big.Int                // the relay waits for funding at or below this balance, if set
 	Port                  string
 	RelayHubAddress       common.Address
 	DefaultGasPrice       int64
@@ -145,18 +221,47 @@ type RelayServer struct {
 	PrivateKey            *ecdsa.PrivateKey
 	RegistrationBlockRate uint64
 	EthereumNodeURL       string
-	gasPrice              *big.Int // set dynamically as suggestedGasPrice*(GasPricePercent+100)/100
+	gasPrice              atomic.Value // *big.Int, set dynamically as suggestedGasPrice*(GasPricePercent+100)/100
 	Client                IClient
 	chainID               *big.Int
 	TxStore               txstore.ITxStore
 	rhub                  *librelay.IRelayHub
 	clock                 clock.Clock
+	nonces                *nonceCache
+	replays               *replayCache
+	profits               *profitTracker
+	pool                  *relayPool
+	haltReason            atomic.Value // string, set while the relay must not sign
+	refill                *refillState
+	penalization          *penalizationWatch
+	stateMutex            *sync.Mutex
+	phase                 atomic.Value // lifecycle.Phase
+	phaseSince            time.Time
+	withdrawalNonce       *uint64 // the withdrawal sent after unstaking, once sent
+	lifecycleMutex        *sync.Mutex
 	DevMode               bool
 }
 
 type RelayParams struct {
 	RelayServer
-	DBFile string
+	DBFile             string
+	ReputationDBFile   string
+	ReputationSettings reputation.Settings
+	HubIndexDBFile     string
+	HubIndexStartBlock uint64
+	IncidentDBFile     string
+	AlertSettings      notify.Settings
+	AlertRules         AlertRules
+	RefillBelow        *big.Int
+	RefillAmount       *big.Int
+	RefillHookUrl      string // treasury service funding the relay
+	RefillKeyFile      string // hex private key of a hot wallet funding the relay
+	RefillTimeout      time.Duration
+	SweepKeepBalance   *big.Int // high-water mark of the periodic sweep, disabled if nil
+	SweepInterval      time.Duration
+	SweepDryRun        bool
+	SweepAuditFile     string
+	StateDBFile        string
 }
 
 func (relayParams *RelayParams) Dump() {
@@ -165,22 +270,43 @@ func (relayParams *RelayParams) Dump() {
 	log.Println("OwnerAddress:", relayParams.OwnerAddress.String())
 	log.Println("Fee:", relayParams.Fee.String())
 	log.Println("Url:", relayParams.Url)
+	if relayParams.UrlScheme != "" {
+		log.Println("Serving:", relayParams.UrlScheme)
+	}
 	log.Println("Port:", relayParams.Port)
 	log.Println("RelayHubAddress:", relayParams.RelayHubAddress.String())
 	log.Println("DefaultGasPrice:", relayParams.DefaultGasPrice)
 	log.Println("GasPricePercent:", relayParams.GasPricePercent.String())
 	log.Println("RegistrationBlockRate:", relayParams.RegistrationBlockRate)
 	log.Println("EthereumNodeUrl:", relayParams.EthereumNodeURL)
+	if relayParams.SimulateRelayCall {
+		log.Println("SimulateRelayCall:", relayParams.SimulateRelayCall, "EnforceSimulation:", relayParams.EnforceSimulation)
+	}
+	if relayParams.MinProfit != nil || relayParams.MinProfitPercent != nil {
+		log.Println("MinProfit:", relayParams.MinProfit, "MinProfitPercent:", relayParams.MinProfitPercent)
+	}
+	log.Printf("Reputation: %+v\n", relayParams.ReputationSettings)
+	if relayParams.Confirmations != 0 {
+		log.Println("Confirmations:", relayParams.Confirmations)
+	}
+	log.Println("MinimumBalance:", relayParams.MinimumBalance)
+	if relayParams.RefillHookUrl != "" || relayParams.RefillKeyFile != "" {
+		log.Println("RefillBelow:", relayParams.RefillBelow, "RefillAmount:", relayParams.RefillAmount)
+	}
+	if relayParams.SweepKeepBalance != nil {
+		log.Println("SweepKeepBalance:", relayParams.SweepKeepBalance, "SweepInterval:", relayParams.SweepInterval, "SweepDryRun:", relayParams.SweepDryRun)
+	}
 	if relayParams.DevMode {
 		log.Println("Using dev mode")
 	}
 }
 
 func NewEthClient(EthereumNodeURL string, defaultGasPrice int64) (IClient, error) {
-	client := &TbkClient{DefaultGasPrice: defaultGasPrice}
-	var err error
-	client.Client, err = ethclient.Dial(EthereumNodeURL)
-	return client, err
+	rpcClient, err := rpc.Dial(EthereumNodeURL)
+	if err != nil {
+		return nil, err
+	}
+	return &TbkClient{Client: ethclient.NewClient(rpcClient), DefaultGasPrice: defaultGasPrice, rpc: rpcClient}, nil
 }
 
 func NewRelayServer(
@@ -223,6 +349,13 @@ func NewRelayServer(
 		TxStore:               TxStore,
 		rhub:                  rhub,
 		clock:                 clk,
+		nonces:                newNonceCache(clk),
+		replays:               newReplayCache(clk),
+		profits:               newProfitTracker(clk),
+		refill:                &refillState{},
+		penalization:          &penalizationWatch{},
+		stateMutex:            &sync.Mutex{},
+		lifecycleMutex:        &sync.Mutex{},
 		DevMode:               DevMode,
 	}
 	return relay, err
@@ -253,10 +386,18 @@ func (relay *RelayServer) Balance() (balance *big.Int, err error) {
 }
 
 func (relay *RelayServer) GasPrice() big.Int {
-	if relay.gasPrice == nil {
+	gasPrice := relay.currentGasPrice()
+	if gasPrice == nil {
 		return *big.NewInt(0)
 	}
-	return *relay.gasPrice
+	return *gasPrice
+}
+
+// currentGasPrice returns the gas price last refreshed, or nil before the first refresh. It is read by the pool's
+// workers while the lifecycle job refreshes it, and is never modified once stored.
+func (relay *RelayServer) currentGasPrice() *big.Int {
+	gasPrice, _ := relay.gasPrice.Load().(*big.Int)
+	return gasPrice
 }
 
 func (relay *RelayServer) RefreshGasPrice() (err error) {
@@ -265,7 +406,7 @@ func (relay *RelayServer) RefreshGasPrice() (err error) {
 		log.Println("SuggestGasPrice() failed ", err)
 		return
 	}
-	relay.gasPrice = gasPrice.Mul(big.NewInt(0).Add(relay.GasPricePercent, big.NewInt(100)), gasPrice).Div(gasPrice, big.NewInt(100))
+	relay.gasPrice.Store(gasPrice.Mul(big.NewInt(0).Add(relay.GasPricePercent, big.NewInt(100)), gasPrice).Div(gasPrice, big.NewInt(100)))
 	return
 }
 
@@ -274,10 +415,19 @@ func (relay *RelayServer) RegisterRelay() (err error) {
 	if err != nil {
 		return err
 	}
-	return relay.awaitTransactionMined(tx)
+	if err = relay.awaitTransactionMined(tx); err != nil {
+		return
+	}
+	relay.recordRegistration(context.Background(), tx.Hash())
+	return
 }
 
 func (relay *RelayServer) sendRegisterTransaction() (tx *types.Transaction, err error) {
+	err = relay.checkUrlScheme()
+	if err != nil {
+		log.Println(err)
+		return
+	}
 	desc := fmt.Sprintf("RegisterRelay(address=%s, url=%s)", relay.RelayHubAddress.Hex(), relay.Url)
 	tx, err = relay.sendDataTransaction(desc, func(auth *bind.TransactOpts) (*types.Transaction, error) {
 		return relay.rhub.RegisterRelay(auth, relay.Fee, relay.Url)
@@ -285,6 +435,21 @@ func (relay *RelayServer) sendRegisterTransaction() (tx *types.Transaction, err
 	return
 }
 
+// checkUrlScheme refuses to advertise a url clients cannot reach, e.g. https while we only serve plain http
+func (relay *RelayServer) checkUrlScheme() (err error) {
+	if relay.UrlScheme == "" {
+		return
+	}
+	u, err := url.Parse(relay.Url)
+	if err != nil {
+		return fmt.Errorf("Cannot parse relay url %s: %v", relay.Url, err)
+	}
+	if u.Scheme != relay.UrlScheme {
+		return fmt.Errorf("Refusing to register url %s: relay serves %s", relay.Url, relay.UrlScheme)
+	}
+	return
+}
+
 func (relay *RelayServer) RemoveRelay(ownerKey *ecdsa.PrivateKey) (err error) {
 	tx, err := relay.sendRemoveTransaction(ownerKey)
 	if err != nil {
@@ -327,10 +492,24 @@ func (relay *RelayServer) IsStaked() (staked bool, err error) {
 		log.Println("Owner is", relay.OwnerAddress.Hex())
 		log.Println("Stake:", stakeEntry.TotalStake.String())
 	}
+	if staked {
+		relay.recordStake(stakeEntry.Owner, stakeEntry.TotalStake, stakeEntry.UnstakeDelay)
+	}
 	return
 }
 
-func (relay *RelayServer) IsUnstaked() (removed bool, err error) {
+func (relay *RelayServer) IsUnstaked() (unstaked bool, err error) {
+	unstaked, err = relay.findUnstaked()
+	if unstaked {
+		relay.recordUnstaked()
+	}
+	return
+}
+
+func (relay *RelayServer) findUnstaked() (removed bool, err error) {
+	if relay.HubIndex != nil {
+		return relay.hasIndexedEvent("Unstaked")
+	}
 	filterOpts := &bind.FilterOpts{
 		Start: 0,
 		End:   nil,
@@ -347,6 +526,9 @@ func (relay *RelayServer) IsUnstaked() (removed bool, err error) {
 }
 
 func (relay *RelayServer) BlockCountSinceRegistration() (count uint64, err error) {
+	if relay.HubIndex != nil {
+		return relay.indexedBlockCountSinceRegistration()
+	}
 	lastBlockHeader, err := relay.Client.HeaderByNumber(context.Background(), nil)
 	if err != nil {
 		log.Println(err)
@@ -384,6 +566,17 @@ func (relay *RelayServer) GetRegistrationBlockRate() (uint64) {
 }
 
 func (relay *RelayServer) IsRemoved() (removed bool, err error) {
+	removed, err = relay.findRemoved()
+	if removed {
+		relay.recordRemoved()
+	}
+	return
+}
+
+func (relay *RelayServer) findRemoved() (removed bool, err error) {
+	if relay.HubIndex != nil {
+		return relay.hasIndexedEvent("RelayRemoved")
+	}
 	filterOpts := &bind.FilterOpts{
 		Start: 0,
 		End:   nil,
@@ -399,41 +592,22 @@ func (relay *RelayServer) IsRemoved() (removed bool, err error) {
 	return true, nil
 }
 
-func (relay *RelayServer) SendBalanceToOwner() (err error) {
-	balance, err := relay.Client.BalanceAt(context.Background(), relay.Address(), nil)
-	if err != nil {
-		log.Println(err)
-		return
-	}
-	if balance.Cmp(big.NewInt(0)) == 0 {
-		log.Println("SendBalanceToOwner: balance is 0")
-		return
-	}
-	log.Println("Sending", balance, "wei to owner address", relay.OwnerAddress.Hex())
-
-	var data []byte
-	gasLimit := uint64(21000) // in units
-	gasPrice, err := relay.Client.SuggestGasPrice(context.Background())
-	if err != nil {
+// ValidateRelayTransaction runs the checks that need no call to the ethereum node: halting, hub, fee, gas price, max
+// nonce, signature and blacklisting. Typed-data requests are resolved into the legacy fields.
+func (relay *RelayServer) ValidateRelayTransaction(request *RelayTransactionRequest) (err error) {
+	if err = relay.checkNotHalted(); err != nil {
 		log.Println(err)
 		return
 	}
-	cost := big.NewInt(int64(gasPrice.Uint64() * gasLimit))
-	value := big.NewInt(0)
-	value.Sub(balance, cost)
-
-	tx, err := relay.sendPlainTransaction(
-		fmt.Sprintf("SendBalanceToOwner(to=%s)", relay.OwnerAddress.Hex()),
-		relay.OwnerAddress, value, gasLimit, gasPrice, data,
-	)
 
-	if err != nil {
-		return
+	if request.TypedData != nil {
+		err = relay.resolveTypedData(request)
+		if err != nil {
+			log.Println(err)
+			return
+		}
 	}
-	return relay.awaitTransactionMined(tx)
-}
 
-func (relay *RelayServer) CreateRelayTransaction(request RelayTransactionRequest) (signedTx *types.Transaction, err error) {
 	// Check that the relayhub is the correct one
 	if bytes.Compare(relay.RelayHubAddress.Bytes(), request.RelayHubAddress.Bytes()) != 0 {
 		err = fmt.Errorf("Wrong hub address.\nRelay server's hub address: %s, request's hub address: %s\n", relay.RelayHubAddress.Hex(), request.RelayHubAddress.Hex())
@@ -449,18 +623,84 @@ func (relay *RelayServer) CreateRelayTransaction(request RelayTransactionRequest
 	}
 
 	// Check that the gasPrice is initialized & acceptable
-	if relay.gasPrice == nil || relay.gasPrice.Cmp(&request.GasPrice) > 0 {
+	if gasPrice := relay.currentGasPrice(); gasPrice == nil || gasPrice.Cmp(&request.GasPrice) > 0 {
 		err = fmt.Errorf("Unacceptable gasPrice")
 		log.Println(err)
 		return
 	}
 
-	if request.RelayMaxNonce.Cmp(big.NewInt(int64(lastNonce))) < 0 {
+	// Early rejection only: the nonce actually assigned is checked again when sending
+	if request.RelayMaxNonce.Cmp(new(big.Int).SetUint64(atomic.LoadUint64(&lastNonce))) < 0 {
 		err = fmt.Errorf("Unacceptable RelayMaxNonce")
 		log.Println(err, request.RelayMaxNonce)
 		return
 	}
 
+	// Reject requests not signed by the sender before spending any calls to the node on them
+	err = relay.validateRequestSignature(request)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	err = relay.checkReputation(request)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	return
+}
+
+// preparedRelay is a relay request that passed every check and is ready to be signed and sent
+type preparedRelay struct {
+	request     RelayTransactionRequest
+	requiredGas *big.Int
+	profit      *ProfitEstimate
+	duplicateOf *types.Transaction // set if an identical request was already relayed
+	// set for a request following others from the same sender, as in a batch: canRelay can only pass once those are
+	// sent, so it runs again against the pending block right before sending
+	recheck bool
+}
+
+// CreateRelayTransaction relays the request and returns the signed transaction. Once the relay pool is started, the
+// request waits its turn there and ErrRelayQueueFull is returned if the queue is full.
+func (relay *RelayServer) CreateRelayTransaction(request RelayTransactionRequest) (signedTx *types.Transaction, err error) {
+	if relay.pool != nil {
+		return relay.relayThroughPool(request)
+	}
+	prepared, err := relay.prepareRelayTransaction(request, 0)
+	if err != nil {
+		return
+	}
+	nonceMutex.Lock()
+	defer nonceMutex.Unlock()
+	return relay.sendRelayTransaction(prepared)
+}
+
+// prepareRelayTransaction runs every check on the request, including the canRelay view call, and computes the gas
+// limit of the relayed transaction. previous is the number of requests from the same sender that will be sent before
+// this one; if any, canRelay may only fail on the nonce, and the request is marked to be checked again before sending.
+func (relay *RelayServer) prepareRelayTransaction(request RelayTransactionRequest, previous int64) (prepared *preparedRelay, err error) {
+	err = relay.ValidateRelayTransaction(&request)
+	if err != nil {
+		return
+	}
+
+	// A retry of a request already relayed gets the same tx back, without checking it again
+	duplicateOf, err := relay.checkReplay(&request)
+	if err != nil {
+		return
+	}
+	if duplicateOf != nil {
+		return &preparedRelay{request: request, duplicateOf: duplicateOf}, nil
+	}
+
+	err = relay.validateRecipientNonce(&request, previous)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
 	// check canRelay view function to see if we'll get paid for relaying this tx
 	res, err := relay.canRelay(request.From,
 		request.To,
@@ -471,14 +711,17 @@ func (relay *RelayServer) CreateRelayTransaction(request RelayTransactionRequest
 		request.RecipientNonce,
 		request.Signature,
 		request.CheckSig,
-		request.ApprovalData)
+		request.ApprovalData,
+		false)
 
 	if err != nil {
 		log.Println("canRelay failed in server", err)
 		return
 	}
 
-	if res.Uint64() != 0 {
+	// The hub checks the signature before the nonce, so WrongNonce means only the earlier requests are missing
+	recheck := previous > 0 && res.Uint64() == canRelayWrongNonce
+	if res.Uint64() != 0 && !recheck {
 		errStr := fmt.Sprintln("EncodedFunction:", request.EncodedFunction, "From:", request.From.Hex(), "To:", request.To.Hex(),
 			"GasPrice:", request.GasPrice.String(), "GasLimit:", request.GasLimit.String(), "Nonce:", request.RecipientNonce.String(), "Fee:",
 			request.RelayFee.String(), "AppData:", hexutil.Encode(request.ApprovalData), "Sig:", hexutil.Encode(request.Signature))
@@ -535,15 +778,105 @@ func (relay *RelayServer) CreateRelayTransaction(request RelayTransactionRequest
 
 	log.Println("Estimated max charge of relayed tx:", maxCharge, "GasLimit of relayed tx:", requiredGas)
 
-	signedTx, err = relay.sendDataTransaction(
+	var simulation *RelayCallSimulation
+	if relay.SimulateRelayCall && !recheck {
+		simulation, err = relay.SimulateRelayTransaction(&request, requiredGas)
+		if err != nil {
+			return nil, err
+		}
+		if err = simulation.Rejection(relay.EnforceSimulation); err != nil {
+			log.Println(err)
+			return nil, err
+		}
+	}
+
+	// The gas of a follow-up request can only be estimated once the earlier ones are sent
+	var profit *ProfitEstimate
+	if !recheck {
+		profit, err = relay.estimateRelayProfit(&request, simulation)
+		if err != nil {
+			return nil, err
+		}
+		if err = relay.checkProfit(profit); err != nil {
+			log.Println(err)
+			return nil, err
+		}
+	}
+
+	return &preparedRelay{request: request, requiredGas: requiredGas, profit: profit, recheck: recheck}, nil
+}
+
+// recheckRelayTransaction runs canRelay, the simulation if enabled and the profit check against the pending block,
+// where the earlier requests from the same sender are already sent
+func (relay *RelayServer) recheckRelayTransaction(prepared *preparedRelay) (err error) {
+	request := &prepared.request
+	res, err := relay.canRelay(request.From, request.To, request.EncodedFunction, request.RelayFee, request.GasPrice,
+		request.GasLimit, request.RecipientNonce, request.Signature, request.CheckSig, request.ApprovalData, true)
+	if err != nil {
+		log.Println("canRelay failed in server", err)
+		return
+	}
+	if res.Uint64() != 0 {
+		err = fmt.Errorf("canRelay() view function returned error code=%d after the earlier requests of %s", res, request.From.Hex())
+		log.Println(err)
+		return
+	}
+	var simulation *RelayCallSimulation
+	if relay.SimulateRelayCall {
+		simulation, err = relay.SimulateRelayTransaction(request, prepared.requiredGas)
+		if err != nil {
+			return
+		}
+		if err = simulation.Rejection(relay.EnforceSimulation); err != nil {
+			log.Println(err)
+			return
+		}
+	}
+	profit, err := relay.estimateRelayProfit(request, simulation)
+	if err != nil {
+		return
+	}
+	if err = relay.checkProfit(profit); err != nil {
+		log.Println(err)
+		return
+	}
+	prepared.profit = profit
+	return nil
+}
+
+// sendRelayTransaction signs and sends a prepared relayCall. The caller must hold nonceMutex.
+func (relay *RelayServer) sendRelayTransaction(prepared *preparedRelay) (signedTx *types.Transaction, err error) {
+	if prepared.duplicateOf != nil {
+		return prepared.duplicateOf, nil
+	}
+	request := prepared.request
+	// Checked again under the nonce lock, in case an identical request was sent since this one was prepared
+	signedTx, err = relay.checkReplay(&request)
+	if err != nil || signedTx != nil {
+		return
+	}
+	if prepared.recheck {
+		if err = relay.recheckRelayTransaction(prepared); err != nil {
+			return
+		}
+	}
+	signedTx, err = relay.sendDataTransactionLocked(
 		fmt.Sprintf("Relay(from=%s, to=%s)", request.From.Hex(), request.To.Hex()),
+		&request.RelayMaxNonce,
 		func(auth *bind.TransactOpts) (*types.Transaction, error) {
-			auth.GasLimit = requiredGas.Uint64()
-			auth.GasPrice = &request.GasPrice
+			auth.GasLimit = prepared.requiredGas.Uint64()
+			auth.GasPrice = relay.relayCallGasPrice(&request)
 			return relay.rhub.RelayCall(auth, request.From, request.To,
-				common.Hex2Bytes(request.EncodedFunction[2:]), &request.RelayFee,
+				common.FromHex(request.EncodedFunction), &request.RelayFee,
 				&request.GasPrice, &request.GasLimit, &request.RecipientNonce, request.Signature, request.ApprovalData)
 		})
+	if err != nil {
+		return
+	}
+	relay.replays.set(newReplayKey(&request), relay.replayHash(&request), signedTx)
+	if prepared.profit != nil {
+		relay.profits.set(signedTx.Nonce(), prepared.profit)
+	}
 
 	return
 }
@@ -581,11 +914,12 @@ func (relay *RelayServer) canRelay(from common.Address,
 	recipientNonce big.Int,
 	signature []byte,
 	checkSig []byte,
-	approvalData []byte) (res *big.Int, err error) {
+	approvalData []byte,
+	pending bool) (res *big.Int, err error) {
 
 	relay.internalCheck(checkSig)
 
-	res, err = relay.externalCheck(from, to, encodedFunction, relayFee, gasPrice, gasLimit, recipientNonce, signature, approvalData);
+	res, err = relay.externalCheck(from, to, encodedFunction, relayFee, gasPrice, gasLimit, recipientNonce, signature, approvalData, pending);
 
 	return 
 }
@@ -635,13 +969,14 @@ func (relay *RelayServer) externalCheck(from common.Address,
 	gasLimit big.Int,
 	recipientNonce big.Int,
 	signature []byte,
-	approvalData []byte) (res *big.Int, err error) {
+	approvalData []byte,
+	pending bool) (res *big.Int, err error) {
 
 	relayAddress := relay.Address()
 
 	callOpt := &bind.CallOpts{
 		From:    relayAddress,
-		Pending: false,
+		Pending: pending,
 	}
 
 	var result struct {
@@ -695,7 +1030,7 @@ func (relay *RelayServer) sendPlainTransaction(desc string, to common.Address, v
 	}
 
 	log.Println(desc, "tx sent:", signedTx.Hash().Hex())
-	lastNonce++
+	commitNonce(nonce)
 
 	err = relay.TxStore.SaveTransaction(signedTx)
 	if err != nil {
@@ -707,16 +1042,32 @@ func (relay *RelayServer) sendPlainTransaction(desc string, to common.Address, v
 }
 
 func (relay *RelayServer) sendDataTransaction(desc string, f func(*bind.TransactOpts) (*types.Transaction, error)) (tx *types.Transaction, err error) {
-	log.Println(desc, "tx sending")
 	nonceMutex.Lock()
 	defer nonceMutex.Unlock()
+	return relay.sendDataTransactionLocked(desc, nil, f)
+}
+
+// sendDataTransactionLocked is sendDataTransaction for callers already holding nonceMutex, e.g. to send several
+// transactions with consecutive nonces. The nonce reserved for the tx must not exceed maxNonce, if given; it is only
+// committed once the tx was sent, so it is released for the next tx if the check or the sending fails.
+func (relay *RelayServer) sendDataTransactionLocked(desc string, maxNonce *big.Int, f func(*bind.TransactOpts) (*types.Transaction, error)) (tx *types.Transaction, err error) {
+	log.Println(desc, "tx sending")
+	if err = relay.checkNotHalted(); err != nil {
+		log.Println(desc, err)
+		return
+	}
 	auth := bind.NewKeyedTransactor(relay.PrivateKey)
 	nonce, err := relay.pollNonce()
 	if err != nil {
 		log.Println(desc, "error polling nonce:", err)
 		return
 	}
-	auth.Nonce = big.NewInt(int64(nonce))
+	if maxNonce != nil && maxNonce.Cmp(new(big.Int).SetUint64(nonce)) < 0 {
+		err = fmt.Errorf("Unacceptable RelayMaxNonce %s: relay nonce is %d", maxNonce.String(), nonce)
+		log.Println(desc, err)
+		return
+	}
+	auth.Nonce = new(big.Int).SetUint64(nonce)
 	tx, err = f(auth)
 	if err != nil {
 		log.Println(desc, "error sending tx:", err)
@@ -724,7 +1075,7 @@ func (relay *RelayServer) sendDataTransaction(desc string, f func(*bind.Transact
 	}
 
 	log.Printf("%v tx sent: %v (%v)\n", desc, tx.Hash().Hex(), tx.Nonce())
-	lastNonce++
+	commitNonce(nonce)
 
 	// TODO: Monitor for tx mined
 	err = relay.TxStore.SaveTransaction(tx)
@@ -739,17 +1090,32 @@ func (relay *RelayServer) sendDataTransaction(desc string, f func(*bind.Transact
 const maxGasPrice = 100e9
 const retryGasPricePercentageIncrease = 20
 
-func (relay *RelayServer) resendTransaction(tx *types.Transaction) (signedTx *types.Transaction, err error) {
+// resentGasPrice is the gas price a tx sent with gasPrice is resent with when it is pending for too long
+func resentGasPrice(gasPrice *big.Int) *big.Int {
 	// Calculate new gas price as a % increase over the previous one
 	newGasPrice := big.NewInt(100 + retryGasPricePercentageIncrease)
-	newGasPrice.Mul(newGasPrice, tx.GasPrice())
+	newGasPrice.Mul(newGasPrice, gasPrice)
 	newGasPrice.Div(newGasPrice, big.NewInt(100))
 
 	// Sanity check to ensure we are not burning all our balance in gas fees
 	if newGasPrice.Cmp(big.NewInt(maxGasPrice)) > 0 {
-		log.Println("Capping gas price to max value of", maxGasPrice)
 		newGasPrice.SetUint64(maxGasPrice)
 	}
+	return newGasPrice
+}
+
+func (relay *RelayServer) resendTransaction(tx *types.Transaction) (signedTx *types.Transaction, err error) {
+	// Withdrawals, which carry no data, are still resent while halted
+	if len(tx.Data()) > 0 {
+		if err = relay.checkNotHalted(); err != nil {
+			return
+		}
+	}
+
+	newGasPrice := resentGasPrice(tx.GasPrice())
+	if newGasPrice.Cmp(big.NewInt(maxGasPrice)) == 0 {
+		log.Println("Capping gas price to max value of", maxGasPrice)
+	}
 
 	// Grab chain ID
 	chainID, err := relay.ChainID()
@@ -792,6 +1158,8 @@ func (relay *RelayServer) awaitTransactionMined(tx *types.Transaction) (err erro
 	return nil
 }
 
+// pollNonce reserves the nonce for the relay's next tx. The caller must hold nonceMutex until it either sent the tx and
+// called commitNonce, or gave up, leaving the nonce to the next tx.
 func (relay *RelayServer) pollNonce() (nonce uint64, err error) {
 	ctx := context.Background()
 	fromAddress := relay.Address()
@@ -802,30 +1170,71 @@ func (relay *RelayServer) pollNonce() (nonce uint64, err error) {
 	}
 
 	// Always overwrite nonce cache if on dev mode
-	if relay.DevMode || lastNonce <= nonce {
-		lastNonce = nonce
+	if last := atomic.LoadUint64(&lastNonce); relay.DevMode || last <= nonce {
+		atomic.StoreUint64(&lastNonce, nonce)
 	} else {
-		nonce = lastNonce
+		nonce = last
 	}
 	return
 }
 
-const confirmationsNeeded = 12
+// commitNonce marks nonce as used once a tx was sent with it. The caller must hold nonceMutex.
+func commitNonce(nonce uint64) {
+	atomic.StoreUint64(&lastNonce, nonce+1)
+}
+
 const pendingTransactionTimeout = 5 * 60 // 5 minutes
 
+// processConfirmedTransactions goes over the txs with a nonce below confirmedNonce before they are removed from the
+// TxStore: the realised profit of each relayCall is logged, and its outcome counts towards the reputation of its
+// recipient and sender
+func (relay *RelayServer) processConfirmedTransactions(confirmedNonce uint64) {
+	txs, err := relay.TxStore.ListTransactions()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	ctx := context.Background()
+	for _, tx := range txs {
+		if tx.Nonce() >= confirmedNonce {
+			continue
+		}
+		for _, hash := range append([]common.Hash{tx.Hash()}, tx.PreviousHashes...) {
+			receipt, err := relay.Client.TransactionReceipt(ctx, hash)
+			if err != nil || receipt == nil {
+				continue
+			}
+			minedTx := tx.Transaction
+			if hash != tx.Hash() {
+				minedTx, _, err = relay.Client.TransactionByHash(ctx, hash)
+				if err != nil {
+					log.Println(err)
+					break
+				}
+			}
+			relay.logRealisedProfit(minedTx, receipt)
+			relay.recordRelayOutcome(minedTx, receipt)
+			break
+		}
+	}
+}
+
+// UpdateUnconfirmedTransactions tracks the blocks the stored txs are mined in, removes the confirmed ones from the
+// store and resends the first unconfirmed tx if it is pending for too long. A tx is only confirmed once it is mined
+// ConfirmationsNeeded blocks deep in the current chain, so txs dropped by a reorg stay in the store to be broadcast again.
 func (relay *RelayServer) UpdateUnconfirmedTransactions() (newTx *types.Transaction, err error) {
 	if relay.DevMode {
 		return nil, nil
 	}
 
 	// Load unconfirmed transactions from store, and bail if there are none
-	tx, err := relay.TxStore.GetFirstTransaction()
+	txs, err := relay.TxStore.ListTransactions()
 	if err != nil {
-		log.Println("UpdateUnconfirmedTransactions: error retrieving first transaction from local store", err)
+		log.Println("UpdateUnconfirmedTransactions: error retrieving transactions from local store", err)
 		return
 	}
 
-	if tx == nil {
+	if len(txs) == 0 {
 		return
 	}
 
@@ -837,35 +1246,63 @@ func (relay *RelayServer) UpdateUnconfirmedTransactions() (newTx *types.Transact
 		return
 	}
 
-	// Get nonce at confirmationsNeeded blocks ago
-	var confirmedBlock big.Int
-	confirmedBlock.Sub(latest.Number, big.NewInt(confirmationsNeeded))
-	nonce, err := relay.Client.NonceAt(ctx, relay.Address(), &confirmedBlock)
-	if err != nil {
-		log.Println("UpdateUnconfirmedTransactions: error retrieving nonce for", relay.Address().Hex(), "on block", confirmedBlock.Uint64(), err)
-		return
+	// Record the blocks the txs are mined in, broadcasting again those a reorg dropped
+	for i, tx := range txs {
+		txs[i], err = relay.trackMinedBlock(ctx, tx)
+		if err != nil {
+			log.Println("UpdateUnconfirmedTransactions: error tracking block of transaction", tx.Nonce(), tx.Hash().Hex(), err)
+			return
+		}
 	}
 
-	// Clear out all confirmed transactions (ie txs with nonce less than the account nonce at confirmationsNeeded blocks ago)
-	err = relay.TxStore.RemoveTransactionsLessThanNonce(nonce)
+	// Confirmed txs are the ones mined at least ConfirmationsNeeded blocks ago. Txs not found mined were replaced by
+	// another tx with the same nonce, and are confirmed once the account nonce at that block is past theirs.
+	confirmations := relay.ConfirmationsNeeded()
+	confirmedNonce := txs[0].Nonce()
+	if latest.Number.Uint64() >= confirmations {
+		confirmedBlock := new(big.Int).SetUint64(latest.Number.Uint64() - confirmations)
+		nonce, err := relay.Client.NonceAt(ctx, relay.Address(), confirmedBlock)
+		if err != nil {
+			log.Println("UpdateUnconfirmedTransactions: error retrieving nonce for", relay.Address().Hex(), "on block", confirmedBlock.Uint64(), err)
+			return nil, err
+		}
+		for _, tx := range txs {
+			if tx.IsMined() && tx.MinedBlock > confirmedBlock.Uint64() || !tx.IsMined() && tx.Nonce() >= nonce {
+				break
+			}
+			confirmedNonce = tx.Nonce() + 1
+		}
+	}
+
+	relay.processConfirmedTransactions(confirmedNonce)
+
+	// Clear out all confirmed transactions
+	err = relay.TxStore.RemoveTransactionsLessThanNonce(confirmedNonce)
 	if err != nil {
 		log.Println("UpdateUnconfirmedTransactions: error deleting confirmed transactions", err)
 		return
 	}
 
 	// Get first unconfirmed transaction
-	tx, err = relay.TxStore.GetFirstTransaction()
-	if err != nil {
-		log.Println("UpdateUnconfirmedTransactions: error retrieving unconfirmed transaction from local store", err)
-		return
+	var tx *txstore.TimestampedTransaction
+	for _, unconfirmed := range txs {
+		if unconfirmed.Nonce() >= confirmedNonce {
+			tx = unconfirmed
+			break
+		}
 	}
 
 	if tx == nil {
 		return
 	}
 
-	// Check if the tx was mined by comparing its nonce against the latest one
-	nonce, err = relay.Client.NonceAt(ctx, relay.Address(), nil)
+	if tx.IsMined() {
+		log.Println("UpdateUnconfirmedTransactions: awaiting confirmations for next mined transaction", tx.Nonce(), tx.Hash().Hex(), "in block", tx.MinedBlock)
+		return nil, nil
+	}
+
+	// Check if a tx replacing it was mined by comparing its nonce against the latest one
+	nonce, err := relay.Client.NonceAt(ctx, relay.Address(), nil)
 	if err != nil {
 		log.Println("UpdateUnconfirmedTransactions: error retrieving nonce for", relay.Address().Hex(), err)
 		return
@@ -900,6 +1337,26 @@ func (relay *RelayServer) UpdateUnconfirmedTransactions() (newTx *types.Transact
 }
 
 func (relay *RelayServer) Close() (err error) {
+	if relay.Reputation != nil {
+		if err = relay.Reputation.Close(); err != nil {
+			log.Println(err)
+		}
+	}
+	if relay.HubIndex != nil {
+		if err = relay.HubIndex.Close(); err != nil {
+			log.Println(err)
+		}
+	}
+	if relay.Incidents != nil {
+		if err = relay.Incidents.Close(); err != nil {
+			log.Println(err)
+		}
+	}
+	if relay.State != nil {
+		if err = relay.State.Close(); err != nil {
+			log.Println(err)
+		}
+	}
 	return relay.TxStore.Close()
 }
 
@@ -9,12 +9,22 @@ import (
 	"fmt"
 	"gen/librelay"
 	"gen/samplerec"
+	"io/ioutil"
+	"librelay/funding"
+	"librelay/hubindex"
+	"librelay/incident"
+	"librelay/lifecycle"
+	"librelay/notify"
+	"librelay/reputation"
+	"librelay/simbackend"
 	"librelay/test"
 	"librelay/txstore"
 	"log"
 	"math/big"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -25,6 +35,7 @@ import (
 	"github.com/ethereum/go-ethereum/accounts/abi/bind"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/ethclient"
@@ -32,33 +43,47 @@ import (
 	"github.com/ethereum/go-ethereum/rpc"
 )
 
-type TestClient struct {
+// TestClient is the chain the tests run on: the simulated backend, or a ganache node
+type TestClient interface {
+	IClient
+	AdjustTime(seconds uint64) error
+	Commit() error
+	MineBlocks(n uint64) error
+	Snapshot() (uint64, error)
+	Revert(id uint64) error
+}
+
+type GanacheClient struct {
 	*ethclient.Client
 
 	RPC *rpc.Client
 }
 
-func NewTestClient(url string) (*TestClient, error) {
+func NewGanacheClient(url string) (*GanacheClient, error) {
 	rpcClient, err := rpc.DialContext(context.Background(), url)
 	if err != nil {
 		return nil, err
 	}
 
-	return &TestClient{
+	return &GanacheClient{
 		ethclient.NewClient(rpcClient),
 		rpcClient,
 	}, nil
 }
 
-func (client *TestClient) AdjustTime(seconds uint64) error {
+func (client *GanacheClient) TransactionBlock(ctx context.Context, txHash common.Hash) (blockNumber uint64, blockHash common.Hash, err error) {
+	return rpcTransactionBlock(ctx, client.RPC, txHash)
+}
+
+func (client *GanacheClient) AdjustTime(seconds uint64) error {
 	return client.RPC.Call(nil, "evm_increaseTime", seconds)
 }
 
-func (client *TestClient) Commit() error {
+func (client *GanacheClient) Commit() error {
 	return client.RPC.Call(nil, "evm_mine")
 }
 
-func (client *TestClient) MineBlocks(n uint64) error {
+func (client *GanacheClient) MineBlocks(n uint64) error {
 	for ; n > 0; n-- {
 		err := client.RPC.Call(nil, "evm_mine")
 		if err != nil {
@@ -68,13 +93,13 @@ func (client *TestClient) MineBlocks(n uint64) error {
 	return nil
 }
 
-func (client *TestClient) Snapshot() (uint64, error) {
+func (client *GanacheClient) Snapshot() (uint64, error) {
 	var result hexutil.Uint64
 	err := client.RPC.Call(&result, "evm_snapshot")
 	return uint64(result), err
 }
 
-func (client *TestClient) Revert(id uint64) error {
+func (client *GanacheClient) Revert(id uint64) error {
 	return client.RPC.Call(nil, "evm_revert", id)
 }
 
@@ -125,7 +150,7 @@ func (relay *TestServer) sendUnstakeTransaction(ownerKey *ecdsa.PrivateKey, stak
 
 var auth *bind.TransactOpts
 var relay TestServer
-var client *TestClient
+var client TestClient
 var relayKey1 *ecdsa.PrivateKey
 var gaslessKey2 *ecdsa.PrivateKey
 var ownerKey3 *ecdsa.PrivateKey
@@ -140,7 +165,11 @@ var rhaddr common.Address
 var boundHub *bind.BoundContract
 var boundRecipient *bind.BoundContract
 
-var ethereumNodeURL = "http://localhost:8543"
+var ethereumNodeURL string
+
+func init() {
+	flag.StringVar(&ethereumNodeURL, "ganache", "", "Url of a ganache node to run the tests against (e.g. http://localhost:8543), instead of the simulated backend")
+}
 
 func InitTestClient(url string) {
 	relayKey1, _ = crypto.HexToECDSA("4f3edf983ac636a65a842ce7c78d9aa706d3b113bce9c46f30d7d21715b23b1d")
@@ -153,12 +182,22 @@ func InitTestClient(url string) {
 	fmt.Println("3. Owner  ", crypto.PubkeyToAddress(ownerKey3.PublicKey).Hex())
 
 	auth = bind.NewKeyedTransactor(relayKey1)
-	var err error
-	client, err = NewTestClient(url)
+	if url == "" {
+		// The accounts ganache -d funds
+		funds := new(big.Int).Mul(big.NewInt(100), big.NewInt(params.Ether))
+		client = simbackend.New(core.GenesisAlloc{
+			crypto.PubkeyToAddress(relayKey1.PublicKey):   {Balance: funds},
+			crypto.PubkeyToAddress(gaslessKey2.PublicKey): {Balance: funds},
+			crypto.PubkeyToAddress(ownerKey3.PublicKey):   {Balance: funds},
+		})
+		return
+	}
+	ganacheClient, err := NewGanacheClient(url)
 	if err != nil {
 		log.Fatalf("Could not connect to local ganache: %v", err)
 	}
-	client.Commit()
+	ganacheClient.Commit()
+	client = ganacheClient
 }
 
 func NewRelay(relayHubAddress common.Address) {
@@ -184,6 +223,7 @@ func NewRelay(relayHubAddress common.Address) {
 }
 
 func TestMain(m *testing.M) {
+	flag.Parse()
 	InitTestClient(ethereumNodeURL)
 	parsed, err := abi.JSON(strings.NewReader(librelay.IRelayHubABI))
 	if err != nil {
@@ -256,7 +296,6 @@ func TestMain(m *testing.M) {
 	log.Println("To.balance: ", toBalance)
 
 	fmt.Println("-----------------------------------------------------")
-	flag.Parse()
 	exitStatus := m.Run()
 	defer os.Exit(exitStatus)
 }
@@ -568,3 +607,1001 @@ func TestGetEncodedFunctionGas(t *testing.T) {
 		test.ErrFail(errors.New("Wrong gas calculation"), t)
 	}
 }
+
+// newPoolRelay returns a RelayServer for the test relay's account with its own relay pool, to be stopped by the test
+func newPoolRelay(t *testing.T, workers int, queueSize int) *RelayServer {
+	poolRelay, err := NewRelayServer(
+		common.Address{}, big.NewInt(10), "", "8090", rhaddr, int64(params.GWei), big.NewInt(10), relayKey1, 5,
+		ethereumNodeURL, client, relay.TxStore, clk, false)
+	test.ErrFail(err, t)
+	test.ErrFail(poolRelay.RefreshGasPrice(), t)
+	poolRelay.StartRelayPool(workers, queueSize)
+	return poolRelay
+}
+
+func TestCreateRelayTransactions(t *testing.T) {
+	t.Run("Inline", func(t *testing.T) {
+		testCreateRelayTransactions(t, relay.RelayServer)
+	})
+	t.Run("Through the relay pool", func(t *testing.T) {
+		poolRelay := newPoolRelay(t, 2, 10)
+		defer poolRelay.StopRelayPool()
+		testCreateRelayTransactions(t, poolRelay)
+		if stats := poolRelay.RelayPoolStats(); stats.Accepted != 1 || stats.Relayed != 3 || stats.Failed != 1 {
+			t.Errorf("Expected the batch to be queued once but got %+v", stats)
+		}
+	})
+}
+
+func testCreateRelayTransactions(t *testing.T, server *RelayServer) {
+	test.ErrFail(relay.TxStore.Clear(), t)
+	test.ErrFail(server.RefreshGasPrice(), t)
+	gaslessNonce, err := rhub.GetNonce(nil, crypto.PubkeyToAddress(gaslessKey2.PublicKey))
+	test.ErrFail(err, t)
+	ownerNonce, err := rhub.GetNonce(nil, crypto.PubkeyToAddress(ownerKey3.PublicKey))
+	test.ErrFail(err, t)
+
+	request1 := newSignedRelayTransactionRequest(t, gaslessNonce.Int64())
+	request2 := newSignedRelayTransactionRequest(t, ownerNonce.Int64())
+	signRelayRequestWithKey(t, &request2, ownerKey3)
+	// The sender's next nonce after request1: sent after it
+	request3 := newSignedRelayTransactionRequest(t, gaslessNonce.Int64()+1)
+	// Skips a nonce: rejected up front, without affecting the others
+	request4 := newSignedRelayTransactionRequest(t, gaslessNonce.Int64()+3)
+
+	results, err := server.CreateRelayTransactions([]RelayTransactionRequest{request1, request2, request3, request4})
+	test.ErrFail(err, t)
+	if len(results) != 4 {
+		t.Fatalf("Expected 4 results but got %d", len(results))
+	}
+	for i := 0; i < 3; i++ {
+		if results[i].Error != nil || results[i].SignedTx == nil {
+			t.Fatalf("Request %d was not relayed: %v", i+1, results[i].Error)
+		}
+		assertTransactionRelayed(t, results[i].SignedTx.Hash())
+	}
+	for i := 1; i < 3; i++ {
+		if results[i].SignedTx.Nonce() != results[i-1].SignedTx.Nonce()+1 {
+			t.Errorf("Expected consecutive nonces but got %d and %d", results[i-1].SignedTx.Nonce(), results[i].SignedTx.Nonce())
+		}
+	}
+	if results[3].SignedTx != nil || results[3].Error == nil || results[3].Error.Code != ErrCodeRejected {
+		t.Errorf("Expected request 4 to be rejected but got %+v", results[3])
+	}
+	gaslessNonceAfter, err := rhub.GetNonce(nil, crypto.PubkeyToAddress(gaslessKey2.PublicKey))
+	test.ErrFail(err, t)
+	if gaslessNonceAfter.Int64() != gaslessNonce.Int64()+2 {
+		t.Errorf("Expected both requests of the sender to be relayed, but its nonce went from %d to %d", gaslessNonce, gaslessNonceAfter)
+	}
+}
+
+func awaitRelayStatus(t *testing.T, server *RelayServer, requestId string, expected string) (status *RelayRequestStatus) {
+	for i := 0; i < 100; i++ {
+		var err error
+		status, err = server.RelayTransactionStatus(requestId)
+		test.ErrFail(err, t)
+		if status.Status == expected {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatalf("Request %s still %s, expected %s: %+v", requestId, status.Status, expected, status)
+	return
+}
+
+func TestAsyncRelayTransaction(t *testing.T) {
+	test.ErrFail(relay.TxStore.Clear(), t)
+	test.ErrFail(relay.RefreshGasPrice(), t)
+	if _, err := relay.SubmitRelayTransaction(newSignedRelayTransactionRequest(t, 0)); err == nil {
+		t.Error("Expected submit to fail before the relay pool is started")
+	}
+	poolRelay := newPoolRelay(t, 2, 10)
+	defer poolRelay.StopRelayPool()
+
+	gaslessNonce, err := rhub.GetNonce(nil, crypto.PubkeyToAddress(gaslessKey2.PublicKey))
+	test.ErrFail(err, t)
+	request := newSignedRelayTransactionRequest(t, gaslessNonce.Int64())
+	requestId, err := poolRelay.SubmitRelayTransaction(request)
+	test.ErrFail(err, t)
+	status := awaitRelayStatus(t, poolRelay, requestId, RelayStatusMined)
+	if status.Receipt == nil || status.TxHash == nil || *status.TxHash != status.Receipt.TxHash {
+		t.Errorf("Expected the receipt of the relayed tx but got %+v", status)
+	}
+	assertTransactionRelayed(t, *status.TxHash)
+
+	// Checks needing the node run on the worker: another request for a used nonce is accepted, then fails
+	conflicting := request
+	conflicting.RelayFee = *big.NewInt(11)
+	signRelayRequest(t, &conflicting)
+	requestId, err = poolRelay.SubmitRelayTransaction(conflicting)
+	test.ErrFail(err, t)
+	status = awaitRelayStatus(t, poolRelay, requestId, RelayStatusFailed)
+	if status.TxHash != nil || !strings.Contains(status.Error, "nonce") {
+		t.Errorf("Expected request with used nonce to fail without a tx but got %+v", status)
+	}
+
+	// A bad signature is rejected before being queued
+	request.RelayFee = *big.NewInt(11)
+	if _, err = poolRelay.SubmitRelayTransaction(request); err == nil {
+		t.Error("Expected request with wrong signature to be rejected")
+	}
+	if _, err = poolRelay.RelayTransactionStatus("unknown"); err != ErrUnknownRequestId {
+		t.Error("Expected unknown request id to be reported")
+	}
+}
+
+func TestRelayTransactionStatusOfResentTx(t *testing.T) {
+	test.ErrFail(relay.TxStore.Clear(), t)
+	test.ErrFail(relay.RefreshGasPrice(), t)
+	gaslessNonce, err := rhub.GetNonce(nil, crypto.PubkeyToAddress(gaslessKey2.PublicKey))
+	test.ErrFail(err, t)
+	signedTx, err := relay.CreateRelayTransaction(newSignedRelayTransactionRequest(t, gaslessNonce.Int64()))
+	test.ErrFail(err, t)
+	assertTransactionRelayed(t, signedTx.Hash())
+
+	// As if the request was sent as first, resent as signedTx, which got mined, then resent again as last
+	first := types.NewTransaction(signedTx.Nonce(), rhaddr, big.NewInt(0), signedTx.Gas(), big.NewInt(1), nil)
+	last := types.NewTransaction(signedTx.Nonce(), rhaddr, big.NewInt(0), signedTx.Gas(), big.NewInt(2), nil)
+	test.ErrFail(relay.TxStore.Clear(), t)
+	test.ErrFail(relay.TxStore.SaveTransaction(first), t)
+	test.ErrFail(relay.TxStore.UpdateTransactionByNonce(signedTx), t)
+	test.ErrFail(relay.TxStore.UpdateTransactionByNonce(last), t)
+	test.ErrFail(relay.setRequestStatus("resent", txstore.RequestStatus{Status: RelayStatusSent, Nonce: signedTx.Nonce(), TxHash: first.Hash()}), t)
+
+	status, err := relay.RelayTransactionStatus("resent")
+	test.ErrFail(err, t)
+	if status.Status != RelayStatusMined || status.TxHash == nil || *status.TxHash != signedTx.Hash() || status.Receipt == nil {
+		t.Fatalf("Expected the replaced tx %s to be reported mined but got %+v", signedTx.Hash().Hex(), status)
+	}
+
+	// The outcome is kept once the confirmed tx is removed from the store
+	test.ErrFail(relay.TxStore.RemoveTransactionsLessThanNonce(signedTx.Nonce()+1), t)
+	status, err = relay.RelayTransactionStatus("resent")
+	test.ErrFail(err, t)
+	if status.Status != RelayStatusMined || *status.TxHash != signedTx.Hash() || status.Receipt == nil {
+		t.Errorf("Expected the mined tx %s to still be reported but got %+v", signedTx.Hash().Hex(), status)
+	}
+}
+
+func TestGetRelayedTransaction(t *testing.T) {
+	test.ErrFail(relay.TxStore.Clear(), t)
+	test.ErrFail(relay.RefreshGasPrice(), t)
+	gaslessNonce, err := rhub.GetNonce(nil, crypto.PubkeyToAddress(gaslessKey2.PublicKey))
+	test.ErrFail(err, t)
+	request := newSignedRelayTransactionRequest(t, gaslessNonce.Int64())
+	signedTx, err := relay.CreateRelayTransaction(request)
+	test.ErrFail(err, t)
+	assertTransactionRelayed(t, signedTx.Hash())
+
+	info, err := relay.GetRelayedTransactionBySender(request.From, gaslessNonce)
+	test.ErrFail(err, t)
+	if info == nil || info.SignedTx.Hash() != signedTx.Hash() || info.Status != TxStatusMined || *info.MinedHash != signedTx.Hash() {
+		t.Fatalf("Expected mined tx %s but got %+v", signedTx.Hash().Hex(), info)
+	}
+	info, err = relay.GetRelayedTransactionBySender(request.From, big.NewInt(0).Add(gaslessNonce, big.NewInt(1)))
+	if info != nil || err != nil {
+		t.Errorf("Expected no tx for the next nonce but got %+v (error %v)", info, err)
+	}
+
+	// A replacement that never made it to the chain: the replaced tx is still the one reported as mined
+	replacement := types.NewTransaction(signedTx.Nonce(), *signedTx.To(), signedTx.Value(), signedTx.Gas(), big.NewInt(0).Mul(signedTx.GasPrice(), big.NewInt(2)), signedTx.Data())
+	test.ErrFail(relay.TxStore.UpdateTransactionByNonce(replacement), t)
+	info, err = relay.GetRelayedTransactionByHash(signedTx.Hash())
+	test.ErrFail(err, t)
+	if info == nil || info.SignedTx.Hash() != replacement.Hash() || len(info.PreviousHashes) != 1 || *info.MinedHash != signedTx.Hash() {
+		t.Fatalf("Expected replacement of mined tx %s but got %+v", signedTx.Hash().Hex(), info)
+	}
+
+	// Once confirmed and pruned from the store, the tx is still found on the node by its hash
+	test.ErrFail(client.MineBlocks(relay.ConfirmationsNeeded()), t)
+	test.ErrFail(relay.TxStore.Clear(), t)
+	info, err = relay.GetRelayedTransactionByHash(signedTx.Hash())
+	test.ErrFail(err, t)
+	if info == nil || info.Status != TxStatusConfirmed || info.SignedTx.Hash() != signedTx.Hash() {
+		t.Errorf("Expected confirmed tx %s but got %+v", signedTx.Hash().Hex(), info)
+	}
+	info, err = relay.GetRelayedTransactionByHash(common.HexToHash("0x1234"))
+	if info != nil || err != nil {
+		t.Errorf("Expected no tx for unknown hash but got %+v (error %v)", info, err)
+	}
+}
+
+func TestReplayedRelayTransaction(t *testing.T) {
+	test.ErrFail(relay.TxStore.Clear(), t)
+	test.ErrFail(relay.RefreshGasPrice(), t)
+	gaslessNonce, err := rhub.GetNonce(nil, crypto.PubkeyToAddress(gaslessKey2.PublicKey))
+	test.ErrFail(err, t)
+	request := newSignedRelayTransactionRequest(t, gaslessNonce.Int64())
+	nonce, err := client.NonceAt(context.Background(), relay.Address(), nil)
+	test.ErrFail(err, t)
+
+	// Snapshot before relaying, to make the node drop the tx later
+	snapshotID, err := client.Snapshot()
+	test.ErrFail(err, t)
+	signedTx, err := relay.CreateRelayTransaction(request)
+	test.ErrFail(err, t)
+
+	// An exact retry gets the same tx, without a new one being sent
+	retriedTx, err := relay.CreateRelayTransaction(request)
+	test.ErrFail(err, t)
+	if retriedTx.Hash() != signedTx.Hash() {
+		t.Errorf("Expected retry to return tx %s but got %s", signedTx.Hash().Hex(), retriedTx.Hash().Hex())
+	}
+	assertRelayNonce(t, nonce+1)
+
+	// A different request for the same sender nonce is rejected
+	conflicting := request
+	conflicting.GasLimit = *big.NewInt(1000001)
+	signRelayRequest(t, &conflicting)
+	if _, err = relay.CreateRelayTransaction(conflicting); err == nil || !strings.Contains(err.Error(), "Conflicting") {
+		t.Errorf("Expected conflicting request to be rejected but got %v", err)
+	}
+
+	// Once the node forgot the tx, a retry is relayed again
+	test.ErrFail(client.Revert(snapshotID), t)
+	test.ErrFail(relay.TxStore.Clear(), t)
+	relay.DevMode = true
+	retriedTx, err = relay.CreateRelayTransaction(request)
+	relay.DevMode = false
+	test.ErrFail(err, t)
+	if retriedTx.Hash() == signedTx.Hash() {
+		t.Error("Expected a dropped tx to be relayed again")
+	}
+	assertTransactionRelayed(t, retriedTx.Hash())
+}
+
+func TestRelayMaxNonceUnderConcurrency(t *testing.T) {
+	test.ErrFail(relay.TxStore.Clear(), t)
+	test.ErrFail(relay.RefreshGasPrice(), t)
+	nonce, err := client.PendingNonceAt(context.Background(), relay.Address())
+	test.ErrFail(err, t)
+
+	// Fresh senders, all accepting at most two more relay txs
+	maxNonce := nonce + 2
+	requests := make([]RelayTransactionRequest, 6)
+	for i := range requests {
+		key, err := crypto.GenerateKey()
+		test.ErrFail(err, t)
+		requests[i] = newSignedRelayTransactionRequest(t, 0)
+		requests[i].RelayMaxNonce = *new(big.Int).SetUint64(maxNonce)
+		signRelayRequestWithKey(t, &requests[i], key)
+	}
+
+	signedTxs := make([]*types.Transaction, len(requests))
+	errs := make([]error, len(requests))
+	var wg sync.WaitGroup
+	for i := range requests {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			signedTxs[i], errs[i] = relay.CreateRelayTransaction(requests[i])
+		}(i)
+	}
+	wg.Wait()
+
+	used := make(map[uint64]bool)
+	for i := range requests {
+		if errs[i] != nil {
+			if !strings.Contains(errs[i].Error(), "RelayMaxNonce") {
+				t.Errorf("Request %d failed for another reason than RelayMaxNonce: %v", i, errs[i])
+			}
+			continue
+		}
+		if signedTxs[i].Nonce() > maxNonce || used[signedTxs[i].Nonce()] {
+			t.Errorf("Request %d relayed with nonce %d, max nonce %d, used %v", i, signedTxs[i].Nonce(), maxNonce, used)
+		}
+		used[signedTxs[i].Nonce()] = true
+	}
+	if len(used) != 3 {
+		t.Errorf("Expected nonces %d to %d to be used but got %v", nonce, maxNonce, used)
+	}
+	assertRelayNonce(t, maxNonce+1)
+}
+
+func TestSimulateRelayTransaction(t *testing.T) {
+	test.ErrFail(relay.TxStore.Clear(), t)
+	test.ErrFail(relay.RefreshGasPrice(), t)
+	gaslessNonce, err := rhub.GetNonce(nil, crypto.PubkeyToAddress(gaslessKey2.PublicKey))
+	test.ErrFail(err, t)
+	request := newSignedRelayTransactionRequest(t, gaslessNonce.Int64())
+	requiredGas, err := rhub.RequiredGas(nil, &request.GasLimit)
+	test.ErrFail(err, t)
+
+	simulation, err := relay.SimulateRelayTransaction(&request, requiredGas)
+	test.ErrFail(err, t)
+	if simulation.CanRelay != 0 || simulation.Status != RelayCallStatusOK || simulation.EstimatedGas == 0 || simulation.Rejection(true) != nil {
+		t.Errorf("Expected simulation to succeed but got %+v", simulation)
+	}
+
+	// preRelayedCall reverting is caught before sending
+	sr, err := samplerec.NewSampleRecipient(sampleRecipient, client)
+	test.ErrFail(err, t)
+	ownerAuth := bind.NewKeyedTransactor(ownerKey3)
+	_, err = sr.SetRevertPreRelayCall(ownerAuth, true)
+	test.ErrFail(err, t)
+	simulation, err = relay.SimulateRelayTransaction(&request, requiredGas)
+	test.ErrFail(err, t)
+	if simulation.Status != RelayCallStatusPreRelayedFailed || simulation.Rejection(false) == nil {
+		t.Errorf("Expected simulation to report preRelayedCall reverting but got %+v", simulation)
+	}
+	relay.SimulateRelayCall = true
+	if _, err = relay.CreateRelayTransaction(request); err == nil {
+		t.Error("Expected request to be rejected by the simulation")
+	}
+	_, err = sr.SetRevertPreRelayCall(ownerAuth, false)
+	test.ErrFail(err, t)
+
+	signedTx, err := relay.CreateRelayTransaction(request)
+	relay.SimulateRelayCall = false
+	test.ErrFail(err, t)
+	assertTransactionRelayed(t, signedTx.Hash())
+}
+
+func TestRelayProfit(t *testing.T) {
+	test.ErrFail(relay.TxStore.Clear(), t)
+	gaslessNonce, err := rhub.GetNonce(nil, crypto.PubkeyToAddress(gaslessKey2.PublicKey))
+	test.ErrFail(err, t)
+	request := newSignedRelayTransactionRequest(t, gaslessNonce.Int64())
+
+	// A 10% fee can't leave a profit of 11% of the gas cost
+	relay.MinProfitPercent = big.NewInt(11)
+	_, err = relay.CreateRelayTransaction(request)
+	relay.MinProfitPercent = nil
+	if err == nil || !strings.Contains(err.Error(), "Unprofitable request") {
+		t.Error("Expected request to be rejected as unprofitable but got", err)
+	}
+
+	relay.MinProfit = big.NewInt(1)
+	signedTx, err := relay.CreateRelayTransaction(request)
+	relay.MinProfit = nil
+	test.ErrFail(err, t)
+	receipt := assertTransactionRelayed(t, signedTx.Hash())
+
+	charge, cost, err := relay.RealisedProfit(signedTx, receipt)
+	test.ErrFail(err, t)
+	expectedCost := new(big.Int).Mul(new(big.Int).SetUint64(receipt.GasUsed), signedTx.GasPrice())
+	if charge.Sign() <= 0 || cost.Cmp(expectedCost) != 0 {
+		t.Errorf("Wrong realised charge %s or cost %s", charge.String(), cost.String())
+	}
+}
+
+func TestRecipientBlacklisting(t *testing.T) {
+	test.ErrFail(relay.TxStore.Clear(), t)
+	relay.Reputation = reputation.NewTracker(reputation.NewMemoryReputationStore(), reputation.Settings{
+		MinSamples:        1,
+		MaxFailurePercent: 50,
+		Window:            time.Hour,
+		Cooldown:          time.Hour,
+	}, clk)
+	defer func() { relay.Reputation = nil }()
+
+	// The recipient accepts the call in canRelay, then reverts in preRelayedCall
+	sr, err := samplerec.NewSampleRecipient(sampleRecipient, client)
+	test.ErrFail(err, t)
+	ownerAuth := bind.NewKeyedTransactor(ownerKey3)
+	_, err = sr.SetRevertPreRelayCall(ownerAuth, true)
+	test.ErrFail(err, t)
+	gaslessNonce, err := rhub.GetNonce(nil, crypto.PubkeyToAddress(gaslessKey2.PublicKey))
+	test.ErrFail(err, t)
+	signedTx, err := relay.CreateRelayTransaction(newSignedRelayTransactionRequest(t, gaslessNonce.Int64()))
+	test.ErrFail(err, t)
+	_, err = sr.SetRevertPreRelayCall(ownerAuth, false)
+	test.ErrFail(err, t)
+
+	receipt, err := client.TransactionReceipt(context.Background(), signedTx.Hash())
+	test.ErrFail(err, t)
+	counted, ok, reason := relay.relayCallOutcome(receipt)
+	if !counted || ok || reason != fmt.Sprintf("TransactionRelayed with status %d", RelayCallStatusPreRelayedFailed) {
+		t.Errorf("Expected relayed call to have failed in preRelayedCall but got %v %v %s", counted, ok, reason)
+	}
+	// Clients polling the request are told it failed, although relayCall itself did not revert
+	test.ErrFail(relay.setRequestStatus("preRelayedFailed", txstore.RequestStatus{Status: RelayStatusSent, Nonce: signedTx.Nonce(), TxHash: signedTx.Hash()}), t)
+	status, err := relay.RelayTransactionStatus("preRelayedFailed")
+	test.ErrFail(err, t)
+	if status.Status != RelayStatusFailed || status.Error != reason {
+		t.Errorf("Expected the request to be reported failed with %q but got %+v", reason, status)
+	}
+
+	// A reverted relayCall, or one without any event of the hub, does not count against the recipient
+	for _, notCounted := range []*types.Receipt{{Status: types.ReceiptStatusFailed}, {Status: types.ReceiptStatusSuccessful}} {
+		if counted, _, reason = relay.relayCallOutcome(notCounted); counted {
+			t.Errorf("Expected %+v not to be counted but got %s", notCounted, reason)
+		}
+		relay.recordRelayOutcome(signedTx, notCounted)
+	}
+	request := newSignedRelayTransactionRequest(t, gaslessNonce.Int64()+1)
+	test.ErrFail(relay.ValidateRelayTransaction(&request), t)
+
+	relay.recordRelayOutcome(signedTx, receipt)
+
+	err = relay.ValidateRelayTransaction(&request)
+	if err == nil || !strings.Contains(err.Error(), "Blacklisted recipient") {
+		t.Error("Expected recipient to be blacklisted but got", err)
+	}
+
+	test.ErrFail(relay.Reputation.Clear(reputation.KindRecipient, sampleRecipient), t)
+	test.ErrFail(relay.Reputation.Clear(reputation.KindSender, request.From), t)
+	signedTx, err = relay.CreateRelayTransaction(request)
+	test.ErrFail(err, t)
+	receipt = assertTransactionRelayed(t, signedTx.Hash())
+	if counted, ok, reason = relay.relayCallOutcome(receipt); !counted || !ok {
+		t.Error("Expected relayed call to succeed but got", reason)
+	}
+}
+
+func TestHubIndex(t *testing.T) {
+	indexer, err := hubindex.NewIndexer("", client, rhaddr)
+	test.ErrFail(err, t)
+	defer indexer.Close()
+
+	// Registered within the last RegistrationBlockRate blocks again
+	tx, err := relay.sendRegisterTransaction()
+	test.ErrFail(err, t)
+	test.ErrFail(relay.awaitTransactionMined(tx), t)
+
+	filteredCount, err := relay.BlockCountSinceRegistration()
+	test.ErrFail(err, t)
+	filteredRemoved, err := relay.IsRemoved()
+	test.ErrFail(err, t)
+	filteredUnstaked, err := relay.IsUnstaked()
+	test.ErrFail(err, t)
+
+	relay.HubIndex = indexer
+	defer func() { relay.HubIndex = nil }()
+	count, err := relay.BlockCountSinceRegistration()
+	test.ErrFail(err, t)
+	removed, err := relay.IsRemoved()
+	test.ErrFail(err, t)
+	unstaked, err := relay.IsUnstaked()
+	test.ErrFail(err, t)
+	if count != filteredCount || removed != filteredRemoved || unstaked != filteredUnstaked {
+		t.Errorf("Indexed answers (%d, %v, %v) differ from filtered ones (%d, %v, %v)", count, removed, unstaked, filteredCount, filteredRemoved, filteredUnstaked)
+	}
+
+	relayed, err := indexer.Events("TransactionRelayed", relay.Address())
+	test.ErrFail(err, t)
+	if len(relayed) == 0 {
+		t.Error("Expected TransactionRelayed events of the relay to be indexed")
+	}
+
+	// New blocks are picked up by the next query
+	test.ErrFail(client.MineBlocks(3), t)
+	newCount, err := relay.BlockCountSinceRegistration()
+	test.ErrFail(err, t)
+	if newCount != count+3 {
+		t.Errorf("Expected %d blocks since registration but got %d", count+3, newCount)
+	}
+}
+
+func TestReorgedTransactionIsBroadcastAgain(t *testing.T) {
+	test.ErrFail(relay.TxStore.Clear(), t)
+	gaslessNonce, err := rhub.GetNonce(nil, crypto.PubkeyToAddress(gaslessKey2.PublicKey))
+	test.ErrFail(err, t)
+
+	// The tx is mined and its block recorded, then dropped from the chain by reverting to a previous snapshot
+	snapshotID, err := client.Snapshot()
+	test.ErrFailWithDesc(err, t, "Creating snapshot")
+	signedTx, err := relay.CreateRelayTransaction(newSignedRelayTransactionRequest(t, gaslessNonce.Int64()))
+	test.ErrFailWithDesc(err, t, "Creating relay transaction")
+	assertTransactionRelayed(t, signedTx.Hash())
+	assertNoTransactionResent(t, relay.RelayServer)
+	storedTx, err := relay.TxStore.GetFirstTransaction()
+	test.ErrFail(err, t)
+	if storedTx == nil || storedTx.Hash() != signedTx.Hash() || !storedTx.IsMined() {
+		t.Fatalf("Expected tx %v to be stored as mined but got %v", signedTx.Hash().Hex(), storedTx)
+	}
+	test.ErrFailWithDesc(client.Revert(snapshotID), t, "Restoring snapshot")
+	if _, _, err = client.TransactionBlock(context.Background(), signedTx.Hash()); err != ethereum.NotFound {
+		t.Errorf("Transaction %v should not have been found (error %v)", signedTx.Hash().Hex(), err)
+	}
+
+	// The same signed tx is broadcast again right away, without waiting to resend it
+	assertNoTransactionResent(t, relay.RelayServer)
+	assertTransactionRelayed(t, signedTx.Hash())
+	assertNoTransactionResent(t, relay.RelayServer)
+	storedTx, err = relay.TxStore.GetFirstTransaction()
+	test.ErrFail(err, t)
+	blockNumber, blockHash, err := client.TransactionBlock(context.Background(), signedTx.Hash())
+	test.ErrFail(err, t)
+	if storedTx == nil || storedTx.MinedBlock != blockNumber || storedTx.MinedBlockHash != blockHash {
+		t.Errorf("Expected tx to be stored as mined in block %d %v but got %v", blockNumber, blockHash.Hex(), storedTx)
+	}
+
+	// It is only removed from the store once confirmed
+	test.ErrFail(client.MineBlocks(relay.ConfirmationsNeeded()-1), t)
+	assertNoTransactionResent(t, relay.RelayServer)
+	if storedTx, err = relay.TxStore.GetFirstTransaction(); storedTx == nil || err != nil {
+		t.Errorf("Transaction was removed from store before %d confirmations (error %v)", relay.ConfirmationsNeeded(), err)
+	}
+	test.ErrFail(client.MineBlocks(1), t)
+	assertNoTransactionResent(t, relay.RelayServer)
+	if storedTx, err = relay.TxStore.GetFirstTransaction(); storedTx != nil || err != nil {
+		t.Errorf("Transaction was not removed from store after %d confirmations (error %v)", relay.ConfirmationsNeeded(), err)
+	}
+}
+
+type recordingNotifier struct {
+	alerts []*notify.Alert
+}
+
+func (notifier *recordingNotifier) Notify(alert *notify.Alert) error {
+	notifier.alerts = append(notifier.alerts, alert)
+	return nil
+}
+
+func TestPenalizationWatchdog(t *testing.T) {
+	// Another relay, staked but never sending anything, is penalized for signing a plain transfer
+	penalizedKey, err := crypto.GenerateKey()
+	test.ErrFail(err, t)
+	penalizedServer, err := NewRelayServer(
+		common.Address{}, big.NewInt(10), "", "8090", rhaddr, int64(params.GWei), big.NewInt(10), penalizedKey, 5,
+		ethereumNodeURL, client, txstore.NewMemoryTxStore(clk), clk, false)
+	test.ErrFail(err, t)
+	penalized := TestServer{penalizedServer}
+	notifier := &recordingNotifier{}
+	penalized.Incidents = incident.NewMemoryIncidentStore()
+	penalized.Notifier = notifier
+	penalized.State = lifecycle.NewMemoryStateStore()
+	penalized.Confirmations = 1
+	test.ErrFail(penalized.Stake(ownerKey3, stakeAmount, unstakeDelay), t)
+
+	incidents, err := penalized.WatchPenalization()
+	test.ErrFail(err, t)
+	if len(incidents) != 0 {
+		t.Fatal("Expected no incident before the penalization but got", incidents)
+	}
+
+	// The next watch looks from the last block checked, less the confirmations, and so does a restarted relay
+	latest, err := client.HeaderByNumber(context.Background(), nil)
+	test.ErrFail(err, t)
+	state, err := penalized.LifecycleState()
+	test.ErrFail(err, t)
+	if fromBlock := latest.Number.Uint64() - 1; penalized.penalization.fromBlock != fromBlock || state.PenalizationBlock != fromBlock {
+		t.Errorf("Expected the watch to resume from block %d but got %d (persisted %d)", fromBlock, penalized.penalization.fromBlock, state.PenalizationBlock)
+	}
+	restarted, err := NewRelayServer(
+		common.Address{}, big.NewInt(10), "", "8090", rhaddr, int64(params.GWei), big.NewInt(10), penalizedKey, 5,
+		ethereumNodeURL, client, txstore.NewMemoryTxStore(clk), clk, false)
+	test.ErrFail(err, t)
+	restarted.State = penalized.State
+	_, err = restarted.RestoreState()
+	test.ErrFail(err, t)
+	if restarted.penalization.fromBlock != state.PenalizationBlock {
+		t.Errorf("Expected the restarted watch to resume from block %d but got %d", state.PenalizationBlock, restarted.penalization.fromBlock)
+	}
+
+	chainID, err := penalized.ChainID()
+	test.ErrFail(err, t)
+	illegalTx, unsignedTx, signature := illegalTransaction(t, penalizedKey, chainID)
+	tx, err := rhub.PenalizeIllegalTransaction(bind.NewKeyedTransactor(ownerKey3), unsignedTx, signature)
+	test.ErrFail(err, t)
+	test.ErrFail(penalized.awaitTransactionMined(tx), t)
+
+	incidents, err = penalized.WatchPenalization()
+	test.ErrFail(err, t)
+	if len(incidents) != 1 || incidents[0].Kind != incident.KindPenalized || incidents[0].TxHash != tx.Hash() ||
+		len(incidents[0].OffendingTxHashes) != 1 || incidents[0].OffendingTxHashes[0] != illegalTx.Hash() ||
+		incidents[0].Reporter != crypto.PubkeyToAddress(ownerKey3.PublicKey) {
+		t.Fatalf("Expected a penalization by %v for %v but got %+v", tx.Hash().Hex(), illegalTx.Hash().Hex(), incidents)
+	}
+	penalization := incidents[0]
+	if len(notifier.alerts) != 1 || notifier.alerts[0].Fields["offendingTxs"] != illegalTx.Hash().Hex() {
+		t.Errorf("Expected one alert for the penalization but got %v", notifier.alerts)
+	}
+
+	// The relay stops signing
+	if halted, _ := penalized.Halted(); !halted {
+		t.Error("Expected the penalized relay to be halted")
+	}
+	if _, err = penalized.sendRegisterTransaction(); err == nil || !strings.Contains(err.Error(), "Relay halted") {
+		t.Error("Expected the halted relay not to register but got", err)
+	}
+	request := newSignedRelayTransactionRequest(t, 0)
+	if err = penalized.ValidateRelayTransaction(&request); err == nil || !strings.Contains(err.Error(), "Relay halted") {
+		t.Error("Expected the halted relay to refuse requests but got", err)
+	}
+
+	// Incidents are only recorded once, and halt the relay again after a restart until resolved
+	incidents, err = penalized.WatchPenalization()
+	test.ErrFail(err, t)
+	if len(incidents) != 0 || len(notifier.alerts) != 1 {
+		t.Errorf("Expected the penalization to be recorded once but got %v", incidents)
+	}
+	penalized.Resume()
+	test.ErrFail(penalized.RestoreIncidents(), t)
+	if halted, _ := penalized.Halted(); !halted {
+		t.Error("Expected the relay to be halted by its unresolved incident")
+	}
+	test.ErrFail(penalized.ResolveIncident(penalization.ID), t)
+	if halted, reason := penalized.Halted(); halted {
+		t.Error("Expected the relay to sign again once the incident is resolved, but it is halted:", reason)
+	}
+}
+
+func TestPenalizationSubscription(t *testing.T) {
+	penalizedKey, err := crypto.GenerateKey()
+	test.ErrFail(err, t)
+	penalizedServer, err := NewRelayServer(
+		common.Address{}, big.NewInt(10), "", "8090", rhaddr, int64(params.GWei), big.NewInt(10), penalizedKey, 5,
+		ethereumNodeURL, client, txstore.NewMemoryTxStore(clk), clk, false)
+	test.ErrFail(err, t)
+	penalized := TestServer{penalizedServer}
+	penalized.Incidents = incident.NewMemoryIncidentStore()
+	test.ErrFail(penalized.Stake(ownerKey3, stakeAmount, unstakeDelay), t)
+
+	sub, err := penalized.SubscribePenalization()
+	if err != nil && ethereumNodeURL != "" {
+		t.Skip("The node does not support log subscriptions:", err)
+	}
+	test.ErrFail(err, t)
+	defer sub.Unsubscribe()
+
+	// The penalization is handled as it is mined, without polling
+	chainID, err := penalized.ChainID()
+	test.ErrFail(err, t)
+	_, unsignedTx, signature := illegalTransaction(t, penalizedKey, chainID)
+	tx, err := rhub.PenalizeIllegalTransaction(bind.NewKeyedTransactor(ownerKey3), unsignedTx, signature)
+	test.ErrFail(err, t)
+	test.ErrFail(penalized.awaitTransactionMined(tx), t)
+	for i := 0; i < 100; i++ {
+		if halted, _ := penalized.Halted(); halted {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if halted, _ := penalized.Halted(); !halted {
+		t.Fatal("Expected the subscription to halt the penalized relay")
+	}
+	incidents, err := penalized.ListIncidents()
+	test.ErrFail(err, t)
+	if len(incidents) != 1 || incidents[0].Kind != incident.KindPenalized || incidents[0].TxHash != tx.Hash() {
+		t.Errorf("Expected the penalization by %v to be recorded but got %+v", tx.Hash().Hex(), incidents)
+	}
+	select {
+	case err = <-sub.Err():
+		t.Error("Expected the subscription to go on but it ended:", err)
+	default:
+	}
+}
+
+func TestCheckAlerts(t *testing.T) {
+	notifier := &recordingNotifier{}
+	relay.Notifier = notifier
+	defer func() {
+		relay.Notifier = nil
+		relay.AlertRules = AlertRules{}
+	}()
+	test.ErrFail(relay.TxStore.Clear(), t)
+
+	relay.AlertRules = AlertRules{BalanceBelow: big.NewInt(1), PendingTxAge: 30 * time.Minute, RegistrationBlocks: 1, RegistrationWindow: 1000000}
+	if alerts := relay.CheckAlerts(); len(alerts) != 0 {
+		t.Errorf("Expected no alert but got %v", alerts)
+	}
+
+	// A tx the node never received is pending long enough, and the balance and registration thresholds are raised. The
+	// relay looks for its registration from the block it recorded, since it is older than the window.
+	latest, err := client.HeaderByNumber(context.Background(), nil)
+	test.ErrFail(err, t)
+	registrations, err := relay.hubEventLogs(context.Background(), "RelayAdded", 0, latest.Number.Uint64())
+	test.ErrFail(err, t)
+	if len(registrations) == 0 {
+		t.Fatal("Expected the relay to be registered")
+	}
+	relay.State = lifecycle.NewMemoryStateStore()
+	defer func() { relay.State = nil }()
+	test.ErrFail(relay.State.SaveState(&lifecycle.State{RegisteredBlock: registrations[len(registrations)-1].BlockNumber}), t)
+	test.ErrFail(relay.TxStore.SaveTransaction(types.NewTransaction(1000000, common.Address{}, big.NewInt(0), 21000, big.NewInt(1), nil)), t)
+	defer relay.TxStore.Clear()
+	clk.IncrementBySeconds(31 * 60)
+	relay.AlertRules = AlertRules{
+		BalanceBelow:       new(big.Int).Exp(big.NewInt(10), big.NewInt(30), nil),
+		PendingTxAge:       30 * time.Minute,
+		RegistrationBlocks: 10,
+		RegistrationWindow: 1,
+	}
+	alerts := relay.CheckAlerts()
+	kinds := map[string]bool{}
+	for _, alert := range alerts {
+		kinds[alert.Kind] = true
+		if alert.Fields["relay"] != relay.Address().Hex() || alert.Time == 0 {
+			t.Errorf("Expected the alert to name the relay and its time but got %+v", alert)
+		}
+	}
+	if len(alerts) != 3 || !kinds[AlertBalance] || !kinds[AlertPendingTx] || !kinds[AlertRegistration] {
+		t.Errorf("Expected balance, pending tx and registration alerts but got %v", alerts)
+	}
+	if len(notifier.alerts) != len(alerts) {
+		t.Errorf("Expected %d alerts to be sent but got %d", len(alerts), len(notifier.alerts))
+	}
+}
+
+func TestRefillBalance(t *testing.T) {
+	defer func() { relay.RefillRules = RefillRules{} }()
+	balance, err := relay.Balance()
+	test.ErrFail(err, t)
+	amount := big.NewInt(1e17)
+	chainID, err := relay.ChainID()
+	test.ErrFail(err, t)
+	relay.RefillRules = RefillRules{
+		Funder: funding.NewWalletFunder(ownerKey3, chainID, client),
+		Below:  balance,
+		Amount: amount,
+	}
+	if txHash, err := relay.RefillBalance(); err != nil || txHash != (common.Hash{}) {
+		t.Fatalf("Expected no refill above the low-water mark but got %v (error %v)", txHash.Hex(), err)
+	}
+
+	// Funds are requested once, and the refill tx is tracked until it is mined
+	relay.RefillRules.Below = new(big.Int).Add(balance, big.NewInt(1))
+	txHash, err := relay.RefillBalance()
+	test.ErrFail(err, t)
+	if txHash == (common.Hash{}) {
+		t.Fatal("Expected a refill tx")
+	}
+	receipt, err := client.TransactionReceipt(context.Background(), txHash)
+	test.ErrFailWithDesc(err, t, "Fetching refill tx receipt")
+	if receipt.Status != 1 {
+		t.Fatal("Refill tx failed")
+	}
+	newBalance, err := relay.Balance()
+	test.ErrFail(err, t)
+	if newBalance.Cmp(new(big.Int).Add(balance, amount)) != 0 {
+		t.Errorf("Expected the balance to be refilled to %v but got %v", new(big.Int).Add(balance, amount), newBalance)
+	}
+	relay.RefillRules.Below = newBalance
+	if txHash, err = relay.RefillBalance(); err != nil || txHash != (common.Hash{}) || relay.refill.tracked != nil {
+		t.Errorf("Expected the mined refill to be forgotten but got %+v (error %v)", relay.refill.tracked, err)
+	}
+}
+
+// fakeFunder answers funding requests with txs that stay pending on the chain
+type fakeFunder struct {
+	chain      *fakeHubChain
+	requested  int
+	replaced   []common.Hash
+	replaceErr error
+}
+
+func (funder *fakeFunder) RequestFunds(relay common.Address, amount *big.Int) (common.Hash, error) {
+	funder.requested++
+	txHash := common.BigToHash(big.NewInt(int64(funder.requested)))
+	funder.chain.setPending(txHash, true)
+	return txHash, nil
+}
+
+func (funder *fakeFunder) ReplaceFunds(relay common.Address, amount *big.Int, txHash common.Hash) (common.Hash, error) {
+	funder.replaced = append(funder.replaced, txHash)
+	if funder.replaceErr != nil {
+		return common.Hash{}, funder.replaceErr
+	}
+	newTxHash := common.BigToHash(new(big.Int).Add(txHash.Big(), big.NewInt(1000)))
+	funder.chain.setPending(newTxHash, true)
+	return newTxHash, nil
+}
+
+func TestRefillReplacement(t *testing.T) {
+	relayKey, err := crypto.GenerateKey()
+	test.ErrFail(err, t)
+	chain := newFakeHubChain(crypto.PubkeyToAddress(relayKey.PublicKey), common.Address{})
+	funder := &fakeFunder{chain: chain}
+	states := lifecycle.NewMemoryStateStore()
+	newRelay := func() *RelayServer {
+		relay, err := NewRelayServer(
+			common.Address{}, big.NewInt(10), "", "8090", rhaddr, int64(params.GWei), big.NewInt(10), relayKey, 5,
+			"", chain, txstore.NewMemoryTxStore(clk), clk, false)
+		test.ErrFail(err, t)
+		relay.State = states
+		relay.RefillRules = RefillRules{
+			Funder:  funder,
+			Below:   big.NewInt(1e18),
+			Amount:  big.NewInt(1e17),
+			Timeout: 10 * time.Minute,
+		}
+		_, err = relay.RestoreState()
+		test.ErrFail(err, t)
+		return relay
+	}
+	relay := newRelay()
+	first, err := relay.RefillBalance()
+	test.ErrFail(err, t)
+
+	// The refill is not requested again while it can still be mined, and is replaced once it timed out
+	clk.Increment(9 * time.Minute)
+	if txHash, err := relay.RefillBalance(); err != nil || txHash != first || funder.requested != 1 || len(funder.replaced) != 0 {
+		t.Errorf("Expected refill tx %v to be tracked but got %v (error %v)", first.Hex(), txHash.Hex(), err)
+	}
+	clk.Increment(2 * time.Minute)
+	replacement, err := relay.RefillBalance()
+	test.ErrFail(err, t)
+	if funder.requested != 1 || len(funder.replaced) != 1 || funder.replaced[0] != first || replacement == first {
+		t.Errorf("Expected refill tx %v to be replaced but got %v (%d requests)", first.Hex(), funder.replaced, funder.requested)
+	}
+	state, err := relay.LifecycleState()
+	test.ErrFail(err, t)
+	if state.Refill == nil || len(state.Refill.TxHashes) != 2 || state.Refill.TxHashes[1] != replacement {
+		t.Errorf("Expected the replaced refill to be saved but got %+v", state.Refill)
+	}
+
+	// A restarted relay goes on tracking the saved refill
+	relay = newRelay()
+	if txHash, err := relay.RefillBalance(); err != nil || txHash != replacement || funder.requested != 1 {
+		t.Errorf("Expected the restarted relay to track refill tx %v but got %v (error %v)", replacement.Hex(), txHash.Hex(), err)
+	}
+
+	// A refill the node dropped is sent again, instead of being tracked forever
+	chain.setPending(first, false)
+	chain.setPending(replacement, false)
+	clk.Increment(11 * time.Minute)
+	resent, err := relay.RefillBalance()
+	test.ErrFail(err, t)
+	if funder.requested != 1 || len(funder.replaced) != 2 || funder.replaced[1] != replacement || resent == replacement {
+		t.Errorf("Expected dropped refill tx %v to be sent again but got %v (%d requests)", replacement.Hex(), funder.replaced, funder.requested)
+	}
+	if state, err = relay.LifecycleState(); err != nil || state.Refill == nil || len(state.Refill.TxHashes) != 1 || state.Refill.TxHashes[0] != resent {
+		t.Errorf("Expected only the refill sent again to be tracked but got %+v (error %v)", state.Refill, err)
+	}
+
+	// Funds are requested again when a dropped refill cannot be sent again
+	chain.setPending(resent, false)
+	funder.replaceErr = errors.New("Unknown funding tx")
+	clk.Increment(11 * time.Minute)
+	requested, err := relay.RefillBalance()
+	test.ErrFail(err, t)
+	if funder.requested != 2 || requested != common.BigToHash(big.NewInt(2)) {
+		t.Errorf("Expected funds to be requested again but got %v (%d requests)", requested.Hex(), funder.requested)
+	}
+}
+
+func TestSweepExcessBalance(t *testing.T) {
+	owner := common.HexToAddress("0x1234567890123456789012345678901234567890")
+	previousOwner := relay.OwnerAddress
+	relay.OwnerAddress = owner
+	dir, err := ioutil.TempDir("", "sweep")
+	test.ErrFail(err, t)
+	defer os.RemoveAll(dir)
+	defer func() {
+		relay.OwnerAddress = previousOwner
+		relay.SweepRules = SweepRules{}
+	}()
+	test.ErrFail(relay.TxStore.Clear(), t)
+	defer relay.TxStore.Clear()
+
+	balance, err := relay.Balance()
+	test.ErrFail(err, t)
+	keep := new(big.Int).Sub(balance, big.NewInt(1e17))
+	relay.SweepRules = SweepRules{KeepBalance: balance, AuditFile: filepath.Join(dir, "sweeps.log")}
+	if record, err := relay.SweepExcessBalance(); record != nil || err != nil {
+		t.Fatalf("Expected nothing to sweep but got %+v (error %v)", record, err)
+	}
+
+	// A dry run only writes the audit log
+	relay.SweepRules.KeepBalance = keep
+	relay.SweepRules.DryRun = true
+	dryRun, err := relay.SweepExcessBalance()
+	test.ErrFail(err, t)
+	if dryRun == nil || !dryRun.DryRun || dryRun.TxHash != (common.Hash{}) || dryRun.To != owner {
+		t.Fatalf("Expected a dry run sweep but got %+v", dryRun)
+	}
+	ownerBalance, err := client.BalanceAt(context.Background(), owner, nil)
+	test.ErrFail(err, t)
+	if ownerBalance.Sign() != 0 {
+		t.Fatal("Dry run sent", ownerBalance, "wei to the owner")
+	}
+
+	// The excess is sent to the owner and tracked like the relay's other txs, leaving the working balance
+	relay.SweepRules.DryRun = false
+	record, err := relay.SweepExcessBalance()
+	test.ErrFail(err, t)
+	if record == nil || record.TxHash == (common.Hash{}) || record.Amount.Cmp(dryRun.Amount) != 0 {
+		t.Fatalf("Expected a sweep of %v wei but got %+v", dryRun.Amount, record)
+	}
+	if storedTx, err := relay.TxStore.GetTransactionByHash(record.TxHash); storedTx == nil || err != nil {
+		t.Errorf("Expected the sweep tx to be stored (error %v)", err)
+	}
+	if record, err := relay.SweepExcessBalance(); record != nil || err != nil {
+		t.Errorf("Expected no sweep while the previous one is not tracked as mined but got %+v (error %v)", record, err)
+	}
+	assertNoTransactionResent(t, relay.RelayServer)
+	ownerBalance, err = client.BalanceAt(context.Background(), owner, nil)
+	test.ErrFail(err, t)
+	balance, err = relay.Balance()
+	test.ErrFail(err, t)
+	// What the transfer could have cost if resent with a higher gas price is left to the relay
+	kept := new(big.Int).Add(keep, withdrawalReserve(record.GasPrice))
+	kept.Sub(kept, new(big.Int).Mul(record.GasPrice, new(big.Int).SetUint64(withdrawalGasLimit)))
+	if ownerBalance.Cmp(record.Amount) != 0 || balance.Cmp(kept) != 0 {
+		t.Errorf("Expected the owner to get %v wei and the relay to keep %v wei but got %v and %v", record.Amount, kept, ownerBalance, balance)
+	}
+	if record, err := relay.SweepExcessBalance(); record != nil || err != nil {
+		t.Errorf("Expected nothing left to sweep but got %+v (error %v)", record, err)
+	}
+
+	audit, err := ioutil.ReadFile(filepath.Join(dir, "sweeps.log"))
+	test.ErrFail(err, t)
+	lines := strings.Split(strings.TrimSpace(string(audit)), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[0], `"DryRun":true`) || !strings.Contains(lines[1], record.TxHash.Hex()) {
+		t.Errorf("Expected the dry run and the sweep in the audit log but got %v", lines)
+	}
+}
+
+func TestWithdraw(t *testing.T) {
+	previousOwner := relay.OwnerAddress
+	relay.OwnerAddress = crypto.PubkeyToAddress(ownerKey3.PublicKey)
+	defer func() { relay.OwnerAddress = previousOwner }()
+	test.ErrFail(relay.TxStore.Clear(), t)
+	defer relay.TxStore.Clear()
+	to := common.HexToAddress("0x2234567890123456789012345678901234567890")
+	amount := big.NewInt(1e16)
+
+	if _, err := relay.Withdraw(to, amount, nil); err == nil || !strings.Contains(err.Error(), "approval") {
+		t.Fatal("Expected a withdrawal without the owner's approval to be refused but got", err)
+	}
+	expiry := clk.Now().Add(time.Hour).Unix()
+	signature, err := crypto.Sign(WithdrawalApprovalHash(relay.Address(), to, expiry).Bytes(), ownerKey3)
+	test.ErrFail(err, t)
+	tx, err := relay.Withdraw(to, amount, &WithdrawalApproval{Expiry: expiry, Signature: signature})
+	test.ErrFail(err, t)
+	if storedTx, err := relay.TxStore.GetTransactionByHash(tx.Hash()); storedTx == nil || err != nil {
+		t.Errorf("Expected the withdrawal to be stored (error %v)", err)
+	}
+	client.Commit()
+	if mined, err := relay.withdrawalMined(tx.Nonce()); !mined || err != nil {
+		t.Errorf("Expected the withdrawal to be mined (error %v)", err)
+	}
+	toBalance, err := client.BalanceAt(context.Background(), to, nil)
+	test.ErrFail(err, t)
+	if toBalance.Cmp(amount) != 0 {
+		t.Errorf("Expected %v wei to be withdrawn but got %v", amount, toBalance)
+	}
+
+	// The balance must also cover the transfer at the highest gas price it may be resent with
+	balance, err := relay.Balance()
+	test.ErrFail(err, t)
+	if _, err = relay.Withdraw(relay.OwnerAddress, balance, nil); err != ErrBalanceTooLow {
+		t.Error("Expected withdrawing the whole balance to be refused but got", err)
+	}
+}
+
+func TestRelayState(t *testing.T) {
+	relay.State = lifecycle.NewMemoryStateStore()
+	defer func() { relay.State = nil }()
+
+	staked, err := relay.IsStaked()
+	test.ErrFail(err, t)
+	if !staked {
+		t.Fatal("Relay is not staked")
+	}
+	test.ErrFail(relay.RegisterRelay(), t)
+	state, err := relay.LifecycleState()
+	test.ErrFail(err, t)
+	owner := crypto.PubkeyToAddress(ownerKey3.PublicKey)
+	if state.Owner != owner || state.Stake.Cmp(stakeAmount) != 0 || state.UnstakeDelay.Cmp(unstakeDelay) != 0 {
+		t.Errorf("Expected the stake of %v to be recorded but got %+v", owner.Hex(), state)
+	}
+	latest, err := client.HeaderByNumber(context.Background(), nil)
+	test.ErrFail(err, t)
+	if state.RegisteredBlock != latest.Number.Uint64() {
+		t.Errorf("Expected the registration in block %d to be recorded but got %+v", latest.Number.Uint64(), state)
+	}
+	removed, err := relay.IsRemoved()
+	test.ErrFail(err, t)
+	if state, err = relay.LifecycleState(); removed || err != nil || state.Removed != 0 {
+		t.Errorf("Expected the relay not to be removed but got %+v (error %v)", state, err)
+	}
+
+	// A restarted relay with no configured owner gets it back from the state store
+	restarted, err := NewRelayServer(
+		common.Address{}, big.NewInt(10), "", "8090", rhaddr, int64(params.GWei), big.NewInt(10), relay.PrivateKey, 5,
+		ethereumNodeURL, client, txstore.NewMemoryTxStore(clk), clk, false)
+	test.ErrFail(err, t)
+	restarted.State = relay.State
+	_, err = restarted.RestoreState()
+	test.ErrFail(err, t)
+	if restarted.OwnerAddress != owner {
+		t.Errorf("Expected the owner %v to be restored but got %v", owner.Hex(), restarted.OwnerAddress.Hex())
+	}
+	test.ErrFail(restarted.RecordWithdrawn(), t)
+	if state, err = relay.LifecycleState(); err != nil || state.Withdrawn == 0 || state.Owner != owner {
+		t.Errorf("Expected the withdrawal to be recorded but got %+v (error %v)", state, err)
+	}
+}
@@ -0,0 +1,121 @@
+package librelay
+
+import (
+	"context"
+	"librelay/lifecycle"
+	"log"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// RestoreState loads the persisted lifecycle state after a restart. The owner seen staking the relay is restored
+// when none is configured, and so are the lifecycle phase and the refill being tracked.
+func (relay *RelayServer) RestoreState() (state *lifecycle.State, err error) {
+	state, err = relay.LifecycleState()
+	if err != nil {
+		log.Println("Could not load relay state", err)
+		return
+	}
+	if relay.OwnerAddress == (common.Address{}) && state.Owner != (common.Address{}) {
+		relay.OwnerAddress = state.Owner
+		log.Println("Owner is", relay.OwnerAddress.Hex())
+	}
+	relay.restorePhase(state)
+	relay.restoreRefill(state)
+	relay.restorePenalizationWatch(state)
+	return
+}
+
+// LifecycleState returns the persisted lifecycle state, or an empty state if there is no state store
+func (relay *RelayServer) LifecycleState() (state *lifecycle.State, err error) {
+	if relay.State == nil {
+		return &lifecycle.State{}, nil
+	}
+	return relay.State.GetState()
+}
+
+// updateState applies update to the persisted state, saving it if update reports a change
+func (relay *RelayServer) updateState(update func(state *lifecycle.State) (changed bool)) (err error) {
+	if relay.State == nil {
+		return nil
+	}
+	relay.stateMutex.Lock()
+	defer relay.stateMutex.Unlock()
+	state, err := relay.State.GetState()
+	if err != nil {
+		log.Println("Could not load relay state", err)
+		return
+	}
+	if !update(state) {
+		return nil
+	}
+	if err = relay.State.SaveState(state); err != nil {
+		log.Println("Could not save relay state", err)
+	}
+	return
+}
+
+func (relay *RelayServer) recordStake(owner common.Address, stake *big.Int, unstakeDelay *big.Int) {
+	relay.updateState(func(state *lifecycle.State) bool {
+		if state.Owner == owner && bigEqual(state.Stake, stake) && bigEqual(state.UnstakeDelay, unstakeDelay) {
+			return false
+		}
+		state.Owner, state.Stake, state.UnstakeDelay = owner, stake, unstakeDelay
+		return true
+	})
+}
+
+func (relay *RelayServer) recordRegistration(ctx context.Context, txHash common.Hash) {
+	blockNumber, _, err := relay.Client.TransactionBlock(ctx, txHash)
+	if err != nil {
+		log.Println("Could not get the block of registration tx", txHash.Hex(), err)
+		return
+	}
+	relay.updateState(func(state *lifecycle.State) bool {
+		state.RegisteredBlock = blockNumber
+		return true
+	})
+}
+
+func (relay *RelayServer) recordPenalizationBlock(blockNumber uint64) {
+	relay.updateState(func(state *lifecycle.State) bool {
+		state.PenalizationBlock = blockNumber
+		return true
+	})
+}
+
+func (relay *RelayServer) recordRemoved() {
+	relay.updateState(func(state *lifecycle.State) bool {
+		if state.Removed != 0 {
+			return false
+		}
+		state.Removed = relay.clock.Now().Unix()
+		return true
+	})
+}
+
+func (relay *RelayServer) recordUnstaked() {
+	relay.updateState(func(state *lifecycle.State) bool {
+		if state.Unstaked != 0 {
+			return false
+		}
+		state.Unstaked = relay.clock.Now().Unix()
+		return true
+	})
+}
+
+// RecordWithdrawn records that the balance was withdrawn to the owner after unstaking, the end of the relay's lifecycle
+func (relay *RelayServer) RecordWithdrawn() (err error) {
+	return relay.updateState(func(state *lifecycle.State) bool {
+		state.Withdrawn = relay.clock.Now().Unix()
+		return true
+	})
+}
+
+func bigEqual(a *big.Int, b *big.Int) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Cmp(b) == 0
+}
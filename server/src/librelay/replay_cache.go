@@ -0,0 +1,129 @@
+package librelay
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/clock"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// How long a relayed request is remembered to detect retries
+const replayCacheTTL = time.Hour
+
+type replayKey struct {
+	from  common.Address
+	to    common.Address
+	hub   common.Address
+	nonce string
+}
+
+type replayEntry struct {
+	requestHash common.Hash
+	signedTx    *types.Transaction
+	sent        time.Time
+}
+
+// replayCache remembers the transaction sent for each (from, to, recipientNonce, hub), so that a client retrying a
+// request gets the transaction already sent instead of the relay paying for a second one that is bound to revert
+type replayCache struct {
+	entries map[replayKey]replayEntry
+	mutex   *sync.Mutex
+	clock   clock.Clock
+}
+
+func newReplayCache(clk clock.Clock) *replayCache {
+	return &replayCache{
+		entries: make(map[replayKey]replayEntry),
+		mutex:   &sync.Mutex{},
+		clock:   clk,
+	}
+}
+
+func newReplayKey(request *RelayTransactionRequest) replayKey {
+	return replayKey{request.From, request.To, request.RelayHubAddress, request.RecipientNonce.String()}
+}
+
+func (cache *replayCache) get(key replayKey) (entry replayEntry, ok bool) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	entry, ok = cache.entries[key]
+	if ok && cache.clock.Since(entry.sent) > replayCacheTTL {
+		delete(cache.entries, key)
+		return entry, false
+	}
+	return
+}
+
+func (cache *replayCache) set(key replayKey, requestHash common.Hash, signedTx *types.Transaction) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	now := cache.clock.Now()
+	for k, entry := range cache.entries {
+		if now.Sub(entry.sent) > replayCacheTTL {
+			delete(cache.entries, k)
+		}
+	}
+	cache.entries[key] = replayEntry{requestHash, signedTx, now}
+}
+
+func (cache *replayCache) remove(key replayKey) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	delete(cache.entries, key)
+}
+
+// replayHash identifies a request exactly: everything the sender signed plus the approval data
+func (relay *RelayServer) replayHash(request *RelayTransactionRequest) common.Hash {
+	return crypto.Keccak256Hash(request.Hash(relay.Address()).Bytes(), request.ApprovalData)
+}
+
+// checkReplay returns the transaction already sent for an identical request, following resends, or an error if a
+// different request for the same sender nonce is still pending. It returns nil, nil for new requests.
+func (relay *RelayServer) checkReplay(request *RelayTransactionRequest) (signedTx *types.Transaction, err error) {
+	key := newReplayKey(request)
+	entry, ok := relay.replays.get(key)
+	if !ok {
+		return nil, nil
+	}
+	pending, err := relay.TxStore.GetTransactionByNonce(entry.signedTx.Nonce())
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	if pending != nil && !pending.HasHash(entry.signedTx.Hash()) {
+		pending = nil
+	}
+
+	if entry.requestHash == relay.replayHash(request) {
+		signedTx = entry.signedTx
+		if pending != nil {
+			signedTx = pending.Transaction
+		}
+		// A tx the node dropped (e.g. after a reorg) is of no use to the client: relay the request again
+		_, _, err = relay.Client.TransactionByHash(context.Background(), signedTx.Hash())
+		if err == ethereum.NotFound {
+			log.Println("Relayed tx", signedTx.Hash().Hex(), "is no longer known to the node, relaying again")
+			relay.replays.remove(key)
+			return nil, nil
+		} else if err != nil {
+			log.Println(err)
+			return nil, err
+		}
+		log.Println("Request from", request.From.Hex(), "nonce", request.RecipientNonce.String(), "already relayed in", signedTx.Hash().Hex())
+		return signedTx, nil
+	}
+	if pending != nil {
+		err = fmt.Errorf("Conflicting request: nonce %s of %s is pending in tx %s", request.RecipientNonce.String(), request.From.Hex(), pending.Hash().Hex())
+		log.Println(err)
+		return nil, err
+	}
+	return nil, nil
+}
@@ -0,0 +1,66 @@
+package reputation
+
+import (
+	"encoding/json"
+
+	"github.com/ethereum/go-ethereum/common"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+type LevelDbReputationStore struct {
+	*leveldb.DB
+}
+
+func NewLevelDbReputationStore(file string) (store *LevelDbReputationStore, err error) {
+	db, err := leveldb.OpenFile(file, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &LevelDbReputationStore{db}, nil
+}
+
+// Records are stored as json under their kind followed by their address
+func recordKey(kind string, address common.Address) []byte {
+	return append([]byte(kind+":"), address.Bytes()...)
+}
+
+// GetRecord returns the record of the address, or nil if there is none
+func (store *LevelDbReputationStore) GetRecord(kind string, address common.Address) (record *Record, err error) {
+	value, err := store.Get(recordKey(kind, address), nil)
+	if err == leveldb.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	record = &Record{}
+	err = json.Unmarshal(value, record)
+	return
+}
+
+func (store *LevelDbReputationStore) SaveRecord(record *Record) (err error) {
+	value, err := json.Marshal(record)
+	if err != nil {
+		return
+	}
+	return store.Put(recordKey(record.Kind, record.Address), value, nil)
+}
+
+func (store *LevelDbReputationStore) DeleteRecord(kind string, address common.Address) (err error) {
+	return store.Delete(recordKey(kind, address), nil)
+}
+
+// ListRecords returns all records, sorted by kind and address
+func (store *LevelDbReputationStore) ListRecords() (records []*Record, err error) {
+	iter := store.NewIterator(nil, nil)
+	defer iter.Release()
+	records = make([]*Record, 0, 20)
+	for iter.Next() {
+		record := &Record{}
+		if err = json.Unmarshal(iter.Value(), record); err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, iter.Error()
+}
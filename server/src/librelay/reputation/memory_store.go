@@ -0,0 +1,73 @@
+package reputation
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+type memoryKey struct {
+	kind    string
+	address common.Address
+}
+
+type MemoryReputationStore struct {
+	records map[memoryKey]Record
+	mutex   *sync.Mutex
+}
+
+func NewMemoryReputationStore() *MemoryReputationStore {
+	return &MemoryReputationStore{
+		records: make(map[memoryKey]Record),
+		mutex:   &sync.Mutex{},
+	}
+}
+
+// GetRecord returns the record of the address, or nil if there is none
+func (store *MemoryReputationStore) GetRecord(kind string, address common.Address) (record *Record, err error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	found, ok := store.records[memoryKey{kind, address}]
+	if !ok {
+		return nil, nil
+	}
+	return &found, nil
+}
+
+func (store *MemoryReputationStore) SaveRecord(record *Record) (err error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.records[memoryKey{record.Kind, record.Address}] = *record
+	return nil
+}
+
+func (store *MemoryReputationStore) DeleteRecord(kind string, address common.Address) (err error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	delete(store.records, memoryKey{kind, address})
+	return nil
+}
+
+// ListRecords returns all records, sorted by kind and address like the LevelDB store
+func (store *MemoryReputationStore) ListRecords() (records []*Record, err error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	records = make([]*Record, 0, len(store.records))
+	for _, record := range store.records {
+		record := record
+		records = append(records, &record)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].Kind != records[j].Kind {
+			return records[i].Kind < records[j].Kind
+		}
+		return bytes.Compare(records[i].Address.Bytes(), records[j].Address.Bytes()) < 0
+	})
+	return
+}
+
+func (store *MemoryReputationStore) Close() (err error) {
+	return nil
+}
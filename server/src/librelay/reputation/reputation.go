@@ -0,0 +1,174 @@
+package reputation
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/clock"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// Kinds of addresses whose relayed calls are tracked
+const (
+	KindRecipient = "recipient"
+	KindSender    = "sender"
+)
+
+// Record is the reputation of a recipient or sender: how many of its relayed calls succeeded or failed since
+// WindowStart, and until when its requests are refused
+type Record struct {
+	Kind             string
+	Address          common.Address
+	Successes        uint64
+	Failures         uint64
+	WindowStart      int64  // unix time the counters were last reset
+	BlacklistedUntil int64  // unix time until which requests are refused, 0 if not blacklisted
+	LastFailure      string `json:",omitempty"`
+}
+
+type IReputationStore interface {
+	GetRecord(kind string, address common.Address) (record *Record, err error)
+	SaveRecord(record *Record) (err error)
+	DeleteRecord(kind string, address common.Address) (err error)
+	ListRecords() (records []*Record, err error)
+	Close() (err error)
+}
+
+// Settings decide when an address gets blacklisted: once at least MinSamples of its relayed calls were seen within
+// Window, and more than MaxFailurePercent of them failed, its requests are refused for Cooldown
+type Settings struct {
+	MinSamples        uint64
+	MaxFailurePercent uint64 // 0 disables automatic blacklisting
+	Window            time.Duration
+	Cooldown          time.Duration
+}
+
+// DefaultSettings blacklist an address for an hour when more than half of at least 10 of its calls in a day failed
+var DefaultSettings = Settings{
+	MinSamples:        10,
+	MaxFailurePercent: 50,
+	Window:            24 * time.Hour,
+	Cooldown:          time.Hour,
+}
+
+// Tracker keeps the reputation of recipients and senders from the outcome of their relayed calls
+type Tracker struct {
+	Settings
+	store IReputationStore
+	clock clock.Clock
+	mutex *sync.Mutex
+}
+
+func NewTracker(store IReputationStore, settings Settings, clk clock.Clock) *Tracker {
+	if clk == nil {
+		clk = clock.NewClock()
+	}
+	return &Tracker{settings, store, clk, &sync.Mutex{}}
+}
+
+func validKind(kind string) error {
+	if kind != KindRecipient && kind != KindSender {
+		return fmt.Errorf("Unknown address kind %q: expected %s or %s", kind, KindRecipient, KindSender)
+	}
+	return nil
+}
+
+// load returns the record of the address, with its counters reset if its window is over. The caller must hold mutex.
+func (tracker *Tracker) load(kind string, address common.Address) (record *Record, err error) {
+	record, err = tracker.store.GetRecord(kind, address)
+	if err != nil {
+		return
+	}
+	now := tracker.clock.Now()
+	if record == nil {
+		return &Record{Kind: kind, Address: address, WindowStart: now.Unix()}, nil
+	}
+	if now.Sub(time.Unix(record.WindowStart, 0)) > tracker.Window {
+		record.Successes = 0
+		record.Failures = 0
+		record.WindowStart = now.Unix()
+	}
+	return
+}
+
+// RecordSuccess counts a successful relayed call of the address
+func (tracker *Tracker) RecordSuccess(kind string, address common.Address) (err error) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	record, err := tracker.load(kind, address)
+	if err != nil {
+		return
+	}
+	record.Successes++
+	return tracker.store.SaveRecord(record)
+}
+
+// RecordFailure counts a failed relayed call of the address, and blacklists it if its failure rate is too high.
+// Returns whether the address got blacklisted.
+func (tracker *Tracker) RecordFailure(kind string, address common.Address, reason string) (blacklisted bool, err error) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	record, err := tracker.load(kind, address)
+	if err != nil {
+		return
+	}
+	record.Failures++
+	record.LastFailure = reason
+	samples := record.Successes + record.Failures
+	now := tracker.clock.Now()
+	if tracker.MaxFailurePercent > 0 && samples >= tracker.MinSamples && record.Failures*100 > tracker.MaxFailurePercent*samples {
+		blacklisted = true
+		record.BlacklistedUntil = now.Add(tracker.Cooldown).Unix()
+		// The address starts over once the cooldown is over
+		record.Successes = 0
+		record.Failures = 0
+		record.WindowStart = record.BlacklistedUntil
+	}
+	return blacklisted, tracker.store.SaveRecord(record)
+}
+
+// BlacklistedUntil returns until when requests involving the address are refused, if they are
+func (tracker *Tracker) BlacklistedUntil(kind string, address common.Address) (until time.Time, blacklisted bool, err error) {
+	record, err := tracker.store.GetRecord(kind, address)
+	if err != nil || record == nil {
+		return
+	}
+	until = time.Unix(record.BlacklistedUntil, 0)
+	return until, tracker.clock.Now().Before(until), nil
+}
+
+// Blacklist refuses requests involving the address for the given duration, regardless of its calls
+func (tracker *Tracker) Blacklist(kind string, address common.Address, duration time.Duration) (err error) {
+	if err = validKind(kind); err != nil {
+		return
+	}
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	record, err := tracker.load(kind, address)
+	if err != nil {
+		return
+	}
+	record.BlacklistedUntil = tracker.clock.Now().Add(duration).Unix()
+	return tracker.store.SaveRecord(record)
+}
+
+// Clear forgets the reputation of the address, lifting its blacklisting
+func (tracker *Tracker) Clear(kind string, address common.Address) (err error) {
+	if err = validKind(kind); err != nil {
+		return
+	}
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	return tracker.store.DeleteRecord(kind, address)
+}
+
+// Records returns the reputation of every address seen
+func (tracker *Tracker) Records() (records []*Record, err error) {
+	return tracker.store.ListRecords()
+}
+
+func (tracker *Tracker) Close() (err error) {
+	return tracker.store.Close()
+}
@@ -0,0 +1,121 @@
+package reputation
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"librelay/test"
+
+	"code.cloudfoundry.org/clock/fakeclock"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+var recipient = common.HexToAddress("0x9C57C0F1965D225951FE1B2618C92Eefd687654F")
+var sender = common.HexToAddress("0xFFcf8FDEE72ac11b5c542428B35EEF5769C409f0")
+
+func testTracker(t *testing.T, store IReputationStore) {
+	clk := fakeclock.NewFakeClock(time.Now())
+	settings := Settings{MinSamples: 4, MaxFailurePercent: 50, Window: time.Hour, Cooldown: 10 * time.Minute}
+	tracker := NewTracker(store, settings, clk)
+
+	t.Run("Failures below MinSamples do not blacklist", func(t *testing.T) {
+		test.ErrFail(tracker.RecordSuccess(KindRecipient, recipient), t)
+		for i := 0; i < 2; i++ {
+			blacklisted, err := tracker.RecordFailure(KindRecipient, recipient, "postRelayedCall reverted")
+			test.ErrFail(err, t)
+			if blacklisted {
+				t.Fatal("Blacklisted with", i+2, "samples")
+			}
+		}
+		_, blacklisted, err := tracker.BlacklistedUntil(KindRecipient, recipient)
+		test.ErrFail(err, t)
+		if blacklisted {
+			t.Error("Expected recipient not to be blacklisted")
+		}
+	})
+
+	t.Run("Failure rate above MaxFailurePercent blacklists for Cooldown", func(t *testing.T) {
+		blacklisted, err := tracker.RecordFailure(KindRecipient, recipient, "postRelayedCall reverted")
+		test.ErrFail(err, t)
+		until, stillBlacklisted, err := tracker.BlacklistedUntil(KindRecipient, recipient)
+		test.ErrFail(err, t)
+		if !blacklisted || !stillBlacklisted || until.Unix() != clk.Now().Add(10*time.Minute).Unix() {
+			t.Errorf("Expected recipient to be blacklisted for 10 minutes but got %v until %v", stillBlacklisted, until)
+		}
+		// Senders are tracked separately
+		_, blacklisted, err = tracker.BlacklistedUntil(KindSender, recipient)
+		test.ErrFail(err, t)
+		if blacklisted {
+			t.Error("Expected sender not to be blacklisted")
+		}
+
+		clk.Increment(11 * time.Minute)
+		_, blacklisted, err = tracker.BlacklistedUntil(KindRecipient, recipient)
+		test.ErrFail(err, t)
+		if blacklisted {
+			t.Error("Expected blacklisting to be over after the cooldown")
+		}
+		record, err := store.GetRecord(KindRecipient, recipient)
+		test.ErrFail(err, t)
+		if record.Failures != 0 || record.Successes != 0 || record.LastFailure != "postRelayedCall reverted" {
+			t.Errorf("Expected counters to be reset after blacklisting but got %+v", record)
+		}
+	})
+
+	t.Run("Counters reset after Window", func(t *testing.T) {
+		for i := 0; i < 3; i++ {
+			_, err := tracker.RecordFailure(KindSender, sender, "CanRelayFailed")
+			test.ErrFail(err, t)
+		}
+		clk.Increment(2 * time.Hour)
+		blacklisted, err := tracker.RecordFailure(KindSender, sender, "CanRelayFailed")
+		test.ErrFail(err, t)
+		record, err := store.GetRecord(KindSender, sender)
+		test.ErrFail(err, t)
+		if blacklisted || record.Failures != 1 {
+			t.Errorf("Expected failures before the window to be forgotten but got %+v", record)
+		}
+	})
+
+	t.Run("Blacklist, Clear and Records", func(t *testing.T) {
+		test.ErrFail(tracker.Blacklist(KindSender, sender, time.Minute), t)
+		_, blacklisted, err := tracker.BlacklistedUntil(KindSender, sender)
+		test.ErrFail(err, t)
+		if !blacklisted {
+			t.Error("Expected sender to be blacklisted")
+		}
+		if tracker.Blacklist("relay", sender, time.Minute) == nil {
+			t.Error("Expected unknown kind to be rejected")
+		}
+
+		records, err := tracker.Records()
+		test.ErrFail(err, t)
+		if len(records) != 2 || records[0].Kind != KindRecipient || records[1].Address != sender {
+			t.Errorf("Unexpected records %+v", records)
+		}
+
+		test.ErrFail(tracker.Clear(KindSender, sender), t)
+		_, blacklisted, err = tracker.BlacklistedUntil(KindSender, sender)
+		test.ErrFail(err, t)
+		if blacklisted {
+			t.Error("Expected sender not to be blacklisted after Clear")
+		}
+	})
+}
+
+func TestMemoryReputationStore(t *testing.T) {
+	testTracker(t, NewMemoryReputationStore())
+}
+
+func TestLevelDbReputationStore(t *testing.T) {
+	os.RemoveAll("test.db")
+	store, err := NewLevelDbReputationStore("test.db")
+	test.ErrFail(err, t)
+	defer func() {
+		store.Close()
+		os.RemoveAll("test.db")
+	}()
+	testTracker(t, store)
+}
@@ -0,0 +1,195 @@
+package scheduler
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/clock"
+)
+
+// Job is a task run periodically by the scheduler. A job never runs concurrently with itself: the next run is
+// scheduled once the previous one returns.
+type Job struct {
+	Name       string
+	Run        func() error
+	Interval   time.Duration // between the end of a run and the start of the next
+	Delay      time.Duration // before the first run
+	Jitter     time.Duration // a random delay up to Jitter is added to each wait, so jobs do not all run at once
+	MaxBackoff time.Duration // the interval doubles after each consecutive failure up to MaxBackoff, no backoff if not above Interval
+}
+
+// JobStatus reports the runs of a job
+type JobStatus struct {
+	Name      string
+	Running   bool
+	Runs      uint64
+	Failures  uint64 // consecutive failed runs, reset by a successful one
+	LastRun   time.Time
+	LastError string `json:",omitempty"`
+	NextRun   time.Time
+}
+
+type scheduledJob struct {
+	Job
+	status JobStatus
+	stop   chan struct{}
+}
+
+// Scheduler runs named jobs, each in a goroutine of its own
+type Scheduler struct {
+	jobs   map[string]*scheduledJob
+	mutex  *sync.Mutex
+	wg     *sync.WaitGroup
+	random *rand.Rand
+	clock  clock.Clock
+}
+
+func New(clk clock.Clock) *Scheduler {
+	if clk == nil {
+		clk = clock.NewClock()
+	}
+	return &Scheduler{
+		jobs:   make(map[string]*scheduledJob),
+		mutex:  &sync.Mutex{},
+		wg:     &sync.WaitGroup{},
+		random: rand.New(rand.NewSource(clk.Now().UnixNano())),
+		clock:  clk,
+	}
+}
+
+// Add starts running the job after its delay
+func (scheduler *Scheduler) Add(job Job) (err error) {
+	if job.Interval <= 0 {
+		return fmt.Errorf("Job %s: interval must be positive", job.Name)
+	}
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+	if _, ok := scheduler.jobs[job.Name]; ok {
+		return fmt.Errorf("Job %s already scheduled", job.Name)
+	}
+	scheduled := &scheduledJob{Job: job, status: JobStatus{Name: job.Name}, stop: make(chan struct{})}
+	scheduler.jobs[job.Name] = scheduled
+	scheduler.wg.Add(1)
+	go scheduler.loop(scheduled)
+	return nil
+}
+
+// Stop stops the job without waiting for a run in progress, so a job may stop itself. Its status is still reported.
+func (scheduler *Scheduler) Stop(name string) {
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+	job, ok := scheduler.jobs[name]
+	if !ok {
+		return
+	}
+	select {
+	case <-job.stop:
+	default:
+		close(job.stop)
+	}
+}
+
+// Close stops all the jobs and waits for the runs in progress. It must not be called from a job.
+func (scheduler *Scheduler) Close() {
+	scheduler.mutex.Lock()
+	names := make([]string, 0, len(scheduler.jobs))
+	for name := range scheduler.jobs {
+		names = append(names, name)
+	}
+	scheduler.mutex.Unlock()
+	for _, name := range names {
+		scheduler.Stop(name)
+	}
+	scheduler.wg.Wait()
+}
+
+// Status returns the status of the jobs, sorted by name
+func (scheduler *Scheduler) Status() (statuses []JobStatus) {
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+	statuses = make([]JobStatus, 0, len(scheduler.jobs))
+	for _, job := range scheduler.jobs {
+		statuses = append(statuses, job.status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return
+}
+
+func (scheduler *Scheduler) loop(job *scheduledJob) {
+	defer scheduler.wg.Done()
+	wait := job.Delay
+	for {
+		wait += scheduler.jitter(job.Jitter)
+		scheduler.mutex.Lock()
+		job.status.NextRun = scheduler.clock.Now().Add(wait)
+		scheduler.mutex.Unlock()
+		if !scheduler.sleep(wait, job.stop) {
+			return
+		}
+
+		scheduler.mutex.Lock()
+		job.status.Running = true
+		job.status.LastRun = scheduler.clock.Now()
+		scheduler.mutex.Unlock()
+		err := job.Run()
+		scheduler.mutex.Lock()
+		job.status.Running = false
+		job.status.Runs++
+		if err != nil {
+			job.status.Failures++
+			job.status.LastError = err.Error()
+			log.Printf("Job %s failed (%d in a row): %v\n", job.Name, job.status.Failures, err)
+		} else {
+			job.status.Failures = 0
+			job.status.LastError = ""
+		}
+		wait = backoff(job.Interval, job.MaxBackoff, job.status.Failures)
+		scheduler.mutex.Unlock()
+	}
+}
+
+// sleep waits for the duration, returning false if the job is stopped first
+func (scheduler *Scheduler) sleep(duration time.Duration, stop chan struct{}) bool {
+	if duration <= 0 {
+		select {
+		case <-stop:
+			return false
+		default:
+			return true
+		}
+	}
+	timer := scheduler.clock.NewTimer(duration)
+	select {
+	case <-timer.C():
+		return true
+	case <-stop:
+		timer.Stop()
+		return false
+	}
+}
+
+func (scheduler *Scheduler) jitter(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+	return time.Duration(scheduler.random.Int63n(int64(max)))
+}
+
+// backoff returns the wait after the given number of consecutive failures: the interval doubled for each, up to
+// maxBackoff
+func backoff(interval time.Duration, maxBackoff time.Duration, failures uint64) time.Duration {
+	wait := interval
+	for i := uint64(0); i < failures && wait < maxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > maxBackoff && maxBackoff > interval {
+		wait = maxBackoff
+	}
+	return wait
+}
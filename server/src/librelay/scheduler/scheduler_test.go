@@ -0,0 +1,184 @@
+package scheduler
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"librelay/test"
+
+	"code.cloudfoundry.org/clock/fakeclock"
+)
+
+// awaitRun waits for the job to report a run, failing if there is none or one was not expected
+func awaitRun(t *testing.T, runs chan int, expected bool) {
+	timeout := time.Second
+	if !expected {
+		timeout = 50 * time.Millisecond
+	}
+	select {
+	case run := <-runs:
+		if !expected {
+			t.Errorf("Unexpected run %d", run)
+		}
+	case <-time.After(timeout):
+		if expected {
+			t.Error("Expected the job to run")
+		}
+	}
+}
+
+// awaitTimer waits until the job waits for its next run on the fake clock
+func awaitTimer(t *testing.T, clk *fakeclock.FakeClock) {
+	for i := 0; clk.WaiterCount() == 0; i++ {
+		if i == 1000 {
+			t.Fatal("Expected the job to wait for its next run")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	clk := fakeclock.NewFakeClock(time.Now())
+	scheduler := New(clk)
+	defer scheduler.Close()
+	runs := make(chan int, 10)
+	count := 0
+	err := scheduler.Add(Job{Name: "count", Interval: 10 * time.Second, Run: func() error {
+		count++
+		runs <- count
+		return nil
+	}})
+	test.ErrFail(err, t)
+
+	awaitRun(t, runs, true)
+	awaitTimer(t, clk)
+	clk.Increment(9 * time.Second)
+	awaitRun(t, runs, false)
+	clk.Increment(time.Second)
+	awaitRun(t, runs, true)
+	awaitTimer(t, clk)
+
+	status := scheduler.Status()
+	if len(status) != 1 || status[0].Name != "count" || status[0].Runs != 2 || status[0].Failures != 0 || status[0].Running ||
+		!status[0].NextRun.Equal(clk.Now().Add(10*time.Second)) {
+		t.Errorf("Wrong status %+v", status)
+	}
+
+	if err = scheduler.Add(Job{Name: "count", Interval: time.Second, Run: func() error { return nil }}); err == nil {
+		t.Error("Expected a job with the same name to be rejected")
+	}
+	if err = scheduler.Add(Job{Name: "zero", Run: func() error { return nil }}); err == nil {
+		t.Error("Expected a job without an interval to be rejected")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	clk := fakeclock.NewFakeClock(time.Now())
+	scheduler := New(clk)
+	defer scheduler.Close()
+	runs := make(chan int, 10)
+	fail := true
+	count := 0
+	scheduler.Add(Job{Name: "flaky", Interval: time.Second, MaxBackoff: 4 * time.Second, Delay: time.Second, Run: func() error {
+		count++
+		runs <- count
+		if fail {
+			return errors.New("Node unreachable")
+		}
+		return nil
+	}})
+
+	// The first run after the delay, then 2, 4 and 4 seconds between failures
+	for _, wait := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 4 * time.Second} {
+		awaitTimer(t, clk)
+		clk.Increment(wait - time.Millisecond)
+		awaitRun(t, runs, false)
+		clk.Increment(time.Millisecond)
+		awaitRun(t, runs, true)
+	}
+	awaitTimer(t, clk)
+	status := scheduler.Status()[0]
+	if status.Runs != 4 || status.Failures != 4 || status.LastError != "Node unreachable" {
+		t.Errorf("Wrong status %+v", status)
+	}
+
+	// A success resets the interval
+	fail = false
+	clk.Increment(4 * time.Second)
+	awaitRun(t, runs, true)
+	awaitTimer(t, clk)
+	clk.Increment(time.Second)
+	awaitRun(t, runs, true)
+	awaitTimer(t, clk)
+	status = scheduler.Status()[0]
+	if status.Runs != 6 || status.Failures != 0 || status.LastError != "" {
+		t.Errorf("Wrong status %+v", status)
+	}
+}
+
+func TestJitter(t *testing.T) {
+	clk := fakeclock.NewFakeClock(time.Now())
+	scheduler := New(clk)
+	defer scheduler.Close()
+	runs := make(chan int, 10)
+	scheduler.Add(Job{Name: "spread", Interval: time.Minute, Delay: time.Minute, Jitter: 10 * time.Second, Run: func() error {
+		runs <- 1
+		return nil
+	}})
+	awaitTimer(t, clk)
+	next := scheduler.Status()[0].NextRun
+	if next.Before(clk.Now().Add(time.Minute)) || !next.Before(clk.Now().Add(70*time.Second)) {
+		t.Errorf("Expected the first run within 10s after a minute but got %v", next.Sub(clk.Now()))
+	}
+	clk.Increment(70 * time.Second)
+	awaitRun(t, runs, true)
+}
+
+func TestStopFromJob(t *testing.T) {
+	clk := fakeclock.NewFakeClock(time.Now())
+	scheduler := New(clk)
+	runs := make(chan int, 10)
+	scheduler.Add(Job{Name: "once", Interval: time.Second, Run: func() error {
+		runs <- 1
+		scheduler.Stop("once")
+		return nil
+	}})
+	awaitRun(t, runs, true)
+	clk.Increment(time.Second)
+	awaitRun(t, runs, false)
+
+	closed := make(chan bool)
+	go func() {
+		scheduler.Close()
+		closed <- true
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Error("Expected the scheduler to close")
+	}
+	if status := scheduler.Status(); len(status) != 1 || status[0].Runs != 1 {
+		t.Errorf("Expected the stopped job to be reported but got %+v", status)
+	}
+}
+
+func TestBackoffDuration(t *testing.T) {
+	for _, c := range []struct {
+		interval   time.Duration
+		maxBackoff time.Duration
+		failures   uint64
+		expected   time.Duration
+	}{
+		{time.Minute, 0, 3, time.Minute},
+		{time.Minute, 10 * time.Minute, 0, time.Minute},
+		{time.Minute, 10 * time.Minute, 1, 2 * time.Minute},
+		{time.Minute, 10 * time.Minute, 3, 8 * time.Minute},
+		{time.Minute, 10 * time.Minute, 4, 10 * time.Minute},
+		{time.Minute, 10 * time.Minute, 100, 10 * time.Minute},
+	} {
+		if wait := backoff(c.interval, c.maxBackoff, c.failures); wait != c.expected {
+			t.Errorf("Expected a wait of %v after %d failures but got %v", c.expected, c.failures, wait)
+		}
+	}
+}
@@ -0,0 +1,696 @@
+package simbackend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/math"
+	"github.com/ethereum/go-ethereum/consensus/ethash"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/event"
+	"github.com/ethereum/go-ethereum/params"
+)
+
+// ErrReverted is returned for txs and calls the EVM reverts, like ganache does
+var ErrReverted = errors.New("VM Exception while processing transaction: revert")
+
+// The chain id, gas price and block gas limit ganache is run with for the tests
+const (
+	DefaultChainID  = 4447
+	DefaultGasPrice = 1000
+	DefaultGasLimit = 8000000
+)
+
+// blockTime is the seconds between blocks, as core.GenerateChain mines them
+const blockTime = 10
+
+// Backend is an in-process chain for tests, built like go-ethereum's simulated backend. It implements the relay's
+// IClient and behaves like the ganache node the relay is tested against: every tx is mined in a block of its own as
+// soon as it is sent (unless Automine is off), and reverted txs and calls return ErrReverted. Time can be advanced,
+// blocks mined and the chain reverted to a snapshot. Failures can be injected: RPC errors with Fail, txs the node
+// loses with DropTransactions and log subscriptions it ends with EndSubscriptions.
+type Backend struct {
+	Automine bool
+	GasPrice *big.Int
+
+	database   ethdb.Database
+	states     state.Database
+	blockchain *core.BlockChain
+	config     *params.ChainConfig
+
+	mutex        *sync.Mutex
+	pending      []*types.Transaction
+	pendingBlock *types.Block // the pending txs mined on the head, nil if there are none
+	timeOffset   int64        // seconds added to the time of the next block
+	receipts     map[common.Hash]*types.Receipt
+	txBlocks     map[common.Hash]*types.Block
+	failures     map[string][]error
+	drop         int
+	subs         map[*logSubscription]struct{}
+}
+
+// logSubscription queues the logs of the blocks inserted while it is active, so that inserting never waits for the
+// subscriber
+type logSubscription struct {
+	query  ethereum.FilterQuery
+	mutex  *sync.Mutex
+	queued []types.Log
+	signal chan struct{}
+	ended  chan error
+}
+
+func (sub *logSubscription) push(logs []types.Log) {
+	sub.mutex.Lock()
+	defer sub.mutex.Unlock()
+	sub.queued = append(sub.queued, logs...)
+	select {
+	case sub.signal <- struct{}{}:
+	default:
+	}
+}
+
+func (sub *logSubscription) take() (logs []types.Log) {
+	sub.mutex.Lock()
+	defer sub.mutex.Unlock()
+	logs, sub.queued = sub.queued, nil
+	return
+}
+
+// New creates a chain whose genesis allocates alloc, starting at the current time
+func New(alloc core.GenesisAlloc) *Backend {
+	config := *params.AllEthashProtocolChanges
+	config.ChainID = big.NewInt(DefaultChainID)
+	database := ethdb.NewMemDatabase()
+	genesis := core.Genesis{Config: &config, GasLimit: DefaultGasLimit, Alloc: alloc, Timestamp: uint64(time.Now().Unix())}
+	genesis.MustCommit(database)
+	blockchain, err := core.NewBlockChain(database, nil, genesis.Config, ethash.NewFaker(), vm.Config{}, nil)
+	if err != nil {
+		panic(err)
+	}
+	return &Backend{
+		Automine:   true,
+		GasPrice:   big.NewInt(DefaultGasPrice),
+		database:   database,
+		states:     state.NewDatabase(database),
+		blockchain: blockchain,
+		config:     genesis.Config,
+		mutex:      &sync.Mutex{},
+		receipts:   make(map[common.Hash]*types.Receipt),
+		txBlocks:   make(map[common.Hash]*types.Block),
+		failures:   make(map[string][]error),
+		subs:       make(map[*logSubscription]struct{}),
+	}
+}
+
+// Fail makes the next times calls of the IClient method, e.g. "SendTransaction", return err
+func (backend *Backend) Fail(method string, err error, times int) {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+	for ; times > 0; times-- {
+		backend.failures[method] = append(backend.failures[method], err)
+	}
+}
+
+// DropTransactions makes the node accept the next n txs sent without ever mining them
+func (backend *Backend) DropTransactions(n int) {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+	backend.drop += n
+}
+
+// EndSubscriptions ends the active log subscriptions with err, like a node dropping its websocket connections
+func (backend *Backend) EndSubscriptions(err error) {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+	for sub := range backend.subs {
+		select {
+		case sub.ended <- err:
+		default:
+		}
+	}
+}
+
+// failure returns the error injected for the method's call, if any. The caller must hold the mutex.
+func (backend *Backend) failure(method string) error {
+	failures := backend.failures[method]
+	if len(failures) == 0 {
+		return nil
+	}
+	backend.failures[method] = failures[1:]
+	return failures[0]
+}
+
+// Commit mines the pending txs in a new block, like ganache's evm_mine
+func (backend *Backend) Commit() error {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+	block, receipts, err := backend.generate(backend.pending)
+	if err != nil {
+		return err
+	}
+	return backend.insert(block, receipts)
+}
+
+// MineBlocks mines n blocks
+func (backend *Backend) MineBlocks(n uint64) error {
+	for ; n > 0; n-- {
+		if err := backend.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AdjustTime moves the time of the next blocks forward, like ganache's evm_increaseTime
+func (backend *Backend) AdjustTime(seconds uint64) error {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+	backend.timeOffset += int64(seconds)
+	if len(backend.pending) > 0 {
+		block, _, err := backend.generate(backend.pending)
+		if err != nil {
+			return err
+		}
+		backend.pendingBlock = block
+	}
+	return nil
+}
+
+// Snapshot returns an id to Revert the chain to its current head
+func (backend *Backend) Snapshot() (uint64, error) {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+	return backend.blockchain.CurrentBlock().NumberU64(), nil
+}
+
+// Revert drops the blocks mined after the snapshot was taken, and the pending txs
+func (backend *Backend) Revert(id uint64) (err error) {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+	head := backend.blockchain.CurrentBlock().NumberU64()
+	if id > head {
+		return fmt.Errorf("Unknown snapshot %d: head is block %d", id, head)
+	}
+	for number := id + 1; number <= head; number++ {
+		for _, tx := range backend.blockchain.GetBlockByNumber(number).Transactions() {
+			delete(backend.receipts, tx.Hash())
+			delete(backend.txBlocks, tx.Hash())
+		}
+	}
+	if err = backend.blockchain.SetHead(id); err != nil {
+		return
+	}
+	backend.pending, backend.pendingBlock, backend.timeOffset = nil, nil, 0
+	return nil
+}
+
+// generate mines the txs on the head without inserting the block. A tx the chain rejects makes GenerateChain panic,
+// which is returned as an error.
+func (backend *Backend) generate(txs []*types.Transaction) (block *types.Block, receipts types.Receipts, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	blocks, allReceipts := core.GenerateChain(backend.config, backend.blockchain.CurrentBlock(), ethash.NewFaker(), backend.database, 1,
+		func(number int, gen *core.BlockGen) {
+			if backend.timeOffset > 0 {
+				gen.OffsetTime(backend.timeOffset)
+			}
+			for _, tx := range txs {
+				gen.AddTxWithChain(backend.blockchain, tx)
+			}
+		})
+	return blocks[0], allReceipts[0], nil
+}
+
+// insert adds the generated block to the chain
+func (backend *Backend) insert(block *types.Block, receipts types.Receipts) (err error) {
+	if _, err = backend.blockchain.InsertChain([]*types.Block{block}); err != nil {
+		return
+	}
+	for i, tx := range block.Transactions() {
+		for _, vLog := range receipts[i].Logs {
+			vLog.BlockHash = block.Hash()
+		}
+		backend.receipts[tx.Hash()] = receipts[i]
+		backend.txBlocks[tx.Hash()] = block
+	}
+	for sub := range backend.subs {
+		var logs []types.Log
+		for _, receipt := range receipts {
+			for _, vLog := range receipt.Logs {
+				if matches(sub.query, vLog) {
+					logs = append(logs, *vLog)
+				}
+			}
+		}
+		if len(logs) > 0 {
+			sub.push(logs)
+		}
+	}
+	backend.pending, backend.pendingBlock, backend.timeOffset = nil, nil, 0
+	return nil
+}
+
+// stateAt returns the state after the block with the number, or the head if nil. The caller must hold the mutex.
+func (backend *Backend) stateAt(blockNumber *big.Int) (statedb *state.StateDB, block *types.Block, err error) {
+	block = backend.blockchain.CurrentBlock()
+	if blockNumber != nil {
+		if block = backend.blockchain.GetBlockByNumber(blockNumber.Uint64()); block == nil {
+			return nil, nil, ethereum.NotFound
+		}
+	}
+	statedb, err = state.New(block.Root(), backend.states)
+	return
+}
+
+// pendingState returns the state after the pending txs, and the block they would be mined in. The caller must hold
+// the mutex.
+func (backend *Backend) pendingState() (statedb *state.StateDB, header *types.Header, err error) {
+	if backend.pendingBlock != nil {
+		statedb, err = state.New(backend.pendingBlock.Root(), backend.states)
+		return statedb, backend.pendingBlock.Header(), err
+	}
+	statedb, head, err := backend.stateAt(nil)
+	if err != nil {
+		return
+	}
+	header = &types.Header{
+		ParentHash: head.Hash(),
+		Number:     new(big.Int).Add(head.Number(), big.NewInt(1)),
+		Time:       new(big.Int).Add(head.Time(), big.NewInt(blockTime+backend.timeOffset)),
+		GasLimit:   head.GasLimit(),
+		Difficulty: head.Difficulty(),
+	}
+	return
+}
+
+func (backend *Backend) CodeAt(ctx context.Context, contract common.Address, blockNumber *big.Int) ([]byte, error) {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+	if err := backend.failure("CodeAt"); err != nil {
+		return nil, err
+	}
+	statedb, _, err := backend.stateAt(blockNumber)
+	if err != nil {
+		return nil, err
+	}
+	return statedb.GetCode(contract), nil
+}
+
+func (backend *Backend) BalanceAt(ctx context.Context, account common.Address, blockNumber *big.Int) (*big.Int, error) {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+	if err := backend.failure("BalanceAt"); err != nil {
+		return nil, err
+	}
+	statedb, _, err := backend.stateAt(blockNumber)
+	if err != nil {
+		return nil, err
+	}
+	return statedb.GetBalance(account), nil
+}
+
+func (backend *Backend) NonceAt(ctx context.Context, account common.Address, blockNumber *big.Int) (uint64, error) {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+	if err := backend.failure("NonceAt"); err != nil {
+		return 0, err
+	}
+	statedb, _, err := backend.stateAt(blockNumber)
+	if err != nil {
+		return 0, err
+	}
+	return statedb.GetNonce(account), nil
+}
+
+func (backend *Backend) StorageAt(ctx context.Context, account common.Address, key common.Hash, blockNumber *big.Int) ([]byte, error) {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+	if err := backend.failure("StorageAt"); err != nil {
+		return nil, err
+	}
+	statedb, _, err := backend.stateAt(blockNumber)
+	if err != nil {
+		return nil, err
+	}
+	value := statedb.GetState(account, key)
+	return value[:], nil
+}
+
+func (backend *Backend) PendingCodeAt(ctx context.Context, account common.Address) ([]byte, error) {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+	if err := backend.failure("PendingCodeAt"); err != nil {
+		return nil, err
+	}
+	statedb, _, err := backend.pendingState()
+	if err != nil {
+		return nil, err
+	}
+	return statedb.GetCode(account), nil
+}
+
+func (backend *Backend) PendingNonceAt(ctx context.Context, account common.Address) (uint64, error) {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+	if err := backend.failure("PendingNonceAt"); err != nil {
+		return 0, err
+	}
+	statedb, _, err := backend.pendingState()
+	if err != nil {
+		return 0, err
+	}
+	return statedb.GetNonce(account), nil
+}
+
+func (backend *Backend) SuggestGasPrice(ctx context.Context) (*big.Int, error) {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+	if err := backend.failure("SuggestGasPrice"); err != nil {
+		return nil, err
+	}
+	return new(big.Int).Set(backend.GasPrice), nil
+}
+
+func (backend *Backend) NetworkID(ctx context.Context) (*big.Int, error) {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+	if err := backend.failure("NetworkID"); err != nil {
+		return nil, err
+	}
+	return new(big.Int).Set(backend.config.ChainID), nil
+}
+
+func (backend *Backend) CallContract(ctx context.Context, call ethereum.CallMsg, blockNumber *big.Int) ([]byte, error) {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+	if err := backend.failure("CallContract"); err != nil {
+		return nil, err
+	}
+	statedb, block, err := backend.stateAt(blockNumber)
+	if err != nil {
+		return nil, err
+	}
+	return backend.call(call, block.Header(), statedb)
+}
+
+func (backend *Backend) PendingCallContract(ctx context.Context, call ethereum.CallMsg) ([]byte, error) {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+	if err := backend.failure("PendingCallContract"); err != nil {
+		return nil, err
+	}
+	statedb, header, err := backend.pendingState()
+	if err != nil {
+		return nil, err
+	}
+	return backend.call(call, header, statedb)
+}
+
+// call runs the call on the state, returning ErrReverted if it fails
+func (backend *Backend) call(call ethereum.CallMsg, header *types.Header, statedb *state.StateDB) ([]byte, error) {
+	ret, _, failed, err := backend.execute(call, header, statedb)
+	if err != nil {
+		return nil, err
+	}
+	if failed {
+		return nil, ErrReverted
+	}
+	return ret, nil
+}
+
+// execute runs the call on the state the way go-ethereum's simulated backend does: the caller can afford any gas
+func (backend *Backend) execute(call ethereum.CallMsg, header *types.Header, statedb *state.StateDB) (ret []byte, usedGas uint64, failed bool, err error) {
+	if call.GasPrice == nil {
+		call.GasPrice = big.NewInt(1)
+	}
+	if call.Gas == 0 {
+		call.Gas = header.GasLimit
+	}
+	if call.Value == nil {
+		call.Value = new(big.Int)
+	}
+	statedb.SetBalance(call.From, math.MaxBig256)
+	msg := callMsg{call}
+	evm := vm.NewEVM(core.NewEVMContext(msg, header, backend.blockchain, nil), statedb, backend.config, vm.Config{})
+	gasPool := new(core.GasPool).AddGas(math.MaxUint64)
+	return core.NewStateTransition(evm, msg, gasPool).TransitionDb()
+}
+
+// EstimateGas finds the lowest gas limit the call succeeds with on the pending state
+func (backend *Backend) EstimateGas(ctx context.Context, call ethereum.CallMsg) (uint64, error) {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+	if err := backend.failure("EstimateGas"); err != nil {
+		return 0, err
+	}
+	statedb, header, err := backend.pendingState()
+	if err != nil {
+		return 0, err
+	}
+	executable := func(gas uint64) bool {
+		call.Gas = gas
+		_, _, failed, err := backend.execute(call, header, statedb.Copy())
+		return err == nil && !failed
+	}
+	lo, hi := params.TxGas-1, header.GasLimit
+	if call.Gas >= params.TxGas {
+		hi = call.Gas
+	}
+	limit := hi
+	for lo+1 < hi {
+		mid := (hi + lo) / 2
+		if executable(mid) {
+			hi = mid
+		} else {
+			lo = mid
+		}
+	}
+	if hi == limit && !executable(hi) {
+		return 0, ErrReverted
+	}
+	return hi, nil
+}
+
+// SendTransaction adds the tx to the pending block, mining it right away if Automine is on. A tx the chain rejects,
+// e.g. for its nonce or for lack of funds, is not added. A reverted tx is mined but returns ErrReverted.
+func (backend *Backend) SendTransaction(ctx context.Context, tx *types.Transaction) (err error) {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+	if err = backend.failure("SendTransaction"); err != nil {
+		return
+	}
+	if _, err = types.Sender(types.NewEIP155Signer(backend.config.ChainID), tx); err != nil {
+		return fmt.Errorf("Invalid transaction sender: %v", err)
+	}
+	if backend.drop > 0 {
+		backend.drop--
+		return nil
+	}
+	txs := append(append([]*types.Transaction{}, backend.pending...), tx)
+	block, receipts, err := backend.generate(txs)
+	if err != nil {
+		return
+	}
+	if backend.Automine {
+		err = backend.insert(block, receipts)
+	} else {
+		backend.pending, backend.pendingBlock = txs, block
+	}
+	if err == nil && receipts[len(receipts)-1].Status == types.ReceiptStatusFailed {
+		err = ErrReverted
+	}
+	return
+}
+
+func (backend *Backend) TransactionByHash(ctx context.Context, txHash common.Hash) (tx *types.Transaction, isPending bool, err error) {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+	if err = backend.failure("TransactionByHash"); err != nil {
+		return
+	}
+	if block, ok := backend.txBlocks[txHash]; ok {
+		return block.Transaction(txHash), false, nil
+	}
+	for _, tx = range backend.pending {
+		if tx.Hash() == txHash {
+			return tx, true, nil
+		}
+	}
+	return nil, false, ethereum.NotFound
+}
+
+func (backend *Backend) TransactionReceipt(ctx context.Context, txHash common.Hash) (*types.Receipt, error) {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+	if err := backend.failure("TransactionReceipt"); err != nil {
+		return nil, err
+	}
+	receipt, ok := backend.receipts[txHash]
+	if !ok {
+		return nil, ethereum.NotFound
+	}
+	return receipt, nil
+}
+
+func (backend *Backend) TransactionBlock(ctx context.Context, txHash common.Hash) (blockNumber uint64, blockHash common.Hash, err error) {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+	if err = backend.failure("TransactionBlock"); err != nil {
+		return
+	}
+	block, ok := backend.txBlocks[txHash]
+	if !ok {
+		return 0, common.Hash{}, ethereum.NotFound
+	}
+	return block.NumberU64(), block.Hash(), nil
+}
+
+func (backend *Backend) BlockByNumber(ctx context.Context, number *big.Int) (*types.Block, error) {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+	if err := backend.failure("BlockByNumber"); err != nil {
+		return nil, err
+	}
+	if number == nil {
+		return backend.blockchain.CurrentBlock(), nil
+	}
+	block := backend.blockchain.GetBlockByNumber(number.Uint64())
+	if block == nil {
+		return nil, ethereum.NotFound
+	}
+	return block, nil
+}
+
+func (backend *Backend) HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error) {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+	if err := backend.failure("HeaderByNumber"); err != nil {
+		return nil, err
+	}
+	if number == nil {
+		return backend.blockchain.CurrentHeader(), nil
+	}
+	header := backend.blockchain.GetHeaderByNumber(number.Uint64())
+	if header == nil {
+		return nil, ethereum.NotFound
+	}
+	return header, nil
+}
+
+// FilterLogs returns the logs of the mined blocks matching the query
+func (backend *Backend) FilterLogs(ctx context.Context, query ethereum.FilterQuery) (logs []types.Log, err error) {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+	if err = backend.failure("FilterLogs"); err != nil {
+		return
+	}
+	from, to := uint64(0), backend.blockchain.CurrentBlock().NumberU64()
+	if query.FromBlock != nil {
+		from = query.FromBlock.Uint64()
+	}
+	if query.ToBlock != nil && query.ToBlock.Uint64() < to {
+		to = query.ToBlock.Uint64()
+	}
+	for number := from; number <= to; number++ {
+		block := backend.blockchain.GetBlockByNumber(number)
+		if block == nil {
+			break
+		}
+		for _, tx := range block.Transactions() {
+			for _, vLog := range backend.receipts[tx.Hash()].Logs {
+				if matches(query, vLog) {
+					logs = append(logs, *vLog)
+				}
+			}
+		}
+	}
+	return
+}
+
+func matches(query ethereum.FilterQuery, vLog *types.Log) bool {
+	if len(query.Addresses) > 0 {
+		found := false
+		for _, address := range query.Addresses {
+			found = found || address == vLog.Address
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(query.Topics) > len(vLog.Topics) {
+		return false
+	}
+	for i, topics := range query.Topics {
+		found := len(topics) == 0
+		for _, topic := range topics {
+			found = found || topic == vLog.Topics[i]
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// SubscribeFilterLogs delivers the logs matching the query of the blocks mined from now on, in order
+func (backend *Backend) SubscribeFilterLogs(ctx context.Context, query ethereum.FilterQuery, ch chan<- types.Log) (ethereum.Subscription, error) {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+	if err := backend.failure("SubscribeFilterLogs"); err != nil {
+		return nil, err
+	}
+	sub := &logSubscription{query: query, mutex: &sync.Mutex{}, signal: make(chan struct{}, 1), ended: make(chan error, 1)}
+	backend.subs[sub] = struct{}{}
+	return event.NewSubscription(func(quit <-chan struct{}) error {
+		defer func() {
+			backend.mutex.Lock()
+			delete(backend.subs, sub)
+			backend.mutex.Unlock()
+		}()
+		for {
+			for _, vLog := range sub.take() {
+				select {
+				case ch <- vLog:
+				case err := <-sub.ended:
+					return err
+				case <-quit:
+					return nil
+				}
+			}
+			select {
+			case <-sub.signal:
+			case err := <-sub.ended:
+				return err
+			case <-quit:
+				return nil
+			}
+		}
+	}), nil
+}
+
+// callMsg implements core.Message for calls
+type callMsg struct {
+	ethereum.CallMsg
+}
+
+func (m callMsg) From() common.Address { return m.CallMsg.From }
+func (m callMsg) Nonce() uint64        { return 0 }
+func (m callMsg) CheckNonce() bool     { return false }
+func (m callMsg) To() *common.Address  { return m.CallMsg.To }
+func (m callMsg) GasPrice() *big.Int   { return m.CallMsg.GasPrice }
+func (m callMsg) Gas() uint64          { return m.CallMsg.Gas }
+func (m callMsg) Value() *big.Int      { return m.CallMsg.Value }
+func (m callMsg) Data() []byte         { return m.CallMsg.Data }
@@ -0,0 +1,262 @@
+package simbackend
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"librelay/test"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/params"
+)
+
+var ctx = context.Background()
+
+var to = common.HexToAddress("0xFFcf8FDEE72ac11b5c542428B35EEF5769C409f0")
+
+// reverting is init code that reverts: PUSH1 0 PUSH1 0 REVERT
+var reverting = common.FromHex("0x60006000fd")
+
+// logging is init code that emits a log with the topic 0x01 and deploys nothing: PUSH32 0x01 PUSH1 0 PUSH1 0 LOG1 STOP
+var logging = common.FromHex("0x7f" + common.BigToHash(big.NewInt(1)).Hex()[2:] + "60006000a100")
+
+func newBackend(t *testing.T) (backend *Backend, send func(nonce uint64, to *common.Address, data []byte) *types.Transaction) {
+	key, err := crypto.GenerateKey()
+	test.ErrFail(err, t)
+	backend = New(core.GenesisAlloc{crypto.PubkeyToAddress(key.PublicKey): {Balance: big.NewInt(params.Ether)}})
+	send = func(nonce uint64, to *common.Address, data []byte) *types.Transaction {
+		var tx *types.Transaction
+		if to == nil {
+			tx = types.NewContractCreation(nonce, big.NewInt(0), 100000, big.NewInt(DefaultGasPrice), data)
+		} else {
+			tx = types.NewTransaction(nonce, *to, big.NewInt(1), 21000, big.NewInt(DefaultGasPrice), data)
+		}
+		tx, err := types.SignTx(tx, types.NewEIP155Signer(big.NewInt(DefaultChainID)), key)
+		test.ErrFail(err, t)
+		return tx
+	}
+	return
+}
+
+func assertMined(t *testing.T, backend *Backend, tx *types.Transaction, blockNumber uint64) {
+	number, hash, err := backend.TransactionBlock(ctx, tx.Hash())
+	if blockNumber == 0 {
+		if err != ethereum.NotFound {
+			t.Errorf("Expected tx %v not to be mined but got block %d (error %v)", tx.Hash().Hex(), number, err)
+		}
+		return
+	}
+	test.ErrFail(err, t)
+	header, err := backend.HeaderByNumber(ctx, new(big.Int).SetUint64(blockNumber))
+	test.ErrFail(err, t)
+	if number != blockNumber || hash != header.Hash() {
+		t.Errorf("Expected tx %v in block %d but got %d", tx.Hash().Hex(), blockNumber, number)
+	}
+}
+
+func TestAutomine(t *testing.T) {
+	backend, send := newBackend(t)
+	tx := send(0, &to, nil)
+	test.ErrFail(backend.SendTransaction(ctx, tx), t)
+	assertMined(t, backend, tx, 1)
+	receipt, err := backend.TransactionReceipt(ctx, tx.Hash())
+	test.ErrFail(err, t)
+	if receipt.Status != types.ReceiptStatusSuccessful {
+		t.Error("Expected the transfer to succeed")
+	}
+	balance, err := backend.BalanceAt(ctx, to, nil)
+	test.ErrFail(err, t)
+	if balance.Int64() != 1 {
+		t.Errorf("Expected a balance of 1 but got %v", balance)
+	}
+
+	// Nonces the chain would not accept are rejected
+	if err = backend.SendTransaction(ctx, send(0, &to, nil)); err == nil {
+		t.Error("Expected a tx with a used nonce to be rejected")
+	}
+	if err = backend.SendTransaction(ctx, send(2, &to, nil)); err == nil {
+		t.Error("Expected a tx with a nonce gap to be rejected")
+	}
+
+	// Mined, but reverted like on ganache
+	tx = send(1, nil, reverting)
+	if err = backend.SendTransaction(ctx, tx); err != ErrReverted {
+		t.Error("Expected the tx to revert but got", err)
+	}
+	receipt, err = backend.TransactionReceipt(ctx, tx.Hash())
+	test.ErrFail(err, t)
+	if receipt.Status != types.ReceiptStatusFailed {
+		t.Error("Expected the reverted tx to be mined as failed")
+	}
+	if _, err = backend.CallContract(ctx, ethereum.CallMsg{Data: reverting}, nil); err != ErrReverted {
+		t.Error("Expected the call to revert but got", err)
+	}
+	if _, err = backend.EstimateGas(ctx, ethereum.CallMsg{Data: reverting}); err != ErrReverted {
+		t.Error("Expected the gas estimation to fail but got", err)
+	}
+	gas, err := backend.EstimateGas(ctx, ethereum.CallMsg{To: &to})
+	test.ErrFail(err, t)
+	if gas != params.TxGas {
+		t.Errorf("Expected a transfer to need %d gas but got %d", params.TxGas, gas)
+	}
+}
+
+func TestCommitAndRevert(t *testing.T) {
+	backend, send := newBackend(t)
+	backend.Automine = false
+	tx := send(0, &to, nil)
+	test.ErrFail(backend.SendTransaction(ctx, tx), t)
+	assertMined(t, backend, tx, 0)
+	sender, err := types.Sender(types.NewEIP155Signer(big.NewInt(DefaultChainID)), tx)
+	test.ErrFail(err, t)
+	if nonce, err := backend.PendingNonceAt(ctx, sender); err != nil || nonce != 1 {
+		t.Errorf("Expected pending nonce 1 but got %d (error %v)", nonce, err)
+	}
+	if nonce, err := backend.NonceAt(ctx, sender, nil); err != nil || nonce != 0 {
+		t.Errorf("Expected nonce 0 but got %d (error %v)", nonce, err)
+	}
+	if _, pending, err := backend.TransactionByHash(ctx, tx.Hash()); err != nil || !pending {
+		t.Error("Expected the tx to be pending", err)
+	}
+
+	snapshot, err := backend.Snapshot()
+	test.ErrFail(err, t)
+	head, err := backend.HeaderByNumber(ctx, nil)
+	test.ErrFail(err, t)
+	test.ErrFail(backend.AdjustTime(3600), t)
+	test.ErrFail(backend.Commit(), t)
+	assertMined(t, backend, tx, 1)
+	block, err := backend.HeaderByNumber(ctx, nil)
+	test.ErrFail(err, t)
+	if block.Time.Int64()-head.Time.Int64() < 3600 {
+		t.Errorf("Expected the block to be an hour later but got %d seconds", block.Time.Int64()-head.Time.Int64())
+	}
+	test.ErrFail(backend.MineBlocks(3), t)
+	if block, err = backend.HeaderByNumber(ctx, nil); err != nil || block.Number.Int64() != 4 {
+		t.Errorf("Expected 4 blocks but got %v (error %v)", block.Number, err)
+	}
+
+	test.ErrFail(backend.Revert(snapshot), t)
+	assertMined(t, backend, tx, 0)
+	if _, err = backend.TransactionReceipt(ctx, tx.Hash()); err != ethereum.NotFound {
+		t.Error("Expected the receipt to be gone after the revert but got", err)
+	}
+	if block, err = backend.HeaderByNumber(ctx, nil); err != nil || block.Number.Int64() != 0 {
+		t.Errorf("Expected the chain to be back at genesis but got %v (error %v)", block.Number, err)
+	}
+
+	// The tx can be mined again on the reverted chain
+	backend.Automine = true
+	test.ErrFail(backend.SendTransaction(ctx, tx), t)
+	assertMined(t, backend, tx, 1)
+}
+
+func TestFilterLogs(t *testing.T) {
+	backend, send := newBackend(t)
+	test.ErrFail(backend.SendTransaction(ctx, send(0, &to, nil)), t)
+	tx := send(1, nil, logging)
+	test.ErrFail(backend.SendTransaction(ctx, tx), t)
+	receipt, err := backend.TransactionReceipt(ctx, tx.Hash())
+	test.ErrFail(err, t)
+
+	topic := common.BigToHash(big.NewInt(1))
+	logs, err := backend.FilterLogs(ctx, ethereum.FilterQuery{Addresses: []common.Address{receipt.ContractAddress}, Topics: [][]common.Hash{{topic}}})
+	test.ErrFail(err, t)
+	if len(logs) != 1 || logs[0].BlockNumber != 2 || logs[0].TxHash != tx.Hash() {
+		t.Fatalf("Wrong logs %+v", logs)
+	}
+	header, err := backend.HeaderByNumber(ctx, big.NewInt(2))
+	test.ErrFail(err, t)
+	if logs[0].BlockHash != header.Hash() {
+		t.Errorf("Expected the log in block %v but got %v", header.Hash().Hex(), logs[0].BlockHash.Hex())
+	}
+	for _, query := range []ethereum.FilterQuery{
+		{FromBlock: big.NewInt(3)},
+		{ToBlock: big.NewInt(1)},
+		{Topics: [][]common.Hash{{common.BigToHash(big.NewInt(2))}}},
+		{Addresses: []common.Address{to}},
+	} {
+		if logs, err = backend.FilterLogs(ctx, query); err != nil || len(logs) != 0 {
+			t.Errorf("Expected no logs for %+v but got %+v (error %v)", query, logs, err)
+		}
+	}
+}
+
+func TestSubscribeFilterLogs(t *testing.T) {
+	backend, send := newBackend(t)
+	topic := common.BigToHash(big.NewInt(1))
+	logs := make(chan types.Log, 1)
+	sub, err := backend.SubscribeFilterLogs(ctx, ethereum.FilterQuery{Topics: [][]common.Hash{{topic}}}, logs)
+	test.ErrFail(err, t)
+	defer sub.Unsubscribe()
+
+	// Only the logs matching the query are delivered, and mining does not wait for the subscriber
+	test.ErrFail(backend.SendTransaction(ctx, send(0, &to, nil)), t)
+	first, second := send(1, nil, logging), send(2, nil, logging)
+	test.ErrFail(backend.SendTransaction(ctx, first), t)
+	test.ErrFail(backend.SendTransaction(ctx, second), t)
+	for i, tx := range []*types.Transaction{first, second} {
+		select {
+		case vLog := <-logs:
+			if vLog.TxHash != tx.Hash() || vLog.BlockNumber != uint64(i+2) {
+				t.Errorf("Expected the log of tx %v in block %d but got %+v", tx.Hash().Hex(), i+2, vLog)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Log %d was not delivered", i)
+		}
+	}
+
+	// An ended subscription reports the error
+	dropped := errors.New("connection closed")
+	backend.EndSubscriptions(dropped)
+	select {
+	case err = <-sub.Err():
+		if err != dropped {
+			t.Error("Expected the subscription to end with the injected error but got", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("The subscription did not end")
+	}
+
+	backend.Fail("SubscribeFilterLogs", dropped, 1)
+	if _, err = backend.SubscribeFilterLogs(ctx, ethereum.FilterQuery{}, logs); err != dropped {
+		t.Error("Expected the injected error but got", err)
+	}
+}
+
+func TestInjectedFailures(t *testing.T) {
+	backend, send := newBackend(t)
+	unreachable := errors.New("connection refused")
+	backend.Fail("BalanceAt", unreachable, 2)
+	for i := 0; i < 2; i++ {
+		if _, err := backend.BalanceAt(ctx, to, nil); err != unreachable {
+			t.Error("Expected the injected error but got", err)
+		}
+	}
+	_, err := backend.BalanceAt(ctx, to, nil)
+	test.ErrFail(err, t)
+
+	backend.Fail("SendTransaction", unreachable, 1)
+	tx := send(0, &to, nil)
+	if err = backend.SendTransaction(ctx, tx); err != unreachable {
+		t.Error("Expected the injected error but got", err)
+	}
+	assertMined(t, backend, tx, 0)
+
+	// A dropped tx is accepted but lost
+	backend.DropTransactions(1)
+	test.ErrFail(backend.SendTransaction(ctx, tx), t)
+	assertMined(t, backend, tx, 0)
+	if _, _, err = backend.TransactionByHash(ctx, tx.Hash()); err != ethereum.NotFound {
+		t.Error("Expected the dropped tx not to be found but got", err)
+	}
+	test.ErrFail(backend.SendTransaction(ctx, tx), t)
+	assertMined(t, backend, tx, 1)
+}
@@ -0,0 +1,139 @@
+package librelay
+
+import (
+	"context"
+	"fmt"
+	"gen/librelay"
+	"log"
+	"math/big"
+	"strings"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// RelayCallStatus values of the TransactionRelayed event, as defined in IRelayHub.sol
+const (
+	RelayCallStatusOK                      = 0
+	RelayCallStatusRelayedCallFailed       = 1
+	RelayCallStatusPreRelayedFailed        = 2
+	RelayCallStatusPostRelayedFailed       = 3
+	RelayCallStatusRecipientBalanceChanged = 4
+	// recipientCallsAtomic reverted after preRelayedCall succeeded: PostRelayedFailed or RecipientBalanceChanged
+	relayCallStatusReverted = -1
+)
+
+// canRelay status when the signature is valid but the sender's nonce is not the next one, as defined in IRelayHub.sol
+const canRelayWrongNonce = 2
+
+// Functions called during relayCall that are not part of IRelayHub's abi
+const relayCallInternalsABI = `[
+	{"type":"function","name":"recipientCallsAtomic","inputs":[{"name":"recipient","type":"address"},{"name":"encodedFunctionWithFrom","type":"bytes"},{"name":"transactionFee","type":"uint256"},{"name":"gasPrice","type":"uint256"},{"name":"gasLimit","type":"uint256"},{"name":"preChecksGas","type":"uint256"},{"name":"recipientContext","type":"bytes"}],"outputs":[{"name":"","type":"uint8"}]},
+	{"type":"function","name":"preRelayedCall","inputs":[{"name":"context","type":"bytes"}],"outputs":[{"name":"","type":"bytes32"}]}
+]`
+
+var relayHubABI, relayCallInternals abi.ABI
+
+func init() {
+	var err error
+	if relayHubABI, err = abi.JSON(strings.NewReader(librelay.IRelayHubABI)); err != nil {
+		log.Fatalln("Invalid RelayHub abi", err)
+	}
+	if relayCallInternals, err = abi.JSON(strings.NewReader(relayCallInternalsABI)); err != nil {
+		log.Fatalln("Invalid relayCall internals abi", err)
+	}
+}
+
+// RelayCallSimulation is the outcome of running a relay request against the pending block with eth_call
+type RelayCallSimulation struct {
+	CanRelay     int64  // canRelay status, 0 if the hub accepts the request
+	Status       int64  // expected TransactionRelayed status, or -1 if postRelayedCall or the balance check reverts
+	EstimatedGas uint64 // eth_estimateGas of the whole relayCall, 0 if it reverts
+	RequiredGas  uint64 // gas limit the relay would send the tx with
+	Error        string // why relayCall would revert, if it would
+}
+
+// Rejection returns why the request must not be relayed according to the simulation, or nil. Requests failing in
+// acceptRelayedCall or preRelayedCall are always rejected; when enforce is set, so are requests whose relayCall would
+// revert or need more gas than RequiredGas.
+func (simulation *RelayCallSimulation) Rejection(enforce bool) error {
+	if simulation.CanRelay != 0 {
+		return fmt.Errorf("Simulated canRelay failed with code %d", simulation.CanRelay)
+	}
+	if simulation.Status == RelayCallStatusPreRelayedFailed {
+		return fmt.Errorf("Simulated preRelayedCall reverted")
+	}
+	if !enforce {
+		return nil
+	}
+	if simulation.Error != "" {
+		return fmt.Errorf("Simulated relayCall reverted: %s", simulation.Error)
+	}
+	if simulation.EstimatedGas > simulation.RequiredGas {
+		return fmt.Errorf("Simulated relayCall needs %d gas, more than the %d it would be sent with", simulation.EstimatedGas, simulation.RequiredGas)
+	}
+	return nil
+}
+
+// SimulateRelayTransaction runs the request against the pending block: canRelay, then the recipient calls RelayHub
+// makes inside relayCall (called as the hub itself, which is the only allowed caller), then eth_estimateGas of
+// relayCall as sent by this relay.
+func (relay *RelayServer) SimulateRelayTransaction(request *RelayTransactionRequest, requiredGas *big.Int) (simulation *RelayCallSimulation, err error) {
+	ctx := context.Background()
+	relayAddress := relay.Address()
+	encodedFunction := common.FromHex(request.EncodedFunction)
+	simulation = &RelayCallSimulation{RequiredGas: requiredGas.Uint64()}
+
+	callOpt := &bind.CallOpts{
+		From:    relayAddress,
+		Pending: true,
+	}
+	canRelay, err := relay.rhub.CanRelay(callOpt, relayAddress, request.From, request.To, encodedFunction, &request.RelayFee,
+		&request.GasPrice, &request.GasLimit, &request.RecipientNonce, request.Signature, request.ApprovalData)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	simulation.CanRelay = canRelay.Status.Int64()
+	if simulation.CanRelay != 0 {
+		return
+	}
+
+	preRelayedCall, err := relayCallInternals.Pack("preRelayedCall", canRelay.RecipientContext)
+	if err != nil {
+		return nil, err
+	}
+	_, err = relay.Client.PendingCallContract(ctx, ethereum.CallMsg{From: relay.RelayHubAddress, To: &request.To, Data: preRelayedCall})
+	if err != nil {
+		log.Println("Simulated preRelayedCall reverted:", err)
+		simulation.Status = RelayCallStatusPreRelayedFailed
+		return simulation, nil
+	}
+
+	encodedFunctionWithFrom := append(append([]byte{}, encodedFunction...), request.From.Bytes()...)
+	atomicCall, err := relayCallInternals.Pack("recipientCallsAtomic", request.To, encodedFunctionWithFrom,
+		&request.RelayFee, &request.GasPrice, &request.GasLimit, big.NewInt(0), canRelay.RecipientContext)
+	if err != nil {
+		return nil, err
+	}
+	output, err := relay.Client.PendingCallContract(ctx, ethereum.CallMsg{From: relay.RelayHubAddress, To: &relay.RelayHubAddress, Data: atomicCall})
+	if err != nil {
+		simulation.Status = relayCallStatusReverted
+	} else {
+		var status uint8
+		if err = relayCallInternals.Unpack(&status, "recipientCallsAtomic", output); err != nil {
+			return nil, err
+		}
+		simulation.Status = int64(status)
+	}
+
+	simulation.EstimatedGas, err = relay.estimateRelayCallGas(request)
+	if err != nil {
+		simulation.EstimatedGas = 0
+		simulation.Error = err.Error()
+	}
+	log.Printf("Simulated relayCall: %+v\n", *simulation)
+	return simulation, nil
+}
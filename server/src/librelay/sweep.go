@@ -0,0 +1,117 @@
+package librelay
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// SweepRules configure sending the balance above a working balance to the owner
+type SweepRules struct {
+	KeepBalance *big.Int // high-water mark: the balance left to the relay, sweeping is disabled if not set
+	DryRun      bool     // only log and audit the sweeps, without sending them
+	AuditFile   string   // every sweep is appended to this file as a json line, if set
+}
+
+// SweepRecord is the audit log entry of a sweep
+type SweepRecord struct {
+	Time     int64
+	Balance  *big.Int
+	Keep     *big.Int
+	Amount   *big.Int // sent to the owner, gas excluded
+	GasPrice *big.Int
+	To       common.Address
+	TxHash   common.Hash `json:",omitempty"`
+	DryRun   bool
+	Error    string `json:",omitempty"`
+}
+
+// SweepExcessBalance withdraws the balance above KeepBalance to the owner, minus the withdrawal's reserve for the
+// transfer cost, so that the kept balance still covers it if it is resent with a higher gas price. The withdrawal is
+// tracked in the TxStore like the relay's other txs, so no sweep is made while a sent tx is not mined yet. Returns the
+// audit record of the sweep, or nil if there was nothing to sweep.
+func (relay *RelayServer) SweepExcessBalance() (record *SweepRecord, err error) {
+	rules := relay.SweepRules
+	if rules.KeepBalance == nil {
+		return
+	}
+	if relay.OwnerAddress == (common.Address{}) {
+		return nil, fmt.Errorf("Owner address not set, not sweeping")
+	}
+	txs, err := relay.TxStore.ListTransactions()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	for _, tx := range txs {
+		if !tx.IsMined() {
+			log.Println("SweepExcessBalance: transaction", tx.Nonce(), "not mined yet, not sweeping")
+			return nil, nil
+		}
+	}
+
+	ctx := context.Background()
+	balance, err := relay.Client.BalanceAt(ctx, relay.Address(), nil)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	gasPrice, err := relay.Client.SuggestGasPrice(ctx)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	amount := new(big.Int).Sub(balance, rules.KeepBalance)
+	amount.Sub(amount, withdrawalReserve(gasPrice))
+	if amount.Sign() <= 0 {
+		return
+	}
+
+	record = &SweepRecord{
+		Time:     relay.clock.Now().Unix(),
+		Balance:  balance,
+		Keep:     rules.KeepBalance,
+		Amount:   amount,
+		GasPrice: gasPrice,
+		To:       relay.OwnerAddress,
+		DryRun:   rules.DryRun,
+	}
+	if rules.DryRun {
+		log.Println("SweepExcessBalance: dry run, would send", amount, "wei to owner", relay.OwnerAddress.Hex())
+	} else {
+		tx, sendErr := relay.Withdraw(relay.OwnerAddress, amount, nil)
+		if sendErr != nil {
+			record.Error = sendErr.Error()
+			err = sendErr
+		} else {
+			record.TxHash, record.GasPrice = tx.Hash(), tx.GasPrice()
+		}
+	}
+	if auditErr := appendSweepRecord(rules.AuditFile, record); auditErr != nil {
+		log.Println("Could not write sweep audit log", auditErr)
+	}
+	return
+}
+
+func appendSweepRecord(file string, record *SweepRecord) (err error) {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return
+	}
+	log.Println("Sweep:", string(line))
+	if file == "" {
+		return nil
+	}
+	f, err := os.OpenFile(file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	_, err = f.Write(append(line, '\n'))
+	return
+}
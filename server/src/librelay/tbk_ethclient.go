@@ -3,8 +3,11 @@ package librelay
 import (
 	"context"
 	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
 	"github.com/ethereum/go-ethereum/ethclient"
 	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/rpc"
 	"log"
 	"math/big"
 )
@@ -16,6 +19,7 @@ type TbkClient struct {
 	*ethclient.Client
 
 	DefaultGasPrice int64
+	rpc             *rpc.Client
 }
 
 func (tbkClient *TbkClient) EstimateGas(ctx context.Context, msg ethereum.CallMsg) (uint64, error) {
@@ -37,3 +41,24 @@ func (tbkClient *TbkClient) SuggestGasPrice(ctx context.Context) (*big.Int, erro
 	}
 	return gasPrice,err
 }
+
+// TransactionBlock returns the number and hash of the block the tx was mined in, or ethereum.NotFound if it is not
+// mined. The receipts of this ethclient version do not carry them.
+func (tbkClient *TbkClient) TransactionBlock(ctx context.Context, txHash common.Hash) (blockNumber uint64, blockHash common.Hash, err error) {
+	return rpcTransactionBlock(ctx, tbkClient.rpc, txHash)
+}
+
+func rpcTransactionBlock(ctx context.Context, client *rpc.Client, txHash common.Hash) (blockNumber uint64, blockHash common.Hash, err error) {
+	var receipt *struct {
+		BlockNumber *hexutil.Big `json:"blockNumber"`
+		BlockHash   *common.Hash `json:"blockHash"`
+	}
+	err = client.CallContext(ctx, &receipt, "eth_getTransactionReceipt", txHash)
+	if err != nil {
+		return
+	}
+	if receipt == nil || receipt.BlockNumber == nil || receipt.BlockHash == nil {
+		return 0, common.Hash{}, ethereum.NotFound
+	}
+	return receipt.BlockNumber.ToInt().Uint64(), *receipt.BlockHash, nil
+}
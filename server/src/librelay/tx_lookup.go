@@ -0,0 +1,150 @@
+package librelay
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"math/big"
+
+	"librelay/txstore"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// Status of a relayed transaction
+const (
+	TxStatusPending   = "pending"   // not mined yet
+	TxStatusMined     = "mined"     // mined, with less than ConfirmationsNeeded confirmations
+	TxStatusConfirmed = "confirmed" // mined with at least ConfirmationsNeeded confirmations
+)
+
+var relayCallSelector = crypto.Keccak256([]byte("relayCall(address,address,bytes,uint256,uint256,uint256,uint256,bytes,bytes)"))[:4]
+
+// RelayedTransactionInfo is what /tx reports about a transaction sent by the relay
+type RelayedTransactionInfo struct {
+	SignedTx       *types.Transaction // latest tx sent for this nonce
+	PreviousHashes []common.Hash      // txs with the same nonce replaced by SignedTx, oldest first
+	Status         string
+	MinedHash      *common.Hash   `json:",omitempty"` // the tx that was mined, SignedTx or one of PreviousHashes
+	Receipt        *types.Receipt `json:",omitempty"`
+}
+
+// decodeRelayCall returns the sender, recipient and sender nonce of a relayCall transaction. They are static
+// arguments, so they are read straight from their abi slots: from is the 1st argument, to the 2nd and nonce the 7th.
+func decodeRelayCall(tx *types.Transaction) (from common.Address, to common.Address, nonce *big.Int, ok bool) {
+	data := tx.Data()
+	if len(data) < 4+9*32 || !bytes.Equal(data[:4], relayCallSelector) {
+		return
+	}
+	args := data[4:]
+	from = common.BytesToAddress(args[:32])
+	to = common.BytesToAddress(args[32:64])
+	nonce = new(big.Int).SetBytes(args[6*32 : 7*32])
+	return from, to, nonce, true
+}
+
+// GetRelayedTransactionByHash looks up a transaction sent by the relay by its hash or the hash of any tx it replaced.
+// Transactions pruned from the TxStore after being confirmed are looked up on the node. Returns nil if not found.
+func (relay *RelayServer) GetRelayedTransactionByHash(hash common.Hash) (info *RelayedTransactionInfo, err error) {
+	tx, err := relay.TxStore.GetTransactionByHash(hash)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if tx != nil {
+		return relay.relayedTransactionInfo(tx)
+	}
+
+	ctx := context.Background()
+	signedTx, _, err := relay.Client.TransactionByHash(ctx, hash)
+	if err == ethereum.NotFound || (err == nil && signedTx == nil) {
+		return nil, nil
+	} else if err != nil {
+		log.Println(err)
+		return
+	}
+	chainID, err := relay.ChainID()
+	if err != nil {
+		return
+	}
+	sender, err := types.Sender(types.NewEIP155Signer(chainID), signedTx)
+	if err != nil || sender != relay.Address() {
+		return nil, nil
+	}
+	return relay.relayedTransactionInfo(&txstore.TimestampedTransaction{Transaction: signedTx})
+}
+
+// GetRelayedTransactionBySender looks up the relayCall sent for the given sender and sender nonce. Only transactions
+// still in the TxStore, i.e. not yet confirmed, can be found. Returns nil if not found.
+func (relay *RelayServer) GetRelayedTransactionBySender(from common.Address, nonce *big.Int) (info *RelayedTransactionInfo, err error) {
+	txs, err := relay.TxStore.ListTransactions()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	for _, tx := range txs {
+		txFrom, _, txNonce, ok := decodeRelayCall(tx.Transaction)
+		if ok && txFrom == from && txNonce.Cmp(nonce) == 0 {
+			return relay.relayedTransactionInfo(tx)
+		}
+	}
+	return nil, nil
+}
+
+// relayedTransactionInfo looks for a receipt of the tx or any of the txs it replaced, and counts its confirmations
+// the same way UpdateUnconfirmedTransactions does, by comparing the relay's nonce some blocks ago to the tx's
+func (relay *RelayServer) relayedTransactionInfo(tx *txstore.TimestampedTransaction) (info *RelayedTransactionInfo, err error) {
+	info = &RelayedTransactionInfo{
+		SignedTx:       tx.Transaction,
+		PreviousHashes: tx.PreviousHashes,
+		Status:         TxStatusPending,
+	}
+	if info.PreviousHashes == nil {
+		info.PreviousHashes = []common.Hash{}
+	}
+
+	ctx := context.Background()
+	hashes := append([]common.Hash{tx.Hash()}, tx.PreviousHashes...)
+	for _, hash := range hashes {
+		receipt, err := relay.Client.TransactionReceipt(ctx, hash)
+		if err == ethereum.NotFound || (err == nil && receipt == nil) {
+			continue
+		} else if err != nil {
+			log.Println(err)
+			return nil, err
+		}
+		minedHash := hash
+		info.MinedHash = &minedHash
+		info.Receipt = receipt
+		info.Status = TxStatusMined
+		break
+	}
+	if info.Receipt == nil {
+		return
+	}
+
+	latest, err := relay.Client.HeaderByNumber(ctx, nil)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	confirmations := new(big.Int).SetUint64(relay.ConfirmationsNeeded())
+	if latest.Number.Cmp(confirmations) < 0 {
+		return
+	}
+	confirmedBlock := new(big.Int).Sub(latest.Number, confirmations)
+	nonce, err := relay.Client.NonceAt(ctx, relay.Address(), confirmedBlock)
+	if err != nil {
+		err = fmt.Errorf("Could not get relay nonce on block %s: %v", confirmedBlock.String(), err)
+		log.Println(err)
+		return nil, err
+	}
+	if tx.Nonce() < nonce {
+		info.Status = TxStatusConfirmed
+	}
+	return
+}
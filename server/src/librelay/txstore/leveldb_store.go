@@ -1,16 +1,19 @@
 package txstore
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
 	"sync"
 
 	"code.cloudfoundry.org/clock"
 
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/rlp"
 
 	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
 )
 
 type LevelDbTxStore struct {
@@ -19,6 +22,32 @@ type LevelDbTxStore struct {
 	mutex *sync.Mutex
 }
 
+// Txs are keyed by their 8 byte nonce, request statuses by this prefix and the request id
+var requestKeyPrefix = []byte("request:")
+
+// isTxKey tells tx keys apart from request keys, which can be 8 bytes long too
+func isTxKey(key []byte) bool {
+	return len(key) == 8 && !bytes.HasPrefix(key, requestKeyPrefix)
+}
+
+// storedRequestStatus is the rlp encoding of a RequestStatus
+type storedRequestStatus struct {
+	Status  string
+	Error   string
+	Nonce   uint64
+	TxHash  common.Hash
+	Updated uint64
+}
+
+// minedBlock is the rlp encoding of the block a stored tx was mined in
+type minedBlock struct {
+	Number uint64
+	Hash   common.Hash
+}
+
+// Encode serializes the tx as its timestamp (8 bytes), the rlp encoded tx and, if there are any, the rlp encoded
+// previous hashes followed by the rlp encoded mined block. Entries written before previous hashes were kept simply end
+// after the tx; a mined tx that replaced none has an empty list of previous hashes.
 func (tx *TimestampedTransaction) Encode() ([]byte, error) {
 	bytes := make([]byte, 8)
 	binary.BigEndian.PutUint64(bytes, uint64(tx.Timestamp))
@@ -27,18 +56,59 @@ func (tx *TimestampedTransaction) Encode() ([]byte, error) {
 		return nil, err
 	}
 	bytes = append(bytes, txBytes...)
+	if len(tx.PreviousHashes) > 0 || tx.IsMined() {
+		hashBytes, err := rlp.EncodeToBytes(tx.PreviousHashes)
+		if err != nil {
+			return nil, err
+		}
+		bytes = append(bytes, hashBytes...)
+	}
+	if tx.IsMined() {
+		blockBytes, err := rlp.EncodeToBytes(minedBlock{tx.MinedBlock, tx.MinedBlockHash})
+		if err != nil {
+			return nil, err
+		}
+		bytes = append(bytes, blockBytes...)
+	}
 	return bytes, nil
 }
 
 func DecodeTimestampedTransaction(bytes []byte) (*TimestampedTransaction, error) {
+	if len(bytes) < 8 {
+		return nil, fmt.Errorf("Invalid stored transaction of %d bytes", len(bytes))
+	}
+	_, _, rest, err := rlp.Split(bytes[8:])
+	if err != nil {
+		return nil, err
+	}
 	var tx types.Transaction
-	err := rlp.DecodeBytes(bytes[8:], &tx)
+	err = rlp.DecodeBytes(bytes[8:len(bytes)-len(rest)], &tx)
 	if err != nil {
 		return nil, err
 	}
-
-	timestamp := int64(binary.BigEndian.Uint64(bytes[:8]))
-	timedtx := TimestampedTransaction{&tx, timestamp}
+	timedtx := TimestampedTransaction{Transaction: &tx, Timestamp: int64(binary.BigEndian.Uint64(bytes[:8]))}
+	if len(rest) > 0 {
+		_, _, blockBytes, err := rlp.Split(rest)
+		if err != nil {
+			return nil, err
+		}
+		var previousHashes []common.Hash
+		err = rlp.DecodeBytes(rest[:len(rest)-len(blockBytes)], &previousHashes)
+		if err != nil {
+			return nil, err
+		}
+		if len(previousHashes) > 0 {
+			timedtx.PreviousHashes = previousHashes
+		}
+		if len(blockBytes) > 0 {
+			var block minedBlock
+			err = rlp.DecodeBytes(blockBytes, &block)
+			if err != nil {
+				return nil, err
+			}
+			timedtx.MinedBlock, timedtx.MinedBlockHash = block.Number, block.Hash
+		}
+	}
 	return &timedtx, nil
 }
 
@@ -64,6 +134,9 @@ func (store *LevelDbTxStore) ListTransactions() (txs []*TimestampedTransaction,
 	iter := store.NewIterator(nil, nil)
 	defer iter.Release()
 	for iter.Next() {
+		if !isTxKey(iter.Key()) {
+			continue
+		}
 		value := iter.Value()
 		tx, err := DecodeTimestampedTransaction(value)
 		if err != nil {
@@ -80,7 +153,10 @@ func (store *LevelDbTxStore) GetFirstTransaction() (tx *TimestampedTransaction,
 	iter := store.NewIterator(nil, nil)
 	defer iter.Release()
 
-	if iter.Next() {
+	for iter.Next() {
+		if !isTxKey(iter.Key()) {
+			continue
+		}
 		value := iter.Value()
 		tx, err := DecodeTimestampedTransaction(value)
 		if err != nil {
@@ -91,40 +167,106 @@ func (store *LevelDbTxStore) GetFirstTransaction() (tx *TimestampedTransaction,
 	return nil, nil
 }
 
+// GetTransactionByNonce returns the transaction with the given nonce, or nil if there is none
+func (store *LevelDbTxStore) GetTransactionByNonce(nonce uint64) (tx *TimestampedTransaction, err error) {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, nonce)
+
+	value, err := store.Get(key, nil)
+	if err == leveldb.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return DecodeTimestampedTransaction(value)
+}
+
+// GetTransactionByHash returns the transaction with the given hash or that replaced it, or nil if there is none
+func (store *LevelDbTxStore) GetTransactionByHash(hash common.Hash) (tx *TimestampedTransaction, err error) {
+	iter := store.NewIterator(nil, nil)
+	defer iter.Release()
+
+	for iter.Next() {
+		if !isTxKey(iter.Key()) {
+			continue
+		}
+		tx, err := DecodeTimestampedTransaction(iter.Value())
+		if err != nil {
+			return nil, err
+		}
+		if tx.HasHash(hash) {
+			return tx, nil
+		}
+	}
+	return nil, nil
+}
+
 // SaveTransaction dates and stores transaction sorted by ascending nonce
 func (store *LevelDbTxStore) SaveTransaction(tx *types.Transaction) (err error) {
 	store.mutex.Lock()
 	defer store.mutex.Unlock()
 
-	timedtx := &TimestampedTransaction{tx, store.clock.Now().Unix()}
+	return store.put(&TimestampedTransaction{Transaction: tx, Timestamp: store.clock.Now().Unix()})
+}
+
+func (store *LevelDbTxStore) put(timedtx *TimestampedTransaction) (err error) {
 	txbytes, err := timedtx.Encode()
 	if err != nil {
 		return err
 	}
 
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, timedtx.Nonce())
+	return store.Put(key, txbytes, nil)
+}
+
+// UpdateTransactionByNonce updates a transaction given its nonce, returns error if tx with same nonce does not exist.
+// The hash of the replaced tx is kept in PreviousHashes.
+func (store *LevelDbTxStore) UpdateTransactionByNonce(tx *types.Transaction) (err error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
 	key := make([]byte, 8)
 	binary.BigEndian.PutUint64(key, tx.Nonce())
-	err = store.Put(key, txbytes, nil)
+
+	value, err := store.Get(key, nil)
+	if err == leveldb.ErrNotFound {
+		return fmt.Errorf("Could not find transaction with nonce %d", tx.Nonce())
+	} else if err != nil {
+		return err
+	}
+	previous, err := DecodeTimestampedTransaction(value)
 	if err != nil {
 		return err
 	}
 
-	return
+	return store.put(replacing(previous, tx, store.clock.Now().Unix()))
 }
 
-// UpdateTransactionByNonce updates a transaction given its nonce, returns error if tx with same nonce does not exist
-func (store *LevelDbTxStore) UpdateTransactionByNonce(tx *types.Transaction) (err error) {
+// UpdateMinedBlock records the block the tx with the given nonce was mined in; a zero hash clears it.
+// Returns error if tx with the nonce does not exist.
+func (store *LevelDbTxStore) UpdateMinedBlock(nonce uint64, blockNumber uint64, blockHash common.Hash) (err error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
 	key := make([]byte, 8)
-	binary.BigEndian.PutUint64(key, tx.Nonce())
+	binary.BigEndian.PutUint64(key, nonce)
 
-	_, err = store.Get(key, nil)
+	value, err := store.Get(key, nil)
 	if err == leveldb.ErrNotFound {
-		return fmt.Errorf("Could not find transaction with nonce %d", tx.Nonce())
+		return fmt.Errorf("Could not find transaction with nonce %d", nonce)
 	} else if err != nil {
 		return err
 	}
-
-	return store.SaveTransaction(tx)
+	tx, err := DecodeTimestampedTransaction(value)
+	if err != nil {
+		return err
+	}
+	tx.MinedBlock, tx.MinedBlockHash = blockNumber, blockHash
+	if blockHash == (common.Hash{}) {
+		tx.MinedBlock = 0
+	}
+	return store.put(tx)
 }
 
 // RemoveTransactionsLessThanNonce removes all transactions with nonce values up to the specified value inclusive
@@ -137,6 +279,9 @@ func (store *LevelDbTxStore) RemoveTransactionsLessThanNonce(nonce uint64) (err
 
 	for iter.Next() {
 		key := iter.Key()
+		if !isTxKey(key) {
+			continue
+		}
 		value := iter.Value()
 		tx, err := DecodeTimestampedTransaction(value)
 		if err != nil {
@@ -155,7 +300,64 @@ func (store *LevelDbTxStore) RemoveTransactionsLessThanNonce(nonce uint64) (err
 	return store.Write(batch, nil)
 }
 
-// Clear removes all transactions stored
+func requestKey(id string) []byte {
+	return append(append([]byte{}, requestKeyPrefix...), id...)
+}
+
+// SaveRequestStatus stores the status of the asynchronous request with the given id, dated now
+func (store *LevelDbTxStore) SaveRequestStatus(id string, status RequestStatus) (err error) {
+	bytes, err := rlp.EncodeToBytes(storedRequestStatus{status.Status, status.Error, status.Nonce, status.TxHash,
+		uint64(store.clock.Now().Unix())})
+	if err != nil {
+		return err
+	}
+	return store.Put(requestKey(id), bytes, nil)
+}
+
+func decodeRequestStatus(bytes []byte) (*RequestStatus, error) {
+	var stored storedRequestStatus
+	if err := rlp.DecodeBytes(bytes, &stored); err != nil {
+		return nil, err
+	}
+	return &RequestStatus{stored.Status, stored.Error, stored.Nonce, stored.TxHash, int64(stored.Updated)}, nil
+}
+
+// GetRequestStatus returns the status of the request with the given id, or nil if there is none
+func (store *LevelDbTxStore) GetRequestStatus(id string) (status *RequestStatus, err error) {
+	value, err := store.Get(requestKey(id), nil)
+	if err == leveldb.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return decodeRequestStatus(value)
+}
+
+func (store *LevelDbTxStore) RemoveRequestStatus(id string) (err error) {
+	return store.Delete(requestKey(id), nil)
+}
+
+// RemoveRequestStatusesBefore removes the statuses last updated before timestamp
+func (store *LevelDbTxStore) RemoveRequestStatusesBefore(timestamp int64) (err error) {
+	batch := new(leveldb.Batch)
+	iter := store.NewIterator(util.BytesPrefix(requestKeyPrefix), nil)
+
+	for iter.Next() {
+		status, err := decodeRequestStatus(iter.Value())
+		if err != nil {
+			iter.Release()
+			return err
+		}
+		if status.Updated < timestamp {
+			batch.Delete(iter.Key())
+		}
+	}
+
+	iter.Release()
+	return store.Write(batch, nil)
+}
+
+// Clear removes all transactions and request statuses stored
 func (store *LevelDbTxStore) Clear() (err error) {
 	store.mutex.Lock()
 	defer store.mutex.Unlock()
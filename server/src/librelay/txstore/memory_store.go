@@ -7,11 +7,13 @@ import (
 
 	"code.cloudfoundry.org/clock"
 
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
 )
 
 type MemoryTxStore struct {
 	transactions *list.List
+	requests     map[string]*RequestStatus
 	mutex        *sync.Mutex
 	clock        clock.Clock
 }
@@ -23,6 +25,7 @@ func NewMemoryTxStore(clk clock.Clock) *MemoryTxStore {
 
 	return &MemoryTxStore{
 		transactions: list.New(),
+		requests:     make(map[string]*RequestStatus),
 		mutex:        &sync.Mutex{},
 		clock:        clk,
 	}
@@ -48,12 +51,38 @@ func (store *MemoryTxStore) GetFirstTransaction() (tx *TimestampedTransaction, e
 	return front.Value.(*TimestampedTransaction), nil
 }
 
+// GetTransactionByNonce returns the transaction with the given nonce, or nil if there is none
+func (store *MemoryTxStore) GetTransactionByNonce(nonce uint64) (tx *TimestampedTransaction, err error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	for e := store.transactions.Front(); e != nil; e = e.Next() {
+		if e.Value.(*TimestampedTransaction).Nonce() == nonce {
+			return e.Value.(*TimestampedTransaction), nil
+		}
+	}
+	return nil, nil
+}
+
+// GetTransactionByHash returns the transaction with the given hash or that replaced it, or nil if there is none
+func (store *MemoryTxStore) GetTransactionByHash(hash common.Hash) (tx *TimestampedTransaction, err error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	for e := store.transactions.Front(); e != nil; e = e.Next() {
+		if e.Value.(*TimestampedTransaction).HasHash(hash) {
+			return e.Value.(*TimestampedTransaction), nil
+		}
+	}
+	return nil, nil
+}
+
 // SaveTransaction dates and stores transaction sorted by ascending nonce
 func (store *MemoryTxStore) SaveTransaction(tx *types.Transaction) (err error) {
 	store.mutex.Lock()
 	defer store.mutex.Unlock()
 
-	timedtx := &TimestampedTransaction{tx, store.clock.Now().Unix()}
+	timedtx := &TimestampedTransaction{Transaction: tx, Timestamp: store.clock.Now().Unix()}
 	for e := store.transactions.Front(); e != nil; e = e.Next() {
 		if e.Value.(*TimestampedTransaction).Nonce() > tx.Nonce() {
 			store.transactions.InsertBefore(timedtx, e)
@@ -65,15 +94,15 @@ func (store *MemoryTxStore) SaveTransaction(tx *types.Transaction) (err error) {
 	return
 }
 
-// UpdateTransactionByNonce updates a transaction given its nonce, returns error if tx with same nonce does not exist
+// UpdateTransactionByNonce updates a transaction given its nonce, returns error if tx with same nonce does not exist.
+// The hash of the replaced tx is kept in PreviousHashes.
 func (store *MemoryTxStore) UpdateTransactionByNonce(tx *types.Transaction) (err error) {
 	store.mutex.Lock()
 	defer store.mutex.Unlock()
 
-	timedtx := &TimestampedTransaction{tx, store.clock.Now().Unix()}
 	for e := store.transactions.Front(); e != nil; e = e.Next() {
 		if e.Value.(*TimestampedTransaction).Nonce() == tx.Nonce() {
-			e.Value = timedtx
+			e.Value = replacing(e.Value.(*TimestampedTransaction), tx, store.clock.Now().Unix())
 			return nil
 		}
 	}
@@ -81,6 +110,27 @@ func (store *MemoryTxStore) UpdateTransactionByNonce(tx *types.Transaction) (err
 	return fmt.Errorf("Could not find transaction with nonce %d", tx.Nonce())
 }
 
+// UpdateMinedBlock records the block the tx with the given nonce was mined in; a zero hash clears it.
+// Returns error if tx with the nonce does not exist.
+func (store *MemoryTxStore) UpdateMinedBlock(nonce uint64, blockNumber uint64, blockHash common.Hash) (err error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	for e := store.transactions.Front(); e != nil; e = e.Next() {
+		if e.Value.(*TimestampedTransaction).Nonce() == nonce {
+			updated := *e.Value.(*TimestampedTransaction)
+			updated.MinedBlock, updated.MinedBlockHash = blockNumber, blockHash
+			if blockHash == (common.Hash{}) {
+				updated.MinedBlock = 0
+			}
+			e.Value = &updated
+			return nil
+		}
+	}
+
+	return fmt.Errorf("Could not find transaction with nonce %d", nonce)
+}
+
 // RemoveTransactionsLessThanNonce removes all transactions with nonce values up to the specified value inclusive
 func (store *MemoryTxStore) RemoveTransactionsLessThanNonce(nonce uint64) (err error) {
 	store.mutex.Lock()
@@ -93,12 +143,57 @@ func (store *MemoryTxStore) RemoveTransactionsLessThanNonce(nonce uint64) (err e
 	return
 }
 
-// Clear removes all transactions stored
+// SaveRequestStatus stores the status of the asynchronous request with the given id, dated now
+func (store *MemoryTxStore) SaveRequestStatus(id string, status RequestStatus) (err error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	status.Updated = store.clock.Now().Unix()
+	store.requests[id] = &status
+	return
+}
+
+// GetRequestStatus returns the status of the request with the given id, or nil if there is none
+func (store *MemoryTxStore) GetRequestStatus(id string) (status *RequestStatus, err error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	found, ok := store.requests[id]
+	if !ok {
+		return nil, nil
+	}
+	copied := *found
+	return &copied, nil
+}
+
+func (store *MemoryTxStore) RemoveRequestStatus(id string) (err error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	delete(store.requests, id)
+	return
+}
+
+// RemoveRequestStatusesBefore removes the statuses last updated before timestamp
+func (store *MemoryTxStore) RemoveRequestStatusesBefore(timestamp int64) (err error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	for id, status := range store.requests {
+		if status.Updated < timestamp {
+			delete(store.requests, id)
+		}
+	}
+	return
+}
+
+// Clear removes all transactions and request statuses stored
 func (store *MemoryTxStore) Clear() (err error) {
 	store.mutex.Lock()
 	defer store.mutex.Unlock()
 
 	store.transactions = list.New()
+	store.requests = make(map[string]*RequestStatus)
 	return
 }
 
@@ -1,20 +1,73 @@
 package txstore
 
 import (
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
 )
 
 type TimestampedTransaction struct {
 	*types.Transaction
-	Timestamp int64
+	Timestamp      int64
+	PreviousHashes []common.Hash // hashes of the txs with the same nonce this one replaced, oldest first
+	MinedBlock     uint64        // number of the block the tx (or one it replaced) was seen mined in
+	MinedBlockHash common.Hash   // hash of that block, zero if the tx was not seen mined
+}
+
+// IsMined returns whether the tx was seen mined. The block may since have been reorged out of the chain.
+func (tx *TimestampedTransaction) IsMined() bool {
+	return tx.MinedBlockHash != (common.Hash{})
+}
+
+// HasHash returns whether hash is the one of the tx or of a tx it replaced
+func (tx *TimestampedTransaction) HasHash(hash common.Hash) bool {
+	if tx.Hash() == hash {
+		return true
+	}
+	for _, previous := range tx.PreviousHashes {
+		if previous == hash {
+			return true
+		}
+	}
+	return false
+}
+
+// replacing returns tx timestamped with timestamp, remembering the hashes of previous as replaced. The new tx is
+// not mined yet.
+func replacing(previous *TimestampedTransaction, tx *types.Transaction, timestamp int64) *TimestampedTransaction {
+	hashes := append([]common.Hash{}, previous.PreviousHashes...)
+	if previous.Hash() != tx.Hash() {
+		hashes = append(hashes, previous.Hash())
+	}
+	return &TimestampedTransaction{Transaction: tx, Timestamp: timestamp, PreviousHashes: hashes}
+}
+
+// RequestStatus is the progress of an asynchronous relay request, stored by request id
+type RequestStatus struct {
+	Status  string
+	Error   string
+	Nonce   uint64
+	TxHash  common.Hash // hash of the relayCall tx as sent, or as mined once it was seen mined
+	Updated int64       // time of the last update
 }
 
 type ITxStore interface {
 	ListTransactions() (txs []*TimestampedTransaction, err error)
 	GetFirstTransaction() (tx *TimestampedTransaction, err error)
+	GetTransactionByNonce(nonce uint64) (tx *TimestampedTransaction, err error)
+	GetTransactionByHash(hash common.Hash) (tx *TimestampedTransaction, err error)
 	SaveTransaction(tx *types.Transaction) (err error)
 	UpdateTransactionByNonce(tx *types.Transaction) (err error)
+	// UpdateMinedBlock records the block the tx with the given nonce was mined in; a zero hash clears it
+	UpdateMinedBlock(nonce uint64, blockNumber uint64, blockHash common.Hash) (err error)
 	RemoveTransactionsLessThanNonce(nonce uint64) (err error)
+	// SaveRequestStatus stores the status of the asynchronous request with the given id, dated now
+	SaveRequestStatus(id string, status RequestStatus) (err error)
+	// GetRequestStatus returns the status of the request with the given id, or nil if there is none
+	GetRequestStatus(id string) (status *RequestStatus, err error)
+	RemoveRequestStatus(id string) (err error)
+	// RemoveRequestStatusesBefore removes the statuses last updated before timestamp
+	RemoveRequestStatusesBefore(timestamp int64) (err error)
+	// Clear removes all transactions and request statuses stored
 	Clear() (err error)
 	Close() (err error)
 }
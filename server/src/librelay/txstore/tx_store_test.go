@@ -60,6 +60,23 @@ func testStore(t *testing.T, store ITxStore, clk *fakeclock.FakeClock) {
 		}
 	})
 
+	t.Run("GetTransactionByNonce returns the tx or nil", func(t *testing.T) {
+		store.Clear()
+		tx4 := newTx(4)
+		test.ErrFail(store.SaveTransaction(newTx(3)), t)
+		test.ErrFail(store.SaveTransaction(tx4), t)
+
+		tx, err := store.GetTransactionByNonce(4)
+		test.ErrFail(err, t)
+		if tx == nil || tx.Hash() != tx4.Hash() {
+			t.Errorf("Expected tx %v but got %v", tx4.Hash().Hex(), tx)
+		}
+		tx, err = store.GetTransactionByNonce(5)
+		if tx != nil || err != nil {
+			t.Errorf("Expected no tx with nonce 5 but got %v (error %v)", tx, err)
+		}
+	})
+
 	t.Run("UpdateTransactionByNonce updates the tx", func(t *testing.T) {
 		store.Clear()
 		updatedTx := newTx(4)
@@ -76,6 +93,31 @@ func testStore(t *testing.T, store ITxStore, clk *fakeclock.FakeClock) {
 		}
 	})
 
+	t.Run("UpdateTransactionByNonce keeps the replaced hashes", func(t *testing.T) {
+		store.Clear()
+		tx1, tx2, tx3 := newTx(4), newTx(4), newTx(4)
+		test.ErrFail(store.SaveTransaction(tx1), t)
+		test.ErrFail(store.UpdateTransactionByNonce(tx2), t)
+		test.ErrFail(store.UpdateTransactionByNonce(tx3), t)
+
+		tx, err := store.GetTransactionByNonce(4)
+		test.ErrFail(err, t)
+		if tx.Hash() != tx3.Hash() || len(tx.PreviousHashes) != 2 || tx.PreviousHashes[0] != tx1.Hash() || tx.PreviousHashes[1] != tx2.Hash() {
+			t.Errorf("Expected %v replacing %v and %v but got %v %v", tx3.Hash().Hex(), tx1.Hash().Hex(), tx2.Hash().Hex(), tx.Hash().Hex(), tx.PreviousHashes)
+		}
+		for _, hash := range []common.Hash{tx1.Hash(), tx2.Hash(), tx3.Hash()} {
+			tx, err = store.GetTransactionByHash(hash)
+			test.ErrFail(err, t)
+			if tx == nil || tx.Hash() != tx3.Hash() {
+				t.Errorf("Expected %v to be found by hash %v but got %v", tx3.Hash().Hex(), hash.Hex(), tx)
+			}
+		}
+		tx, err = store.GetTransactionByHash(newTx(5).Hash())
+		if tx != nil || err != nil {
+			t.Errorf("Expected no tx for unknown hash but got %v (error %v)", tx, err)
+		}
+	})
+
 	t.Run("UpdateTransactionByNonce fails if tx is not present", func(t *testing.T) {
 		store.Clear()
 		test.ErrFail(store.SaveTransaction(newTx(3)), t)
@@ -85,6 +127,43 @@ func testStore(t *testing.T, store ITxStore, clk *fakeclock.FakeClock) {
 		}
 	})
 
+	t.Run("UpdateMinedBlock records and clears the mined block", func(t *testing.T) {
+		store.Clear()
+		blockHash := common.HexToHash("0x1234")
+		test.ErrFail(store.SaveTransaction(newTx(3)), t)
+		test.ErrFail(store.SaveTransaction(newTx(4)), t)
+		test.ErrFail(store.UpdateMinedBlock(4, 12, blockHash), t)
+
+		tx, err := store.GetTransactionByNonce(4)
+		test.ErrFail(err, t)
+		if !tx.IsMined() || tx.MinedBlock != 12 || tx.MinedBlockHash != blockHash {
+			t.Errorf("Expected tx mined in block 12 %v but got %v %v", blockHash.Hex(), tx.MinedBlock, tx.MinedBlockHash.Hex())
+		}
+		tx, err = store.GetTransactionByNonce(3)
+		test.ErrFail(err, t)
+		if tx.IsMined() {
+			t.Errorf("Expected tx 3 not to be mined")
+		}
+
+		test.ErrFail(store.UpdateTransactionByNonce(newTx(4)), t)
+		tx, err = store.GetTransactionByNonce(4)
+		test.ErrFail(err, t)
+		if tx.IsMined() {
+			t.Errorf("Expected the replacing tx not to be mined")
+		}
+
+		test.ErrFail(store.UpdateMinedBlock(4, 12, blockHash), t)
+		test.ErrFail(store.UpdateMinedBlock(4, 0, common.Hash{}), t)
+		tx, err = store.GetTransactionByNonce(4)
+		test.ErrFail(err, t)
+		if tx.IsMined() || tx.MinedBlock != 0 {
+			t.Errorf("Expected the mined block to be cleared but got %v %v", tx.MinedBlock, tx.MinedBlockHash.Hex())
+		}
+		if err = store.UpdateMinedBlock(5, 12, blockHash); err == nil {
+			t.Errorf("Expected an error for a missing tx")
+		}
+	})
+
 	t.Run("RemoveTransactionsLessThanNonce removes transactions strictly less than parameter", func(t *testing.T) {
 		store.Clear()
 		test.ErrFail(store.SaveTransaction(newTx(4)), t)
@@ -100,6 +179,46 @@ func testStore(t *testing.T, store ITxStore, clk *fakeclock.FakeClock) {
 			t.Errorf("Transactions left after removal: %v", txs)
 		}
 	})
+
+	t.Run("Request statuses are kept apart from txs", func(t *testing.T) {
+		store.Clear()
+		test.ErrFail(store.SaveTransaction(newTx(3)), t)
+		txHash := newTx(3).Hash()
+		test.ErrFail(store.SaveRequestStatus("a", RequestStatus{Status: "sent", Nonce: 3, TxHash: txHash}), t)
+		clk.IncrementBySeconds(10)
+		test.ErrFail(store.SaveRequestStatus("b", RequestStatus{Status: "failed", Error: "rejected"}), t)
+		// Its key is as long as a tx key
+		test.ErrFail(store.SaveRequestStatus("", RequestStatus{Status: "sent"}), t)
+
+		status, err := store.GetRequestStatus("a")
+		test.ErrFail(err, t)
+		if status == nil || status.Status != "sent" || status.Nonce != 3 || status.TxHash != txHash || status.Updated != clk.Now().Unix()-10 {
+			t.Errorf("Wrong status stored: %+v", status)
+		}
+		txs, err := store.ListTransactions()
+		test.ErrFail(err, t)
+		first, err := store.GetFirstTransaction()
+		test.ErrFail(err, t)
+		if len(txs) != 1 || first == nil || first.Nonce() != 3 {
+			t.Errorf("Expected only the tx to be listed but got %v", txs)
+		}
+		test.ErrFail(store.RemoveTransactionsLessThanNonce(4), t)
+		if status, err = store.GetRequestStatus("a"); status == nil || err != nil {
+			t.Errorf("Expected the status to outlive its tx but got %+v (error %v)", status, err)
+		}
+
+		test.ErrFail(store.RemoveRequestStatusesBefore(clk.Now().Unix()-5), t)
+		if status, err = store.GetRequestStatus("a"); status != nil || err != nil {
+			t.Errorf("Expected the old status to be removed but got %+v (error %v)", status, err)
+		}
+		if status, err = store.GetRequestStatus("b"); status == nil || err != nil || status.Error != "rejected" {
+			t.Errorf("Expected the recent status to be kept but got %+v (error %v)", status, err)
+		}
+		test.ErrFail(store.RemoveRequestStatus("b"), t)
+		if status, err = store.GetRequestStatus("b"); status != nil || err != nil {
+			t.Errorf("Expected the status to be removed but got %+v (error %v)", status, err)
+		}
+	})
 }
 
 func TestMemoryStore(t *testing.T) {
@@ -119,7 +238,7 @@ func TestLevelDbStore(t *testing.T) {
 
 func TestTransactionEncode(t *testing.T) {
 	timestamp := time.Now().Unix()
-	tx := TimestampedTransaction{newTx(10), timestamp}
+	tx := TimestampedTransaction{Transaction: newTx(10), Timestamp: timestamp}
 	bytes, err := tx.Encode()
 	test.ErrFailWithDesc(err, t, "Error encoding transaction")
 	decodedTx, err := DecodeTimestampedTransaction(bytes)
@@ -137,6 +256,37 @@ func TestTransactionEncode(t *testing.T) {
 	if decodedTx.To().Hex() != tx.To().Hex() {
 		t.Errorf("Incorrect recipient %v, expected %v", decodedTx.To().Hex(), tx.To().Hex())
 	}
+	if decodedTx.PreviousHashes != nil {
+		t.Errorf("Expected no previous hashes but got %v", decodedTx.PreviousHashes)
+	}
+
+	tx.PreviousHashes = []common.Hash{newTx(10).Hash(), newTx(10).Hash()}
+	bytes, err = tx.Encode()
+	test.ErrFailWithDesc(err, t, "Error encoding replacing transaction")
+	decodedTx, err = DecodeTimestampedTransaction(bytes)
+	test.ErrFailWithDesc(err, t, "Error decoding replacing transaction")
+	if decodedTx.Hash() != tx.Hash() || len(decodedTx.PreviousHashes) != 2 || decodedTx.PreviousHashes[1] != tx.PreviousHashes[1] {
+		t.Errorf("Incorrect previous hashes %v, expected %v", decodedTx.PreviousHashes, tx.PreviousHashes)
+	}
+	if decodedTx.IsMined() {
+		t.Errorf("Expected no mined block but got %v", decodedTx.MinedBlockHash.Hex())
+	}
+
+	for _, hashes := range [][]common.Hash{nil, tx.PreviousHashes} {
+		tx.PreviousHashes = hashes
+		tx.MinedBlock, tx.MinedBlockHash = 42, common.HexToHash("0xabcd")
+		bytes, err = tx.Encode()
+		test.ErrFailWithDesc(err, t, "Error encoding mined transaction")
+		decodedTx, err = DecodeTimestampedTransaction(bytes)
+		test.ErrFailWithDesc(err, t, "Error decoding mined transaction")
+		if decodedTx.MinedBlock != 42 || decodedTx.MinedBlockHash != tx.MinedBlockHash || len(decodedTx.PreviousHashes) != len(hashes) {
+			t.Errorf("Incorrect mined block %v %v with previous hashes %v, expected %v %v with %v", decodedTx.MinedBlock,
+				decodedTx.MinedBlockHash.Hex(), decodedTx.PreviousHashes, tx.MinedBlock, tx.MinedBlockHash.Hex(), hashes)
+		}
+		if hashes == nil && decodedTx.PreviousHashes != nil {
+			t.Errorf("Expected no previous hashes but got %v", decodedTx.PreviousHashes)
+		}
+	}
 }
 
 func cleanupDb(store *LevelDbTxStore) {
@@ -0,0 +1,160 @@
+package librelay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// ErrBalanceTooLow is returned when the relay's balance cannot cover a withdrawal and its transfer cost
+var ErrBalanceTooLow = errors.New("Balance too low to withdraw")
+
+const withdrawalGasLimit = uint64(21000)
+
+// withdrawalReserve is the balance kept to pay for a withdrawal. Resending a tx with another value is penalizable as
+// a repeated nonce, so the value cannot be lowered when the gas price is bumped: enough is kept for the transfer at
+// the highest gas price resendTransaction bumps it to.
+func withdrawalReserve(gasPrice *big.Int) *big.Int {
+	price := big.NewInt(maxGasPrice)
+	if gasPrice.Cmp(price) > 0 {
+		price.Set(gasPrice)
+	}
+	return price.Mul(price, new(big.Int).SetUint64(withdrawalGasLimit))
+}
+
+// pendingSpend returns what the stored txs not known to be mined yet may still take from the balance
+func pendingSpend(txs []*types.Transaction) *big.Int {
+	spend := big.NewInt(0)
+	for _, tx := range txs {
+		spend.Add(spend, tx.Cost())
+	}
+	return spend
+}
+
+// WithdrawalApproval is the owner's approval of withdrawals from the relay to an address other than the owner's
+type WithdrawalApproval struct {
+	Expiry    int64  // unix time after which the approval is refused
+	Signature []byte // the owner's signature of WithdrawalApprovalHash
+}
+
+// WithdrawalApprovalHash is the hash the owner signs (with eth_sign, i.e. prefixed as an Ethereum signed message) to
+// approve withdrawals from the relay to an address other than the owner's until expiry
+func WithdrawalApprovalHash(relayAddress common.Address, to common.Address, expiry int64) common.Hash {
+	hash := crypto.Keccak256(relayAddress.Bytes(), to.Bytes(), common.BigToHash(big.NewInt(expiry)).Bytes())
+	return crypto.Keccak256Hash([]byte(fmt.Sprintf("\x19Ethereum Signed Message:\n%d", len(hash))), hash)
+}
+
+// checkWithdrawalApproval checks that withdrawals to the address are approved by the owner: the owner's address needs
+// no approval, others need the owner's signature of WithdrawalApprovalHash, before it expires
+func (relay *RelayServer) checkWithdrawalApproval(to common.Address, approval *WithdrawalApproval) (err error) {
+	if relay.OwnerAddress == (common.Address{}) {
+		return fmt.Errorf("Owner address not set, cannot withdraw")
+	}
+	if to == relay.OwnerAddress {
+		return nil
+	}
+	if approval == nil || len(approval.Signature) != 65 {
+		return fmt.Errorf("Withdrawals to %s need the owner's approval", to.Hex())
+	}
+	if relay.clock.Now().Unix() > approval.Expiry {
+		return fmt.Errorf("The approval of withdrawals to %s expired at %d", to.Hex(), approval.Expiry)
+	}
+	signature := make([]byte, 65)
+	copy(signature, approval.Signature)
+	if signature[64] >= 27 {
+		signature[64] -= 27
+	}
+	pubKey, err := crypto.SigToPub(WithdrawalApprovalHash(relay.Address(), to, approval.Expiry).Bytes(), signature)
+	if err != nil || crypto.PubkeyToAddress(*pubKey) != relay.OwnerAddress {
+		return fmt.Errorf("Withdrawals to %s are not approved by the owner %s", to.Hex(), relay.OwnerAddress.Hex())
+	}
+	return nil
+}
+
+// Withdraw sends amount wei to the owner or an address the owner approved, or everything that can be withdrawn if
+// amount is nil. The balance must cover the amount, what the relay's pending txs may still spend, and the transfer at
+// the highest gas price it may be resent with. The withdrawal is tracked in the TxStore and resent with a higher gas
+// price like the relay's other txs. Withdrawing is allowed while the relay is halted.
+func (relay *RelayServer) Withdraw(to common.Address, amount *big.Int, approval *WithdrawalApproval) (tx *types.Transaction, err error) {
+	if err = relay.checkWithdrawalApproval(to, approval); err != nil {
+		log.Println(err)
+		return
+	}
+	if amount != nil && amount.Sign() <= 0 {
+		return nil, fmt.Errorf("Withdrawal amount %s must be positive", amount)
+	}
+	ctx := context.Background()
+	balance, err := relay.Client.BalanceAt(ctx, relay.Address(), nil)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	gasPrice, err := relay.Client.SuggestGasPrice(ctx)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	stored, err := relay.TxStore.ListTransactions()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	var pending []*types.Transaction
+	for _, storedTx := range stored {
+		if !storedTx.IsMined() {
+			pending = append(pending, storedTx.Transaction)
+		}
+	}
+	reserve := withdrawalReserve(gasPrice)
+	available := new(big.Int).Sub(balance, reserve)
+	available.Sub(available, pendingSpend(pending))
+	if amount == nil {
+		amount = available
+	}
+	if available.Sign() <= 0 || amount.Cmp(available) > 0 {
+		log.Printf("Withdraw: balance %s cannot cover %s wei, %d pending txs and the transfer cost of up to %s wei\n",
+			balance, amount, len(pending), reserve)
+		return nil, ErrBalanceTooLow
+	}
+
+	log.Println("Withdrawing", amount, "wei to", to.Hex())
+	return relay.sendPlainTransaction(
+		fmt.Sprintf("Withdraw(to=%s, amount=%s)", to.Hex(), amount),
+		to, amount, withdrawalGasLimit, gasPrice, nil,
+	)
+}
+
+// SendBalanceToOwner withdraws everything it can to the owner, without waiting for the withdrawal to be mined
+func (relay *RelayServer) SendBalanceToOwner() (err error) {
+	_, err = relay.Withdraw(relay.OwnerAddress, nil, nil)
+	return
+}
+
+// withdrawalMined returns whether the withdrawal sent with the nonce, or a resend of it, is mined
+func (relay *RelayServer) withdrawalMined(nonce uint64) (mined bool, err error) {
+	stored, err := relay.TxStore.GetTransactionByNonce(nonce)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if stored == nil {
+		// Confirmed and removed from the store
+		return true, nil
+	}
+	blockNumber, _, err := relay.transactionBlock(context.Background(), stored)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if blockNumber == 0 {
+		return false, nil
+	}
+	log.Println("Withdrawal", stored.Hash().Hex(), "mined in block", blockNumber)
+	return true, nil
+}
@@ -0,0 +1,82 @@
+package librelay
+
+import (
+	"math/big"
+	"testing"
+	"time"
+
+	"librelay/test"
+
+	"code.cloudfoundry.org/clock/fakeclock"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func TestWithdrawalReserve(t *testing.T) {
+	// Below the maximum the transfer may be resent at that price; above it, at its own
+	if reserve := withdrawalReserve(big.NewInt(1e9)); reserve.Cmp(big.NewInt(21000*maxGasPrice)) != 0 {
+		t.Errorf("Expected a reserve of %d but got %s", 21000*maxGasPrice, reserve)
+	}
+	// A price that overflows uint64 once multiplied by the gas limit
+	gasPrice := new(big.Int).Exp(big.NewInt(10), big.NewInt(18), nil)
+	expected := new(big.Int).Mul(gasPrice, big.NewInt(21000))
+	if reserve := withdrawalReserve(gasPrice); reserve.Cmp(expected) != 0 {
+		t.Errorf("Expected a reserve of %s but got %s", expected, reserve)
+	}
+
+	txs := []*types.Transaction{
+		types.NewTransaction(0, common.Address{}, big.NewInt(5), 21000, big.NewInt(2), nil),
+		types.NewTransaction(1, common.Address{}, big.NewInt(0), 100000, big.NewInt(3), []byte{1}),
+	}
+	if spend := pendingSpend(txs); spend.Int64() != 5+21000*2+100000*3 {
+		t.Errorf("Wrong pending spend %s", spend)
+	}
+}
+
+func TestWithdrawalApproval(t *testing.T) {
+	relayKey, err := crypto.GenerateKey()
+	test.ErrFail(err, t)
+	ownerKey, err := crypto.GenerateKey()
+	test.ErrFail(err, t)
+	otherKey, err := crypto.GenerateKey()
+	test.ErrFail(err, t)
+	clk := fakeclock.NewFakeClock(time.Now())
+	relayServer := &RelayServer{PrivateKey: relayKey, clock: clk}
+	to := common.HexToAddress("0x1234567890123456789012345678901234567890")
+
+	if err = relayServer.checkWithdrawalApproval(to, nil); err == nil {
+		t.Error("Expected withdrawals to be refused without an owner")
+	}
+	relayServer.OwnerAddress = crypto.PubkeyToAddress(ownerKey.PublicKey)
+	test.ErrFail(relayServer.checkWithdrawalApproval(relayServer.OwnerAddress, nil), t)
+	if err = relayServer.checkWithdrawalApproval(to, nil); err == nil {
+		t.Error("Expected withdrawals to another address to need an approval")
+	}
+
+	expiry := clk.Now().Add(time.Hour).Unix()
+	hash := WithdrawalApprovalHash(relayServer.Address(), to, expiry)
+	signature, err := crypto.Sign(hash.Bytes(), ownerKey)
+	test.ErrFail(err, t)
+	// eth_sign returns v as 27 or 28
+	signature[64] += 27
+	approval := &WithdrawalApproval{Expiry: expiry, Signature: signature}
+	test.ErrFail(relayServer.checkWithdrawalApproval(to, approval), t)
+
+	if err = relayServer.checkWithdrawalApproval(common.HexToAddress("0x1"), approval); err == nil {
+		t.Error("Expected the approval to be refused for another address")
+	}
+	forged, err := crypto.Sign(hash.Bytes(), otherKey)
+	test.ErrFail(err, t)
+	if err = relayServer.checkWithdrawalApproval(to, &WithdrawalApproval{Expiry: expiry, Signature: forged}); err == nil {
+		t.Error("Expected an approval not signed by the owner to be refused")
+	}
+	// The expiry is part of what the owner signed
+	if err = relayServer.checkWithdrawalApproval(to, &WithdrawalApproval{Expiry: expiry + 3600, Signature: signature}); err == nil {
+		t.Error("Expected an approval with another expiry to be refused")
+	}
+	clk.Increment(2 * time.Hour)
+	if err = relayServer.checkWithdrawalApproval(to, approval); err == nil {
+		t.Error("Expected an expired approval to be refused")
+	}
+}
@@ -1,217 +1,97 @@
 package main
 
 import (
-	"encoding/json"
 	"flag"
-	"fmt"
-	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum"
 	"github.com/ethereum/go-ethereum/crypto"
-	"github.com/ethereum/go-ethereum/params"
-	"io/ioutil"
 	"librelay"
+	"librelay/config"
+	"librelay/funding"
+	"librelay/hubindex"
+	"librelay/incident"
+	"librelay/lifecycle"
+	"librelay/notify"
+	"librelay/reputation"
+	"librelay/scheduler"
 	"librelay/txstore"
 	"log"
-	"math/big"
 	"net/http"
-	"net/url"
 	"os"
 	"path/filepath"
+	"relayhttp"
 	"time"
 )
 
-const VERSION = "0.4.2"
-
 var KeystoreDir = filepath.Join(os.Getenv("PWD"), "data/keystore")
 var devMode bool                                                  // Whether we wait after calls to blockchain or return (almost) immediately. Usually when testing...
 
-var ready = false
-var removed = false
+var relayWorkers int64
+var relayQueueSize int64
 
 var relay librelay.IRelay
 var server *http.Server
-var stopKeepAlive chan bool
-var stopRefreshBlockchainView chan bool
-var stopUpdatingPendingTxs chan bool
-var stopListeningToRelayRemoved chan bool
+var jobs *scheduler.Scheduler
 
 var timeUnit time.Duration
 
-var minimumRelayBalance = big.NewInt(1e17) // 0.1 eth
-
 func main() {
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
-	log.Println("RelayHttpServer starting. version:", VERSION)
+	log.Println("RelayHttpServer starting. version:", relayhttp.VERSION)
 
-	configRelay(parseCommandLine())
+	if len(os.Args) > 1 && os.Args[1] == "config" {
+		os.Exit(runConfigCommand(os.Args[2:]))
+	}
 
-	server = &http.Server{Addr: ":" + relay.GetPort(), Handler: nil}
+	cfg, relayParams := parseCommandLine()
+	configRelay(relayParams)
 
-	http.HandleFunc("/relay", assureRelayReady(relayHandler))
-	http.HandleFunc("/getaddr", getEthAddrHandler)
+	jobs = scheduler.New(nil)
+	server = &http.Server{Addr: ":" + relay.GetPort(), Handler: relayhttp.New(relay, jobs, cfg.MaxBatchSize, cfg.AdminToken)}
 
 	timeUnit = time.Minute
 	if devMode {
 		timeUnit = time.Second
 	}
-	stopKeepAlive = schedule(keepAlive, 10*timeUnit, 0)
-	stopRefreshBlockchainView = schedule(refreshBlockchainView, 1*timeUnit, 0)
-	stopUpdatingPendingTxs = schedule(updatePendingTxs, 1*timeUnit, 0)
-	stopListeningToRelayRemoved = schedule(stopServingOnRelayRemoved, 1*timeUnit, 0)
+	scheduleJob("stepLifecycle", stepLifecycle, 1*timeUnit)
+	scheduleJob("updatePendingTxs", updatePendingTxs, 1*timeUnit)
+	scheduleJob("watchPenalization", watchPenalization, timeUnit/4)
+	scheduleJob("checkAlerts", checkAlerts, 1*timeUnit)
+	scheduleJob("refillBalance", refillBalance, 1*timeUnit)
+	if relayParams.SweepKeepBalance != nil {
+		scheduleJob("sweepExcessBalance", sweepExcessBalance, time.Duration(relayParams.SweepInterval.Minutes())*timeUnit)
+	}
 
 	log.Println("RelayHttpServer started. Listening on port: ", relay.GetPort())
-	err := server.ListenAndServe()
-	if err != nil {
+	err := relayhttp.Serve(server, cfg)
+	jobs.Close()
+	// Requests already queued are sent before the stores they are tracked in are closed
+	relay.StopRelayPool()
+	if closeErr := relay.Close(); closeErr != nil {
+		log.Println("Could not close the relay's stores", closeErr)
+	}
+	if err != nil && err != http.ErrServerClosed {
 		log.Fatalln(err)
 	}
 
 }
 
-// http.HandlerFunc wrapper to assure we have enough balance to operate, and server already has stake and registered
-func assureRelayReady(fn http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-
-		w.Header()["Access-Control-Allow-Origin"] = []string{"*"}
-		w.Header()["Access-Control-Allow-Headers"] = []string{"Content-Type, Authorization, Content-Length, X-Requested-With"}
-		w.Header()["Access-Control-Allow-Methods"] = []string{"GET, POST, OPTIONS"}
-
-		if !shouldHandleRelayRequests() {
-			err := fmt.Errorf("Relay not staked and registered yet")
-			log.Println(err)
-			w.Write([]byte("{\"error\":\"" + err.Error() + "\"}"))
-			return
-		}
-
-		// wait for funding
-		balance, err := relay.Balance()
-		if err != nil {
-			log.Println(err)
-			w.Write([]byte("{\"error\":\"" + err.Error() + "\"}"))
-			return
-		}
-		if balance.Cmp(big.NewInt(0)) == 0 {
-			err = fmt.Errorf("Waiting for funding...")
-			log.Println(err)
-			w.Write([]byte("{\"error\":\"" + err.Error() + "\"}"))
-			return
-		}
-		log.Println("Relay balance:", balance.String())
-
-		gasPrice := relay.GasPrice()
-		if gasPrice.Uint64() == 0 {
-			err = fmt.Errorf("Waiting for gasPrice...")
-			log.Println(err)
-			w.Write([]byte("{\"error\":\"" + err.Error() + "\"}"))
-			return
-		}
-		log.Println("Relay received gasPrice:", gasPrice.Uint64())
-		fn(w, r)
-	}
-
-}
-
-func getEthAddrHandler(w http.ResponseWriter, _ *http.Request) {
-
-	w.Header()["Access-Control-Allow-Origin"] = []string{"*"}
-	w.Header()["Access-Control-Allow-Headers"] = []string{"Content-Type, Authorization, Content-Length, X-Requested-With"}
-	w.Header()["Access-Control-Allow-Methods"] = []string{"GET, OPTIONS"}
-
-	getEthAddrResponse := &librelay.GetEthAddrResponse{
-		RelayServerAddress: relay.Address(),
-		MinGasPrice:        relay.GasPrice(),
-		Ready:              shouldHandleRelayRequests(),
-		Version:            VERSION,
-	}
-	resp, err := json.Marshal(getEthAddrResponse)
-	if err != nil {
-		log.Println(err)
-		w.Write([]byte("{\"error\":\"" + err.Error() + "\"}"))
-		return
-	}
-	log.Printf("address %s sent\n", relay.Address().Hex())
-
-	w.Write(resp)
-}
-
-func relayHandler(w http.ResponseWriter, r *http.Request) {
-
-	log.Println("Handling relay request...")
-	if r.Method != http.MethodPost {
-		w.WriteHeader(http.StatusOK)
-		return
-	}
-	body, err := ioutil.ReadAll(r.Body)
-
-	if err != nil {
-		log.Println("Could not read request body", body, err)
-		w.Write([]byte("{\"error\":\"" + err.Error() + "\"}"))
-		return
-	}
-	var request = &librelay.RelayTransactionRequest{}
-	err = json.Unmarshal(body, request)
-	if err != nil {
-		log.Println("Invalid json", body, err)
-		w.Write([]byte("{\"error\":\"" + err.Error() + "\"}"))
-		return
-	}
-	signedTx, err := relay.CreateRelayTransaction(*request)
-	if err != nil {
-		log.Println("Failed to relay")
-		w.Write([]byte("{\"error\":\"" + err.Error() + "\"}"))
-
-		return
-	}
-	resp, err := signedTx.MarshalJSON()
-	if err != nil {
-		log.Println(err)
-		w.Write([]byte("{\"error\":\"" + err.Error() + "\"}"))
-		return
-	}
-	w.Write(resp)
-}
-
-func parseCommandLine() (relayParams librelay.RelayParams) {
-	ownerAddress := flag.String("OwnerAddress", common.HexToAddress("0").Hex(), "Relay's owner address")
-	fee := flag.Int64("Fee", 70, "Relay's per transaction fee")
-	urlStr := flag.String("Url", "http://localhost:8090", "Relay server's url ")
-	port := flag.String("Port", "", "Relay server's port")
-	relayHubAddress := flag.String("RelayHubAddress", "0xD216153c06E857cD7f72665E0aF1d7D82172F494", "RelayHub address")
-	defaultGasPrice := flag.Int64("DefaultGasPrice", int64(params.GWei), "Relay's default gasPrice per (non-relayed) transaction in wei")
-	gasPricePercent := flag.Int64("GasPricePercent", 10, "Relay's gas price increase as percentage from current average. GasPrice = (100+GasPricePercent)/100 * eth_gasPrice() ")
-	RegistrationBlockRate:= flag.Uint64("RegistrationBlockRate", 6000-200, "Relay registeration rate (in blocks)")
-	ethereumNodeUrl := flag.String("EthereumNodeUrl", "http://localhost:8545", "The relay's ethereum node")
-	workdir := flag.String("Workdir", filepath.Join(os.Getenv("PWD"), "data"), "The relay server's workdir")
-	flag.BoolVar(&devMode, "DevMode", false, "Enable developer mode (do not retry unconfirmed txs, do not cache account nonce, do not wait after calls to the chain, faster polling)")
-
-	flag.Parse()
-
-	relayParams.OwnerAddress = common.HexToAddress(*ownerAddress)
-	relayParams.Fee = big.NewInt(*fee)
-	relayParams.Url = *urlStr
-	u, err := url.Parse(*urlStr)
+func parseCommandLine() (cfg *config.Config, relayParams librelay.RelayParams) {
+	cfg, err := loadConfig(flag.CommandLine, os.Args[1:])
 	if err != nil {
-		log.Fatalln("Could not parse url")
-	}
-	if *port == "" && u.Port() != "" {
-		log.Println("Using default published port given in url:", *port)
-		*port = u.Port()
+		log.Fatalln(err)
 	}
 
-	relayParams.Port = *port
-	relayParams.RelayHubAddress = common.HexToAddress(*relayHubAddress)
-	relayParams.DefaultGasPrice = *defaultGasPrice
-	relayParams.GasPricePercent = big.NewInt(*gasPricePercent)
-	relayParams.RegistrationBlockRate = *RegistrationBlockRate
-	relayParams.EthereumNodeURL = *ethereumNodeUrl
-	relayParams.DBFile = filepath.Join(*workdir, "db")
-	relayParams.DevMode = devMode
-
-	KeystoreDir = filepath.Join(*workdir, "keystore")
+	relayParams = cfg.RelayParams()
+	devMode = cfg.DevMode
+	relayWorkers = cfg.RelayWorkers
+	relayQueueSize = cfg.RelayQueueSize
+	KeystoreDir = cfg.KeystoreDir()
 
 	// Dumping initial configuration
-	log.Println("Workdir:", *workdir)
+	log.Println("Workdir:", cfg.Workdir)
 	relayParams.Dump()
 
-	return relayParams
+	return cfg, relayParams
 
 }
 
@@ -221,156 +101,147 @@ func configRelay(relayParams librelay.RelayParams) {
 	log.Println("relay server address: ", crypto.PubkeyToAddress(privateKey.PublicKey).Hex())
 	client, err := librelay.NewEthClient(relayParams.EthereumNodeURL, relayParams.DefaultGasPrice)
 	if err != nil {
-		log.Println("Could not connect to ethereum node", err)
-		return
+		log.Fatalln("Could not connect to ethereum node", err)
 	}
 	txStore, err := txstore.NewLevelDbTxStore(relayParams.DBFile, nil)
 	if err != nil {
-		log.Println("Could not create local transactions database", err)
-		return
+		log.Fatalln("Could not create local transactions database", err)
 	}
-	relay, err = librelay.NewRelayServer(
+	relayServer, err := librelay.NewRelayServer(
 		relayParams.OwnerAddress, relayParams.Fee, relayParams.Url, relayParams.Port,
 		relayParams.RelayHubAddress, relayParams.DefaultGasPrice, relayParams.GasPricePercent,
 		privateKey, relayParams.RegistrationBlockRate, relayParams.EthereumNodeURL,
 		client, txStore, nil, relayParams.DevMode)
 	if err != nil {
-		log.Println("Could not create Relay Server", err)
-		return
+		log.Fatalln("Could not create Relay Server", err)
+	}
+	relayServer.UrlScheme = relayParams.UrlScheme
+	relayServer.SimulateRelayCall = relayParams.SimulateRelayCall
+	relayServer.EnforceSimulation = relayParams.EnforceSimulation
+	relayServer.MinProfit = relayParams.MinProfit
+	relayServer.MinProfitPercent = relayParams.MinProfitPercent
+	relayServer.Confirmations = relayParams.Confirmations
+	reputationStore, err := reputation.NewLevelDbReputationStore(relayParams.ReputationDBFile)
+	if err != nil {
+		log.Fatalln("Could not create reputation database", err)
 	}
-}
-
-// Wait for server to be staked & funded by owner, then try and register on RelayHub
-func refreshBlockchainView() {
-	if removed {
-		log.Println("Relay removed. No need to wait for owner actions")
-		return
+	relayServer.Reputation = reputation.NewTracker(reputationStore, relayParams.ReputationSettings, nil)
+	hubIndex, err := hubindex.NewIndexer(relayParams.HubIndexDBFile, client, relayParams.RelayHubAddress)
+	if err != nil {
+		log.Fatalln("Could not create hub events database", err)
 	}
-	waitForOwnerActions()
-	_, err := relay.BlockCountSinceRegistration()
-	for ; err != nil; _, err = relay.BlockCountSinceRegistration() {
+	hubIndex.StartBlock = relayParams.HubIndexStartBlock
+	relayServer.HubIndex = hubIndex
+	incidentStore, err := incident.NewLevelDbIncidentStore(relayParams.IncidentDBFile)
+	if err != nil {
+		log.Fatalln("Could not create incidents database", err)
+	}
+	relayServer.Incidents = incidentStore
+	relayServer.Notifier = notify.New(relayParams.AlertSettings, nil)
+	relayServer.AlertRules = relayParams.AlertRules
+	relayServer.RefillRules = librelay.RefillRules{
+		Below:   relayParams.RefillBelow,
+		Amount:  relayParams.RefillAmount,
+		Timeout: relayParams.RefillTimeout,
+	}
+	if relayParams.RefillHookUrl != "" {
+		relayServer.RefillRules.Funder = funding.NewHttpFunder(relayParams.RefillHookUrl)
+	} else if relayParams.RefillKeyFile != "" {
+		chainID, err := relayServer.ChainID()
 		if err != nil {
-			log.Println(err)
+			log.Fatalln(err)
 		}
-		ready = false
-		sleep(15*time.Second, devMode)
-	}
-
-	for err := relay.RefreshGasPrice(); err != nil; err = relay.RefreshGasPrice() {
+		funder, err := funding.NewWalletFunderFromFile(relayParams.RefillKeyFile, chainID, client)
 		if err != nil {
-			log.Println(err)
+			log.Fatalln(err)
 		}
-		ready = false
-		sleep(10*time.Second, devMode)
-
+		log.Println("Refilling the relay from", funder.Address().Hex())
+		relayServer.RefillRules.Funder = funder
 	}
-	if !ready {
-		log.Println("Relay ready for client requests.")
+	relayServer.MinimumBalance = relayParams.MinimumBalance
+	relayServer.SweepRules = librelay.SweepRules{
+		KeepBalance: relayParams.SweepKeepBalance,
+		DryRun:      relayParams.SweepDryRun,
+		AuditFile:   relayParams.SweepAuditFile,
 	}
-	ready = true
-}
-
-func updatePendingTxs() {
-	if removed {
-		log.Println("Relay removed. No need to wait for owner actions")
-		return
-	}
-	waitForOwnerActions()
-
-	_, err := relay.UpdateUnconfirmedTransactions()
+	stateStore, err := lifecycle.NewLevelDbStateStore(relayParams.StateDBFile)
 	if err != nil {
-		log.Println("Error updating unconfirmed txs", err)
+		log.Fatalln("Could not create relay state database", err)
 	}
-}
-
-func waitForOwnerActions() {
-	if removed {
-		log.Println("Relay removed. No need to wait for owner actions")
-		return
+	relayServer.State = stateStore
+	if _, err = relayServer.RestoreState(); err != nil {
+		log.Fatalln("Could not restore the relay state", err)
 	}
-	staked, err := relay.IsStaked()
-	for ; err != nil || !staked; staked, err = relay.IsStaked() {
-		if err != nil {
-			log.Println(err)
-		}
-		ready = false
-		log.Println("Waiting for stake...")
-		sleep(5*time.Second, devMode)
+	if err = relayServer.RestoreIncidents(); err != nil {
+		log.Fatalln("Could not load incidents", err)
 	}
+	relayServer.StartRelayPool(int(relayWorkers), int(relayQueueSize))
+	relay = relayServer
+}
 
-	// wait for funding
-	balance, err := relay.Balance()
-	if err != nil {
-		log.Println(err)
-		return
-	}
-	for ; err != nil || balance.Cmp(minimumRelayBalance) <= 0; balance, err = relay.Balance() {
-		ready = false
-		log.Printf("Server's balance too low (%s, required %s). Waiting for funding...", balance.String(), minimumRelayBalance.String())
-		sleep(10*time.Second, devMode)
+// stepLifecycle moves the relay through its lifecycle: waiting for the owner's stake and funding, registering on
+// RelayHub, and once removed and unstaked, withdrawing its balance to the owner and shutting down
+func stepLifecycle() (err error) {
+	phase, err := relay.Step()
+	if phase == lifecycle.Withdrawn {
+		log.Println("Relay withdrawn. Shutting down")
+		server.Close()
 	}
+	return
 }
 
-func keepAlive() {
-	if removed {
-		log.Println("Relay removed. No need to reregister")
+func updatePendingTxs() (err error) {
+	if relay.Phase().IsRemoved() {
 		return
 	}
-	waitForOwnerActions()
-	count, err := relay.BlockCountSinceRegistration()
-	if err != nil {
-		log.Println(err)
-	} else if count < relay.GetRegistrationBlockRate() {
-		return
+	_, err = relay.UpdateUnconfirmedTransactions()
+	return
+}
+
+// penalizationSub delivers the hub's Penalized and RelayRemoved events of the relay as they are mined
+var penalizationSub ethereum.Subscription
+
+// watchPenalization halts the relay as soon as the hub penalizes or removes it. The events are watched with a log
+// subscription; the hub is polled only to catch up after (re)subscribing, or when the node does not support
+// subscriptions.
+func watchPenalization() (err error) {
+	if penalizationSub != nil {
+		select {
+		case err = <-penalizationSub.Err():
+			log.Println("Penalization subscription ended, polling until it is restored:", err)
+			penalizationSub = nil
+		default:
+			return nil
+		}
 	}
-	log.Println("Registering relay...")
-	
-	err = relay.RegisterRelay()
-	if err == nil {
-		log.Println("Done registering")
-		return
+	if penalizationSub, err = relay.SubscribePenalization(); err != nil {
+		penalizationSub = nil
 	}
-	log.Println(err)
+	_, err = relay.WatchPenalization()
+	return
 }
 
-func stopServingOnRelayRemoved() {
-	var err error
-	removed, err = relay.IsRemoved()
-	if err != nil {
-		log.Println(err)
+// refillBalance requests funds from the funding hook when the balance is low, and tracks the refill tx
+func refillBalance() (err error) {
+	if relay.Phase().IsRemoved() {
 		return
 	}
-	if removed {
-		log.Println("Relay removed. Listening to Unstaked event")
-		schedule(shutdownOnRelayUnstaked, 1*timeUnit, 0)
-		stopListeningToRelayRemoved <- true
-	}
-
+	_, err = relay.RefillBalance()
+	return
 }
 
-func shutdownOnRelayUnstaked() {
-	var err error
-	removed, err = relay.IsUnstaked()
-	if err != nil {
-		log.Println(err)
+// sweepExcessBalance sends the balance above the working balance to the owner. Once the relay is removed its whole
+// balance is sent after unstaking instead.
+func sweepExcessBalance() (err error) {
+	if relay.Phase().IsRemoved() {
 		return
 	}
-	if removed {
-		log.Println("Relay removed. Listening to Unstaked event")
-		log.Println("Relay unstaked. Sending balance back to owner")
-		sleep(2*time.Minute, devMode)
-		for {
-			err = relay.SendBalanceToOwner()
-			if err == nil {
-				break
-			}
-			sleep(5*time.Second, devMode)
-		}
-		server.Close()
-	}
-
+	_, err = relay.SweepExcessBalance()
+	return
 }
 
-func shouldHandleRelayRequests() bool {
-	return ready && !removed
+// checkAlerts alerts the operator about low balance, stuck txs, an expiring registration or an unreachable node
+func checkAlerts() (err error) {
+	relay.CheckAlerts()
+	return
 }
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"librelay/config"
+	"os"
+)
+
+// loadConfig builds the relay configuration from, in increasing order of precedence: the defaults, the -Config file,
+// the GSN_RELAY_* environment variables and the command line flags that were explicitly set.
+func loadConfig(flags *flag.FlagSet, args []string) (cfg *config.Config, err error) {
+	defaults := config.Default()
+	configFile := flags.String("Config", "", "Relay's configuration file (.yaml, .yml or .toml)")
+	flags.String("OwnerAddress", defaults.OwnerAddress, "Relay's owner address")
+	flags.Int64("Fee", defaults.Fee, "Relay's per transaction fee")
+	flags.String("Url", defaults.Url, "Relay server's url ")
+	flags.String("Port", defaults.Port, "Relay server's port")
+	flags.String("RelayHubAddress", defaults.RelayHubAddress, "RelayHub address")
+	flags.Int64("DefaultGasPrice", defaults.DefaultGasPrice, "Relay's default gasPrice per (non-relayed) transaction in wei")
+	flags.Int64("GasPricePercent", defaults.GasPricePercent, "Relay's gas price increase as percentage from current average. GasPrice = (100+GasPricePercent)/100 * eth_gasPrice() ")
+	flags.Uint64("RegistrationBlockRate", defaults.RegistrationBlockRate, "Relay registeration rate (in blocks)")
+	flags.String("EthereumNodeUrl", defaults.EthereumNodeUrl, "The relay's ethereum node")
+	flags.String("Workdir", defaults.Workdir, "The relay server's workdir")
+	flags.Int64("MaxBatchSize", defaults.MaxBatchSize, "Maximum number of requests accepted in one /relay/batch call")
+	flags.Int64("RelayWorkers", defaults.RelayWorkers, "Number of workers validating relay requests concurrently")
+	flags.Int64("RelayQueueSize", defaults.RelayQueueSize, "Maximum number of relay requests waiting for a worker, more are refused with 503")
+	flags.Bool("SimulateRelayCall", defaults.SimulateRelayCall, "Simulate each relayCall against the pending block before sending it, rejecting requests that fail in acceptRelayedCall or preRelayedCall")
+	flags.Bool("EnforceSimulation", defaults.EnforceSimulation, "Also reject requests whose simulated relayCall reverts or needs more gas than the relay sends it with")
+	flags.Int64("MinProfit", defaults.MinProfit, "Reject requests expected to leave less than this profit in wei (the hub's charge minus the relay's gas cost) if resent 20% higher")
+	flags.Int64("MinProfitPercent", defaults.MinProfitPercent, "Reject requests expected to leave a profit of less than this percentage of the relay's gas cost if resent 20% higher")
+	flags.Int64("ReputationMinSamples", defaults.ReputationMinSamples, "Number of relayed calls of a recipient or sender needed before it can be blacklisted")
+	flags.Int64("ReputationMaxFailurePercent", defaults.ReputationMaxFailurePercent, "Blacklist recipients and senders when more than this percentage of their relayed calls fail (0 never blacklists)")
+	flags.Int64("ReputationWindowMinutes", defaults.ReputationWindowMinutes, "Relayed calls are counted towards a recipient's or sender's failure rate for this many minutes")
+	flags.Int64("BlacklistMinutes", defaults.BlacklistMinutes, "Refuse requests of blacklisted recipients and senders for this many minutes")
+	flags.String("AdminToken", defaults.AdminToken, "Bearer token required by the /admin API, which is disabled when not set")
+	flags.Uint64("HubIndexStartBlock", defaults.HubIndexStartBlock, "First block to index the RelayHub's events from, e.g. the block the hub was deployed in")
+	flags.Uint64("Confirmations", defaults.Confirmations, "Blocks mined on top of a relayed tx before it is final and removed from the store (0 uses the chain's default: 12 on mainnet)")
+	flags.String("AlertWebhookUrl", defaults.AlertWebhookUrl, "Post alerts (e.g. the relay being penalized) as json to this url, they are only logged when not set")
+	flags.String("AlertSlackWebhookUrl", defaults.AlertSlackWebhookUrl, "Post alerts to this Slack incoming webhook url")
+	flags.String("AlertSmtpAddr", defaults.AlertSmtpAddr, "Email alerts through this SMTP server (host:port)")
+	flags.String("AlertSmtpFrom", defaults.AlertSmtpFrom, "Sender address of alert emails")
+	flags.String("AlertSmtpTo", defaults.AlertSmtpTo, "Comma separated recipients of alert emails")
+	flags.String("AlertSmtpUsername", defaults.AlertSmtpUsername, "SMTP username, alerts are sent without authentication when not set")
+	flags.String("AlertSmtpPassword", defaults.AlertSmtpPassword, "SMTP password")
+	flags.Int64("AlertDedupMinutes", defaults.AlertDedupMinutes, "Do not send an alert again while the same condition was alerted within this many minutes")
+	flags.Int64("AlertMaxPerHour", defaults.AlertMaxPerHour, "Send at most this many alerts per hour, except penalizations and removals (0 for no limit)")
+	flags.String("AlertBalanceBelow", defaults.AlertBalanceBelow.String(), "Alert when the relay's balance is below this amount in wei (0 disables the alert)")
+	flags.Int64("AlertPendingTxMinutes", defaults.AlertPendingTxMinutes, "Alert when a tx sent by the relay is not mined after this many minutes (0 disables the alert)")
+	flags.Uint64("AlertRegistrationBlocks", defaults.AlertRegistrationBlocks, "Alert when clients stop seeing the relay's registration within this many blocks (0 disables the alert)")
+	flags.String("MinimumRelayBalance", defaults.MinimumRelayBalance.String(), "Stop serving and wait for funding while the relay's balance is at most this amount in wei")
+	flags.String("RefillBelow", defaults.RefillBelow.String(), "Request funds from the funding hook when the relay's balance is below this amount in wei")
+	flags.String("RefillAmount", defaults.RefillAmount.String(), "Amount in wei requested from the funding hook per refill")
+	flags.String("RefillHookUrl", defaults.RefillHookUrl, "Funding hook: treasury service the relay posts {\"Relay\", \"Amount\"} to when its balance is low")
+	flags.String("RefillKeyFile", defaults.RefillKeyFile, "Funding hook: file with the hex private key of a hot wallet sending funds to the relay when its balance is low")
+	flags.Int64("RefillTimeoutMinutes", defaults.RefillTimeoutMinutes, "Replace the refill tx with one paying a higher gas price if it is not mined after this many minutes")
+	flags.String("SweepKeepBalance", defaults.SweepKeepBalance.String(), "Periodically send the relay's balance above this amount in wei to the owner (0 disables sweeping)")
+	flags.Int64("SweepIntervalMinutes", defaults.SweepIntervalMinutes, "Minutes between balance sweeps")
+	flags.Bool("SweepDryRun", defaults.SweepDryRun, "Only log and audit the balance sweeps, without sending them")
+	flags.Bool("DevMode", defaults.DevMode, "Enable developer mode (do not retry unconfirmed txs, do not cache account nonce, do not wait after calls to the chain, faster polling)")
+	flags.String("TLSCertFile", defaults.TLSCertFile, "Serve TLS with this certificate file (reloaded when changed)")
+	flags.String("TLSKeyFile", defaults.TLSKeyFile, "Private key of TLSCertFile")
+	flags.Bool("TLSOffloaded", defaults.TLSOffloaded, "TLS is terminated by a proxy in front of the relay (Url is https but the relay serves plain http)")
+	flags.Bool("ACME", defaults.ACME, "Obtain and renew the TLS certificate for Url's host automatically with ACME")
+	flags.String("ACMEDirectoryUrl", defaults.ACMEDirectoryUrl, "ACME directory url")
+	flags.String("ACMEEmail", defaults.ACMEEmail, "Contact email for the ACME account")
+	flags.String("ACMECARootFile", defaults.ACMECARootFile, "CA certificate to trust for the ACME directory (e.g. a local pebble server)")
+	flags.String("ACMEHttpPort", defaults.ACMEHttpPort, "Also answer ACME http-01 challenges on this port")
+
+	if err = flags.Parse(args); err != nil {
+		return
+	}
+
+	var errs config.Errors
+	cfg = config.Default()
+	if *configFile != "" {
+		if err = cfg.LoadFile(*configFile); err != nil {
+			errs = append(errs, fmt.Errorf("Could not load %s: %v", *configFile, err))
+		}
+	}
+	if err = cfg.ApplyEnv(os.LookupEnv); err != nil {
+		errs = append(errs, err.(config.Errors)...)
+	}
+	flags.Visit(func(f *flag.Flag) {
+		if f.Name == "Config" {
+			return
+		}
+		if err := cfg.Set(f.Name, f.Value.String()); err != nil {
+			errs = append(errs, err)
+		}
+	})
+	if err = cfg.Validate(); err != nil {
+		errs = append(errs, err.(config.Errors)...)
+	}
+	if len(errs) > 0 {
+		return cfg, errs
+	}
+	return cfg, nil
+}
+
+// runConfigCommand implements the "config check" subcommand: it loads and validates the configuration the relay would
+// run with, printing every error found, and returns the process exit code
+func runConfigCommand(args []string) int {
+	if len(args) == 0 || args[0] != "check" {
+		fmt.Fprintln(os.Stderr, "Usage: RelayHttpServer config check [-Config file] [flags]")
+		return 2
+	}
+	flags := flag.NewFlagSet("config check", flag.ContinueOnError)
+	cfg, err := loadConfig(flags, args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Println("Configuration OK")
+	relayParams := cfg.RelayParams()
+	relayParams.Dump()
+	return 0
+}
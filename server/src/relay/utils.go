@@ -6,6 +6,7 @@ import (
 	"github.com/ethereum/go-ethereum/accounts/keystore"
 	"io"
 	"io/ioutil"
+	"librelay/scheduler"
 	"log"
 	"os"
 	"path/filepath"
@@ -67,29 +68,17 @@ func loadPrivateKey(keystoreDir string) *ecdsa.PrivateKey {
 	return keyWrapper.PrivateKey
 }
 
-func schedule(job func(), delay time.Duration, when time.Duration) chan bool {
-
-	stop := make(chan bool)
-
-	go func() {
-		time.Sleep(when)
-		for {
-			job()
-			select {
-			case <-time.After(delay):
-			case <-stop:
-				return
-			}
-		}
-	}()
-
-	return stop
-}
-
-func sleep(duration time.Duration, shortSleep bool) {
-	if shortSleep {
-		time.Sleep(time.Second)
-	} else {
-		time.Sleep(duration)
+// scheduleJob runs the job every interval. A failing job backs off up to 10 intervals, and the runs are spread out by
+// a jitter of a tenth of the interval.
+func scheduleJob(name string, run func() error, interval time.Duration) {
+	err := jobs.Add(scheduler.Job{
+		Name:       name,
+		Run:        run,
+		Interval:   interval,
+		Jitter:     interval / 10,
+		MaxBackoff: 10 * interval,
+	})
+	if err != nil {
+		log.Fatalln(err)
 	}
 }
@@ -0,0 +1,212 @@
+package relayhttp
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"librelay"
+	"librelay/scheduler"
+	"log"
+	"math/big"
+	"net/http"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+// http.HandlerFunc wrapper to restrict an /admin handler to requests carrying the admin token
+func (server *Server) assureAdmin(fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if server.adminToken == "" {
+			writeError(w, http.StatusNotFound, "Admin API is disabled")
+			return
+		}
+		expected := []byte("Bearer " + server.adminToken)
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			log.Println("Unauthorized admin request to", r.URL.Path, "from", r.RemoteAddr)
+			writeError(w, http.StatusUnauthorized, "Unauthorized")
+			return
+		}
+		fn(w, r)
+	}
+}
+
+// ReputationRequest blacklists an address for Minutes, or clears its reputation
+type ReputationRequest struct {
+	Action  string // "blacklist" or "clear"
+	Kind    string // "recipient" or "sender"
+	Address common.Address
+	Minutes int64
+}
+
+// reputationHandler lists the reputation of recipients and senders on GET, and blacklists or clears an address on POST
+func (server *Server) reputationHandler(w http.ResponseWriter, r *http.Request) {
+	tracker := server.relay.ReputationTracker()
+	if tracker == nil {
+		writeError(w, http.StatusNotFound, "Reputation tracking is disabled")
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			log.Println("Could not read request body", body, err)
+			writeError(w, http.StatusOK, err.Error())
+			return
+		}
+		var request ReputationRequest
+		err = json.Unmarshal(body, &request)
+		if err == nil {
+			switch request.Action {
+			case "blacklist":
+				if request.Minutes <= 0 {
+					err = fmt.Errorf("Minutes must be positive")
+					break
+				}
+				err = tracker.Blacklist(request.Kind, request.Address, time.Duration(request.Minutes)*time.Minute)
+			case "clear":
+				err = tracker.Clear(request.Kind, request.Address)
+			default:
+				err = fmt.Errorf("Unknown action %q: expected blacklist or clear", request.Action)
+			}
+		}
+		if err != nil {
+			log.Println(err)
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		log.Printf("Admin %s of %s %s\n", request.Action, request.Kind, request.Address.Hex())
+	}
+
+	records, err := tracker.Records()
+	if err != nil {
+		log.Println(err)
+		writeError(w, http.StatusOK, err.Error())
+		return
+	}
+	resp, err := json.Marshal(records)
+	if err != nil {
+		log.Println(err)
+		writeError(w, http.StatusOK, err.Error())
+		return
+	}
+	w.Write(resp)
+}
+
+// IncidentRequest resolves the incident with the given ID, letting the relay sign again once none is unresolved
+type IncidentRequest struct {
+	Action string // "resolve"
+	ID     string
+}
+
+// incidentsHandler lists the incidents recorded by the penalization watchdog on GET, and resolves one on POST
+func (server *Server) incidentsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			log.Println("Could not read request body", body, err)
+			writeError(w, http.StatusOK, err.Error())
+			return
+		}
+		var request IncidentRequest
+		err = json.Unmarshal(body, &request)
+		if err == nil {
+			if request.Action == "resolve" {
+				err = server.relay.ResolveIncident(request.ID)
+			} else {
+				err = fmt.Errorf("Unknown action %q: expected resolve", request.Action)
+			}
+		}
+		if err != nil {
+			log.Println(err)
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		log.Println("Admin resolved incident", request.ID)
+	}
+
+	incidents, err := server.relay.ListIncidents()
+	if err != nil {
+		log.Println(err)
+		writeError(w, http.StatusOK, err.Error())
+		return
+	}
+	resp, err := json.Marshal(incidents)
+	if err != nil {
+		log.Println(err)
+		writeError(w, http.StatusOK, err.Error())
+		return
+	}
+	w.Write(resp)
+}
+
+// WithdrawalRequest withdraws Amount wei, or everything that can be withdrawn if not set, to To. Withdrawals to an
+// address other than the owner's need Approval, the owner's signature of librelay.WithdrawalApprovalHash, valid until
+// the unix time ApprovalExpiry.
+type WithdrawalRequest struct {
+	To             common.Address
+	Amount         *big.Int
+	Approval       hexutil.Bytes
+	ApprovalExpiry int64
+}
+
+// WithdrawalResponse is the withdrawal tx, tracked and resent by the relay like its other txs
+type WithdrawalResponse struct {
+	TxHash common.Hash
+	Amount *big.Int
+}
+
+// withdrawHandler sends a withdrawal on POST
+func (server *Server) withdrawHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "Withdrawals must be posted")
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Println("Could not read request body", body, err)
+		writeError(w, http.StatusOK, err.Error())
+		return
+	}
+	var request WithdrawalRequest
+	if err = json.Unmarshal(body, &request); err != nil {
+		log.Println(err)
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var approval *librelay.WithdrawalApproval
+	if len(request.Approval) > 0 {
+		approval = &librelay.WithdrawalApproval{Expiry: request.ApprovalExpiry, Signature: request.Approval}
+	}
+	tx, err := server.relay.Withdraw(request.To, request.Amount, approval)
+	if err != nil {
+		log.Println(err)
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	log.Println("Admin withdrew", tx.Value(), "wei to", request.To.Hex(), "in tx", tx.Hash().Hex())
+	resp, err := json.Marshal(WithdrawalResponse{TxHash: tx.Hash(), Amount: tx.Value()})
+	if err != nil {
+		log.Println(err)
+		writeError(w, http.StatusOK, err.Error())
+		return
+	}
+	w.Write(resp)
+}
+
+// jobsHandler lists the status of the relay's periodic jobs
+func (server *Server) jobsHandler(w http.ResponseWriter, r *http.Request) {
+	statuses := []scheduler.JobStatus{}
+	if server.jobs != nil {
+		statuses = server.jobs.Status()
+	}
+	resp, err := json.Marshal(statuses)
+	if err != nil {
+		log.Println(err)
+		writeError(w, http.StatusOK, err.Error())
+		return
+	}
+	w.Write(resp)
+}
@@ -0,0 +1,347 @@
+package relayhttp
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"librelay"
+	"librelay/scheduler"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+const VERSION = "0.4.2"
+
+// Server is the relay's http API
+type Server struct {
+	relay        librelay.IRelay
+	jobs         *scheduler.Scheduler
+	maxBatchSize int64
+	adminToken   string // bearer token required by the /admin API, which is disabled when empty
+	mux          *http.ServeMux
+}
+
+// New returns the http API of the relay. jobs are the relay's periodic jobs reported by /admin/jobs, and may be nil.
+func New(relay librelay.IRelay, jobs *scheduler.Scheduler, maxBatchSize int64, adminToken string) *Server {
+	server := &Server{
+		relay:        relay,
+		jobs:         jobs,
+		maxBatchSize: maxBatchSize,
+		adminToken:   adminToken,
+		mux:          http.NewServeMux(),
+	}
+	server.mux.HandleFunc("/relay", server.assureRelayReady(server.relayHandler))
+	server.mux.HandleFunc("/relay/batch", server.assureRelayReady(server.relayBatchHandler))
+	server.mux.HandleFunc("/relay/status/", server.relayStatusHandler)
+	server.mux.HandleFunc("/getaddr", server.getEthAddrHandler)
+	server.mux.HandleFunc("/metrics", server.metricsHandler)
+	server.mux.HandleFunc("/tx", server.txHandler)
+	server.mux.HandleFunc("/tx/", server.txHandler)
+	server.mux.HandleFunc("/admin/reputation", server.assureAdmin(server.reputationHandler))
+	server.mux.HandleFunc("/admin/incidents", server.assureAdmin(server.incidentsHandler))
+	server.mux.HandleFunc("/admin/withdraw", server.assureAdmin(server.withdrawHandler))
+	server.mux.HandleFunc("/admin/jobs", server.assureAdmin(server.jobsHandler))
+	return server
+}
+
+func (server *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	server.mux.ServeHTTP(w, r)
+}
+
+// allowCors lets browser clients on any origin call the handler with the given methods
+func allowCors(w http.ResponseWriter, methods string) {
+	w.Header()["Access-Control-Allow-Origin"] = []string{"*"}
+	w.Header()["Access-Control-Allow-Headers"] = []string{"Content-Type, Authorization, Content-Length, X-Requested-With"}
+	w.Header()["Access-Control-Allow-Methods"] = []string{methods}
+}
+
+// ErrorResponse is the body of every failed request
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
+
+// writeError answers {"error": message} with the status, escaping the message so the body is always valid json
+func writeError(w http.ResponseWriter, status int, message string) {
+	resp, _ := json.Marshal(ErrorResponse{Error: message})
+	if status != http.StatusOK {
+		w.WriteHeader(status)
+	}
+	w.Write(resp)
+}
+
+// http.HandlerFunc wrapper to assure we have enough balance to operate, and server already has stake and registered
+func (server *Server) assureRelayReady(fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		allowCors(w, "GET, POST, OPTIONS")
+
+		if !server.relay.Ready() {
+			err := fmt.Errorf("Relay not staked and registered yet")
+			log.Println(err)
+			writeError(w, http.StatusOK, err.Error())
+			return
+		}
+
+		// wait for funding
+		balance, err := server.relay.Balance()
+		if err != nil {
+			log.Println(err)
+			writeError(w, http.StatusOK, err.Error())
+			return
+		}
+		if balance.Cmp(big.NewInt(0)) == 0 {
+			err = fmt.Errorf("Waiting for funding...")
+			log.Println(err)
+			writeError(w, http.StatusOK, err.Error())
+			return
+		}
+		log.Println("Relay balance:", balance.String())
+
+		gasPrice := server.relay.GasPrice()
+		if gasPrice.Uint64() == 0 {
+			err = fmt.Errorf("Waiting for gasPrice...")
+			log.Println(err)
+			writeError(w, http.StatusOK, err.Error())
+			return
+		}
+		log.Println("Relay received gasPrice:", gasPrice.Uint64())
+		fn(w, r)
+	}
+
+}
+
+func (server *Server) getEthAddrHandler(w http.ResponseWriter, _ *http.Request) {
+	allowCors(w, "GET, OPTIONS")
+
+	getEthAddrResponse := &librelay.GetEthAddrResponse{
+		RelayServerAddress: server.relay.Address(),
+		MinGasPrice:        server.relay.GasPrice(),
+		Ready:              server.relay.Ready(),
+		Phase:              server.relay.Phase(),
+		Version:            VERSION,
+	}
+	resp, err := json.Marshal(getEthAddrResponse)
+	if err != nil {
+		log.Println(err)
+		writeError(w, http.StatusOK, err.Error())
+		return
+	}
+	log.Printf("address %s sent\n", server.relay.Address().Hex())
+
+	w.Write(resp)
+}
+
+func (server *Server) relayHandler(w http.ResponseWriter, r *http.Request) {
+
+	log.Println("Handling relay request...")
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+
+	if err != nil {
+		log.Println("Could not read request body", body, err)
+		writeError(w, http.StatusOK, err.Error())
+		return
+	}
+	var request = &librelay.RelayTransactionRequest{}
+	err = json.Unmarshal(body, request)
+	if err != nil {
+		log.Println("Invalid json", body, err)
+		writeError(w, http.StatusOK, err.Error())
+		return
+	}
+	if r.URL.Query().Get("async") == "1" {
+		server.asyncRelay(w, *request)
+		return
+	}
+	signedTx, err := server.relay.CreateRelayTransaction(*request)
+	if err != nil {
+		log.Println("Failed to relay")
+		status := http.StatusOK
+		if err == librelay.ErrRelayQueueFull {
+			status = http.StatusServiceUnavailable
+		}
+		writeError(w, status, err.Error())
+		return
+	}
+	resp, err := signedTx.MarshalJSON()
+	if err != nil {
+		log.Println(err)
+		writeError(w, http.StatusOK, err.Error())
+		return
+	}
+	w.Write(resp)
+}
+
+// asyncRelay queues the request and answers with its id, to be polled at /relay/status/<id>
+func (server *Server) asyncRelay(w http.ResponseWriter, request librelay.RelayTransactionRequest) {
+	requestId, err := server.relay.SubmitRelayTransaction(request)
+	if err != nil {
+		log.Println("Failed to queue relay request")
+		status := http.StatusOK
+		if err == librelay.ErrRelayQueueFull {
+			status = http.StatusServiceUnavailable
+		}
+		writeError(w, status, err.Error())
+		return
+	}
+	resp, err := json.Marshal(struct{ RequestId string }{requestId})
+	if err != nil {
+		log.Println(err)
+		writeError(w, http.StatusOK, err.Error())
+		return
+	}
+	w.Write(resp)
+}
+
+func (server *Server) relayStatusHandler(w http.ResponseWriter, r *http.Request) {
+	allowCors(w, "GET, OPTIONS")
+
+	requestId := strings.TrimPrefix(r.URL.Path, "/relay/status/")
+	status, err := server.relay.RelayTransactionStatus(requestId)
+	if err != nil {
+		log.Println("Status of request", requestId, err)
+		code := http.StatusInternalServerError
+		if err == librelay.ErrUnknownRequestId {
+			code = http.StatusNotFound
+		}
+		writeError(w, code, err.Error())
+		return
+	}
+	resp, err := json.Marshal(status)
+	if err != nil {
+		log.Println(err)
+		writeError(w, http.StatusOK, err.Error())
+		return
+	}
+	w.Write(resp)
+}
+
+// metricsHandler reports the relay pool's queue depths and counters
+func (server *Server) metricsHandler(w http.ResponseWriter, _ *http.Request) {
+	resp, err := json.Marshal(struct {
+		Pool *librelay.RelayPoolStats
+	}{server.relay.RelayPoolStats()})
+	if err != nil {
+		log.Println(err)
+		writeError(w, http.StatusOK, err.Error())
+		return
+	}
+	w.Write(resp)
+}
+
+// txHandler looks up a transaction sent by the relay, either by hash (/tx/<hash>) or by the sender and nonce of the
+// relayed request (/tx?from=<address>&nonce=<nonce>)
+func (server *Server) txHandler(w http.ResponseWriter, r *http.Request) {
+	allowCors(w, "GET, OPTIONS")
+
+	var info *librelay.RelayedTransactionInfo
+	var err error
+	if hash := strings.TrimPrefix(r.URL.Path, "/tx/"); hash != r.URL.Path {
+		hashBytes, decodeErr := hexutil.Decode(hash)
+		if decodeErr != nil || len(hashBytes) != common.HashLength {
+			err = fmt.Errorf("Invalid transaction hash %s", hash)
+			log.Println(err)
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		info, err = server.relay.GetRelayedTransactionByHash(common.BytesToHash(hashBytes))
+	} else {
+		from := r.URL.Query().Get("from")
+		nonce, ok := new(big.Int).SetString(r.URL.Query().Get("nonce"), 0)
+		if !common.IsHexAddress(from) || !ok || nonce.Sign() < 0 {
+			err = fmt.Errorf("Expected /tx/<hash> or /tx?from=<address>&nonce=<nonce>")
+			log.Println(err)
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		info, err = server.relay.GetRelayedTransactionBySender(common.HexToAddress(from), nonce)
+	}
+	if err != nil {
+		log.Println(err)
+		writeError(w, http.StatusOK, err.Error())
+		return
+	}
+	if info == nil {
+		writeError(w, http.StatusNotFound, "Transaction not found")
+		return
+	}
+	resp, err := json.Marshal(info)
+	if err != nil {
+		log.Println(err)
+		writeError(w, http.StatusOK, err.Error())
+		return
+	}
+	w.Write(resp)
+}
+
+func (server *Server) relayBatchHandler(w http.ResponseWriter, r *http.Request) {
+
+	log.Println("Handling relay batch request...")
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Println("Could not read request body", body, err)
+		writeError(w, http.StatusOK, err.Error())
+		return
+	}
+	var items []json.RawMessage
+	err = json.Unmarshal(body, &items)
+	if err != nil {
+		log.Println("Invalid json", body, err)
+		writeError(w, http.StatusOK, err.Error())
+		return
+	}
+	if len(items) == 0 || int64(len(items)) > server.maxBatchSize {
+		err = fmt.Errorf("Batch must contain between 1 and %d requests", server.maxBatchSize)
+		log.Println(err)
+		writeError(w, http.StatusOK, err.Error())
+		return
+	}
+
+	// Items that cannot be parsed are reported in place, the rest are relayed together
+	results := make([]librelay.RelayTransactionResult, len(items))
+	requests := make([]librelay.RelayTransactionRequest, 0, len(items))
+	indexes := make([]int, 0, len(items))
+	for i, item := range items {
+		var request librelay.RelayTransactionRequest
+		if err := json.Unmarshal(item, &request); err != nil {
+			results[i].Error = &librelay.RelayError{Code: librelay.ErrCodeInvalidRequest, Message: err.Error()}
+			continue
+		}
+		requests = append(requests, request)
+		indexes = append(indexes, i)
+	}
+	if len(requests) > 0 {
+		relayed, err := server.relay.CreateRelayTransactions(requests)
+		if err != nil {
+			log.Println("Failed to relay batch")
+			status := http.StatusOK
+			if err == librelay.ErrRelayQueueFull {
+				status = http.StatusServiceUnavailable
+			}
+			writeError(w, status, err.Error())
+			return
+		}
+		for i, result := range relayed {
+			results[indexes[i]] = result
+		}
+	}
+
+	resp, err := json.Marshal(results)
+	if err != nil {
+		log.Println(err)
+		writeError(w, http.StatusOK, err.Error())
+		return
+	}
+	w.Write(resp)
+}
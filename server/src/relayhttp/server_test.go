@@ -0,0 +1,355 @@
+package relayhttp
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"encoding/json"
+	"fmt"
+	hub "gen/librelay"
+	"gen/samplerec"
+	"io"
+	"io/ioutil"
+	"librelay"
+	"librelay/lifecycle"
+	"librelay/simbackend"
+	"librelay/test"
+	"librelay/txstore"
+	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/params"
+)
+
+// The relay under test, staked, funded and registered on a simulated chain, served at url
+var client *simbackend.Backend
+var relay *librelay.RelayServer
+var url string
+
+var relayKey, _ = crypto.HexToECDSA("4f3edf983ac636a65a842ce7c78d9aa706d3b113bce9c46f30d7d21715b23b1d")
+var gaslessKey, _ = crypto.HexToECDSA("6cbed15c793ce57650b9877cf6fa156fbef513c4e6134f022a85b1ffdd59b2a1")
+var ownerKey, _ = crypto.HexToECDSA("6370fd033278c143179d81c5526140625662b8daa446c22ee2d73db3707e620c")
+
+var rhaddr common.Address
+var sampleRecipient common.Address
+
+const adminToken = "secret"
+
+// deploy deploys RelayHub and a SampleRecipient with a deposit on it
+func deploy() (err error) {
+	auth := bind.NewKeyedTransactor(ownerKey)
+	auth.GasLimit = 8000000
+	parsed, err := abi.JSON(strings.NewReader(hub.IRelayHubABI))
+	if err != nil {
+		return
+	}
+	rhaddr, _, _, err = bind.DeployContract(auth, parsed, common.FromHex(hub.IRelayHubBin), client)
+	if err != nil {
+		return
+	}
+	auth.GasLimit = 4000000
+	parsed, err = abi.JSON(strings.NewReader(samplerec.SampleRecipientABI))
+	if err != nil {
+		return
+	}
+	sampleRecipient, _, _, err = bind.DeployContract(auth, parsed, common.FromHex(samplerec.SampleRecipientBin), client)
+	if err != nil {
+		return
+	}
+	recipient, err := samplerec.NewSampleRecipient(sampleRecipient, client)
+	if err != nil {
+		return
+	}
+	auth.GasLimit = 0
+	if _, err = recipient.SetHub(auth, rhaddr); err != nil {
+		return
+	}
+	rhub, err := hub.NewIRelayHub(rhaddr, client)
+	if err != nil {
+		return
+	}
+	auth.Value = new(big.Int).Lsh(big.NewInt(1), 40)
+	_, err = rhub.DepositFor(auth, sampleRecipient)
+	return
+}
+
+// newRelay creates a relay on the hub that is neither staked nor registered
+func newRelay(key *ecdsa.PrivateKey) (*librelay.RelayServer, error) {
+	return librelay.NewRelayServer(
+		common.Address{}, big.NewInt(10), "http://localhost:8090", "8090",
+		rhaddr, int64(params.GWei), big.NewInt(10), key, 5, "",
+		client, txstore.NewMemoryTxStore(nil), nil, true)
+}
+
+// stake stakes the relay from the owner's account, and steps the relay's lifecycle until it registers
+func stake(relayServer *librelay.RelayServer) (err error) {
+	rhub, err := hub.NewIRelayHub(rhaddr, client)
+	if err != nil {
+		return
+	}
+	auth := bind.NewKeyedTransactor(ownerKey)
+	auth.Value = big.NewInt(1100000000000000000)
+	if _, err = rhub.Stake(auth, relayServer.Address(), big.NewInt(1*60*60*24*7)); err != nil {
+		return
+	}
+	phase, err := relayServer.Step()
+	if err != nil {
+		return
+	}
+	if phase != lifecycle.Ready {
+		return fmt.Errorf("Expected the relay to be ready but it is %s", phase)
+	}
+	return
+}
+
+func TestMain(m *testing.M) {
+	funds := new(big.Int).Mul(big.NewInt(100), big.NewInt(params.Ether))
+	client = simbackend.New(core.GenesisAlloc{
+		crypto.PubkeyToAddress(relayKey.PublicKey): {Balance: funds},
+		crypto.PubkeyToAddress(ownerKey.PublicKey): {Balance: funds},
+	})
+	if err := deploy(); err != nil {
+		log.Fatalln("Could not deploy the contracts:", err)
+	}
+	var err error
+	if relay, err = newRelay(relayKey); err != nil {
+		log.Fatalln(err)
+	}
+	if err = stake(relay); err != nil {
+		log.Fatalln(err)
+	}
+	server := httptest.NewServer(New(relay, nil, 2, adminToken))
+	url = server.URL
+	exitStatus := m.Run()
+	server.Close()
+	os.Exit(exitStatus)
+}
+
+// call sends the request to the relay, decoding a successful response into result. Returns the response and the error
+// reported in its body, if any.
+func call(t *testing.T, method string, path string, body interface{}, result interface{}) (resp *http.Response, relayError string) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		test.ErrFail(err, t)
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, url+path, reader)
+	test.ErrFail(err, t)
+	if strings.HasPrefix(path, "/admin/") {
+		req.Header.Set("Authorization", "Bearer "+adminToken)
+	}
+	resp, err = http.DefaultClient.Do(req)
+	test.ErrFail(err, t)
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	test.ErrFail(err, t)
+
+	var errorResponse ErrorResponse
+	if json.Unmarshal(data, &errorResponse) == nil && errorResponse.Error != "" {
+		return resp, errorResponse.Error
+	}
+	if result != nil {
+		test.ErrFailWithDesc(json.Unmarshal(data, result), t, "Decoding "+string(data))
+	}
+	return
+}
+
+func assertCors(t *testing.T, resp *http.Response, methods string) {
+	if origin := resp.Header.Get("Access-Control-Allow-Origin"); origin != "*" {
+		t.Errorf("Expected any origin to be allowed but got %q", origin)
+	}
+	if allowed := resp.Header.Get("Access-Control-Allow-Methods"); allowed != methods {
+		t.Errorf("Expected the methods %q to be allowed but got %q", methods, allowed)
+	}
+	if headers := resp.Header.Get("Access-Control-Allow-Headers"); !strings.Contains(headers, "Content-Type") {
+		t.Errorf("Expected Content-Type to be allowed but got %q", headers)
+	}
+}
+
+// newRelayRequest builds a call to SampleRecipient.emitMessage("hello world") signed by the gasless account
+func newRelayRequest(t *testing.T, recipientNonce int64) *librelay.RelayTransactionRequest {
+	request := &librelay.RelayTransactionRequest{
+		EncodedFunction: "0x2ac0df260000000000000000000000000000000000000000000000000000000000000020000000000000000000000000000000000000000000000000000000000000000b68656c6c6f20776f726c64000000000000000000000000000000000000000000",
+		From:            crypto.PubkeyToAddress(gaslessKey.PublicKey),
+		To:              sampleRecipient,
+		GasPrice:        *big.NewInt(2000),
+		GasLimit:        *big.NewInt(1000000),
+		RecipientNonce:  *big.NewInt(recipientNonce),
+		RelayMaxNonce:   *big.NewInt(1000000),
+		RelayFee:        *big.NewInt(10),
+		RelayHubAddress: rhaddr,
+	}
+	signature, err := crypto.Sign(request.Hash(relay.Address()).Bytes(), gaslessKey)
+	test.ErrFail(err, t)
+	signature[64] += 27
+	request.Signature = signature
+	return request
+}
+
+func TestGetAddr(t *testing.T) {
+	var response librelay.GetEthAddrResponse
+	resp, relayError := call(t, http.MethodGet, "/getaddr", nil, &response)
+	if relayError != "" {
+		t.Fatal(relayError)
+	}
+	assertCors(t, resp, "GET, OPTIONS")
+	if response.RelayServerAddress != relay.Address() || !response.Ready || response.Phase != lifecycle.Ready ||
+		response.Version != VERSION {
+		t.Errorf("Wrong response %+v", response)
+	}
+	// The gas price of the chain plus the relay's 10%
+	if response.MinGasPrice.Cmp(big.NewInt(simbackend.DefaultGasPrice*110/100)) != 0 {
+		t.Error("Wrong gas price", response.MinGasPrice.String())
+	}
+}
+
+func TestRelay(t *testing.T) {
+	request := newRelayRequest(t, 0)
+	signedTx := new(types.Transaction)
+	resp, relayError := call(t, http.MethodPost, "/relay", request, signedTx)
+	if relayError != "" {
+		t.Fatal(relayError)
+	}
+	assertCors(t, resp, "GET, POST, OPTIONS")
+
+	// Signed by the relay for the hub
+	signer := types.NewEIP155Signer(big.NewInt(simbackend.DefaultChainID))
+	sender, err := types.Sender(signer, signedTx)
+	test.ErrFail(err, t)
+	if sender != relay.Address() {
+		t.Errorf("Expected the tx to be signed by the relay %s but got %s", relay.Address().Hex(), sender.Hex())
+	}
+	if signedTx.To() == nil || *signedTx.To() != rhaddr {
+		t.Errorf("Expected a tx to the hub but got %v", signedTx.To())
+	}
+	if signedTx.GasPrice().Cmp(&request.GasPrice) != 0 {
+		t.Errorf("Expected the requested gas price %s but got %s", request.GasPrice.String(), signedTx.GasPrice())
+	}
+	receipt, err := client.TransactionReceipt(context.Background(), signedTx.Hash())
+	test.ErrFail(err, t)
+	if receipt.Status != types.ReceiptStatusSuccessful {
+		t.Error("Expected the relayed tx to succeed")
+	}
+
+	// The relay answers a retry with the same tx
+	retriedTx := new(types.Transaction)
+	if _, relayError = call(t, http.MethodPost, "/relay", request, retriedTx); relayError != "" {
+		t.Fatal(relayError)
+	}
+	if retriedTx.Hash() != signedTx.Hash() {
+		t.Errorf("Expected the retry to return tx %s but got %s", signedTx.Hash().Hex(), retriedTx.Hash().Hex())
+	}
+
+	var info librelay.RelayedTransactionInfo
+	if _, relayError = call(t, http.MethodGet, "/tx/"+signedTx.Hash().Hex(), nil, &info); relayError != "" {
+		t.Fatal(relayError)
+	}
+}
+
+func TestRelayErrors(t *testing.T) {
+	// A forged signature is refused
+	request := newRelayRequest(t, 1)
+	request.RelayFee = *big.NewInt(11)
+	resp, relayError := call(t, http.MethodPost, "/relay", request, nil)
+	if relayError == "" {
+		t.Error("Expected a request with a forged signature to be refused")
+	}
+	assertCors(t, resp, "GET, POST, OPTIONS")
+
+	resp, err := http.Post(url+"/relay", "application/json", strings.NewReader("{not json"))
+	test.ErrFail(err, t)
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	test.ErrFail(err, t)
+	var errorResponse ErrorResponse
+	if err = json.Unmarshal(body, &errorResponse); err != nil || !strings.HasPrefix(errorResponse.Error, "invalid character") {
+		t.Errorf("Expected a json error body but got %s", body)
+	}
+
+	resp, relayError = call(t, http.MethodPost, "/relay/batch", []*librelay.RelayTransactionRequest{request, request, request}, nil)
+	if relayError != "Batch must contain between 1 and 2 requests" {
+		t.Error("Expected the batch to be refused but got", relayError)
+	}
+
+	resp, relayError = call(t, http.MethodGet, "/tx/0x1234", nil, nil)
+	if resp.StatusCode != http.StatusBadRequest || relayError != "Invalid transaction hash 0x1234" {
+		t.Errorf("Expected a bad request but got %d %q", resp.StatusCode, relayError)
+	}
+	resp, relayError = call(t, http.MethodGet, "/tx/"+common.Hash{}.Hex(), nil, nil)
+	if resp.StatusCode != http.StatusNotFound || relayError != "Transaction not found" {
+		t.Errorf("Expected not found but got %d %q", resp.StatusCode, relayError)
+	}
+}
+
+func TestNotReady(t *testing.T) {
+	key, err := crypto.GenerateKey()
+	test.ErrFail(err, t)
+	unstaked, err := newRelay(key)
+	test.ErrFail(err, t)
+	server := httptest.NewServer(New(unstaked, nil, 2, ""))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/getaddr")
+	test.ErrFail(err, t)
+	var response librelay.GetEthAddrResponse
+	err = json.NewDecoder(resp.Body).Decode(&response)
+	resp.Body.Close()
+	test.ErrFail(err, t)
+	if response.Ready || response.Phase != lifecycle.New || response.RelayServerAddress != unstaked.Address() {
+		t.Errorf("Wrong response %+v", response)
+	}
+
+	resp, err = http.Post(server.URL+"/relay", "application/json", strings.NewReader("{}"))
+	test.ErrFail(err, t)
+	var errorResponse ErrorResponse
+	err = json.NewDecoder(resp.Body).Decode(&errorResponse)
+	resp.Body.Close()
+	test.ErrFail(err, t)
+	if errorResponse.Error != "Relay not staked and registered yet" {
+		t.Error("Expected the relay to refuse requests but got", errorResponse.Error)
+	}
+	assertCors(t, resp, "GET, POST, OPTIONS")
+
+	// The admin API is disabled without a token
+	resp, err = http.Get(server.URL + "/admin/jobs")
+	test.ErrFail(err, t)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Error("Expected the admin API to be disabled but got", resp.StatusCode)
+	}
+}
+
+func TestAdmin(t *testing.T) {
+	req, err := http.NewRequest(http.MethodGet, url+"/admin/jobs", nil)
+	test.ErrFail(err, t)
+	req.Header.Set("Authorization", "Bearer wrong")
+	resp, err := http.DefaultClient.Do(req)
+	test.ErrFail(err, t)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Error("Expected a wrong token to be refused but got", resp.StatusCode)
+	}
+
+	var jobs []interface{}
+	if _, relayError := call(t, http.MethodGet, "/admin/jobs", nil, &jobs); relayError != "" || len(jobs) != 0 {
+		t.Errorf("Expected no jobs but got %v (error %q)", jobs, relayError)
+	}
+
+	// Error messages with quotes are still valid json
+	resp, relayError := call(t, http.MethodPost, "/admin/incidents", IncidentRequest{Action: "ignore"}, nil)
+	if resp.StatusCode != http.StatusBadRequest || relayError != `Unknown action "ignore": expected resolve` {
+		t.Errorf("Expected a bad request but got %d %q", resp.StatusCode, relayError)
+	}
+}
@@ -0,0 +1,157 @@
+package relayhttp
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"librelay/config"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/clock"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const certReloadCheckInterval = 5 * time.Second
+
+// certReloader serves a certificate/key pair from disk, reloading it when either file changes so renewed certificates
+// are picked up without restarting the relay
+type certReloader struct {
+	certFile  string
+	keyFile   string
+	mutex     sync.Mutex
+	cert      *tls.Certificate
+	modTime   time.Time
+	lastCheck time.Time
+	clock     clock.Clock
+}
+
+func newCertReloader(certFile string, keyFile string, clk clock.Clock) (*certReloader, error) {
+	if clk == nil {
+		clk = clock.NewClock()
+	}
+	reloader := &certReloader{certFile: certFile, keyFile: keyFile, clock: clk}
+	modTime, err := reloader.latestModTime()
+	if err != nil {
+		return nil, err
+	}
+	if err = reloader.load(modTime); err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+func (reloader *certReloader) latestModTime() (modTime time.Time, err error) {
+	for _, file := range []string{reloader.certFile, reloader.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return modTime, err
+		}
+		if info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+	}
+	return
+}
+
+func (reloader *certReloader) load(modTime time.Time) error {
+	cert, err := tls.LoadX509KeyPair(reloader.certFile, reloader.keyFile)
+	if err != nil {
+		return err
+	}
+	reloader.cert = &cert
+	reloader.modTime = modTime
+	return nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate. A certificate that fails to load (e.g. while being rewritten)
+// is ignored and the previous one keeps being served.
+func (reloader *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	reloader.mutex.Lock()
+	defer reloader.mutex.Unlock()
+
+	if reloader.clock.Since(reloader.lastCheck) < certReloadCheckInterval {
+		return reloader.cert, nil
+	}
+	reloader.lastCheck = reloader.clock.Now()
+
+	modTime, err := reloader.latestModTime()
+	if err != nil {
+		log.Println("Could not check TLS certificate files", err)
+		return reloader.cert, nil
+	}
+	if !modTime.After(reloader.modTime) {
+		return reloader.cert, nil
+	}
+	if err = reloader.load(modTime); err != nil {
+		log.Println("Could not reload TLS certificate, keeping the previous one", err)
+		return reloader.cert, nil
+	}
+	log.Println("Reloaded TLS certificate", reloader.certFile)
+	return reloader.cert, nil
+}
+
+// newAcmeManager obtains and renews certificates for the host in the relay's Url from the configured ACME directory
+func newAcmeManager(cfg *config.Config) (*autocert.Manager, error) {
+	u, err := url.Parse(cfg.Url)
+	if err != nil {
+		return nil, err
+	}
+	client := &acme.Client{DirectoryURL: cfg.ACMEDirectoryUrl}
+	if cfg.ACMECARootFile != "" {
+		// Lets us talk to test ACME servers (e.g. pebble) whose directory is served with a self-signed certificate
+		pem, err := ioutil.ReadFile(cfg.ACMECARootFile)
+		if err != nil {
+			return nil, err
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in %s", cfg.ACMECARootFile)
+		}
+		client.HTTPClient = &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+	}
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(cfg.ACMECacheDir()),
+		HostPolicy: autocert.HostWhitelist(u.Hostname()),
+		Email:      cfg.ACMEEmail,
+		Client:     client,
+	}, nil
+}
+
+// Serve runs the http server, over TLS if the relay is configured to terminate it
+func Serve(server *http.Server, cfg *config.Config) error {
+	switch {
+	case cfg.ACME:
+		manager, err := newAcmeManager(cfg)
+		if err != nil {
+			return err
+		}
+		if cfg.ACMEHttpPort != "" {
+			// http-01 challenges; tls-alpn-01 challenges are answered on the relay's own port
+			go func() {
+				log.Fatalln(http.ListenAndServe(":"+cfg.ACMEHttpPort, manager.HTTPHandler(nil)))
+			}()
+		}
+		server.TLSConfig = manager.TLSConfig()
+		log.Println("Serving TLS with certificates from", cfg.ACMEDirectoryUrl)
+		return server.ListenAndServeTLS("", "")
+	case cfg.TLSCertFile != "":
+		reloader, err := newCertReloader(cfg.TLSCertFile, cfg.TLSKeyFile, nil)
+		if err != nil {
+			return err
+		}
+		server.TLSConfig = &tls.Config{GetCertificate: reloader.GetCertificate}
+		log.Println("Serving TLS with certificate", cfg.TLSCertFile)
+		return server.ListenAndServeTLS("", "")
+	default:
+		return server.ListenAndServe()
+	}
+}
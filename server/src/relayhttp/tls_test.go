@@ -0,0 +1,317 @@
+package relayhttp
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"librelay/config"
+	"librelay/test"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"code.cloudfoundry.org/clock/fakeclock"
+)
+
+// issue signs a certificate for the public key and the names with the parent, or self-signs it if parent is nil
+func issue(t *testing.T, serial int64, names []string, publicKey interface{}, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) *x509.Certificate {
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: fmt.Sprintf("test %d", serial)},
+		DNSNames:              names,
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(90 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  parent == nil,
+	}
+	if parent == nil {
+		parent = template
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, publicKey, parentKey)
+	test.ErrFail(err, t)
+	cert, err := x509.ParseCertificate(der)
+	test.ErrFail(err, t)
+	return cert
+}
+
+// newSelfSigned returns a self-signed certificate for localhost and its key
+func newSelfSigned(t *testing.T, serial int64) (cert *x509.Certificate, key *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	test.ErrFail(err, t)
+	return issue(t, serial, []string{"localhost"}, &key.PublicKey, nil, key), key
+}
+
+func certPEM(cert *x509.Certificate) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+}
+
+// writeKeyPair writes the certificate and key in PEM, dating the files modTime
+func writeKeyPair(t *testing.T, certFile string, keyFile string, cert *x509.Certificate, key *ecdsa.PrivateKey, modTime time.Time) {
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	test.ErrFail(err, t)
+	test.ErrFail(ioutil.WriteFile(certFile, certPEM(cert), 0600), t)
+	test.ErrFail(ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600), t)
+	test.ErrFail(os.Chtimes(certFile, modTime, modTime), t)
+	test.ErrFail(os.Chtimes(keyFile, modTime, modTime), t)
+}
+
+// servedCertificate connects to a TLS server with the config as serverName, returning the certificate it serves.
+// The certificate is verified against roots unless they are nil.
+func servedCertificate(tlsConfig *tls.Config, serverName string, roots *x509.CertPool) (cert *x509.Certificate, err error) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	server.TLS = tlsConfig
+	server.StartTLS()
+	defer server.Close()
+	conn, err := tls.Dial("tcp", server.Listener.Addr().String(), &tls.Config{
+		ServerName:         serverName,
+		RootCAs:            roots,
+		InsecureSkipVerify: roots == nil,
+	})
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0], nil
+}
+
+func TestCertReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "relay-tls")
+	test.ErrFail(err, t)
+	defer os.RemoveAll(dir)
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	modTime := time.Now().Add(-time.Hour)
+	cert, key := newSelfSigned(t, 1)
+	writeKeyPair(t, certFile, keyFile, cert, key, modTime)
+
+	clk := fakeclock.NewFakeClock(time.Now())
+	reloader, err := newCertReloader(certFile, keyFile, clk)
+	test.ErrFail(err, t)
+	tlsConfig := &tls.Config{GetCertificate: reloader.GetCertificate}
+	assertServed := func(serial int64) {
+		served, err := servedCertificate(tlsConfig, "localhost", nil)
+		test.ErrFail(err, t)
+		if served.SerialNumber.Int64() != serial {
+			t.Errorf("Expected certificate %d to be served but got %d", serial, served.SerialNumber)
+		}
+	}
+	assertServed(1)
+
+	// A renewed certificate is picked up at the next check
+	cert, key = newSelfSigned(t, 2)
+	writeKeyPair(t, certFile, keyFile, cert, key, modTime.Add(time.Minute))
+	assertServed(1)
+	clk.Increment(certReloadCheckInterval)
+	assertServed(2)
+
+	// A certificate that does not load is ignored
+	test.ErrFail(ioutil.WriteFile(certFile, []byte("half written"), 0600), t)
+	test.ErrFail(os.Chtimes(certFile, modTime.Add(2*time.Minute), modTime.Add(2*time.Minute)), t)
+	clk.Increment(certReloadCheckInterval)
+	assertServed(2)
+}
+
+// acmeStandIn is an ACME (RFC 8555) directory that authorizes every order and issues certificates signed by its CA.
+// Requests are not authenticated: only the payloads of the JWS bodies are read.
+type acmeStandIn struct {
+	*httptest.Server
+	t           *testing.T
+	ca          *x509.Certificate
+	caKey       *ecdsa.PrivateKey
+	mutex       sync.Mutex
+	nonce       int
+	identifiers []string // ordered so far
+	leaf        *x509.Certificate
+}
+
+func newAcmeStandIn(t *testing.T) *acmeStandIn {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	test.ErrFail(err, t)
+	standIn := &acmeStandIn{t: t, caKey: caKey, ca: issue(t, 100, nil, &caKey.PublicKey, nil, caKey)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/directory", standIn.directory)
+	mux.HandleFunc("/nonce", func(http.ResponseWriter, *http.Request) {})
+	mux.HandleFunc("/account", standIn.account)
+	mux.HandleFunc("/order", standIn.order)
+	mux.HandleFunc("/order/1", standIn.order)
+	mux.HandleFunc("/finalize/1", standIn.finalize)
+	mux.HandleFunc("/cert/1", standIn.cert)
+	standIn.Server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		standIn.mutex.Lock()
+		standIn.nonce++
+		w.Header().Set("Replay-Nonce", fmt.Sprint("nonce-", standIn.nonce))
+		standIn.mutex.Unlock()
+		mux.ServeHTTP(w, r)
+	}))
+	return standIn
+}
+
+// payload decodes the payload of the JWS request body into v
+func (standIn *acmeStandIn) payload(r *http.Request, v interface{}) {
+	var jws struct{ Payload string }
+	if err := json.NewDecoder(r.Body).Decode(&jws); err != nil {
+		standIn.t.Error("Invalid JWS", err)
+		return
+	}
+	if jws.Payload == "" {
+		return
+	}
+	data, err := base64.RawURLEncoding.DecodeString(jws.Payload)
+	if err == nil {
+		err = json.Unmarshal(data, v)
+	}
+	if err != nil {
+		standIn.t.Error("Invalid JWS payload", err)
+	}
+}
+
+func (standIn *acmeStandIn) directory(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]string{
+		"newNonce":   standIn.URL + "/nonce",
+		"newAccount": standIn.URL + "/account",
+		"newOrder":   standIn.URL + "/order",
+		"revokeCert": standIn.URL + "/revoke",
+		"keyChange":  standIn.URL + "/key-change",
+	})
+}
+
+func (standIn *acmeStandIn) account(w http.ResponseWriter, r *http.Request) {
+	standIn.payload(r, &struct{}{})
+	w.Header().Set("Location", standIn.URL+"/account/1")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{"status": "valid"})
+}
+
+// order answers new orders and order polls with a ready order: the domains count as already authorized
+func (standIn *acmeStandIn) order(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Identifiers []struct{ Type, Value string }
+	}
+	standIn.payload(r, &request)
+	status := "ready"
+	standIn.mutex.Lock()
+	for _, identifier := range request.Identifiers {
+		standIn.identifiers = append(standIn.identifiers, identifier.Value)
+	}
+	if standIn.leaf != nil {
+		status = "valid"
+	}
+	standIn.mutex.Unlock()
+	w.Header().Set("Location", standIn.URL+"/order/1")
+	if r.URL.Path == "/order" {
+		w.WriteHeader(http.StatusCreated)
+	}
+	standIn.writeOrder(w, status)
+}
+
+func (standIn *acmeStandIn) writeOrder(w http.ResponseWriter, status string) {
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":         status,
+		"identifiers":    []map[string]string{},
+		"authorizations": []string{},
+		"finalize":       standIn.URL + "/finalize/1",
+		"certificate":    standIn.URL + "/cert/1",
+	})
+}
+
+func (standIn *acmeStandIn) finalize(w http.ResponseWriter, r *http.Request) {
+	var request struct{ CSR string }
+	standIn.payload(r, &request)
+	der, err := base64.RawURLEncoding.DecodeString(request.CSR)
+	if err != nil {
+		standIn.t.Error("Invalid CSR encoding", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		standIn.t.Error("Invalid CSR", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	names := csr.DNSNames
+	if len(names) == 0 {
+		names = []string{csr.Subject.CommonName}
+	}
+	leaf := issue(standIn.t, 101, names, csr.PublicKey, standIn.ca, standIn.caKey)
+	standIn.mutex.Lock()
+	standIn.leaf = leaf
+	standIn.mutex.Unlock()
+	w.Header().Set("Location", standIn.URL+"/order/1")
+	standIn.writeOrder(w, "valid")
+}
+
+func (standIn *acmeStandIn) cert(w http.ResponseWriter, r *http.Request) {
+	standIn.mutex.Lock()
+	defer standIn.mutex.Unlock()
+	w.Header().Set("Content-Type", "application/pem-certificate-chain")
+	w.Write(append(certPEM(standIn.leaf), certPEM(standIn.ca)...))
+}
+
+func TestAcme(t *testing.T) {
+	standIn := newAcmeStandIn(t)
+	defer standIn.Close()
+	dir, err := ioutil.TempDir("", "relay-acme")
+	test.ErrFail(err, t)
+	defer os.RemoveAll(dir)
+
+	// The directory is served with a certificate only trusted through ACMECARootFile
+	rootFile := filepath.Join(dir, "root.pem")
+	test.ErrFail(ioutil.WriteFile(rootFile, certPEM(standIn.Certificate()), 0600), t)
+
+	cfg := config.Default()
+	cfg.Url = "https://relay.test"
+	cfg.Workdir = dir
+	cfg.ACME = true
+	cfg.ACMEDirectoryUrl = standIn.URL + "/directory"
+	cfg.ACMECARootFile = rootFile
+	manager, err := newAcmeManager(cfg)
+	test.ErrFail(err, t)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(standIn.ca)
+	served, err := servedCertificate(manager.TLSConfig(), "relay.test", roots)
+	test.ErrFail(err, t)
+	if served.SerialNumber.Cmp(big.NewInt(101)) != 0 || len(served.DNSNames) != 1 || served.DNSNames[0] != "relay.test" {
+		t.Errorf("Expected the certificate issued for relay.test but got %v %v", served.SerialNumber, served.DNSNames)
+	}
+	if strings.Join(standIn.identifiers, ",") != "relay.test" {
+		t.Errorf("Expected a single order for relay.test but got %v", standIn.identifiers)
+	}
+
+	// Only the host of the relay's url gets a certificate
+	if _, err = servedCertificate(manager.TLSConfig(), "other.test", roots); err == nil {
+		t.Error("Expected no certificate for another host")
+	}
+
+	// The certificate is cached in the workdir
+	if files, err := ioutil.ReadDir(cfg.ACMECacheDir()); err != nil || len(files) == 0 {
+		t.Errorf("Expected the certificate to be cached in %s (error %v)", cfg.ACMECacheDir(), err)
+	}
+
+	// An untrusted directory is refused
+	cfg.ACMECARootFile = ""
+	cfg.Url = "https://relay2.test"
+	cfg.Workdir = filepath.Join(dir, "untrusted")
+	manager, err = newAcmeManager(cfg)
+	test.ErrFail(err, t)
+	if _, err = servedCertificate(manager.TLSConfig(), "relay2.test", nil); err == nil {
+		t.Error("Expected no certificate from an untrusted directory")
+	}
+}